@@ -0,0 +1,169 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// snapctl exports the snapshots of a node as portable archives and imports them on another node.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vhive-serverless/vhive/ctriface/image"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+const (
+	containerdAddress   = "/run/firecracker-containerd/containerd.sock"
+	containerdNamespace = "firecracker-containerd"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s export|import [options]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = exportCmd(os.Args[2:])
+	case "import":
+		err = importCmd(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// exportCmd writes a snapshot archive of a snapshot of the node.
+func exportCmd(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	snapDir := flags.String("dir", "/fccd/snapshots", "Directory the snapshots are stored in")
+	id := flags.String("id", "", "Id of the snapshot to export")
+	output := flags.String("o", "", "Path of the snapshot archive (standard output if empty)")
+	compress := flags.Bool("zstd", false, "Compress the snapshot archive with zstd")
+	flags.Parse(args)
+
+	if *id == "" {
+		return errors.New("missing snapshot id")
+	}
+
+	snap, err := snapshotting.LoadSnapshot(*id, *snapDir)
+	if err != nil {
+		return errors.Wrapf(err, "loading snapshot %s", *id)
+	}
+
+	if *output == "" {
+		return snapshotting.ExportSnapshot(snap, os.Stdout, *compress)
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", *output)
+	}
+
+	if err := snapshotting.ExportSnapshot(snap, file, *compress); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return err
+	}
+
+	return file.Close()
+}
+
+// importCmd unpacks a snapshot archive into the snapshots of the node, after checking that the image of the snapshot
+// can be pulled and, if the snapshot is keyed by an image digest, that the image has not changed.
+func importCmd(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	snapDir := flags.String("dir", "/fccd/snapshots", "Directory the snapshots are stored in")
+	input := flags.String("i", "", "Path of the snapshot archive (standard input if empty)")
+	snapshotter := flags.String("ss", "devmapper", "snapshotter name")
+	skipImageCheck := flags.Bool("skipImageCheck", false, "Do not check that the image of the snapshot is available")
+	flags.Parse(args)
+
+	in := os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return errors.Wrapf(err, "opening %s", *input)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	if err := os.MkdirAll(*snapDir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "creating %s", *snapDir)
+	}
+
+	var checkImage func(*snapshotting.Snapshot) error
+	if !*skipImageCheck {
+		client, err := containerd.New(containerdAddress)
+		if err != nil {
+			return errors.Wrapf(err, "connecting to containerd")
+		}
+		defer client.Close()
+
+		checkImage = func(snap *snapshotting.Snapshot) error {
+			return checkSnapshotImage(client, *snapshotter, snap)
+		}
+	}
+
+	snap, err := snapshotting.ImportSnapshot(in, *snapDir, checkImage)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Imported snapshot %s of image %s", snap.GetId(), snap.GetImage())
+	return nil
+}
+
+// checkSnapshotImage pulls the image of a snapshot and checks that its digest is the one the snapshot is keyed by.
+func checkSnapshotImage(client *containerd.Client, snapshotter string, snap *snapshotting.Snapshot) error {
+	ctx, cancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), containerdNamespace), 5*time.Minute)
+	defer cancel()
+
+	img, err := image.NewImageManager(client, snapshotter).GetImage(ctx, snap.GetImage())
+	if err != nil {
+		return errors.Wrapf(err, "pulling image")
+	}
+
+	expected := snap.GetKey().ImageDigest
+	if digest := (*img).Target().Digest.String(); expected != "" && digest != expected {
+		return errors.New(fmt.Sprintf("image has digest %s instead of %s", digest, expected))
+	}
+
+	return nil
+}
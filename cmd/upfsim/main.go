@@ -0,0 +1,148 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// upfsim replays the page fault traces recorded by the memory manager offline to compare prefetch policies.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vhive-serverless/vhive/memory/manager"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <trace of each invocation>...\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	recordPath := flag.String("record", "", "Trace of the instance that recorded the working set (the first trace if empty)")
+	policies := flag.String("policies", strings.Join([]string{manager.RecordPrefetch, manager.NoPrefetch, manager.ReadaheadPrefetch}, ","),
+		"Comma-separated prefetch policies to simulate (record, readahead, stride, none)")
+	prefetchPages := flag.Int("prefetchPages", 16, "Number of pages prefetched upon each page fault by the readahead and stride policies")
+	diskLatency := flag.Duration("diskLatency", 100*time.Microsecond, "Latency of a read request to the disk")
+	diskBandwidth := flag.Float64("diskBandwidth", 500, "Sequential read bandwidth of the disk, in MB/s")
+	faultLatency := flag.Duration("faultLatency", 5*time.Microsecond, "Latency of serving a page fault, excluding reads")
+	output := flag.String("o", "", "Path of the CSV file of the results (standard output if empty)")
+	flag.Usage = usage
+	flag.Parse()
+
+	paths := flag.Args()
+	if *recordPath == "" {
+		if len(paths) < 2 {
+			usage()
+		}
+		*recordPath, paths = paths[0], paths[1:]
+	}
+	if len(paths) == 0 {
+		usage()
+	}
+
+	disk := manager.DiskModel{
+		RequestLatency: *diskLatency,
+		Bandwidth:      *diskBandwidth * 1e6,
+		FaultLatency:   *faultLatency,
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := simulate(out, *recordPath, paths, strings.Split(*policies, ","), *prefetchPages, disk); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// simulate writes one row of results per invocation, so that the results can be
+// plotted against the invocation number with profile.PlotLineCharts.
+func simulate(out io.Writer, recordPath string, paths, policyNames []string, prefetchPages int, disk manager.DiskModel) error {
+	policies := make([]manager.PrefetchPolicy, len(policyNames))
+	header := []string{"Unique", "Reused"}
+	for i, name := range policyNames {
+		policy, err := manager.NewPrefetchPolicy(strings.TrimSpace(name), prefetchPages)
+		if err != nil {
+			return err
+		}
+		policies[i] = policy
+		for _, col := range []string{"Faults", "Prefetched", "OverFetchedBytes", "LatencyUs"} {
+			header = append(header, policy.Name()+"-"+col)
+		}
+	}
+
+	record, err := manager.ReadTrace(recordPath)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(out)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		invocation, err := manager.ReadTrace(path)
+		if err != nil {
+			return err
+		}
+
+		var row []string
+		for i, policy := range policies {
+			res, err := manager.SimulateReplay(record, invocation, policy, disk)
+			if err != nil {
+				return errors.Wrapf(err, "simulating %s", path)
+			}
+
+			if i == 0 {
+				row = append(row, strconv.Itoa(res.Unique), strconv.Itoa(res.Reused))
+			}
+			row = append(row,
+				strconv.Itoa(res.Faults),
+				strconv.Itoa(res.Prefetched),
+				strconv.FormatUint(res.OverFetchedBytes, 10),
+				strconv.FormatInt(res.Latency.Microseconds(), 10),
+			)
+		}
+
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
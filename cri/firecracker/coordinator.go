@@ -66,11 +66,12 @@ func newFirecrackerCoordinator(orch *ctriface.Orchestrator, opts ...coordinatorO
 		opt(c)
 	}
 
-	snapshotsDir := "/fccd/test/snapshots"
-	if !c.withoutOrchestrator {
-		snapshotsDir = orch.GetSnapshotsDir()
+	// The snapshots are managed by the orchestrator, which shares its manager with the function pool
+	if c.withoutOrchestrator {
+		c.snapshotManager = snapshotting.NewSnapshotManager("/fccd/test/snapshots")
+	} else {
+		c.snapshotManager = orch.GetSnapshotManager()
 	}
-	c.snapshotManager = snapshotting.NewSnapshotManager(snapshotsDir)
 
 	return c
 }
@@ -80,14 +81,47 @@ func (c *coordinator) startVM(ctx context.Context, image, revision string) (*fun
 }
 
 func (c *coordinator) startVMWithEnvironment(ctx context.Context, image, revision string, environment []string) (*funcInstance, error) {
+	snapshotKey := snapshotting.SnapshotKey{Revision: revision}
+
 	if c.orch != nil && c.orch.GetSnapshotsEnabled() {
+		var err error
+		if snapshotKey, err = c.getSnapshotKey(ctx, image, revision); err != nil {
+			return nil, err
+		}
+
 		// Check if snapshot is available
-		if snap, err := c.snapshotManager.AcquireSnapshot(revision); err == nil {
-			return c.orchLoadInstance(ctx, snap)
+		snap, err := c.snapshotManager.AcquireSnapshotWithKey(snapshotKey)
+		if err == nil {
+			// The snapshot is released when the instance is stopped, so that its files are neither evicted nor
+			// compressed while the VM uses them
+			fi, err := c.orchLoadInstance(ctx, snap)
+			if err != nil {
+				if errors.Is(err, snapshotting.ErrChecksumMismatch) {
+					// The compressed memory file is corrupted, quarantine the snapshot so that it is created again
+					_ = c.snapshotManager.VerifySnapshot(snap.GetId())
+				}
+				c.snapshotManager.ReleaseSnapshot(snap.GetId())
+			}
+			return fi, err
 		}
+
+		log.WithFields(log.Fields{"revision": revision, "snapshot": snapshotKey.ID()}).WithError(err).Debug("snapshot not available, creating fresh instance")
+	}
+
+	return c.orchStartVM(ctx, image, snapshotKey, environment)
+}
+
+// getSnapshotKey returns the key of the snapshot of a revision for the image and the VM configuration.
+func (c *coordinator) getSnapshotKey(ctx context.Context, image, revision string) (snapshotting.SnapshotKey, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	key, err := c.orch.GetSnapshotKey(ctxTimeout, revision, image)
+	if err != nil {
+		return snapshotting.SnapshotKey{}, fmt.Errorf("getting snapshot key of revision %s: %w", revision, err)
 	}
 
-	return c.orchStartVM(ctx, image, revision, environment)
+	return key, nil
 }
 
 func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
@@ -103,13 +137,27 @@ func (c *coordinator) stopVM(ctx context.Context, containerID string) error {
 	}
 
 	if c.orch != nil && c.orch.GetSnapshotsEnabled() && !fi.SnapBooted {
-		err := c.orchCreateSnapshot(ctx, fi)
-		if err != nil {
-			log.Printf("Err creating snapshot %s\n", err)
+		// Only a single instance of a revision creates its snapshot, the other instances skip the snapshot creation
+		switch state := c.snapshotManager.GetSnapshotState(fi.SnapshotKey.ID()); state {
+		case snapshotting.SnapshotCreating, snapshotting.SnapshotReady:
+			fi.Logger.Debugf("snapshot is %s, skipping snapshot creation", state)
+		default:
+			if err := c.orchCreateSnapshot(ctx, fi); err != nil {
+				fi.Logger.WithError(err).Error("failed to create snapshot")
+			}
 		}
 	}
 
-	return c.orchStopVM(ctx, fi)
+	if err := c.orchStopVM(ctx, fi); err != nil {
+		// The VM may still be using the files of its snapshot
+		return err
+	}
+
+	if fi.Snapshot != nil {
+		c.snapshotManager.ReleaseSnapshot(fi.Snapshot.GetId())
+	}
+
+	return nil
 }
 
 // for testing
@@ -135,13 +183,13 @@ func (c *coordinator) insertActive(containerID string, fi *funcInstance) error {
 	return nil
 }
 
-func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, envVariables []string) (*funcInstance, error) {
+func (c *coordinator) orchStartVM(ctx context.Context, image string, snapshotKey snapshotting.SnapshotKey, envVariables []string) (*funcInstance, error) {
 	vmID := c.getVMID()
 	logger := log.WithFields(
 		log.Fields{
 			"vmID":     vmID,
 			"image":    image,
-			"revision": revision,
+			"revision": snapshotKey.Revision,
 		},
 	)
 
@@ -162,7 +210,7 @@ func (c *coordinator) orchStartVM(ctx context.Context, image, revision string, e
 		}
 	}
 
-	fi := newFuncInstance(vmID, image, revision, false, resp)
+	fi := newFuncInstance(vmID, image, snapshotKey, false, resp)
 	logger.Debug("successfully created fresh instance")
 	return fi, err
 }
@@ -192,7 +240,8 @@ func (c *coordinator) orchLoadInstance(ctx context.Context, snap *snapshotting.S
 		return nil, err
 	}
 
-	fi := newFuncInstance(vmID, snap.GetImage(), snap.GetId(), true, resp)
+	fi := newFuncInstance(vmID, snap.GetImage(), snap.GetKey(), true, resp)
+	fi.Snapshot = snap
 	logger.Debug("successfully loaded instance from snapshot")
 	return fi, nil
 }
@@ -200,10 +249,13 @@ func (c *coordinator) orchLoadInstance(ctx context.Context, snap *snapshotting.S
 func (c *coordinator) orchCreateSnapshot(ctx context.Context, fi *funcInstance) error {
 	var err error
 
-	snap, err := c.snapshotManager.InitSnapshot(fi.Revision, fi.Image)
-	if err != nil {
-		fi.Logger.WithError(err).Error("failed to initialize snapshot")
+	snap, err := c.snapshotManager.InitSnapshotWithKey(fi.SnapshotKey, fi.Image)
+	if errors.Is(err, snapshotting.ErrSnapshotExists) {
+		// Another instance started creating the snapshot concurrently
+		fi.Logger.Debug("snapshot is already being created, skipping snapshot creation")
 		return nil
+	} else if err != nil {
+		return err
 	}
 
 	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*60)
@@ -215,22 +267,25 @@ func (c *coordinator) orchCreateSnapshot(ctx context.Context, fi *funcInstance)
 		err = c.orch.PauseVM(ctxTimeout, fi.VmID)
 		if err != nil {
 			fi.Logger.WithError(err).Error("failed to pause VM")
+			c.snapshotManager.FailSnapshot(snap.GetId())
 			return err
 		}
 
 		err = c.orch.CreateSnapshot(ctxTimeout, fi.VmID, snap)
 		if err != nil {
 			fi.Logger.WithError(err).Error("failed to create snapshot")
+			c.snapshotManager.FailSnapshot(snap.GetId())
 			return err
 		}
 
 		if _, err := c.orch.ResumeVM(ctx, fi.VmID); err != nil {
 			fi.Logger.WithError(err).Error("failed to resume VM")
+			c.snapshotManager.FailSnapshot(snap.GetId())
 			return err
 		}
 	}
 
-	if err := c.snapshotManager.CommitSnapshot(fi.Revision); err != nil {
+	if err := c.snapshotManager.CommitSnapshot(snap.GetId()); err != nil {
 		fi.Logger.WithError(err).Error("failed to commit snapshot")
 		return err
 	}
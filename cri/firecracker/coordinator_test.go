@@ -31,6 +31,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
 const (
@@ -123,3 +124,27 @@ func TestOrchCreateSnapshot(t *testing.T) {
 	err = coord.stopVM(context.Background(), containerID)
 	require.NoError(t, err, "could not stop VM")
 }
+
+func TestConcurrentCreateSnapshot(t *testing.T) {
+	var wg sync.WaitGroup
+
+	revision := "myrev-concurrent"
+	instanceNum := 10
+
+	// All instances of the revision try to create its snapshot upon scale-down, only one of them does
+	for i := 0; i < instanceNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fi, err := coord.startVM(context.Background(), testImageName, revision)
+			require.NoError(t, err, "could not start VM")
+
+			err = coord.orchCreateSnapshot(context.Background(), fi)
+			require.NoError(t, err, "snapshot creation failed")
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, snapshotting.SnapshotReady, coord.snapshotManager.GetSnapshotState(revision))
+}
@@ -25,22 +25,28 @@ package firecracker
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
 type funcInstance struct {
 	VmID            string
 	Image           string
 	Revision        string
+	SnapshotKey     snapshotting.SnapshotKey
 	Logger          *log.Entry
 	SnapBooted      bool
 	StartVMResponse *ctriface.StartVMResponse
+	// Snapshot the instance has been loaded from, acquired until the instance is stopped
+	Snapshot *snapshotting.Snapshot
 }
 
-func newFuncInstance(vmID, image, revision string, snapBooted bool, startVMResponse *ctriface.StartVMResponse) *funcInstance {
+func newFuncInstance(vmID, image string, snapshotKey snapshotting.SnapshotKey, snapBooted bool, startVMResponse *ctriface.StartVMResponse) *funcInstance {
+	revision := snapshotKey.Revision
 	f := &funcInstance{
 		VmID:            vmID,
 		Image:           image,
 		Revision:        revision,
+		SnapshotKey:     snapshotKey,
 		SnapBooted:      snapBooted,
 		StartVMResponse: startVMResponse,
 	}
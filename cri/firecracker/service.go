@@ -37,6 +37,7 @@ const (
 	userContainerName = "user-container"
 	queueProxyName    = "queue-proxy"
 	guestIPEnv        = "GUEST_ADDR"
+	guestIPv6Env      = "GUEST_ADDR6"
 	guestPortEnv      = "GUEST_PORT"
 	guestImageEnv     = "GUEST_IMAGE"
 	revisionEnv       = "K_REVISION"
@@ -55,6 +56,7 @@ type FirecrackerService struct {
 // VMConfig wraps the IP and port of the guest VM
 type VMConfig struct {
 	guestIP   string
+	guestIPv6 string // empty if IPv6 is disabled
 	guestPort string
 }
 
@@ -130,7 +132,11 @@ func (fs *FirecrackerService) createUserContainer(ctx context.Context, r *criapi
 		return nil, err
 	}
 
-	vmConfig := &VMConfig{guestIP: funcInst.StartVMResponse.GuestIP, guestPort: guestPort}
+	vmConfig := &VMConfig{
+		guestIP:   funcInst.StartVMResponse.GuestIP,
+		guestIPv6: funcInst.StartVMResponse.GuestIPv6,
+		guestPort: guestPort,
+	}
 	fs.insertVMConfig(r.GetPodSandboxId(), vmConfig)
 
 	// Wait for placeholder UC to be created
@@ -164,6 +170,9 @@ func (fs *FirecrackerService) createQueueProxy(ctx context.Context, r *criapi.Cr
 	guestIPKeyVal := &criapi.KeyValue{Key: guestIPEnv, Value: vmConfig.guestIP}
 	guestPortKeyVal := &criapi.KeyValue{Key: guestPortEnv, Value: vmConfig.guestPort}
 	r.Config.Envs = append(r.Config.Envs, guestIPKeyVal, guestPortKeyVal)
+	if vmConfig.guestIPv6 != "" {
+		r.Config.Envs = append(r.Config.Envs, &criapi.KeyValue{Key: guestIPv6Env, Value: vmConfig.guestIPv6})
+	}
 
 	resp, err := fs.stockRuntimeClient.CreateContainer(ctx, r)
 	if err != nil {
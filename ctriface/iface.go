@@ -24,7 +24,9 @@ package ctriface
 
 import (
 	"context"
+	"fmt"
 	"github.com/vhive-serverless/vhive/snapshotting"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -51,6 +53,7 @@ import (
 	"github.com/vhive-serverless/vhive/memory/manager"
 	"github.com/vhive-serverless/vhive/metrics"
 	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/networking"
 
 	_ "github.com/davecgh/go-spew/spew" //tmp
 )
@@ -60,12 +63,25 @@ import (
 type StartVMResponse struct {
 	// GuestIP is the IP of the guest MicroVM
 	GuestIP string
+	// GuestIPv6 is the IPv6 address of the guest MicroVM, empty if IPv6 is disabled
+	GuestIPv6 string
 }
 
 const (
 	testImageName = "ghcr.io/ease-lab/helloworld:var_workload"
+
+	kernelArgs = "ro noapic reboot=k panic=1 pci=off nomodules systemd.log_color=false systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet 8250.nr_uarts=0 ipv6.disable=1"
 )
 
+// getKernelArgs returns the kernel arguments of the VMs, IPv6 is only enabled in the guest kernel if the VMs are
+// reachable over IPv6
+func (o *Orchestrator) getKernelArgs() string {
+	if o.vethPrefix6 == "" {
+		return kernelArgs
+	}
+	return strings.Replace(kernelArgs, " ipv6.disable=1", "", 1)
+}
+
 // StartVM Boots a VM if it does not exist
 func (o *Orchestrator) StartVM(ctx context.Context, vmID, imageName string) (_ *StartVMResponse, _ *metrics.Metric, retErr error) {
 	return o.StartVMWithEnvironment(ctx, vmID, imageName, []string{})
@@ -80,7 +96,12 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 	logger := log.WithFields(log.Fields{"vmID": vmID, "image": imageName})
 	logger.Debug("StartVM: Received StartVM")
 
-	vm, err := o.vmPool.Allocate(vmID)
+	if err := o.devMapper.CheckPoolCapacity(); err != nil {
+		logger.WithError(err).Error("rejecting VM")
+		return nil, nil, err
+	}
+
+	vm, err := o.vmPool.Allocate(vmID, imageName, networking.WithEgressPolicy(o.getEgressPolicy(imageName)))
 	if err != nil {
 		logger.Error("failed to allocate VM in VM pool")
 		return nil, nil, err
@@ -198,33 +219,9 @@ func (o *Orchestrator) StartVMWithEnvironment(ctx context.Context, vmID, imageNa
 		}
 	}()
 
-	if err := os.MkdirAll(o.getVMBaseDir(vmID), 0777); err != nil {
-		logger.Error("Failed to create VM base dir")
-		return nil, nil, err
-	}
-	if o.GetUPFEnabled() {
-		logger.Debug("Registering VM with the memory manager")
-
-		stateCfg := manager.SnapshotStateCfg{
-			VMID:           vmID,
-			GuestMemPath:   o.getMemoryFile(vmID),
-			BaseDir:        o.getVMBaseDir(vmID),
-			GuestMemSize:   int(conf.MachineCfg.MemSizeMib) * 1024 * 1024,
-			IsLazyMode:     o.isLazyMode,
-			VMMStatePath:   o.getSnapshotFile(vmID),
-			WorkingSetPath: o.getWorkingSetFile(vmID),
-			// FIXME (gh-807)
-			//InstanceSockAddr: resp.UPFSockPath,
-		}
-		if err := o.memoryManager.RegisterVM(stateCfg); err != nil {
-			return nil, nil, errors.Wrap(err, "failed to register VM with memory manager")
-			// NOTE (Plamen): Potentially need a defer(DeregisteVM) here if RegisterVM is not last to execute
-		}
-	}
-
 	logger.Debug("Successfully started a VM")
 
-	return &StartVMResponse{GuestIP: vm.GetIP()}, startVMMetric, nil
+	return &StartVMResponse{GuestIP: vm.GetIP(), GuestIPv6: vm.GetIPv6()}, startVMMetric, nil
 }
 
 // StopSingleVM Shuts down a VM
@@ -281,6 +278,10 @@ func (o *Orchestrator) StopSingleVM(ctx context.Context, vmID string) error {
 
 	o.workloadIo.Delete(vmID)
 
+	if vm.SnapBooted && o.GetUPFEnabled() {
+		o.deregisterFromMemoryManager(vmID)
+	}
+
 	if vm.SnapBooted {
 		if err := o.devMapper.RemoveDeviceSnapshot(ctx, vm.ContainerSnapKey); err != nil {
 			logger.Error("failed to deactivate container snapshot")
@@ -315,17 +316,41 @@ func getK8sDNS() []string {
 	return dnsIPs
 }
 
-func (o *Orchestrator) getVMConfig(vm *misc.VM) *proto.CreateVMRequest {
-	kernelArgs := "ro noapic reboot=k panic=1 pci=off nomodules systemd.log_color=false systemd.unit=firecracker.target init=/sbin/overlay-init tsc=reliable quiet 8250.nr_uarts=0 ipv6.disable=1"
+// GetSnapshotKey Returns the key of the snapshots of VMs started from the
+// given image for a function revision, given the current VM configuration
+func (o *Orchestrator) GetSnapshotKey(ctx context.Context, revision, imageName string) (snapshotting.SnapshotKey, error) {
+	ctx = namespaces.WithNamespace(ctx, namespaceName)
+
+	digest, err := o.imageManager.GetImageDigest(ctx, imageName)
+	if err != nil {
+		return snapshotting.SnapshotKey{}, err
+	}
 
+	return snapshotting.SnapshotKey{
+		Revision:      revision,
+		ImageDigest:   digest,
+		KernelArgs:    o.getKernelArgs(),
+		MachineConfig: getMachineConfigString(getMachineConfig()),
+	}, nil
+}
+
+func getMachineConfig() *proto.FirecrackerMachineConfiguration {
+	return &proto.FirecrackerMachineConfiguration{
+		VcpuCount:  1,
+		MemSizeMib: 256,
+	}
+}
+
+func getMachineConfigString(cfg *proto.FirecrackerMachineConfiguration) string {
+	return fmt.Sprintf("vcpus=%d,mem=%dMiB", cfg.VcpuCount, cfg.MemSizeMib)
+}
+
+func (o *Orchestrator) getVMConfig(vm *misc.VM) *proto.CreateVMRequest {
 	return &proto.CreateVMRequest{
 		VMID:           vm.ID,
 		TimeoutSeconds: 100,
-		KernelArgs:     kernelArgs,
-		MachineCfg: &proto.FirecrackerMachineConfiguration{
-			VcpuCount:  1,
-			MemSizeMib: 256,
-		},
+		KernelArgs:     o.getKernelArgs(),
+		MachineCfg:     getMachineConfig(),
 		NetworkInterfaces: []*proto.FirecrackerNetworkInterface{{
 			StaticConfig: &proto.StaticNetworkConfiguration{
 				MacAddress:  vm.GetMacAddress(),
@@ -458,9 +483,14 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 	logger.Debug("Orchestrator received LoadSnapshot")
 
+	if err := o.devMapper.CheckPoolCapacity(); err != nil {
+		logger.WithError(err).Error("rejecting VM")
+		return nil, nil, err
+	}
+
 	ctx = namespaces.WithNamespace(ctx, namespaceName)
 
-	vm, err := o.vmPool.Allocate(vmID)
+	vm, err := o.vmPool.Allocate(vmID, snap.GetImage(), networking.WithEgressPolicy(o.getEgressPolicy(snap.GetImage())))
 	if err != nil {
 		logger.Error("failed to allocate VM in VM pool")
 		return nil, nil, err
@@ -487,10 +517,20 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 		return nil, nil, errors.Wrapf(err, "previously created container device does not exist")
 	}
 
-	if err := o.devMapper.RestorePatch(ctx, vm.ContainerSnapKey, snap.GetPatchFilePath()); err != nil {
+	if err := o.devMapper.RestorePatch(ctx, vm.ContainerSnapKey, snap.GetPatchFilePath(), *vm.Image); err != nil {
 		return nil, nil, errors.Wrapf(err, "unpacking patch into container snapshot")
 	}
 
+	decompressTime, err := o.GetSnapshotManager().PrepareMemFile(snap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only reported if the memory file was compressed
+	if decompressTime > 0 {
+		loadSnapshotMetric.MetricMap[metrics.DecompressMemFile] = metrics.ToUS(decompressTime)
+	}
+
 	conf := o.getVMConfig(vm)
 	conf.LoadSnapshot = true
 	conf.SnapshotPath = snap.GetSnapshotFilePath()
@@ -498,6 +538,16 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 	conf.ContainerSnapshotPath = containerSnap.GetDevicePath()
 
 	if o.GetUPFEnabled() {
+		if err := o.registerWithMemoryManager(vmID, snap, conf); err != nil {
+			return nil, nil, err
+		}
+
+		defer func() {
+			if retErr != nil {
+				o.deregisterFromMemoryManager(vmID)
+			}
+		}()
+
 		if err := o.memoryManager.FetchState(vmID); err != nil {
 			return nil, nil, err
 		}
@@ -553,5 +603,131 @@ func (o *Orchestrator) LoadSnapshot(ctx context.Context, vmID string, snap *snap
 
 	vm.SnapBooted = true
 
-	return &StartVMResponse{GuestIP: vm.GetIP()}, loadSnapshotMetric, nil
+	return &StartVMResponse{GuestIP: vm.GetIP(), GuestIPv6: vm.GetIPv6()}, loadSnapshotMetric, nil
+}
+
+// registerWithMemoryManager Registers a VM loaded from a snapshot with the memory manager, which serves its
+// page faults. The working set recorded by the first instance of the snapshot is stored next to the snapshot
+// files, so that it is prefetched by the next instances. The VMM must load the guest memory with the Uffd
+// backend, sending the uffd over the socket in the base directory of the VM, which is kept outside the
+// snapshots dir
+func (o *Orchestrator) registerWithMemoryManager(vmID string, snap *snapshotting.Snapshot, conf *proto.CreateVMRequest) error {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+	logger.Debug("Registering VM with the memory manager")
+
+	if err := os.MkdirAll(o.getVMBaseDir(vmID), 0777); err != nil {
+		logger.Error("Failed to create VM base dir")
+		return err
+	}
+
+	var (
+		policy manager.PrefetchPolicy
+		err    error
+	)
+	if o.prefetchPolicy != "" {
+		// policies keep track of the page faults of a single VM
+		if policy, err = manager.NewPrefetchPolicy(o.prefetchPolicy, o.prefetchPages); err != nil {
+			return err
+		}
+	}
+
+	stateCfg := manager.SnapshotStateCfg{
+		VMID:             vmID,
+		GuestMemPath:     snap.GetMemFilePath(),
+		BaseDir:          filepath.Dir(snap.GetMemFilePath()),
+		GuestMemSize:     int(conf.MachineCfg.MemSizeMib) * 1024 * 1024,
+		IsLazyMode:       o.isLazyMode,
+		PrefetchPolicy:   policy,
+		Refinement:       o.wsRefinement,
+		StreamWorkingSet: o.streamWorkingSet,
+		VMMStatePath:     snap.GetSnapshotFilePath(),
+		WorkingSetPath:   snap.GetWorkingSetFilePath(),
+		InstanceSockAddr: o.getUFFDSocket(vmID),
+	}
+	if o.snapshotStore != nil {
+		o.shareRecord(&stateCfg, snap)
+	}
+
+	if err := o.memoryManager.RegisterVM(stateCfg); err != nil {
+		return errors.Wrap(err, "failed to register VM with memory manager")
+	}
+
+	return nil
+}
+
+// deregisterFromMemoryManager Stops serving the page faults of a VM, dumps its final page fault counters
+// and deregisters it from the memory manager, removing the base directory of the VM
+func (o *Orchestrator) deregisterFromMemoryManager(vmID string) {
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+	logger.Debug("Deregistering VM from the memory manager")
+
+	if err := o.memoryManager.Deactivate(vmID); err != nil {
+		logger.WithError(err).Error("failed to deactivate VM in the memory manager")
+	}
+
+	if stats, err := o.memoryManager.GetUPFStats(vmID); err == nil {
+		logger.WithFields(log.Fields{
+			"activations":     stats.Activations,
+			"faults":          stats.Faults,
+			"uniqueFaults":    stats.UniqueFaults,
+			"prefetchedPages": stats.PrefetchedPages,
+			"workingSetPages": stats.WorkingSetPages,
+			"fetchedBytes":    stats.FetchedBytes,
+		}).Info("UPF stats of the VM")
+	}
+
+	if err := o.memoryManager.DeregisterVM(vmID); err != nil {
+		logger.WithError(err).Error("failed to deregister VM from the memory manager")
+	}
+
+	if err := os.RemoveAll(o.getVMBaseDir(vmID)); err != nil {
+		logger.WithError(err).Error("failed to remove VM base dir")
+	}
+}
+
+// shareRecord Shares the working set recorded for a snapshot with the other nodes through the snapshot store:
+// the record is uploaded once written, and the trace of a record made on another node is downloaded, its
+// working set is then streamed from the store if streaming is on
+func (o *Orchestrator) shareRecord(stateCfg *manager.SnapshotStateCfg, snap *snapshotting.Snapshot) {
+	var (
+		tracePath = filepath.Join(stateCfg.BaseDir, manager.TraceFileName)
+		wsPath    = stateCfg.WorkingSetPath
+		wsName    = filepath.Base(wsPath)
+	)
+
+	if _, err := os.Stat(tracePath); os.IsNotExist(err) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := o.snapshotStore.GetFile(ctx, snap.GetId(), manager.TraceFileName, tracePath)
+		cancel()
+		if err != nil && err != snapshotting.ErrSnapshotNotFound {
+			log.WithError(err).Warnf("failed to download the trace of snapshot %s", snap.GetId())
+		}
+	}
+
+	stateCfg.OnRecordWritten = func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		// the trace is uploaded last, as the working set is only used along with its trace
+		for _, file := range []struct{ name, path string }{{wsName, wsPath}, {manager.TraceFileName, tracePath}} {
+			if err := o.snapshotStore.PutFile(ctx, snap.GetId(), file.name, file.path); err != nil {
+				return errors.Wrapf(err, "uploading %s", file.name)
+			}
+		}
+		return nil
+	}
+
+	if o.streamWorkingSet {
+		stateCfg.WorkingSetOpener = func(ctx context.Context) (io.ReadCloser, int64, error) {
+			if f, err := os.Open(wsPath); err == nil {
+				info, err := f.Stat()
+				if err != nil {
+					f.Close()
+					return nil, 0, err
+				}
+				return f, info.Size(), nil
+			}
+			return o.snapshotStore.OpenFile(ctx, snap.GetId(), wsName)
+		}
+	}
 }
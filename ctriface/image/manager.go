@@ -30,12 +30,22 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// digestTTL is the duration after which the digest an image tag resolves to is refreshed in the background, to detect
+// tags that have been pushed again without querying the registry when a function instance is started.
+const digestTTL = 30 * time.Second
+
+// digestRefreshTimeout bounds the time spent resolving an image tag with the registry in the background.
+const digestRefreshTimeout = 10 * time.Second
+
 // ImageState is used for synchronization to avoid pulling the same image multiple times concurrently.
 type ImageState struct {
 	sync.Mutex
@@ -49,12 +59,20 @@ func NewImageState() *ImageState {
 	return state
 }
 
+// resolvedDigest is the digest an image name resolved to at a given time.
+type resolvedDigest struct {
+	digest     string
+	resolved   time.Time
+	refreshing bool // the digest is being resolved again in the background
+}
+
 // ImageManager manages the images that have been pulled to the node.
 type ImageManager struct {
 	sync.Mutex
 	snapshotter  string                      // image snapshotter
 	cachedImages map[string]containerd.Image // Cached container images
 	imageStates  map[string]*ImageState
+	digests      map[string]*resolvedDigest // Digests of the pulled or resolved images
 	client       *containerd.Client
 }
 
@@ -65,6 +83,7 @@ func NewImageManager(client *containerd.Client, snapshotter string) *ImageManage
 	manager.snapshotter = snapshotter
 	manager.cachedImages = make(map[string]containerd.Image)
 	manager.imageStates = make(map[string]*ImageState)
+	manager.digests = make(map[string]*resolvedDigest)
 	manager.client = client
 	return manager
 }
@@ -78,16 +97,10 @@ func (mgr *ImageManager) pullImage(ctx context.Context, imageName string) error
 	local, _ := isLocalDomain(imageURL)
 	if local {
 		// Pull local image using HTTP
-		resolver := docker.NewResolver(docker.ResolverOptions{
-			Client: http.DefaultClient,
-			Hosts: docker.ConfigureDefaultRegistries(
-				docker.WithPlainHTTP(docker.MatchAllHosts),
-			),
-		})
 		image, err = mgr.client.Pull(ctx, imageURL,
 			containerd.WithPullUnpack,
 			containerd.WithPullSnapshotter(mgr.snapshotter),
-			containerd.WithResolver(resolver),
+			containerd.WithResolver(getResolver(imageURL)),
 		)
 	} else {
 		// Pull remote image
@@ -101,6 +114,7 @@ func (mgr *ImageManager) pullImage(ctx context.Context, imageName string) error
 	}
 	mgr.Lock()
 	mgr.cachedImages[imageName] = image
+	mgr.digests[imageName] = &resolvedDigest{digest: image.Target().Digest.String(), resolved: time.Now()}
 	mgr.Unlock()
 	return nil
 }
@@ -135,6 +149,109 @@ func (mgr *ImageManager) GetImage(ctx context.Context, imageName string) (*conta
 	return &image, nil
 }
 
+// GetImageDigest returns the digest of the manifest an image name refers to. Digest references are returned as is.
+// The digest of a tag is recorded when the image is pulled, or resolved once with the registry if the image has not
+// been pulled yet, and an error is returned if it cannot be resolved. Digests older than digestTTL are refreshed in
+// the background: if a tag has been pushed again, the cached image is invalidated so that the next GetImage pulls the
+// new image, and the new digest is returned from then on.
+func (mgr *ImageManager) GetImageDigest(ctx context.Context, imageName string) (string, error) {
+	if i := strings.Index(imageName, "@"); i >= 0 {
+		return imageName[i+1:], nil
+	}
+
+	mgr.Lock()
+	if cached, ok := mgr.digests[imageName]; ok {
+		if time.Since(cached.resolved) >= digestTTL && !cached.refreshing {
+			cached.refreshing = true
+			go mgr.refreshDigest(imageName)
+		}
+		mgr.Unlock()
+		return cached.digest, nil
+	}
+	mgr.Unlock()
+
+	digest, err := resolveDigest(ctx, imageName)
+	if err != nil {
+		return "", err
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+	if cached, ok := mgr.digests[imageName]; ok {
+		// the image has been pulled or resolved concurrently
+		return cached.digest, nil
+	}
+	mgr.digests[imageName] = &resolvedDigest{digest: digest, resolved: time.Now()}
+
+	return digest, nil
+}
+
+// refreshDigest resolves an image tag again with the registry, invalidating the cached image if the tag has been
+// pushed again. The previous digest is kept if the registry cannot be reached.
+func (mgr *ImageManager) refreshDigest(imageName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), digestRefreshTimeout)
+	defer cancel()
+
+	digest, err := resolveDigest(ctx, imageName)
+
+	mgr.Lock()
+	cached := mgr.digests[imageName]
+	cached.refreshing = false
+	if err != nil {
+		mgr.Unlock()
+		log.WithError(err).Warnf("failed to refresh the digest of image %s, keeping %s", imageName, cached.digest)
+		return
+	}
+	previous := cached.digest
+	cached.digest, cached.resolved = digest, time.Now()
+	mgr.Unlock()
+
+	if previous != digest {
+		log.Infof("Image %s changed from %s to %s, invalidating cached image", imageName, previous, digest)
+		mgr.invalidateImage(imageName)
+	}
+}
+
+// resolveDigest resolves the digest of the manifest an image tag refers to with the registry.
+func resolveDigest(ctx context.Context, imageName string) (string, error) {
+	imageURL := getImageURL(imageName)
+	_, desc, err := getResolver(imageURL).Resolve(ctx, imageURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving image %s", imageName)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// invalidateImage makes the next GetImage for an image name pull the image again.
+func (mgr *ImageManager) invalidateImage(imageName string) {
+	mgr.Lock()
+	imgState, found := mgr.imageStates[imageName]
+	mgr.Unlock()
+
+	if !found {
+		return
+	}
+
+	imgState.Lock()
+	imgState.isCached = false
+	imgState.Unlock()
+}
+
+// getResolver returns the resolver used to pull an image, images of a .local domain are pulled using HTTP
+func getResolver(imageURL string) remotes.Resolver {
+	if local, _ := isLocalDomain(imageURL); local {
+		return docker.NewResolver(docker.ResolverOptions{
+			Client: http.DefaultClient,
+			Hosts: docker.ConfigureDefaultRegistries(
+				docker.WithPlainHTTP(docker.MatchAllHosts),
+			),
+		})
+	}
+
+	return docker.NewResolver(docker.ResolverOptions{})
+}
+
 // Converts an image name to a url if it is not a URL
 func getImageURL(image string) string {
 	// Pull from dockerhub by default if not specified (default k8s behavior)
@@ -23,6 +23,7 @@
 package ctriface
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -36,6 +37,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
 
 	fcclient "github.com/firecracker-microvm/firecracker-containerd/firecracker-control/client"
 	// note: from the original repo
@@ -47,6 +49,8 @@ import (
 	"github.com/vhive-serverless/vhive/memory/manager"
 	"github.com/vhive-serverless/vhive/metrics"
 	"github.com/vhive-serverless/vhive/misc"
+	"github.com/vhive-serverless/vhive/networking"
+	"github.com/vhive-serverless/vhive/snapshotting"
 
 	_ "github.com/davecgh/go-spew/spew" //tmp
 )
@@ -55,6 +59,13 @@ const (
 	containerdAddress      = "/run/firecracker-containerd/containerd.sock"
 	containerdTTRPCAddress = containerdAddress + ".ttrpc"
 	namespaceName          = "firecracker-containerd"
+
+	// vmRuntimeDir holds the per-VM runtime files, e.g. the UPF sockets, outside the snapshots dir so
+	// that they are not mistaken for snapshots
+	vmRuntimeDir = "/run/vhive/vms"
+
+	// poolCheckInterval is the interval at which the usage of the thin pool is sampled
+	poolCheckInterval = 10 * time.Second
 )
 
 type WorkloadIoWriter struct {
@@ -88,12 +99,41 @@ type Orchestrator struct {
 	snapshotsEnabled bool
 	isUPFEnabled     bool
 	isLazyMode       bool
+	prefetchPolicy   string
+	prefetchPages    int
+	wsRefinement     manager.WorkingSetRefinement
+	streamWorkingSet bool
 	snapshotsDir     string
 	isMetricsMode    bool
+
+	snapshotsDiskQuota int64
+	maxSnapshots       int
+	snapshotStore      snapshotting.SnapshotStore
+	memCompressAfter   time.Duration
+	patchMode          devmapper.PatchMode
+	reconcileDevices   bool
+	reconcileDryRun    bool
+
+	// Manager of the snapshots in snapshotsDir, created upon first use
+	snapshotManager     *snapshotting.SnapshotManager
+	snapshotManagerOnce sync.Once
+
+	thinPool            string
+	poolWarnThreshold   float64
+	poolRejectThreshold float64
+
 	netPoolSize      int
+	netPoolMaxSize   int
+	reconcileNetwork bool
 
-	vethPrefix  string
-	clonePrefix string
+	vethPrefix   string
+	clonePrefix  string
+	vethPrefix6  string
+	clonePrefix6 string
+	ipamState    string
+
+	egressPolicy        networking.EgressPolicy
+	imageEgressPolicies sync.Map // image name string -> networking.EgressPolicy
 
 	memoryManager *manager.MemoryManager
 }
@@ -109,12 +149,24 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	o.netPoolSize = 10
 	o.vethPrefix = "172.17"
 	o.clonePrefix = "172.18"
+	o.poolWarnThreshold = 80
+	o.poolRejectThreshold = 95
 
 	for _, opt := range opts {
 		opt(o)
 	}
 
-	o.vmPool = misc.NewVMPool(hostIface, o.netPoolSize, o.vethPrefix, o.clonePrefix)
+	netOpts := []networking.NetworkManagerOption{networking.WithIPAMState(o.ipamState)}
+	if o.netPoolMaxSize > 0 {
+		netOpts = append(netOpts, networking.WithPoolMaxSize(o.netPoolMaxSize))
+	}
+	if o.reconcileNetwork {
+		netOpts = append(netOpts, networking.WithReconciliation())
+	}
+	if o.vethPrefix6 != "" {
+		netOpts = append(netOpts, networking.WithIPv6(o.vethPrefix6, o.clonePrefix6))
+	}
+	o.vmPool = misc.NewVMPool(hostIface, o.netPoolSize, o.vethPrefix, o.clonePrefix, netOpts...)
 
 	if _, err := os.Stat(o.snapshotsDir); err != nil {
 		if !os.IsNotExist(err) {
@@ -147,12 +199,53 @@ func NewOrchestrator(snapshotter, hostIface string, opts ...OrchestratorOption)
 	}
 	log.Info("Created firecracker client")
 
-	o.devMapper = devmapper.NewDeviceMapper(o.client)
+	o.devMapper = devmapper.NewDeviceMapper(
+		o.client,
+		devmapper.WithPatchMode(o.patchMode),
+		devmapper.WithPoolMonitoring(o.thinPool, poolCheckInterval),
+		devmapper.WithPoolThresholds(o.poolWarnThreshold, o.poolRejectThreshold),
+	)
 	o.imageManager = image.NewImageManager(o.client, o.snapshotter)
 
+	if o.reconcileDevices {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if _, err := o.ReconcileDeviceSnapshots(ctx, o.reconcileDryRun); err != nil {
+			log.WithError(err).Warn("failed to reconcile device snapshots")
+		}
+		cancel()
+	}
+
 	return o
 }
 
+// GetPoolUsage Returns the last sampled usage of the thin pool,
+// false if the thin pool is not monitored
+func (o *Orchestrator) GetPoolUsage() (devmapper.PoolUsage, bool) {
+	if o.devMapper == nil {
+		return devmapper.PoolUsage{}, false
+	}
+	return o.devMapper.GetPoolUsage()
+}
+
+// ReconcileDeviceSnapshots Removes the device snapshots and leases leaked by previous runs
+// of vHive that are not used by any VM of the orchestrator, or only reports them if dryRun is set
+func (o *Orchestrator) ReconcileDeviceSnapshots(ctx context.Context, dryRun bool) (*devmapper.ReconcileReport, error) {
+	liveSnapKeys := make([]string, 0)
+	for _, vm := range o.vmPool.GetVMMap() {
+		liveSnapKeys = append(liveSnapKeys, vm.ContainerSnapKey)
+	}
+
+	report, err := o.devMapper.Reconcile(namespaces.WithNamespace(ctx, namespaceName), liveSnapKeys, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Found %d orphaned device snapshots and %d orphaned leases (removed: %t)",
+		len(report.Snapshots), len(report.Leases), report.Removed)
+
+	return report, nil
+}
+
 func (o *Orchestrator) setupCloseHandler() {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -166,9 +259,13 @@ func (o *Orchestrator) setupCloseHandler() {
 }
 
 // Cleanup Removes the bridges created by the VM pool's tap manager
-// Cleans up snapshots directory
+// Cleans up snapshots directory, unless snapshots are enabled, in which
+// case they are kept to be reused after a restart
 func (o *Orchestrator) Cleanup() {
 	o.vmPool.CleanupNetwork()
+	if o.snapshotsEnabled {
+		return
+	}
 	if err := os.RemoveAll(o.snapshotsDir); err != nil {
 		log.Panic("failed to delete snapshots dir", err)
 	}
@@ -209,25 +306,84 @@ func (o *Orchestrator) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, error
 	return o.memoryManager.GetUPFLatencyStats(vmID)
 }
 
+// GetUPFStats Returns the page fault counters of the VMs registered with the memory manager,
+// nil if the UPF mode is off
+func (o *Orchestrator) GetUPFStats() []manager.VMStats {
+	if o.memoryManager == nil {
+		return nil
+	}
+
+	return o.memoryManager.GetAllUPFStats()
+}
+
+// SetEgressPolicy Selects the restrictions of the traffic sent by the VMs of an image, which
+// replace the default egress policy of the orchestrator. The policy is applied immediately to
+// the running VMs of the image, and to the VMs started or loaded from a snapshot afterwards
+func (o *Orchestrator) SetEgressPolicy(imageName string, policy networking.EgressPolicy) error {
+	logger := log.WithFields(log.Fields{"image": imageName})
+	logger.Debug("Orchestrator received SetEgressPolicy")
+
+	o.imageEgressPolicies.Store(imageName, policy)
+
+	for vmID, vm := range o.vmPool.GetVMMap() {
+		if vm.ImageName != imageName {
+			continue
+		}
+
+		err := o.vmPool.SetEgressPolicy(vmID, policy)
+		if _, ok := err.(misc.NonExistErr); ok {
+			// the VM has been stopped in the meantime
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getEgressPolicy Returns the egress policy selected for the VMs of the image, or the default egress policy
+func (o *Orchestrator) getEgressPolicy(imageName string) networking.EgressPolicy {
+	if policy, ok := o.imageEgressPolicies.Load(imageName); ok {
+		return policy.(networking.EgressPolicy)
+	}
+
+	return o.egressPolicy
+}
+
 // GetSnapshotsDir Returns the orchestrator's snapshot directory
 func (o *Orchestrator) GetSnapshotsDir() string {
 	return o.snapshotsDir
 }
 
-func (o *Orchestrator) getSnapshotFile(vmID string) string {
-	return filepath.Join(o.getVMBaseDir(vmID), "snap_file")
+// GetSnapshotManager Returns the manager of the snapshots stored in the orchestrator's snapshot directory. The
+// manager is shared by all its users, so that the snapshots are recovered, garbage collected and compressed by a
+// single manager that knows all the snapshots in use
+func (o *Orchestrator) GetSnapshotManager() *snapshotting.SnapshotManager {
+	o.snapshotManagerOnce.Do(func() {
+		o.snapshotManager = snapshotting.NewSnapshotManager(o.snapshotsDir, o.getSnapshotManagerOptions()...)
+	})
+
+	return o.snapshotManager
 }
 
-func (o *Orchestrator) getMemoryFile(vmID string) string {
-	return filepath.Join(o.getVMBaseDir(vmID), "mem_file")
+// getSnapshotManagerOptions Returns the options to configure the garbage collection, the snapshot
+// store and the memory file compression of the snapshot manager
+func (o *Orchestrator) getSnapshotManagerOptions() []snapshotting.SnapshotManagerOption {
+	return []snapshotting.SnapshotManagerOption{
+		snapshotting.WithDiskQuota(o.snapshotsDiskQuota),
+		snapshotting.WithMaxSnapshots(o.maxSnapshots),
+		snapshotting.WithSnapshotStore(o.snapshotStore),
+		snapshotting.WithMemoryCompression(o.memCompressAfter),
+	}
 }
 
-func (o *Orchestrator) getWorkingSetFile(vmID string) string {
-	return filepath.Join(o.getVMBaseDir(vmID), "working_set_pages")
+func (o *Orchestrator) getUFFDSocket(vmID string) string {
+	return filepath.Join(o.getVMBaseDir(vmID), "uffd.sock")
 }
 
 func (o *Orchestrator) getVMBaseDir(vmID string) string {
-	return filepath.Join(o.snapshotsDir, vmID)
+	return filepath.Join(vmRuntimeDir, vmID)
 }
 
 func (o *Orchestrator) setupHeartbeat() {
@@ -237,6 +393,9 @@ func (o *Orchestrator) setupHeartbeat() {
 		for {
 			<-heartbeat.C
 			log.Info("HEARTBEAT: number of active VMs: ", len(o.vmPool.GetVMMap()))
+			if usage, ok := o.GetPoolUsage(); ok {
+				log.Infof("HEARTBEAT: thin pool usage: data %.1f%%, metadata %.1f%%", usage.DataPercent(), usage.MetadataPercent())
+			}
 		} // for
 	}() // go func
 }
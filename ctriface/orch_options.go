@@ -22,6 +22,15 @@
 
 package ctriface
 
+import (
+	"time"
+
+	"github.com/vhive-serverless/vhive/devmapper"
+	"github.com/vhive-serverless/vhive/memory/manager"
+	"github.com/vhive-serverless/vhive/networking"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
 // OrchestratorOption Options to pass to Orchestrator
 type OrchestratorOption func(*Orchestrator)
 
@@ -57,6 +66,65 @@ func WithSnapshotsDir(snapshotsDir string) OrchestratorOption {
 	}
 }
 
+// WithSnapshotsDiskQuota Sets the maximum disk space (in bytes) that
+// snapshots may use before the least-recently-used ones are evicted
+func WithSnapshotsDiskQuota(snapshotsDiskQuota int64) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.snapshotsDiskQuota = snapshotsDiskQuota
+	}
+}
+
+// WithMaxSnapshots Sets the maximum number of snapshots that are kept
+// before the least-recently-used ones are evicted
+func WithMaxSnapshots(maxSnapshots int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.maxSnapshots = maxSnapshots
+	}
+}
+
+// WithSnapshotStore Sets the remote store used to share
+// snapshots between nodes (nil keeps snapshots local)
+func WithSnapshotStore(store snapshotting.SnapshotStore) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.snapshotStore = store
+	}
+}
+
+// WithSnapshotsMemCompression Sets the duration after which the memory file
+// of an unused snapshot is compressed (0 disables compression)
+func WithSnapshotsMemCompression(idleTime time.Duration) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.memCompressAfter = idleTime
+	}
+}
+
+// WithPatchMode Sets the mode used to capture the container
+// disk state of snapshots (rsync or block-level patches)
+func WithPatchMode(mode devmapper.PatchMode) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.patchMode = mode
+	}
+}
+
+// WithDeviceSnapshotsReconciliation Enables the removal of the device snapshots
+// and leases leaked by previous runs upon startup, or only reports them if dryRun is set
+func WithDeviceSnapshotsReconciliation(dryRun bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.reconcileDevices = true
+		o.reconcileDryRun = dryRun
+	}
+}
+
+// WithThinPoolMonitoring Sets the thin pool whose usage is monitored, new VMs are
+// rejected when the usage of the pool exceeds rejectPercent (disabled if empty)
+func WithThinPoolMonitoring(poolName string, warnPercent, rejectPercent float64) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.thinPool = poolName
+		o.poolWarnThreshold = warnPercent
+		o.poolRejectThreshold = rejectPercent
+	}
+}
+
 // WithLazyMode Sets the lazy paging mode on (or off),
 // where all guest memory pages are brought on demand.
 // Only works if snapshots are enabled
@@ -66,6 +134,35 @@ func WithLazyMode(isLazyMode bool) OrchestratorOption {
 	}
 }
 
+// WithPrefetchPolicy Sets the policy deciding the pages prefetched upon user-level
+// page faults and the number of pages prefetched by the readahead and stride policies.
+// The record-and-prefetch policy (or none in lazy mode) is used if the name is empty
+func WithPrefetchPolicy(name string, pages int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.prefetchPolicy = name
+		o.prefetchPages = pages
+	}
+}
+
+// WithWorkingSetRefinement Sets the number of invocations of a snapshot after which the pages
+// missed by at least minMisses of them are merged into the recorded working set (0 disables it)
+func WithWorkingSetRefinement(interval, minMisses int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.wsRefinement = manager.WorkingSetRefinement{
+			Interval:  interval,
+			MinMisses: minMisses,
+		}
+	}
+}
+
+// WithWorkingSetStreaming Sets the streaming of the working set on (or off), where the working set
+// is installed in chunks as it is fetched, from the snapshot store if it is not stored locally
+func WithWorkingSetStreaming(streamWorkingSet bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.streamWorkingSet = streamWorkingSet
+	}
+}
+
 // WithMetricsMode Sets the metrics mode
 func WithMetricsMode(isMetricsMode bool) OrchestratorOption {
 	return func(o *Orchestrator) {
@@ -73,12 +170,47 @@ func WithMetricsMode(isMetricsMode bool) OrchestratorOption {
 	}
 }
 
+// WithEgressPolicy Sets the default restrictions of the traffic sent by the VMs,
+// which can be replaced for the VMs of an image with SetEgressPolicy
+func WithEgressPolicy(policy networking.EgressPolicy) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.egressPolicy = policy
+	}
+}
+
+// WithEgressConfig Sets the default restrictions of the traffic sent by the VMs
+// and the restrictions of the VMs of each image listed in the configuration
+func WithEgressConfig(cfg networking.EgressConfig) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.egressPolicy = cfg.Default
+		for imageName, policy := range cfg.Images {
+			o.imageEgressPolicies.Store(imageName, policy)
+		}
+	}
+}
+
 func WithNetPoolSize(netPoolSize int) OrchestratorOption {
 	return func(o *Orchestrator) {
 		o.netPoolSize = netPoolSize
 	}
 }
 
+// WithNetPoolMaxSize Sets the maximum number of free network devices kept in the pool,
+// the surplus ones are removed in the background (twice the pool size if 0)
+func WithNetPoolMaxSize(netPoolMaxSize int) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.netPoolMaxSize = netPoolMaxSize
+	}
+}
+
+// WithNetworkReconciliation Sets whether the intact networks left by previous runs of vHive are
+// adopted into the network pool, and the ones not used by VMs anymore removed, upon startup
+func WithNetworkReconciliation(reconcileNetwork bool) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.reconcileNetwork = reconcileNetwork
+	}
+}
+
 func WithVethPrefix(vethPrefix string) OrchestratorOption {
 	return func(o *Orchestrator) {
 		o.vethPrefix = vethPrefix
@@ -90,3 +222,20 @@ func WithClonePrefix(clonePrefix string) OrchestratorOption {
 		o.clonePrefix = clonePrefix
 	}
 }
+
+// WithIPv6Prefixes Sets the IPv6 networks of the IP addresses of the veth devices and of the
+// node-accessible IP addresses of the VMs, which are reachable over IPv6 (disabled if empty)
+func WithIPv6Prefixes(vethPrefix6, clonePrefix6 string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.vethPrefix6 = vethPrefix6
+		o.clonePrefix6 = clonePrefix6
+	}
+}
+
+// WithIPAMState Sets the file persisting the IP addresses allocated to the VMs,
+// so that they are recovered after a restart (not persisted if empty)
+func WithIPAMState(statePath string) OrchestratorOption {
+	return func(o *Orchestrator) {
+		o.ipamState = statePath
+	}
+}
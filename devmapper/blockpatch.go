@@ -0,0 +1,476 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sectorSize is the unit of the device sizes and block sizes reported by the device mapper.
+	sectorSize = 512
+
+	// maxPatchChunk is the maximum length of the data of a single block patch record.
+	maxPatchChunk = 1 << 20
+)
+
+// blockPatchMagic identifies block-level patch files, rsync batch files are used otherwise. The last two bytes are
+// the version of the format.
+var blockPatchMagic = [8]byte{'V', 'H', 'B', 'L', 'K', 'P', '0', '2'}
+
+// blockPatchHeader is the uncompressed header of a block-level patch file. It is followed by a zstd stream of
+// blockPatchRecords, each followed by the data of the range unless the range has been discarded, the stream is
+// terminated by a record with a length of 0.
+type blockPatchHeader struct {
+	Magic      [8]byte
+	BlockSize  uint32   // size of the thin-pool data blocks in bytes
+	DeviceSize uint64   // size of the container device in bytes
+	BaseImage  [32]byte // identity of the image the blocks were compared against, see baseImageID
+}
+
+// blockPatchRecord is a range of the container device that differs from the image.
+type blockPatchRecord struct {
+	Offset    uint64
+	Length    uint64
+	Discarded uint32 // 1 if the range is unmapped in the container device and reads as zeros
+}
+
+// blockRange is a range of thin-pool data blocks.
+type blockRange struct {
+	Begin     uint64
+	Length    uint64
+	Discarded bool
+}
+
+// thinDelta is the output of thin_delta comparing two thin devices.
+type thinDelta struct {
+	XMLName       xml.Name `xml:"superblock"`
+	DataBlockSize uint64   `xml:"data_block_size,attr"` // in sectors
+	Diff          struct {
+		Ranges []struct {
+			XMLName xml.Name
+			Begin   uint64 `xml:"begin,attr"`
+			Length  uint64 `xml:"length,attr"`
+		} `xml:",any"`
+	} `xml:"diff"`
+}
+
+// thinDevice is a thin device of a thin pool.
+type thinDevice struct {
+	pool string // name of the thin pool
+	id   string // thin device id in the pool
+}
+
+// parseThinDelta returns the size of the data blocks in bytes and the ranges of blocks that differ between the two
+// devices compared by thin_delta. Blocks only mapped in the first device are returned as discarded ranges.
+func parseThinDelta(output []byte) (uint64, []blockRange, error) {
+	var delta thinDelta
+	if err := xml.Unmarshal(output, &delta); err != nil {
+		return 0, nil, errors.Wrapf(err, "parsing thin_delta output")
+	}
+
+	ranges := make([]blockRange, 0)
+	for _, r := range delta.Diff.Ranges {
+		switch r.XMLName.Local {
+		case "same":
+		case "different", "right_only":
+			ranges = append(ranges, blockRange{Begin: r.Begin, Length: r.Length})
+		case "left_only":
+			ranges = append(ranges, blockRange{Begin: r.Begin, Length: r.Length, Discarded: true})
+		default:
+			return 0, nil, errors.New(fmt.Sprintf("unexpected range %s in thin_delta output", r.XMLName.Local))
+		}
+	}
+
+	return delta.DataBlockSize * sectorSize, ranges, nil
+}
+
+// baseImageID returns the identity recorded in block-level patches of the image whose snapshot has the given key. The
+// key is the chain ID of the layers of the image, so that the identity is the same on all nodes and changes when the
+// image is pulled again with different content.
+func baseImageID(imageKey string) [32]byte {
+	return sha256.Sum256([]byte(imageKey))
+}
+
+// getThinDevice returns the thin pool and the id of the thin device at devicePath.
+func getThinDevice(devicePath string) (thinDevice, error) {
+	// Table of a thin device: <start> <length> thin <pool major:minor> <device id>
+	fields, err := dmsetupTable(devicePath)
+	if err != nil {
+		return thinDevice{}, err
+	}
+	if len(fields) < 5 || fields[2] != "thin" {
+		return thinDevice{}, errors.New(fmt.Sprintf("%s is not a thin device", devicePath))
+	}
+
+	pool, err := dmsetup("info", "-c", "--noheadings", "-o", "name", "/dev/block/"+fields[3])
+	if err != nil {
+		return thinDevice{}, err
+	}
+
+	return thinDevice{pool: strings.TrimSpace(string(pool)), id: fields[4]}, nil
+}
+
+// getThinPoolMetadataDevice returns the path of the metadata device of a thin pool.
+func getThinPoolMetadataDevice(pool string) (string, error) {
+	// Table of a thin pool: <start> <length> thin-pool <metadata major:minor> <data major:minor> ...
+	fields, err := dmsetupTable(pool)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) < 5 || fields[2] != "thin-pool" {
+		return "", errors.New(fmt.Sprintf("%s is not a thin pool", pool))
+	}
+
+	return "/dev/block/" + fields[3], nil
+}
+
+// dmsetupTable returns the fields of the device mapper table of a device.
+func dmsetupTable(device string) ([]string, error) {
+	out, err := dmsetup("table", device)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+// dmsetup runs a dmsetup command and returns its output.
+func dmsetup(args ...string) ([]byte, error) {
+	var errb bytes.Buffer
+	cmd := exec.Command("sudo", append([]string{"dmsetup"}, args...)...)
+	cmd.Stderr = &errb
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "running dmsetup %s: %s", strings.Join(args, " "), errb.String())
+	}
+
+	return out, nil
+}
+
+// diffThinDevices computes the ranges of blocks that differ between two thin devices of the same pool using a
+// snapshot of the thin-pool metadata, so that the pool can be used while the devices are compared.
+func (dmpr *DeviceMapper) diffThinDevices(baseDevicePath, devicePath string) (uint64, []blockRange, error) {
+	base, err := getThinDevice(baseDevicePath)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dev, err := getThinDevice(devicePath)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if base.pool != dev.pool {
+		return 0, nil, errors.New(fmt.Sprintf("%s and %s belong to different thin pools", baseDevicePath, devicePath))
+	}
+
+	metadataDevice, err := getThinPoolMetadataDevice(dev.pool)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// A thin pool has a single metadata snapshot
+	dmpr.metadataLock.Lock()
+	defer dmpr.metadataLock.Unlock()
+
+	if _, err := dmsetup("message", dev.pool, "0", "reserve_metadata_snap"); err != nil {
+		return 0, nil, err
+	}
+	defer func() { _, _ = dmsetup("message", dev.pool, "0", "release_metadata_snap") }()
+
+	var errb bytes.Buffer
+	cmd := exec.Command("sudo", "thin_delta", "--metadata-snap", metadataDevice, "--snap1", base.id, "--snap2", dev.id)
+	cmd.Stderr = &errb
+
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "running thin_delta: %s", errb.String())
+	}
+
+	return parseThinDelta(out)
+}
+
+// createBlockPatch writes the blocks of the container device that differ from the device of the image with the given
+// key to patchPath.
+func (dmpr *DeviceMapper) createBlockPatch(imageKey, imageDevicePath, containerDevicePath, patchPath string) error {
+	device, err := os.Open(containerDevicePath)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", containerDevicePath)
+	}
+	defer device.Close()
+
+	// Make sure the writes of the VM have reached the thin pool before its metadata is inspected
+	if err := device.Sync(); err != nil {
+		return errors.Wrapf(err, "flushing %s", containerDevicePath)
+	}
+
+	deviceSize, err := device.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrapf(err, "getting size of %s", containerDevicePath)
+	}
+
+	blockSize, ranges, err := dmpr.diffThinDevices(imageDevicePath, containerDevicePath)
+	if err != nil {
+		return err
+	}
+
+	patch, err := os.Create(patchPath)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", patchPath)
+	}
+	defer patch.Close()
+
+	if err := writeBlockPatch(patch, device, uint64(deviceSize), blockSize, baseImageID(imageKey), ranges); err != nil {
+		return errors.Wrapf(err, "writing %s", patchPath)
+	}
+
+	return patch.Close()
+}
+
+// writeBlockPatch writes a block-level patch storing the supplied ranges of blocks read from device, which differ
+// from the base image, to w.
+func writeBlockPatch(w io.Writer, device io.ReaderAt, deviceSize, blockSize uint64, baseImage [32]byte, ranges []blockRange) error {
+	hdr := blockPatchHeader{Magic: blockPatchMagic, BlockSize: uint32(blockSize), DeviceSize: deviceSize, BaseImage: baseImage}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxPatchChunk)
+	for _, r := range ranges {
+		offset := r.Begin * blockSize
+		end := (r.Begin + r.Length) * blockSize
+		if end > deviceSize {
+			end = deviceSize
+		}
+
+		if r.Discarded {
+			if offset < end {
+				if err := binary.Write(zw, binary.LittleEndian, blockPatchRecord{Offset: offset, Length: end - offset, Discarded: 1}); err != nil {
+					zw.Close()
+					return err
+				}
+			}
+			continue
+		}
+
+		for ; offset < end; offset += maxPatchChunk {
+			length := end - offset
+			if length > maxPatchChunk {
+				length = maxPatchChunk
+			}
+
+			if _, err := device.ReadAt(buf[:length], int64(offset)); err != nil {
+				zw.Close()
+				return errors.Wrapf(err, "reading blocks at offset %d", offset)
+			}
+			if err := binary.Write(zw, binary.LittleEndian, blockPatchRecord{Offset: offset, Length: length}); err != nil {
+				zw.Close()
+				return err
+			}
+			if _, err := zw.Write(buf[:length]); err != nil {
+				zw.Close()
+				return err
+			}
+		}
+	}
+
+	if err := binary.Write(zw, binary.LittleEndian, blockPatchRecord{}); err != nil {
+		zw.Close()
+		return err
+	}
+
+	return zw.Close()
+}
+
+// isBlockPatch returns whether the patch file at patchPath is a block-level patch.
+func isBlockPatch(patchPath string) (bool, error) {
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "opening %s", patchPath)
+	}
+	defer patch.Close()
+
+	var magic [8]byte
+	if _, err := io.ReadFull(patch, magic[:]); err != nil {
+		return false, nil
+	}
+
+	// Patches of any version are block-level patches, unsupported versions are rejected when they are applied
+	return bytes.Equal(magic[:6], blockPatchMagic[:6]), nil
+}
+
+// restoreBlockPatch writes the blocks stored in a block-level patch to the container device, without mounting its
+// filesystem. The container device must have been created from the image with the given key, which the patch was
+// created against.
+func restoreBlockPatch(imageKey, containerDevicePath, patchPath string) error {
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", patchPath)
+	}
+	defer patch.Close()
+
+	device, err := os.OpenFile(containerDevicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", containerDevicePath)
+	}
+	defer device.Close()
+
+	if err := applyBlockPatch(device, bufio.NewReader(patch), baseImageID(imageKey)); err != nil {
+		return errors.Wrapf(err, "applying %s to %s", patchPath, containerDevicePath)
+	}
+
+	return device.Sync()
+}
+
+// applyBlockPatch writes the ranges stored in a block-level patch read from r to device, which must be a copy of the
+// base image the patch was created against. Discarded ranges are discarded from the device, or overwritten with zeros
+// if the device does not support discarding.
+func applyBlockPatch(device *os.File, r io.Reader, baseImage [32]byte) error {
+	var hdr blockPatchHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return errors.Wrapf(err, "reading patch header")
+	}
+	if hdr.Magic != blockPatchMagic {
+		return errors.New(fmt.Sprintf("unsupported block-level patch version %q", hdr.Magic[:]))
+	}
+	if hdr.BaseImage != baseImage {
+		return errors.New("block-level patch was created against another image")
+	}
+
+	deviceSize, err := device.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrapf(err, "getting device size")
+	}
+	if uint64(deviceSize) != hdr.DeviceSize {
+		return errors.New(fmt.Sprintf("device has size %d instead of %d", deviceSize, hdr.DeviceSize))
+	}
+
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	buf := make([]byte, maxPatchChunk)
+	for {
+		var rec blockPatchRecord
+		if err := binary.Read(zr, binary.LittleEndian, &rec); err != nil {
+			return errors.Wrapf(err, "reading patch record")
+		}
+		if rec.Length == 0 {
+			break
+		}
+		if rec.Offset+rec.Length > hdr.DeviceSize {
+			return errors.New(fmt.Sprintf("patch record at offset %d exceeds the device", rec.Offset))
+		}
+
+		if rec.Discarded != 0 {
+			if err := discardRange(device, rec.Offset, rec.Length, buf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if rec.Length > maxPatchChunk {
+			return errors.New(fmt.Sprintf("patch record at offset %d is too long", rec.Offset))
+		}
+		if _, err := io.ReadFull(zr, buf[:rec.Length]); err != nil {
+			return errors.Wrapf(err, "reading patch data")
+		}
+		if _, err := device.WriteAt(buf[:rec.Length], int64(rec.Offset)); err != nil {
+			return errors.Wrapf(err, "writing blocks at offset %d", rec.Offset)
+		}
+	}
+
+	return nil
+}
+
+// discardRange makes a range of a device read as zeros, punching a hole if the device supports it and overwriting the
+// range with zeros otherwise.
+func discardRange(device *os.File, offset, length uint64, buf []byte) error {
+	err := unix.Fallocate(int(device.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, int64(offset), int64(length))
+	if err == nil {
+		return nil
+	}
+
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	for end := offset + length; offset < end; {
+		n := end - offset
+		if n > uint64(len(buf)) {
+			n = uint64(len(buf))
+		}
+		if _, err := device.WriteAt(buf[:n], int64(offset)); err != nil {
+			return errors.Wrapf(err, "zeroing blocks at offset %d", offset)
+		}
+		offset += n
+	}
+
+	return nil
+}
+
+// ParsePatchMode returns the patch mode with the given name, rsync or block.
+func ParsePatchMode(name string) (PatchMode, error) {
+	switch name {
+	case "rsync":
+		return PatchModeRsync, nil
+	case "block":
+		return PatchModeBlock, nil
+	default:
+		return PatchModeRsync, errors.New(fmt.Sprintf("unknown patch mode %s, valid options: rsync, block", name))
+	}
+}
+
+// String returns the name of the patch mode.
+func (m PatchMode) String() string {
+	switch m {
+	case PatchModeRsync:
+		return "rsync"
+	case PatchModeBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("PatchMode(%d)", int(m))
+	}
+}
@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testThinDelta = `<superblock uuid="" time="3" transaction="4" data_block_size="8" nr_data_blocks="1024">
+  <diff left="1" right="2">
+    <same begin="0" length="2"/>
+    <different begin="2" length="1"/>
+    <right_only begin="5" length="2"/>
+    <left_only begin="9" length="1"/>
+  </diff>
+</superblock>
+`
+
+const testImageKey = "sha256:7c0c5e1c6e8b0e9f4a3d2b1a0f9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e"
+
+func TestParseThinDelta(t *testing.T) {
+	blockSize, ranges, err := parseThinDelta([]byte(testThinDelta))
+	require.NoError(t, err, "Failed to parse thin_delta output")
+	require.Equal(t, uint64(4096), blockSize, "Wrong block size")
+	require.Equal(t, []blockRange{
+		{Begin: 2, Length: 1},
+		{Begin: 5, Length: 2},
+		{Begin: 9, Length: 1, Discarded: true},
+	}, ranges, "Wrong ranges")
+
+	_, _, err = parseThinDelta([]byte(`<superblock data_block_size="8"><diff><moved begin="0" length="1"/></diff></superblock>`))
+	require.Error(t, err, "Unknown ranges should be rejected")
+}
+
+func TestBlockPatch(t *testing.T) {
+	const blockSize = 4096
+	dir := t.TempDir()
+
+	image := bytes.Repeat([]byte{0xaa}, 12*blockSize)
+	container := append([]byte{}, image...)
+	for i := 2 * blockSize; i < 3*blockSize; i++ {
+		container[i] = byte(i)
+	}
+	for i := 5 * blockSize; i < 7*blockSize; i++ {
+		container[i] = byte(i * 3)
+	}
+	for i := 9 * blockSize; i < 10*blockSize; i++ {
+		container[i] = 0
+	}
+
+	containerPath := filepath.Join(dir, "container")
+	require.NoError(t, os.WriteFile(containerPath, container, 0644), "Failed to write container device")
+	devicePath := filepath.Join(dir, "device")
+	require.NoError(t, os.WriteFile(devicePath, image, 0644), "Failed to write device")
+
+	_, ranges, err := parseThinDelta([]byte(testThinDelta))
+	require.NoError(t, err, "Failed to parse thin_delta output")
+
+	src, err := os.Open(containerPath)
+	require.NoError(t, err, "Failed to open container device")
+	defer src.Close()
+
+	patchPath := filepath.Join(dir, "patch_file")
+	patch, err := os.Create(patchPath)
+	require.NoError(t, err, "Failed to create patch")
+	require.NoError(t, writeBlockPatch(patch, src, uint64(len(container)), blockSize, baseImageID(testImageKey), ranges), "Failed to write patch")
+	require.NoError(t, patch.Close(), "Failed to write patch")
+
+	blockPatch, err := isBlockPatch(patchPath)
+	require.NoError(t, err, "Failed to check patch")
+	require.True(t, blockPatch, "Patch should be a block-level patch")
+
+	// Patches created against another image are rejected
+	require.Error(t, restoreBlockPatch("sha256:other", devicePath, patchPath), "Patch of another image should be rejected")
+
+	require.NoError(t, restoreBlockPatch(testImageKey, devicePath, patchPath), "Failed to restore patch")
+
+	restored, err := os.ReadFile(devicePath)
+	require.NoError(t, err, "Failed to read device")
+	require.True(t, bytes.Equal(container, restored), "Restored device differs from the container device")
+
+	// Patches of devices of another size are rejected
+	require.NoError(t, os.WriteFile(devicePath, image[:blockSize], 0644), "Failed to write device")
+	require.Error(t, restoreBlockPatch(testImageKey, devicePath, patchPath), "Patch of a device of another size should be rejected")
+}
+
+func TestIsBlockPatch(t *testing.T) {
+	patchPath := filepath.Join(t.TempDir(), "patch_file")
+	require.NoError(t, os.WriteFile(patchPath, []byte("rsync batch"), 0644), "Failed to write patch")
+
+	blockPatch, err := isBlockPatch(patchPath)
+	require.NoError(t, err, "Failed to check patch")
+	require.False(t, blockPatch, "rsync patch should not be a block-level patch")
+
+	// Patches of the first version do not record their base image and are rejected
+	require.NoError(t, os.WriteFile(patchPath, append([]byte("VHBLKP01"), make([]byte, 64)...), 0644), "Failed to write patch")
+	blockPatch, err = isBlockPatch(patchPath)
+	require.NoError(t, err, "Failed to check patch")
+	require.True(t, blockPatch, "Patch of the first version should be a block-level patch")
+
+	devicePath := filepath.Join(t.TempDir(), "device")
+	require.NoError(t, os.WriteFile(devicePath, make([]byte, 4096), 0644), "Failed to write device")
+	require.Error(t, restoreBlockPatch(testImageKey, devicePath, patchPath), "Patch of the first version should be rejected")
+}
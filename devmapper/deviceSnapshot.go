@@ -23,6 +23,7 @@
 package devmapper
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -32,12 +33,23 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ErrIncompatibleMount is returned when mounting a device snapshot that is already mounted in an incompatible mode,
+// i.e., when either the existing mount or the requested mount is read-write.
+var ErrIncompatibleMount = errors.New("device snapshot is already mounted in an incompatible mode")
+
+// Functions used to mount and unmount devices, replaced in tests
+var (
+	mountDevice   = mountExt4
+	unmountDevice = unMountExt4
+)
+
 // DeviceSnapshot represents a device mapper snapshot
 type DeviceSnapshot struct {
 	sync.Mutex
 	path            string
 	mountDir        string
 	mountedReadonly bool
+	numMounts       int // number of users of the mount
 }
 
 // NewDeviceSnapshot initializes a new device mapper snapshot.
@@ -50,23 +62,35 @@ func NewDeviceSnapshot(path string) *DeviceSnapshot {
 }
 
 // Mount a snapshot device and returns the path where it is mounted. For better performance and efficiency,
-// a snapshot is only mounted once and shared if it is already mounted.
+// a snapshot is only mounted once and shared if it is already mounted. A read-only mount is shared by all the readers,
+// while a read-write mount is exclusive: ErrIncompatibleMount is returned if the snapshot is already mounted and
+// either mount is read-write. Every successful Mount must be paired with an UnMount.
 func (dsnp *DeviceSnapshot) Mount(readOnly bool) (string, error) {
 	dsnp.Lock()
 	defer dsnp.Unlock()
 
+	if dsnp.numMounts > 0 {
+		if !readOnly || !dsnp.mountedReadonly {
+			return "", errors.Wrapf(ErrIncompatibleMount, "mounting %s (read-only: %t, mounted read-only: %t)", dsnp.path, readOnly, dsnp.mountedReadonly)
+		}
+		dsnp.numMounts++
+		return dsnp.mountDir, nil
+	}
+
 	mountDir, err := os.MkdirTemp("", filepath.Base(dsnp.path))
 	if err != nil {
 		return "", err
 	}
 	mountDir = removeTrailingSlash(mountDir)
 
-	err = mountExt4(dsnp.path, mountDir, readOnly)
+	err = mountDevice(dsnp.path, mountDir, readOnly)
 	if err != nil {
+		_ = os.Remove(mountDir)
 		return "", errors.Wrapf(err, "mounting %s at %s", dsnp.path, mountDir)
 	}
 	dsnp.mountDir = mountDir
 	dsnp.mountedReadonly = readOnly
+	dsnp.numMounts = 1
 
 	return dsnp.mountDir, nil
 }
@@ -77,16 +101,28 @@ func (dsnp *DeviceSnapshot) UnMount() error {
 	dsnp.Lock()
 	defer dsnp.Unlock()
 
-	err := unMountExt4(dsnp.mountDir)
-	if err != nil {
-		return errors.Wrapf(err, "unmounting %s", dsnp.mountDir)
+	if dsnp.numMounts == 0 {
+		return errors.New(fmt.Sprintf("unmounting %s: device snapshot is not mounted", dsnp.path))
 	}
 
-	err = os.RemoveAll(dsnp.mountDir)
+	if dsnp.numMounts > 1 {
+		dsnp.numMounts--
+		return nil
+	}
+
+	mountDir := dsnp.mountDir
+	err := unmountDevice(mountDir)
 	if err != nil {
-		return errors.Wrapf(err, "removing %s", dsnp.mountDir)
+		return errors.Wrapf(err, "unmounting %s", mountDir)
 	}
 	dsnp.mountDir = ""
+	dsnp.mountedReadonly = false
+	dsnp.numMounts = 0
+
+	err = os.RemoveAll(mountDir)
+	if err != nil {
+		return errors.Wrapf(err, "removing %s", mountDir)
+	}
 
 	return nil
 }
@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMounts replaces the mount functions with fakes counting the mounted devices.
+func fakeMounts(t *testing.T) map[string]bool {
+	var mu sync.Mutex
+	mounted := make(map[string]bool)
+
+	mountDevice = func(devicePath, mountPath string, readOnly bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		require.False(t, mounted[mountPath], "Mount point is already mounted")
+		mounted[mountPath] = true
+		return nil
+	}
+	unmountDevice = func(mountPath string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		require.True(t, mounted[mountPath], "Mount point is not mounted")
+		delete(mounted, mountPath)
+		return nil
+	}
+
+	t.Cleanup(func() {
+		mountDevice = mountExt4
+		unmountDevice = unMountExt4
+	})
+
+	return mounted
+}
+
+func TestDeviceSnapshotSharedMount(t *testing.T) {
+	mounted := fakeMounts(t)
+	dsnp := NewDeviceSnapshot("/dev/mapper/test-snap")
+
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path, err := dsnp.Mount(true)
+			require.NoError(t, err, "Failed to mount device snapshot")
+			paths[i] = path
+		}(i)
+	}
+	wg.Wait()
+
+	require.Len(t, mounted, 1, "Read-only mounts should be shared")
+	for _, path := range paths {
+		require.Equal(t, paths[0], path, "Read-only mounts should be shared")
+	}
+
+	_, err := dsnp.Mount(false)
+	require.ErrorIs(t, err, ErrIncompatibleMount, "Read-write mount of a mounted device should fail")
+
+	for range paths[1:] {
+		require.NoError(t, dsnp.UnMount(), "Failed to unmount device snapshot")
+		require.Len(t, mounted, 1, "Device should stay mounted while in use")
+	}
+
+	require.NoError(t, dsnp.UnMount(), "Failed to unmount device snapshot")
+	require.Empty(t, mounted, "Device should be unmounted by the last user")
+	require.Error(t, dsnp.UnMount(), "Unmounting a device that is not mounted should fail")
+}
+
+func TestDeviceSnapshotExclusiveMount(t *testing.T) {
+	mounted := fakeMounts(t)
+	dsnp := NewDeviceSnapshot("/dev/mapper/test-snap")
+
+	_, err := dsnp.Mount(false)
+	require.NoError(t, err, "Failed to mount device snapshot")
+
+	_, err = dsnp.Mount(true)
+	require.ErrorIs(t, err, ErrIncompatibleMount, "Read-only mount of a device mounted read-write should fail")
+	_, err = dsnp.Mount(false)
+	require.ErrorIs(t, err, ErrIncompatibleMount, "Read-write mounts should be exclusive")
+
+	require.NoError(t, dsnp.UnMount(), "Failed to unmount device snapshot")
+	require.Empty(t, mounted, "Device should be unmounted")
+
+	_, err = dsnp.Mount(true)
+	require.NoError(t, err, "Device should be mountable once unmounted")
+	require.NoError(t, dsnp.UnMount(), "Failed to unmount device snapshot")
+}
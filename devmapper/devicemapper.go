@@ -27,6 +27,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
 	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/opencontainers/image-spec/identity"
@@ -35,26 +36,93 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 )
 
+// PatchMode is the way the disk state of a container is captured in a patch file.
+type PatchMode int
+
+const (
+	// PatchModeRsync captures the file differences between the image and the container filesystems with rsync.
+	PatchModeRsync PatchMode = iota
+	// PatchModeBlock captures the blocks that differ between the image and the container devices, found using the
+	// thin-pool metadata with thin_delta.
+	PatchModeBlock
+)
+
+// DeviceMapperOption Options to pass to DeviceMapper
+type DeviceMapperOption func(*DeviceMapper)
+
+// WithPatchMode Sets the mode used to create patch files, patch
+// files of any mode can be restored
+func WithPatchMode(mode PatchMode) DeviceMapperOption {
+	return func(dmpr *DeviceMapper) {
+		dmpr.patchMode = mode
+	}
+}
+
+// WithPoolMonitoring Sets the thin pool whose data and metadata usage is
+// sampled at the given interval for admission control (disabled if empty)
+func WithPoolMonitoring(poolName string, interval time.Duration) DeviceMapperOption {
+	return func(dmpr *DeviceMapper) {
+		dmpr.poolName = poolName
+		dmpr.poolCheckInterval = interval
+	}
+}
+
+// WithPoolThresholds Sets the usage of the thin pool, in percent, above
+// which warnings are emitted and new VMs are rejected
+func WithPoolThresholds(warnPercent, rejectPercent float64) DeviceMapperOption {
+	return func(dmpr *DeviceMapper) {
+		dmpr.poolWarnThreshold = warnPercent
+		dmpr.poolRejectThreshold = rejectPercent
+	}
+}
+
 // DeviceMapper creates and manages device snapshots used to store container images.
 type DeviceMapper struct {
 	sync.Mutex
 	snapDevices     map[string]*DeviceSnapshot // maps revision snapkey to snapshot device
 	snapshotService snapshots.Snapshotter      // used to interact with the device mapper through containerd
+	containerStore  containers.Store           // used to find the device snapshots used by containers
 
 	// Manage leases to avoid garbage collection of manually created snapshots. Done automatically for snapshots
 	// created directly through containerd (eg. container.create)
 	leaseManager leases.Manager
 	leases       map[string]*leases.Lease
+
+	patchMode    PatchMode
+	metadataLock sync.Mutex // serializes the use of the thin-pool metadata snapshot
+
+	// Thin pool monitoring
+	poolName            string
+	poolCheckInterval   time.Duration
+	poolWarnThreshold   float64
+	poolRejectThreshold float64
+	poolLock            sync.Mutex
+	poolUsage           PoolUsage // last sampled usage, guarded by poolLock
+	poolWarned          bool      // whether the usage is above the warning threshold, guarded by poolLock
+	poolStaleWarned     bool      // whether the last sample has been reported as stale, guarded by poolLock
 }
 
-func NewDeviceMapper(client *containerd.Client) *DeviceMapper {
+func NewDeviceMapper(client *containerd.Client, opts ...DeviceMapperOption) *DeviceMapper {
 	devMapper := new(DeviceMapper)
 	devMapper.snapDevices = make(map[string]*DeviceSnapshot)
 	devMapper.snapshotService = client.SnapshotService("devmapper")
+	devMapper.containerStore = client.ContainerService()
 	devMapper.leaseManager = client.LeasesService()
 	devMapper.leases = make(map[string]*leases.Lease)
+	devMapper.poolWarnThreshold = defaultPoolWarnThreshold
+	devMapper.poolRejectThreshold = defaultPoolRejectThreshold
+
+	for _, opt := range opts {
+		opt(devMapper)
+	}
+
+	if devMapper.poolName != "" && devMapper.poolCheckInterval > 0 {
+		go devMapper.monitorPool()
+	}
+
 	return devMapper
 }
 
@@ -180,8 +248,9 @@ func addTrailingSlash(path string) string {
 }
 
 // CreatePatch creates a patch file storing the file differences between and image and the changes applied
-// by the container using rsync. Note that this is a different approach than using thin_delta which is able to
-// extract blocks directly by leveraging the metadata stored by the device mapper.
+// by the container using rsync. In the block patch mode, the patch file instead stores the blocks that differ
+// between the image and the container devices, which are found using thin_delta on the metadata stored by the
+// device mapper without mounting the filesystems.
 func (dmpr *DeviceMapper) CreatePatch(ctx context.Context, patchPath, containerSnapKey string, image containerd.Image) error {
 	containerSnap, err := dmpr.GetDeviceSnapshot(ctx, containerSnapKey)
 	if err != nil {
@@ -199,6 +268,14 @@ func (dmpr *DeviceMapper) CreatePatch(ctx context.Context, patchPath, containerS
 		return err
 	}
 
+	if dmpr.patchMode == PatchModeBlock {
+		imageKey, err := getImageKey(image, ctx)
+		if err != nil {
+			return err
+		}
+		return dmpr.createBlockPatch(imageKey, imageSnap.GetDevicePath(), containerSnap.GetDevicePath(), patchPath)
+	}
+
 	// 1. Mount original and snapshot image
 	imageMountPath, err := imageSnap.Mount(true)
 	if err != nil {
@@ -242,13 +319,25 @@ func extractPatch(imageMountPath, containerMountPath, patchPath string) error {
 	return nil
 }
 
-// RestorePatch applies the file changes stored in the supplied patch file on top of the given container snapshot.
-func (dmpr *DeviceMapper) RestorePatch(ctx context.Context, containerSnapKey, patchPath string) error {
+// RestorePatch applies the file changes stored in the supplied patch file on top of the given container snapshot,
+// created from the given image. Block-level patches are written directly to the container snapshot device, whatever
+// the configured patch mode, and are rejected if they were created against another image.
+func (dmpr *DeviceMapper) RestorePatch(ctx context.Context, containerSnapKey, patchPath string, image containerd.Image) error {
 	containerSnap, err := dmpr.GetDeviceSnapshot(ctx, containerSnapKey)
 	if err != nil {
 		return err
 	}
 
+	if blockPatch, err := isBlockPatch(patchPath); err != nil {
+		return err
+	} else if blockPatch {
+		imageKey, err := getImageKey(image, ctx)
+		if err != nil {
+			return err
+		}
+		return restoreBlockPatch(imageKey, containerSnap.GetDevicePath(), patchPath)
+	}
+
 	// 1. Mount container snapshot device
 	containerMountPath, err := containerSnap.Mount(false)
 	if err != nil {
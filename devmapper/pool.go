@@ -0,0 +1,258 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+// ErrPoolExhausted is returned when the thin pool storing the device snapshots is too full to start new VMs.
+var ErrPoolExhausted = errors.New("thin pool exhausted")
+
+// Default thresholds, in percent of the data or metadata space of the thin pool
+const (
+	defaultPoolWarnThreshold   = 80.0
+	defaultPoolRejectThreshold = 95.0
+)
+
+// poolStaleSamples is the number of sampling intervals after which the last sample of the pool usage is stale, e.g.
+// because dmsetup keeps failing, and is not used anymore to reject VMs.
+const poolStaleSamples = 3
+
+// PoolUsage is the usage of the data and metadata space of a thin pool, in blocks.
+type PoolUsage struct {
+	UsedDataBlocks      uint64
+	TotalDataBlocks     uint64
+	UsedMetadataBlocks  uint64
+	TotalMetadataBlocks uint64
+	ReadOnly            bool // whether the pool has switched to read-only or out-of-data-space mode
+	Sampled             time.Time
+}
+
+// DataPercent returns the percentage of the data space of the pool in use.
+func (u PoolUsage) DataPercent() float64 {
+	return percent(u.UsedDataBlocks, u.TotalDataBlocks)
+}
+
+// MetadataPercent returns the percentage of the metadata space of the pool in use.
+func (u PoolUsage) MetadataPercent() float64 {
+	return percent(u.UsedMetadataBlocks, u.TotalMetadataBlocks)
+}
+
+// Metric returns the usage of the data and metadata space of the pool as a metric.
+func (u PoolUsage) Metric() *metrics.Metric {
+	m := metrics.NewMetric()
+	m.MetricMap[metrics.PoolDataUsage] = u.DataPercent()
+	m.MetricMap[metrics.PoolMetadataUsage] = u.MetadataPercent()
+
+	return m
+}
+
+func percent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(used) / float64(total)
+}
+
+// parsePoolStatus parses the device mapper status of a thin pool:
+// <start> <length> thin-pool <transaction id> <used>/<total metadata blocks> <used>/<total data blocks> <held root>
+// rw|ro|out_of_data_space ...
+func parsePoolStatus(status string) (PoolUsage, error) {
+	var usage PoolUsage
+
+	fields := strings.Fields(status)
+	if len(fields) < 8 || fields[2] != "thin-pool" {
+		return usage, errors.New(fmt.Sprintf("unexpected thin pool status %q", status))
+	}
+
+	var err error
+	if usage.UsedMetadataBlocks, usage.TotalMetadataBlocks, err = parseBlockUsage(fields[4]); err != nil {
+		return usage, err
+	}
+	if usage.UsedDataBlocks, usage.TotalDataBlocks, err = parseBlockUsage(fields[5]); err != nil {
+		return usage, err
+	}
+	usage.ReadOnly = fields[7] != "rw"
+
+	return usage, nil
+}
+
+// parseBlockUsage parses a <used>/<total> block count.
+func parseBlockUsage(field string) (uint64, uint64, error) {
+	parts := strings.Split(field, "/")
+	if len(parts) != 2 {
+		return 0, 0, errors.New(fmt.Sprintf("unexpected block usage %q", field))
+	}
+
+	used, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parsing block usage %q", field)
+	}
+	total, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parsing block usage %q", field)
+	}
+
+	return used, total, nil
+}
+
+// monitorPool periodically samples the usage of the thin pool.
+func (dmpr *DeviceMapper) monitorPool() {
+	ticker := time.NewTicker(dmpr.poolCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		dmpr.samplePool()
+		<-ticker.C
+	}
+}
+
+// samplePool reads the usage of the thin pool and warns when it crosses the warning threshold.
+func (dmpr *DeviceMapper) samplePool() {
+	logger := log.WithFields(log.Fields{"pool": dmpr.poolName})
+
+	out, err := dmsetup("status", dmpr.poolName)
+	if err == nil {
+		var usage PoolUsage
+		if usage, err = parsePoolStatus(string(out)); err == nil {
+			usage.Sampled = time.Now()
+			dmpr.updatePoolUsage(usage)
+			return
+		}
+	}
+
+	logger.WithError(err).Warn("failed to read thin pool usage")
+}
+
+// updatePoolUsage records a sample of the pool usage, warning when the usage crosses the warning threshold.
+func (dmpr *DeviceMapper) updatePoolUsage(usage PoolUsage) {
+	dmpr.poolLock.Lock()
+	defer dmpr.poolLock.Unlock()
+
+	logger := log.WithFields(log.Fields{
+		"pool":     dmpr.poolName,
+		"data":     fmt.Sprintf("%.1f%%", usage.DataPercent()),
+		"metadata": fmt.Sprintf("%.1f%%", usage.MetadataPercent()),
+	})
+
+	above := usage.DataPercent() >= dmpr.poolWarnThreshold || usage.MetadataPercent() >= dmpr.poolWarnThreshold
+	if above && !dmpr.poolWarned {
+		logger.Warnf("Thin pool usage exceeds %.0f%%, new VMs are rejected above %.0f%%", dmpr.poolWarnThreshold, dmpr.poolRejectThreshold)
+	} else if !above && dmpr.poolWarned {
+		logger.Info("Thin pool usage is back below the warning threshold")
+	}
+	if usage.ReadOnly && !dmpr.poolUsage.ReadOnly {
+		logger.Error("Thin pool has switched to read-only mode")
+	}
+
+	dmpr.poolWarned = above
+	dmpr.poolStaleWarned = false
+	dmpr.poolUsage = usage
+}
+
+// GetPoolUsage returns the last sampled usage of the thin pool, false if the pool is not monitored or has not been
+// sampled yet.
+func (dmpr *DeviceMapper) GetPoolUsage() (PoolUsage, bool) {
+	dmpr.poolLock.Lock()
+	defer dmpr.poolLock.Unlock()
+
+	return dmpr.poolUsage, !dmpr.poolUsage.Sampled.IsZero()
+}
+
+// isPoolSampleStale reports whether the last sample of the pool usage is older than poolStaleSamples intervals,
+// warning once per stale sample. It must be called with poolLock held.
+func (dmpr *DeviceMapper) isPoolSampleStale() bool {
+	age := time.Since(dmpr.poolUsage.Sampled)
+	if dmpr.poolCheckInterval <= 0 || age <= poolStaleSamples*dmpr.poolCheckInterval {
+		return false
+	}
+
+	if !dmpr.poolStaleWarned {
+		log.WithFields(log.Fields{"pool": dmpr.poolName}).Warnf("Thin pool usage has not been sampled for %s, admitting new VMs", age.Round(time.Second))
+		dmpr.poolStaleWarned = true
+	}
+	return true
+}
+
+// CheckPoolCapacity returns ErrPoolExhausted if the last sampled usage of the data or metadata space of the thin pool
+// exceeds the rejection threshold, or if the pool has switched to read-only mode, in which case new VMs must not be
+// started. Nil is returned if the pool is not monitored, or if the last sample is stale so that VMs are not rejected
+// (or admitted) based on an outdated usage.
+func (dmpr *DeviceMapper) CheckPoolCapacity() error {
+	dmpr.poolLock.Lock()
+	usage := dmpr.poolUsage
+	stale := !usage.Sampled.IsZero() && dmpr.isPoolSampleStale()
+	dmpr.poolLock.Unlock()
+
+	if usage.Sampled.IsZero() || stale {
+		return nil
+	}
+
+	if usage.ReadOnly {
+		return errors.Wrapf(ErrPoolExhausted, "pool %s is read-only", dmpr.poolName)
+	}
+	if usage.DataPercent() >= dmpr.poolRejectThreshold {
+		return errors.Wrapf(ErrPoolExhausted, "pool %s data space is %.1f%% full", dmpr.poolName, usage.DataPercent())
+	}
+	if usage.MetadataPercent() >= dmpr.poolRejectThreshold {
+		return errors.Wrapf(ErrPoolExhausted, "pool %s metadata space is %.1f%% full", dmpr.poolName, usage.MetadataPercent())
+	}
+
+	return nil
+}
+
+// WritePoolMetrics writes the usage of the thin pool in the Prometheus text exposition format
+func WritePoolMetrics(w io.Writer, poolName string, usage PoolUsage) error {
+	m := usage.Metric()
+	readOnly := 0
+	if usage.ReadOnly {
+		readOnly = 1
+	}
+
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"vhive_thinpool_data_usage_percent", "Percentage of the data space of the thin pool in use.", m.MetricMap[metrics.PoolDataUsage]},
+		{"vhive_thinpool_metadata_usage_percent", "Percentage of the metadata space of the thin pool in use.", m.MetricMap[metrics.PoolMetadataUsage]},
+		{"vhive_thinpool_read_only", "Whether the thin pool has switched to read-only mode.", float64(readOnly)},
+		{"vhive_thinpool_sample_age_seconds", "Time since the usage of the thin pool was last sampled.", time.Since(usage.Sampled).Seconds()},
+	}
+
+	for _, g := range gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{pool=%q} %g\n", g.name, g.help, g.name, g.name, poolName, g.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/metrics"
+)
+
+func TestPoolParseStatus(t *testing.T) {
+	usage, err := parsePoolStatus("0 2097152 thin-pool 1 100/1000 900/1000 - rw discard_passdown queue_if_no_space - 1024\n")
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), usage.UsedMetadataBlocks)
+	require.Equal(t, uint64(1000), usage.TotalMetadataBlocks)
+	require.Equal(t, uint64(900), usage.UsedDataBlocks)
+	require.Equal(t, uint64(1000), usage.TotalDataBlocks)
+	require.False(t, usage.ReadOnly)
+	require.InDelta(t, 90.0, usage.DataPercent(), 1e-9)
+	require.InDelta(t, 10.0, usage.MetadataPercent(), 1e-9)
+
+	m := usage.Metric()
+	require.InDelta(t, 90.0, m.MetricMap[metrics.PoolDataUsage], 1e-9)
+	require.InDelta(t, 10.0, m.MetricMap[metrics.PoolMetadataUsage], 1e-9)
+
+	usage, err = parsePoolStatus("0 2097152 thin-pool 1 100/1000 1000/1000 - out_of_data_space discard_passdown queue_if_no_space - 1024")
+	require.NoError(t, err)
+	require.True(t, usage.ReadOnly)
+
+	_, err = parsePoolStatus("0 2097152 thin 1 100/1000")
+	require.Error(t, err)
+
+	_, err = parsePoolStatus("0 2097152 thin-pool 1 100-1000 900/1000 - rw")
+	require.Error(t, err)
+}
+
+func TestPoolCheckCapacity(t *testing.T) {
+	dmpr := &DeviceMapper{
+		poolName:            "test-pool",
+		poolWarnThreshold:   defaultPoolWarnThreshold,
+		poolRejectThreshold: defaultPoolRejectThreshold,
+	}
+
+	// Not sampled yet: VMs are admitted
+	_, ok := dmpr.GetPoolUsage()
+	require.False(t, ok)
+	require.NoError(t, dmpr.CheckPoolCapacity())
+
+	sample := func(data, metadata uint64, readOnly bool) {
+		dmpr.updatePoolUsage(PoolUsage{
+			UsedDataBlocks:      data,
+			TotalDataBlocks:     100,
+			UsedMetadataBlocks:  metadata,
+			TotalMetadataBlocks: 100,
+			ReadOnly:            readOnly,
+			Sampled:             time.Now(),
+		})
+	}
+
+	sample(50, 10, false)
+	require.NoError(t, dmpr.CheckPoolCapacity())
+	require.False(t, dmpr.poolWarned)
+
+	sample(85, 10, false)
+	require.NoError(t, dmpr.CheckPoolCapacity())
+	require.True(t, dmpr.poolWarned)
+
+	sample(96, 10, false)
+	err := dmpr.CheckPoolCapacity()
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrPoolExhausted))
+
+	sample(10, 97, false)
+	require.True(t, errors.Is(dmpr.CheckPoolCapacity(), ErrPoolExhausted))
+
+	sample(10, 10, true)
+	require.True(t, errors.Is(dmpr.CheckPoolCapacity(), ErrPoolExhausted))
+
+	sample(10, 10, false)
+	require.NoError(t, dmpr.CheckPoolCapacity())
+	require.False(t, dmpr.poolWarned)
+
+	usage, ok := dmpr.GetPoolUsage()
+	require.True(t, ok)
+	require.InDelta(t, 10.0, usage.DataPercent(), 1e-9)
+}
+
+func TestPoolStaleSample(t *testing.T) {
+	dmpr := &DeviceMapper{
+		poolName:            "test-pool",
+		poolCheckInterval:   time.Second,
+		poolWarnThreshold:   defaultPoolWarnThreshold,
+		poolRejectThreshold: defaultPoolRejectThreshold,
+	}
+
+	full := PoolUsage{UsedDataBlocks: 99, TotalDataBlocks: 100, UsedMetadataBlocks: 10, TotalMetadataBlocks: 100}
+
+	full.Sampled = time.Now()
+	dmpr.updatePoolUsage(full)
+	require.True(t, errors.Is(dmpr.CheckPoolCapacity(), ErrPoolExhausted))
+
+	// The monitor has not managed to sample the pool for several intervals: VMs are admitted
+	full.Sampled = time.Now().Add(-(poolStaleSamples + 1) * dmpr.poolCheckInterval)
+	dmpr.updatePoolUsage(full)
+	require.NoError(t, dmpr.CheckPoolCapacity())
+	require.True(t, dmpr.poolStaleWarned)
+
+	full.Sampled = time.Now()
+	dmpr.updatePoolUsage(full)
+	require.False(t, dmpr.poolStaleWarned)
+	require.True(t, errors.Is(dmpr.CheckPoolCapacity(), ErrPoolExhausted))
+}
+
+func TestPoolWriteMetrics(t *testing.T) {
+	usage := PoolUsage{
+		UsedDataBlocks:      90,
+		TotalDataBlocks:     100,
+		UsedMetadataBlocks:  10,
+		TotalMetadataBlocks: 100,
+		ReadOnly:            true,
+		Sampled:             time.Now(),
+	}
+
+	var sb strings.Builder
+	require.NoError(t, WritePoolMetrics(&sb, "test-pool", usage))
+
+	out := sb.String()
+	require.Contains(t, out, "# TYPE vhive_thinpool_data_usage_percent gauge\n")
+	require.Contains(t, out, "vhive_thinpool_data_usage_percent{pool=\"test-pool\"} 90\n")
+	require.Contains(t, out, "vhive_thinpool_metadata_usage_percent{pool=\"test-pool\"} 10\n")
+	require.Contains(t, out, "vhive_thinpool_read_only{pool=\"test-pool\"} 1\n")
+	require.Contains(t, out, "vhive_thinpool_sample_age_seconds{pool=\"test-pool\"} ")
+}
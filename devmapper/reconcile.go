@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// vhiveSnapKey matches the keys of the device snapshots created by vHive for the containers of VMs (see misc.NewVM)
+// and for the base images used to create patches (see CreatePatch).
+var vhiveSnapKey = regexp.MustCompile(`^vm.+-containersnap-[0-9a-f-]{16}(-base-image)?$`)
+
+// ReconcileReport lists the device snapshots and leases created by vHive that are not used by any live VM.
+type ReconcileReport struct {
+	Snapshots []string // keys of the orphaned device snapshots
+	Leases    []string // ids of the orphaned leases
+	Removed   bool     // whether the orphans have been removed, false in dry-run mode
+}
+
+// Reconcile finds the device snapshots and the leases created by vHive that have been leaked, e.g. because vHive
+// crashed between CreateDeviceSnapshot and RemoveDeviceSnapshot, and removes them unless dryRun is set. Device
+// snapshots are kept if they are tracked by this device mapper, used by a containerd container or backing one of the
+// supplied live container snapshot keys. The context must carry the containerd namespace of the VMs.
+func (dmpr *DeviceMapper) Reconcile(ctx context.Context, liveSnapKeys []string, dryRun bool) (*ReconcileReport, error) {
+	live := make(map[string]bool)
+	for _, key := range liveSnapKeys {
+		live[key] = true
+	}
+
+	dmpr.Lock()
+	for key := range dmpr.snapDevices {
+		live[key] = true
+	}
+	for key := range dmpr.leases {
+		live[key] = true
+	}
+	dmpr.Unlock()
+
+	if dmpr.containerStore != nil {
+		containers, err := dmpr.containerStore.List(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing containers")
+		}
+		for _, container := range containers {
+			live[container.SnapshotKey] = true
+		}
+	}
+
+	isOrphan := func(key string) bool {
+		if !vhiveSnapKey.MatchString(key) {
+			return false
+		}
+		// A base image snapshot is in use while a patch of its container snapshot is being created
+		return !live[key] && !live[strings.TrimSuffix(key, "-base-image")]
+	}
+
+	report := &ReconcileReport{Snapshots: make([]string, 0), Leases: make([]string, 0), Removed: !dryRun}
+
+	err := dmpr.snapshotService.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Kind == snapshots.KindActive && isOrphan(info.Name) {
+			report.Snapshots = append(report.Snapshots, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing device snapshots")
+	}
+
+	leaseList, err := dmpr.leaseManager.List(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing leases")
+	}
+	for _, lease := range leaseList {
+		if isOrphan(lease.ID) {
+			report.Leases = append(report.Leases, lease.ID)
+		}
+	}
+
+	sort.Strings(report.Snapshots)
+	sort.Strings(report.Leases)
+
+	for _, key := range report.Snapshots {
+		logger := log.WithFields(log.Fields{"snapKey": key, "dryRun": dryRun})
+		logger.Info("Found orphaned device snapshot")
+		if dryRun {
+			continue
+		}
+		if err := dmpr.snapshotService.Remove(ctx, key); err != nil {
+			logger.WithError(err).Warn("failed to remove orphaned device snapshot")
+		}
+	}
+
+	for _, id := range report.Leases {
+		logger := log.WithFields(log.Fields{"lease": id, "dryRun": dryRun})
+		logger.Info("Found orphaned lease")
+		if dryRun {
+			continue
+		}
+		if err := dmpr.leaseManager.Delete(ctx, leases.Lease{ID: id}); err != nil {
+			logger.WithError(err).Warn("failed to delete orphaned lease")
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSnapshotter implements the subset of the snapshotter used by Reconcile.
+type fakeSnapshotter struct {
+	snapshots.Snapshotter
+	infos   []snapshots.Info
+	removed []string
+}
+
+func (s *fakeSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, _ ...string) error {
+	for _, info := range s.infos {
+		if err := fn(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSnapshotter) Remove(_ context.Context, key string) error {
+	s.removed = append(s.removed, key)
+	return nil
+}
+
+// fakeLeaseManager implements the subset of the lease manager used by Reconcile.
+type fakeLeaseManager struct {
+	leases.Manager
+	leases  []leases.Lease
+	deleted []string
+}
+
+func (m *fakeLeaseManager) List(context.Context, ...string) ([]leases.Lease, error) {
+	return m.leases, nil
+}
+
+func (m *fakeLeaseManager) Delete(_ context.Context, lease leases.Lease, _ ...leases.DeleteOpt) error {
+	m.deleted = append(m.deleted, lease.ID)
+	return nil
+}
+
+// fakeContainerStore implements the subset of the container store used by Reconcile.
+type fakeContainerStore struct {
+	containers.Store
+	containers []containers.Container
+}
+
+func (s *fakeContainerStore) List(context.Context, ...string) ([]containers.Container, error) {
+	return s.containers, nil
+}
+
+func newTestDeviceMapper() (*DeviceMapper, *fakeSnapshotter, *fakeLeaseManager) {
+	const (
+		orphan    = "vm1-abc-containersnap-0123456789abcdef"
+		live      = "vm2-abc-containersnap-0123456789abcdef"
+		container = "vm3-abc-containersnap-0123456789abcdef"
+		tracked   = "vm4-abc-containersnap-0123456789abcdef"
+	)
+
+	snapshotter := &fakeSnapshotter{infos: []snapshots.Info{
+		{Name: orphan, Kind: snapshots.KindActive},
+		{Name: orphan + "-base-image", Kind: snapshots.KindActive},
+		{Name: live, Kind: snapshots.KindActive},
+		{Name: live + "-base-image", Kind: snapshots.KindActive},
+		{Name: container, Kind: snapshots.KindActive},
+		{Name: tracked, Kind: snapshots.KindActive},
+		{Name: "sha256:0123", Kind: snapshots.KindCommitted},
+		{Name: "other-snapshot", Kind: snapshots.KindActive},
+	}}
+	leaseManager := &fakeLeaseManager{leases: []leases.Lease{
+		{ID: orphan}, {ID: orphan + "-base-image"}, {ID: live}, {ID: tracked}, {ID: "other-lease"},
+	}}
+
+	dmpr := &DeviceMapper{
+		snapDevices:     map[string]*DeviceSnapshot{tracked: NewDeviceSnapshot("/dev/mapper/tracked")},
+		snapshotService: snapshotter,
+		containerStore:  &fakeContainerStore{containers: []containers.Container{{ID: container, SnapshotKey: container}}},
+		leaseManager:    leaseManager,
+		leases:          make(map[string]*leases.Lease),
+	}
+
+	return dmpr, snapshotter, leaseManager
+}
+
+func TestReconcile(t *testing.T) {
+	dmpr, snapshotter, leaseManager := newTestDeviceMapper()
+
+	report, err := dmpr.Reconcile(context.Background(), []string{"vm2-abc-containersnap-0123456789abcdef"}, false)
+	require.NoError(t, err, "Failed to reconcile device snapshots")
+
+	orphans := []string{"vm1-abc-containersnap-0123456789abcdef", "vm1-abc-containersnap-0123456789abcdef-base-image"}
+	require.Equal(t, orphans, report.Snapshots, "Wrong orphaned device snapshots")
+	require.Equal(t, orphans, report.Leases, "Wrong orphaned leases")
+	require.True(t, report.Removed, "Orphans should be removed")
+	require.Equal(t, orphans, snapshotter.removed, "Orphaned device snapshots should be removed")
+	require.Equal(t, orphans, leaseManager.deleted, "Orphaned leases should be deleted")
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	dmpr, snapshotter, leaseManager := newTestDeviceMapper()
+
+	report, err := dmpr.Reconcile(context.Background(), []string{"vm2-abc-containersnap-0123456789abcdef"}, true)
+	require.NoError(t, err, "Failed to reconcile device snapshots")
+
+	require.Len(t, report.Snapshots, 2, "Orphaned device snapshots should be reported")
+	require.Len(t, report.Leases, 2, "Orphaned leases should be reported")
+	require.False(t, report.Removed, "Orphans should not be removed in dry-run mode")
+	require.Empty(t, snapshotter.removed, "Device snapshots should not be removed in dry-run mode")
+	require.Empty(t, leaseManager.deleted, "Leases should not be deleted in dry-run mode")
+}
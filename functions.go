@@ -72,7 +72,7 @@ func NewFuncPool(saveMemoryMode bool, servedTh uint64, pinnedFuncNum int, testMo
 	p.servedTh = servedTh
 	p.pinnedFuncNum = pinnedFuncNum
 	p.stats = NewStats()
-	p.snapshotManager = snapshotting.NewSnapshotManager("/fccd/snapshots")
+	p.snapshotManager = orch.GetSnapshotManager()
 
 	if !testModeOn {
 		heartbeat := time.NewTicker(60 * time.Second)
@@ -81,6 +81,9 @@ func NewFuncPool(saveMemoryMode bool, servedTh uint64, pinnedFuncNum int, testMo
 			for {
 				<-heartbeat.C
 				log.Info("FuncPool heartbeat: ", p.stats.SprintStats())
+				if orch.GetSnapshotsEnabled() {
+					log.Info("FuncPool heartbeat: ", SprintSnapshotStats(p.snapshotManager.GetStats()))
+				}
 			}
 		}()
 	}
@@ -183,6 +186,9 @@ type Function struct {
 	conn                   *grpc.ClientConn
 	guestIP                string
 	snapshotManager        *snapshotting.SnapshotManager
+	snapshotKey            snapshotting.SnapshotKey // key of the snapshot of the current image and VM configuration
+	hasSnapshotKey         bool                     // if the key could not be resolved, the instance does not use snapshots
+	loadedSnapshot         *snapshotting.Snapshot   // snapshot the instance was loaded from, acquired until it is removed
 }
 
 // NewFunction Initializes a function
@@ -198,6 +204,21 @@ func NewFunction(fID, imageName string, Stats *Stats, servedTh uint64, isToPin b
 	f.OnceCreateSnapInstance = new(sync.Once)
 	f.snapshotManager = snapshotManager
 
+	// Reuse the snapshot of the function if it has been recovered from a previous run of the daemon
+	if orch.GetSnapshotsEnabled() {
+		var err error
+		if f.snapshotKey, err = f.getSnapshotKey(); err != nil {
+			log.WithFields(log.Fields{"fID": fID}).WithError(err).Warn("Failed to get snapshot key, not reusing snapshots")
+		} else {
+			f.hasSnapshotKey = true
+			if snap, err := snapshotManager.AcquireSnapshotWithKey(f.snapshotKey); err == nil {
+				snapshotManager.ReleaseSnapshot(snap.GetId())
+				f.isSnapshotReady = true
+				f.OnceCreateSnapInstance.Do(func() {})
+			}
+		}
+	}
+
 	// Normal distribution with stddev=servedTh/2, mean=servedTh
 	thresh := int64(rand.NormFloat64()*float64(servedTh/2) + float64(servedTh))
 	if thresh <= 0 {
@@ -302,7 +323,8 @@ func (f *Function) Serve(ctx context.Context, fID, imageName, reqPayload string)
 		}
 	}
 
-	if orch.GetSnapshotsEnabled() {
+	// Instances whose snapshot key could not be resolved are not snapshotted
+	if orch.GetSnapshotsEnabled() && f.hasSnapshotKey {
 		f.OnceCreateSnapInstance.Do(
 			func() {
 				logger.Debug("First time offloading, need to create a snapshot first")
@@ -359,10 +381,36 @@ func (f *Function) AddInstance() *metrics.Metric {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
 	defer cancel()
 
-	if f.isSnapshotReady {
+	if orch.GetSnapshotsEnabled() {
+		key, err := f.getSnapshotKey()
+		if err != nil {
+			// The key is resolved again for the next instance
+			logger.WithError(err).Warn("Failed to get snapshot key, starting the instance without snapshots")
+		} else {
+			f.snapshotKey = key
+		}
+		f.hasSnapshotKey = err == nil
+	}
+
+	var snap *snapshotting.Snapshot
+	if f.isSnapshotReady && f.hasSnapshotKey {
+		var err error
+		snap, err = f.snapshotManager.AcquireSnapshotWithKey(f.snapshotKey)
+		if err != nil {
+			// The snapshot has been evicted or is stale, start a fresh instance and snapshot it again
+			logger.Debug("Snapshot is not available anymore, starting a fresh instance")
+			f.isSnapshotReady = false
+			f.OnceCreateSnapInstance = new(sync.Once)
+		}
+	}
+
+	if snap != nil {
 		var resp *ctriface.StartVMResponse
 
-		resp, metr = f.LoadInstance(f.getVMID())
+		// The snapshot is released when the instance is removed, so that its files are neither evicted nor
+		// compressed while the VM uses them
+		f.loadedSnapshot = snap
+		resp, metr = f.LoadInstance(f.getVMID(), snap)
 		f.guestIP = resp.GuestIP
 		f.vmID = f.getVMID()
 		f.lastInstanceID++
@@ -397,12 +445,14 @@ func (f *Function) RemoveInstanceAsync() {
 
 	logger.Debug("Removing instance (async)")
 
-	go func(vmID string) {
+	go func(vmID string, snap *snapshotting.Snapshot) {
 		err := orch.StopSingleVM(context.Background(), vmID)
 		if err != nil {
 			log.Warn(err)
+			return
 		}
-	}(f.vmID)
+		f.releaseSnapshot(snap)
+	}(f.vmID, f.takeLoadedSnapshot())
 }
 
 // RemoveInstance Stops an instance (VM) of the function.
@@ -422,7 +472,10 @@ func (f *Function) RemoveInstance(isSync bool) (string, error) {
 	f.OnceAddInstance = new(sync.Once)
 
 	if isSync {
-		err = orch.StopSingleVM(context.Background(), f.vmID)
+		snap := f.takeLoadedSnapshot()
+		if err = orch.StopSingleVM(context.Background(), f.vmID); err == nil {
+			f.releaseSnapshot(snap)
+		}
 	} else {
 		f.RemoveInstanceAsync()
 		r = "Successfully removed (async) instance " + f.vmID
@@ -431,6 +484,20 @@ func (f *Function) RemoveInstance(isSync bool) (string, error) {
 	return r, err
 }
 
+// takeLoadedSnapshot Returns the snapshot the current instance was loaded from, if any, and forgets it
+func (f *Function) takeLoadedSnapshot() *snapshotting.Snapshot {
+	snap := f.loadedSnapshot
+	f.loadedSnapshot = nil
+	return snap
+}
+
+// releaseSnapshot Releases the snapshot a stopped instance was loaded from, if any
+func (f *Function) releaseSnapshot(snap *snapshotting.Snapshot) {
+	if snap != nil {
+		f.snapshotManager.ReleaseSnapshot(snap.GetId())
+	}
+}
+
 // DumpUPFPageStats Dumps the memory manager's stats about the number of
 // the unique pages and the number of the pages that are reused across invocations
 func (f *Function) DumpUPFPageStats(functionName, metricsOutFilePath string) error {
@@ -456,7 +523,7 @@ func (f *Function) CreateInstanceSnapshot() {
 		log.Panic(err)
 	}
 
-	snap, err := f.snapshotManager.InitSnapshot(f.fID, f.imageName)
+	snap, err := f.snapshotManager.InitSnapshotWithKey(f.snapshotKey, f.imageName)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -471,15 +538,24 @@ func (f *Function) CreateInstanceSnapshot() {
 		log.Panic(err)
 	}
 
-	err = f.snapshotManager.CommitSnapshot(f.fID)
+	err = f.snapshotManager.CommitSnapshot(snap.GetId())
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
-// LoadInstance Loads a new instance of the function from its snapshot and resumes it
+// getSnapshotKey Returns the key of the snapshot of the function for its image and the VM configuration.
+// Fails if the image digest cannot be resolved, in which case the instance is started without snapshots
+func (f *Function) getSnapshotKey() (snapshotting.SnapshotKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	return orch.GetSnapshotKey(ctx, f.fID, f.imageName)
+}
+
+// LoadInstance Loads a new instance of the function from the supplied snapshot and resumes it
 // The tap, the shim and the vmID remain the same
-func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metrics.Metric) {
+func (f *Function) LoadInstance(vmID string, snap *snapshotting.Snapshot) (*ctriface.StartVMResponse, *metrics.Metric) {
 	logger := log.WithFields(log.Fields{"fID": f.fID})
 
 	logger.Debug("Loading instance")
@@ -487,11 +563,6 @@ func (f *Function) LoadInstance(vmID string) (*ctriface.StartVMResponse, *metric
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
 	defer cancel()
 
-	snap, err := f.snapshotManager.AcquireSnapshot(f.fID)
-	if err != nil {
-		log.Panic(err)
-	}
-
 	resp, loadMetr, err := orch.LoadSnapshot(ctx, vmID, snap)
 	if err != nil {
 		log.Panic(err)
@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// guestRegion A region of the guest memory registered with the userfaultfd, with
+// the mapping of its pages in the guest memory file
+type guestRegion struct {
+	GuestRegionUffdMapping
+	mem       []byte // the region in the guest memory file
+	installed []bool // pages of the region installed since the activation
+}
+
+// contains Returns whether the page at the offset in the guest memory file belongs to the region
+func (r *guestRegion) contains(offset uint64) bool {
+	return offset >= r.Offset && offset < r.Offset+r.Size
+}
+
+// regionAt Returns the region containing the address of the VMM, nil if there is none
+func (s *SnapshotState) regionAt(address uint64) *guestRegion {
+	for _, r := range s.regions {
+		if address >= r.BaseHostVirtAddr && address < r.BaseHostVirtAddr+r.Size {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// regionOf Returns the region containing the offset in the guest memory file, nil if there is none
+func (s *SnapshotState) regionOf(offset uint64) *guestRegion {
+	for _, r := range s.regions {
+		if r.contains(offset) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// guestMemSize Returns the size of the guest memory file covered by the regions
+func (s *SnapshotState) guestMemSize() uint64 {
+	var size uint64
+	for _, r := range s.regions {
+		if end := r.Offset + r.Size; end > size {
+			size = end
+		}
+	}
+
+	return size
+}
+
+// memLayout Returns the regions of the guest memory file, sorted by offset, as recorded in the traces
+func (s *SnapshotState) memLayout() []traceRegion {
+	layout := make([]traceRegion, 0, len(s.regions))
+	for _, r := range s.regions {
+		layout = append(layout, traceRegion{Offset: r.Offset, Size: r.Size})
+	}
+	sort.Slice(layout, func(i, j int) bool { return layout[i].Offset < layout[j].Offset })
+
+	return layout
+}
+
+// setRegions Sets the regions of the guest memory sent by the VMM, they must be backed by pages of the same size
+func (s *SnapshotState) setRegions(mappings []GuestRegionUffdMapping) {
+	s.regions = make([]*guestRegion, 0, len(mappings))
+	for _, m := range mappings {
+		s.regions = append(s.regions, &guestRegion{GuestRegionUffdMapping: m})
+	}
+	s.pageSize = mappings[0].GetPageSize()
+}
+
+// mapGuestMemory Maps the regions of the guest memory file, the pages are copied from these mappings
+func (s *SnapshotState) mapGuestMemory() error {
+	if s.GuestMemSize != 0 {
+		var size uint64
+		for _, r := range s.regions {
+			size += r.Size
+		}
+		if size != uint64(s.GuestMemSize) {
+			log.Warnf("Guest memory regions have size %d instead of %d", size, s.GuestMemSize)
+		}
+	}
+
+	fd, err := os.OpenFile(s.GuestMemPath, os.O_RDONLY, 0444)
+	if err != nil {
+		log.Errorf("Failed to open guest memory file: %v", err)
+		return err
+	}
+	defer fd.Close()
+
+	for _, r := range s.regions {
+		r.mem, err = unix.Mmap(int(fd.Fd()), int64(r.Offset), int(r.Size), unix.PROT_READ, unix.MAP_PRIVATE)
+		if err != nil {
+			log.Errorf("Failed to mmap guest memory file: %v", err)
+			_ = s.unmapGuestMemory()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmapGuestMemory Unmaps the regions of the guest memory file
+func (s *SnapshotState) unmapGuestMemory() error {
+	var err error
+	for _, r := range s.regions {
+		if r.mem == nil {
+			continue
+		}
+
+		if e := unix.Munmap(r.mem); e != nil {
+			log.Errorf("Failed to munmap guest memory file: %v", e)
+			err = e
+		}
+		r.mem = nil
+	}
+
+	return err
+}
@@ -0,0 +1,183 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// uffdHandshakeTimeout is the time the VMM has to connect to the socket of the VM once it is activated
+	uffdHandshakeTimeout = 10 * time.Second
+	// maxHandshakeSize is the maximum size of the guest memory mappings sent by the VMM
+	maxHandshakeSize = 64 * 1024
+	// hugePageSize is the size of the huge pages that may back the guest memory (hugetlbfs)
+	hugePageSize = 2 * 1024 * 1024
+)
+
+// GuestRegionUffdMapping A region of the guest memory registered with the userfaultfd,
+// as sent by Firecracker when a snapshot is loaded with the Uffd memory backend
+type GuestRegionUffdMapping struct {
+	BaseHostVirtAddr uint64 `json:"base_host_virt_addr"` // start address of the region in the VMM
+	Size             uint64 `json:"size"`                // size of the region in bytes
+	Offset           uint64 `json:"offset"`              // offset of the region in the guest memory file
+	PageSizeKiB      uint64 `json:"page_size_kib,omitempty"`
+	PageSize         uint64 `json:"page_size,omitempty"` // sent instead of PageSizeKiB by newer Firecracker versions
+}
+
+// GetPageSize Returns the size of the pages backing the region in bytes
+func (m GuestRegionUffdMapping) GetPageSize() uint64 {
+	if m.PageSize != 0 {
+		return m.PageSize
+	}
+	return m.PageSizeKiB * 1024
+}
+
+// listenUFFD Creates the socket the VMM connects to in order to send the userfaultfd
+func listenUFFD(sockPath string) (*net.UnixListener, error) {
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove stale uffd socket: %v", err)
+		return nil, err
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+	if err != nil {
+		log.Errorf("Failed to listen on uffd socket: %v", err)
+		return nil, err
+	}
+	l.SetUnlinkOnClose(true)
+
+	return l, nil
+}
+
+// acceptUFFD Waits for the VMM to connect and receives the userfaultfd and the guest memory mappings
+func acceptUFFD(l *net.UnixListener, timeout time.Duration) (*os.File, []GuestRegionUffdMapping, error) {
+	if err := l.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		log.Error("VMM did not connect to the uffd socket within the timeout")
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+
+	return receiveUFFD(conn)
+}
+
+// receiveUFFD Reads the guest memory mappings, serialized in JSON, along
+// with the userfaultfd passed as ancillary data (SCM_RIGHTS)
+func receiveUFFD(conn *net.UnixConn) (*os.File, []GuestRegionUffdMapping, error) {
+	buf := make([]byte, maxHandshakeSize)
+	oob := make([]byte, unix.CmsgSpace(4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		log.Errorf("Failed to read the uffd handshake: %v", err)
+		return nil, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		log.Errorf("Failed to parse the uffd handshake control message: %v", err)
+		return nil, nil, err
+	}
+
+	fds := make([]int, 0, 1)
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, nil, errors.New(fmt.Sprintf("expected a single uffd in the handshake, got %d", len(fds)))
+	}
+
+	uffd := os.NewFile(uintptr(fds[0]), "uffd")
+
+	var mappings []GuestRegionUffdMapping
+	if err := json.Unmarshal(buf[:n], &mappings); err != nil {
+		uffd.Close()
+		log.Errorf("Failed to decode the guest memory mappings: %v", err)
+		return nil, nil, err
+	}
+
+	if err := checkMappings(mappings); err != nil {
+		uffd.Close()
+		return nil, nil, err
+	}
+
+	return uffd, mappings, nil
+}
+
+// checkMappings Checks that the guest memory mappings can be served by the memory manager: the regions
+// must be backed by pages of the same supported size and map disjoint, page-aligned ranges of the guest memory file
+func checkMappings(mappings []GuestRegionUffdMapping) error {
+	if len(mappings) == 0 {
+		return errors.New("no guest memory regions in the uffd handshake")
+	}
+
+	pageSize := mappings[0].GetPageSize()
+	if pageSize != uint64(os.Getpagesize()) && pageSize != hugePageSize {
+		return errors.New(fmt.Sprintf("unsupported guest memory page size %d", pageSize))
+	}
+
+	for i, m := range mappings {
+		if m.Size == 0 {
+			return errors.New("empty guest memory region in the uffd handshake")
+		}
+		if m.GetPageSize() != pageSize {
+			return errors.New(fmt.Sprintf("guest memory regions backed by pages of sizes %d and %d", pageSize, m.GetPageSize()))
+		}
+		if m.BaseHostVirtAddr%pageSize != 0 || m.Size%pageSize != 0 || m.Offset%pageSize != 0 {
+			return errors.New(fmt.Sprintf("guest memory region %d is not aligned to the page size %d", i, pageSize))
+		}
+
+		for _, other := range mappings[:i] {
+			if m.Offset < other.Offset+other.Size && other.Offset < m.Offset+m.Size {
+				return errors.New(fmt.Sprintf("guest memory region %d overlaps another region in the guest memory file", i))
+			}
+		}
+	}
+
+	return nil
+}
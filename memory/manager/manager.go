@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -52,7 +53,8 @@ type MemoryManagerCfg struct {
 type MemoryManager struct {
 	sync.Mutex
 	MemoryManagerCfg
-	instances map[string]*SnapshotState // Indexed by vmID
+	instances map[string]*SnapshotState  // Indexed by vmID
+	records   map[string]*snapshotRecord // Indexed by the base directory of the snapshot
 }
 
 // NewMemoryManager Initializes a new memory manager
@@ -61,6 +63,7 @@ func NewMemoryManager(cfg MemoryManagerCfg) *MemoryManager {
 
 	m := new(MemoryManager)
 	m.instances = make(map[string]*SnapshotState)
+	m.records = make(map[string]*snapshotRecord)
 	m.MemoryManagerCfg = cfg
 
 	return m
@@ -82,8 +85,30 @@ func (m *MemoryManager) RegisterVM(cfg SnapshotStateCfg) error {
 		return errors.New("VM already registered with the memory manager")
 	}
 
+	if err := cfg.Refinement.Validate(); err != nil {
+		logger.Error("Invalid working set refinement policy")
+		return err
+	}
+
+	record, ok := m.records[cfg.BaseDir]
+	if !ok {
+		record = newSnapshotRecord()
+		m.records[cfg.BaseDir] = record
+	}
+
 	cfg.metricsModeOn = m.MetricsModeOn
+
+	record.RLock()
 	state := NewSnapshotState(cfg)
+	state.record = record
+	state.recordGeneration = record.generation
+	record.RUnlock()
+
+	// the socket must exist before the VMM is started
+	if err := state.listenUFFD(); err != nil {
+		logger.Error("Failed to create the uffd socket")
+		return err
+	}
 
 	m.instances[vmID] = state
 
@@ -110,6 +135,9 @@ func (m *MemoryManager) DeregisterVM(vmID string) error {
 		return errors.New("Failed to deactivate, VM still active")
 	}
 
+	state.closeListener()
+	state.stopStreaming()
+
 	delete(m.instances, vmID)
 
 	return nil
@@ -143,13 +171,14 @@ func (m *MemoryManager) Activate(vmID string) error {
 		return errors.New("VM already active")
 	}
 
-	if err := state.mapGuestMemory(); err != nil {
-		logger.Error("Failed to map guest memory")
+	if err := state.getUFFD(); err != nil {
+		logger.Error("Failed to get uffd")
 		return err
 	}
 
-	if err := state.getUFFD(); err != nil {
-		logger.Error("Failed to get uffd")
+	if err := state.mapGuestMemory(); err != nil {
+		logger.Error("Failed to map guest memory")
+		state.userFaultFD.Close()
 		return err
 	}
 
@@ -186,7 +215,13 @@ func (m *MemoryManager) FetchState(vmID string) error {
 
 	m.Unlock()
 
-	if state.isRecordReady && !state.IsLazyMode {
+	state.record.RLock()
+	defer state.record.RUnlock()
+
+	// the working set must match the trace loaded by the instance
+	state.reloadRecord()
+
+	if state.isRecordReady && state.PrefetchPolicy.UsesWorkingSet() {
 		if state.metricsModeOn {
 			tStart = time.Now()
 		}
@@ -230,7 +265,8 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 		return errors.New("VM not activated")
 	}
 
-	state.quitCh <- 0
+	state.stopPolling()
+	state.stopStreaming()
 	if err := state.unmapGuestMemory(); err != nil {
 		logger.Error("Failed to munmap guest memory")
 		return err
@@ -239,23 +275,45 @@ func (m *MemoryManager) Deactivate(vmID string) error {
 	state.processMetrics()
 
 	state.userFaultFD.Close()
-	if !state.isRecordReady && !state.IsLazyMode {
-		state.trace.ProcessRecord(state.GuestMemPath, state.WorkingSetPath)
+	state.isActive = false
+
+	state.record.Lock()
+	defer state.record.Unlock()
+
+	if state.isRecordReady {
+		if state.Refinement.Enabled() {
+			if err := state.refineRecord(); err != nil {
+				logger.Errorf("Failed to refine the working set: %v", err)
+			}
+		}
+		return nil
+	}
+
+	// the record is kept in the base directory for the next instances of the snapshot
+	state.record.generation++
+	state.recordGeneration = state.record.generation
+
+	if err := state.trace.ProcessRecord(state.GuestMemPath, state.WorkingSetPath); err != nil {
+		logger.Errorf("Failed to write the working set: %v", err)
+		// the next activation records the working set again
+		state.trace = initTrace(state.getTraceFile())
+		return nil
+	}
+
+	if err := state.trace.WriteTrace(); err != nil {
+		// the record is still replayed by this instance, it is only lost upon restart
+		logger.Errorf("Failed to persist the record: %v", err)
+	} else {
+		state.publishRecord()
 	}
 
 	state.isRecordReady = true
-	state.isActive = false
 
 	return nil
 }
 
 // DumpUPFPageStats Saves the per VM stats
 func (m *MemoryManager) DumpUPFPageStats(vmID, functionName, metricsOutFilePath string) error {
-	var (
-		statHeader []string
-		stats      []string
-	)
-
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
 	logger.Debug("Dumping stats about number of page faults")
@@ -281,6 +339,11 @@ func (m *MemoryManager) DumpUPFPageStats(vmID, functionName, metricsOutFilePath
 		return errors.New("Metrics mode is not on")
 	}
 
+	var (
+		statHeader []string
+		stats      []string
+	)
+
 	if state.IsLazyMode {
 		statHeader, stats = getLazyHeaderStats(state, functionName)
 	} else {
@@ -351,6 +414,36 @@ func (m *MemoryManager) GetUPFLatencyStats(vmID string) ([]*metrics.Metric, erro
 	return state.latencyMetrics, nil
 }
 
+// GetUPFStats Returns the page fault counters of the VM, which can be read while the VM is active
+func (m *MemoryManager) GetUPFStats(vmID string) (VMStats, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	state, ok := m.instances[vmID]
+	if !ok {
+		return VMStats{}, errors.New("VM not registered with the memory manager")
+	}
+
+	return state.stats.snapshot(vmID), nil
+}
+
+// GetAllUPFStats Returns the page fault counters of all the VMs registered with the memory manager, sorted by VM ID
+func (m *MemoryManager) GetAllUPFStats() []VMStats {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := make([]VMStats, 0, len(m.instances))
+	for vmID, state := range m.instances {
+		stats = append(stats, state.stats.snapshot(vmID))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].VMID < stats[j].VMID })
+
+	return stats
+}
+
+// getLazyHeaderStats Returns the page fault stats of a VM in lazy mode. The columns
+// added for the prefetch policies follow the original ones, which are read by the
+// plotting scripts.
 func getLazyHeaderStats(state *SnapshotState, functionName string) ([]string, []string) {
 	header := []string{
 		"FuncName",
@@ -361,11 +454,15 @@ func getLazyHeaderStats(state *SnapshotState, functionName string) ([]string, []
 		"StdDev",
 		"Unique",
 		"StdDev",
+		"Policy",
+		"Prefetched",
+		"StdDev",
 	}
 
 	uniqueMean, uniqueStd := stat.MeanStdDev(state.uniquePFServed, nil)
 	totalMean, totalStd := stat.MeanStdDev(state.totalPFServed, nil)
 	reusedMean, reusedStd := stat.MeanStdDev(state.reusedPFServed, nil)
+	prefetchedMean, prefetchedStd := stat.MeanStdDev(state.prefetchedPFServed, nil)
 
 	stats := []string{
 		functionName,
@@ -376,11 +473,16 @@ func getLazyHeaderStats(state *SnapshotState, functionName string) ([]string, []
 		fmt.Sprintf("%.1f", reusedStd),
 		strconv.Itoa(int(uniqueMean)), // number of pages not found in the trace
 		fmt.Sprintf("%.1f", uniqueStd),
+		state.PrefetchPolicy.Name(),
+		strconv.Itoa(int(prefetchedMean)), // number of pages installed ahead of page faults
+		fmt.Sprintf("%.1f", prefetchedStd),
 	}
 
 	return header, stats
 }
 
+// getRecRepHeaderStats Returns the page fault stats of a VM in record-and-prefetch
+// mode, see getLazyHeaderStats for the order of the columns.
 func getRecRepHeaderStats(state *SnapshotState, functionName string) ([]string, []string) {
 	header := []string{
 		"FuncName",
@@ -388,9 +490,16 @@ func getRecRepHeaderStats(state *SnapshotState, functionName string) ([]string,
 		"RecRegions",
 		"Unique",
 		"StdDev",
+		"Policy",
+		"Faults",
+		"StdDev",
+		"Prefetched",
+		"StdDev",
 	}
 
 	uniqueMean, uniqueStd := stat.MeanStdDev(state.uniquePFServed, nil)
+	totalMean, totalStd := stat.MeanStdDev(state.totalPFServed, nil)
+	prefetchedMean, prefetchedStd := stat.MeanStdDev(state.prefetchedPFServed, nil)
 
 	stats := []string{
 		functionName,
@@ -398,6 +507,11 @@ func getRecRepHeaderStats(state *SnapshotState, functionName string) ([]string,
 		strconv.Itoa(len(state.trace.regions)), // number of contiguous regions in the trace
 		strconv.Itoa(int(uniqueMean)),          // number of pages not found in the trace
 		fmt.Sprintf("%.1f", uniqueStd),
+		state.PrefetchPolicy.Name(),
+		strconv.Itoa(int(totalMean)), // number of page faults served
+		fmt.Sprintf("%.1f", totalStd),
+		strconv.Itoa(int(prefetchedMean)), // number of pages installed ahead of page faults
+		fmt.Sprintf("%.1f", prefetchedStd),
 	}
 
 	return header, stats
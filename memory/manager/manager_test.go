@@ -20,149 +20,655 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-//nolint:deadcode,unused
 package manager
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
 
-	"errors"
+// Environment of the fake VM processes, which emulate a VMM loading a
+// snapshot with the Uffd memory backend and a guest reading its memory
+const (
+	fakeVMSockEnv     = "FAKE_VM_SOCK"
+	fakeVMRegionsEnv  = "FAKE_VM_REGIONS" // comma-separated sizes of the regions, stored contiguously in the guest memory file
+	fakeVMPagesEnv    = "FAKE_VM_PAGES"   // number of pages read in each region
+	fakeVMPageSizeEnv = "FAKE_VM_PAGE_SIZE"
+
+	fakeVMTimeout = 10 * time.Second
 )
 
-/*
-func TestSingleClient(t *testing.T) {
-	log.SetFormatter(&log.TextFormatter{
-		TimestampFormat: ctrdlog.RFC3339NanoFixed,
-		FullTimestamp:   true,
-	})
+func TestMain(m *testing.M) {
+	if sockPath := os.Getenv(fakeVMSockEnv); sockPath != "" {
+		if err := runFakeVM(sockPath); err != nil {
+			fmt.Fprintf(os.Stderr, "fake VM: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runFakeVM Registers the guest memory regions with a userfaultfd, sends the uffd and the guest memory
+// mappings to the memory manager as Firecracker does, and validates the pages. The regions are mapped
+// independently, and with huge pages if the page size is the huge page size
+func runFakeVM(sockPath string) error {
+	pages, _ := strconv.Atoi(os.Getenv(fakeVMPagesEnv))
+	pageSize, _ := strconv.Atoi(os.Getenv(fakeVMPageSizeEnv))
+
+	flags := unix.MAP_PRIVATE | unix.MAP_ANONYMOUS
+	if pageSize == hugePageSize {
+		flags |= unix.MAP_HUGETLB
+	}
+
 	var (
-		uffd            int
-		region          []byte
-		regionSize      int    = 4 * os.Getpagesize()
-		uffdFileName    string = "/tmp/uffd_file.file"
-		guestMemoryPath        = "/tmp/guest_mem"
-		vmID            string = "1"
+		uffd     = -1
+		regions  [][]byte
+		mappings []GuestRegionUffdMapping
+		offset   int
 	)
 
-	log.SetLevel(log.DebugLevel)
+	for _, field := range strings.Split(os.Getenv(fakeVMRegionsEnv), ",") {
+		size, err := strconv.Atoi(field)
+		if err != nil {
+			return err
+		}
 
-	prepareGuestMemoryFile(guestMemoryPath, regionSize)
+		region, err := unix.Mmap(-1, 0, size, unix.PROT_READ, flags)
+		if err != nil {
+			return err
+		}
+
+		if uffd < 0 {
+			uffd, err = registerForUpf(region, uint64(size))
+		} else {
+			err = registerRange(uffd, region, uint64(size))
+		}
+		if err != nil {
+			return err
+		}
+
+		regions = append(regions, region)
+		mappings = append(mappings, GuestRegionUffdMapping{
+			BaseHostVirtAddr: uint64(uintptr(unsafe.Pointer(&region[0]))),
+			Size:             uint64(size),
+			Offset:           uint64(offset),
+			PageSize:         uint64(pageSize),
+		})
+		offset += size
+	}
+
+	msg, err := json.Marshal(mappings)
+	if err != nil {
+		return err
+	}
 
-	region, err := unix.Mmap(-1, 0, regionSize, unix.PROT_READ, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: sockPath, Net: "unix"})
 	if err != nil {
-		log.Errorf("Failed to mmap: %v", err)
+		return err
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.WriteMsgUnix(msg, unix.UnixRights(uffd), nil); err != nil {
+		return err
+	}
+
+	// page faults block until the memory manager serves them
+	for i, region := range regions {
+		firstPage := int(mappings[i].Offset) / os.Getpagesize()
+		if err := validateGuestMemory(region[:pages*pageSize], firstPage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startFakeVM Starts a fake VM process that reads the given number of guest memory pages
+func startFakeVM(t *testing.T, cfg SnapshotStateCfg, pages, pageSize int) *exec.Cmd {
+	return startFakeVMRegions(t, cfg, []int{cfg.GuestMemSize}, pages, pageSize)
+}
+
+// startFakeVMRegions Starts a fake VM process with several guest memory regions,
+// which reads the given number of pages in each of them
+func startFakeVMRegions(t *testing.T, cfg SnapshotStateCfg, regionSizes []int, pages, pageSize int) *exec.Cmd {
+	sizes := make([]string, 0, len(regionSizes))
+	for _, size := range regionSizes {
+		sizes = append(sizes, strconv.Itoa(size))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(),
+		fakeVMSockEnv+"="+cfg.InstanceSockAddr,
+		fakeVMRegionsEnv+"="+strings.Join(sizes, ","),
+		fakeVMPagesEnv+"="+strconv.Itoa(pages),
+		fakeVMPageSizeEnv+"="+strconv.Itoa(pageSize),
+	)
+	cmd.Stderr = os.Stderr
+
+	require.NoError(t, cmd.Start(), "Failed to start fake VM")
+
+	return cmd
+}
+
+// waitFakeVM Waits for a fake VM process to validate its guest memory
+func waitFakeVM(cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(fakeVMTimeout):
+		_ = cmd.Process.Kill()
+		<-done
+		return errors.New("fake VM timed out")
 	}
+}
 
+// requireUFFD Skips the test if userfaultfd is not available
+func requireUFFD(t *testing.T) {
+	region, err := unix.Mmap(-1, 0, os.Getpagesize(), unix.PROT_READ, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	require.NoError(t, err)
 	defer unix.Munmap(region)
 
-	uffd = registerForUpf(region, uint64(regionSize))
+	uffd, err := registerForUpf(region, uint64(len(region)))
+	if err != nil {
+		t.Skipf("userfaultfd is not available: %v", err)
+	}
+	unix.Close(uffd)
+}
+
+// requireHugePages Skips the test if the given number of huge pages cannot be allocated
+func requireHugePages(t *testing.T, pages int) {
+	region, err := unix.Mmap(-1, 0, pages*hugePageSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_HUGETLB|unix.MAP_POPULATE)
+	if err != nil {
+		t.Skipf("huge pages are not available: %v", err)
+	}
+	require.NoError(t, unix.Munmap(region))
+}
+
+func newStateCfg(t *testing.T, vmID, baseDir, guestMemPath string, size int) SnapshotStateCfg {
+	vmmStatePath := filepath.Join(baseDir, "snap_file")
+	require.NoError(t, os.WriteFile(vmmStatePath, []byte("state"), 0644))
+
+	return SnapshotStateCfg{
+		VMID:             vmID,
+		BaseDir:          baseDir,
+		GuestMemPath:     guestMemPath,
+		GuestMemSize:     size,
+		VMMStatePath:     vmmStatePath,
+		WorkingSetPath:   filepath.Join(baseDir, "working_set_pages"),
+		InstanceSockAddr: filepath.Join(t.TempDir(), "uffd.sock"),
+	}
+}
+
+// loadVM Registers and activates a fake VM reading the given number of guest memory pages
+func loadVM(manager *MemoryManager, cfg SnapshotStateCfg, cmd func() *exec.Cmd) error {
+	if err := manager.RegisterVM(cfg); err != nil {
+		return err
+	}
+	if err := manager.FetchState(cfg.VMID); err != nil {
+		return err
+	}
 
-	uffdFile := os.NewFile(uintptr(uffd), uffdFileName)
+	vm := cmd()
 
-	managerCfg := MemoryManagerCfg{}
-	manager := NewMemoryManager(managerCfg)
+	if err := manager.Activate(cfg.VMID); err != nil {
+		_ = vm.Process.Kill()
+		_ = vm.Wait()
+		return err
+	}
 
-	stateCfg := SnapshotStateCfg{
-		VMID:         vmID,
-		BaseDir:      "/tmp/snap_base",
-		GuestMemPath: guestMemoryPath,
-		GuestMemSize: regionSize,
+	if err := waitFakeVM(vm); err != nil {
+		return err
 	}
 
-	err = manager.RegisterVM(stateCfg)
-	require.NoError(t, err, "Failed to register VM")
+	return manager.Deactivate(cfg.VMID)
+}
+
+func TestSingleClient(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		regionSize      = 4 * os.Getpagesize()
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+		vmID            = "1"
+	)
 
-	err = manager.Activate(vmID, uffdFile)
-	require.NoError(t, err, "Failed to add VM")
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
 
-	err = validateGuestMemory(region)
-	require.NoError(t, err, "Failed to validate guest memory")
+	manager := NewMemoryManager(MemoryManagerCfg{})
+	stateCfg := newStateCfg(t, vmID, baseDir, guestMemoryPath, regionSize)
 
-	err = manager.Deactivate(vmID)
-	require.NoError(t, err, "Failed to remove intance")
+	err := loadVM(manager, stateCfg, func() *exec.Cmd { return startFakeVM(t, stateCfg, 4, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the VM")
 
-	err = manager.DeregisterVM(vmID)
-	require.NoError(t, err, "Failed to deregister vm")
+	require.NoError(t, manager.DeregisterVM(vmID), "Failed to deregister vm")
+	_, err = os.Stat(stateCfg.InstanceSockAddr)
+	require.True(t, os.IsNotExist(err), "uffd socket not removed")
 }
 
-func TestParallelClients(t *testing.T) {
-	numParallel := 1000
+func TestRecordReplay(t *testing.T) {
+	requireUFFD(t)
 
-	log.SetFormatter(&log.TextFormatter{
-		TimestampFormat: ctrdlog.RFC3339NanoFixed,
-		FullTimestamp:   true,
-	})
 	var (
-		regionSize int = 4 * os.Getpagesize()
-		err        error
+		numPages        = 16
+		regionSize      = numPages * os.Getpagesize()
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
 	)
 
-	log.SetLevel(log.DebugLevel)
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
 
-	clients := make(map[int]*upfClient)
+	manager := NewMemoryManager(MemoryManagerCfg{MetricsModeOn: true})
+
+	// The first instance records the pages it touches
+	recordCfg := newStateCfg(t, "record", baseDir, guestMemoryPath, regionSize)
+	err := loadVM(manager, recordCfg, func() *exec.Cmd { return startFakeVM(t, recordCfg, numPages/2, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the recording VM")
+
+	info, err := os.Stat(recordCfg.WorkingSetPath)
+	require.NoError(t, err, "Working set not written")
+	require.Equal(t, int64(numPages/2*os.Getpagesize()), info.Size())
+
+	// The next instances of the snapshot install the recorded working set upon the first page fault
+	replayCfg := newStateCfg(t, "replay", baseDir, guestMemoryPath, regionSize)
+	err = loadVM(manager, replayCfg, func() *exec.Cmd { return startFakeVM(t, replayCfg, numPages, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the replaying VM")
+
+	state := manager.instances["replay"]
+	require.True(t, state.isRecordReady)
+	require.Len(t, state.trace.trace, numPages/2)
+	require.Equal(t, uint64(regionSize), state.trace.guestMemSize, "record read back from the trace file")
+	require.True(t, state.trace.hasTimestamps)
+	require.Equal(t, []float64{float64(numPages / 2)}, state.uniquePFServed, "pages missing from the working set")
+
+	// the counters match the stats of the metrics mode
+	stats, err := manager.GetUPFStats("replay")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stats.Activations)
+	require.Equal(t, uint64(numPages/2+1), stats.Faults)
+	require.Equal(t, uint64(numPages/2), stats.UniqueFaults)
+	require.Equal(t, uint64(numPages/2-1), stats.PrefetchedPages)
+	require.Equal(t, uint64(numPages/2), stats.WorkingSetPages)
+	require.Equal(t, uint64(numPages/2*os.Getpagesize()), stats.FetchedBytes)
+	require.Equal(t, stats.Faults, stats.FaultLatency.Count)
+	require.Len(t, manager.GetAllUPFStats(), 2)
+
+	statsPath := filepath.Join(t.TempDir(), "stats.csv")
+	require.NoError(t, manager.DumpUPFPageStats("replay", "test", statsPath))
+
+	for _, vmID := range []string{"record", "replay"} {
+		require.NoError(t, manager.DeregisterVM(vmID), "Failed to deregister vm")
+	}
+}
 
-	for i := 0; i < numParallel; i++ {
-		vmID := fmt.Sprintf("%d", i)
-		guestMemoryPath := "/tmp/guest_mem_" + vmID
+func TestPrefetchPolicies(t *testing.T) {
+	requireUFFD(t)
 
-		prepareGuestMemoryFile(guestMemoryPath, regionSize)
+	var (
+		numPages        = 16
+		regionSize      = numPages * os.Getpagesize()
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+	)
 
-		region, err := unix.Mmap(-1, 0, regionSize, unix.PROT_READ, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
-		if err != nil {
-			log.Errorf("Failed to mmap: %v", err)
-		}
-		defer unix.Munmap(region)
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
+
+	manager := NewMemoryManager(MemoryManagerCfg{MetricsModeOn: true})
+
+	recordCfg := newStateCfg(t, "record", baseDir, guestMemoryPath, regionSize)
+	err := loadVM(manager, recordCfg, func() *exec.Cmd { return startFakeVM(t, recordCfg, numPages/2, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the recording VM")
+
+	// page faults, page faults on pages missing from the record, and prefetched
+	// pages when reading the whole guest memory sequentially
+	policies := []struct {
+		policy     PrefetchPolicy
+		faults     int
+		unique     int
+		prefetched int
+	}{
+		{NewRecordPrefetchPolicy(), numPages/2 + 1, numPages / 2, numPages/2 - 1},
+		{NewReadaheadPrefetchPolicy(4), numPages / 4, 2, numPages * 3 / 4},
+		{NewStridePrefetchPolicy(4), 8, 4, 8},
+		{NewNoPrefetchPolicy(), numPages, numPages / 2, 0},
+	}
+
+	statsPath := filepath.Join(t.TempDir(), "stats.csv")
 
-		uffd := registerForUpf(region, uint64(regionSize))
-		uffdFileName := fmt.Sprintf("file_%s", vmID)
-		uffdFile := os.NewFile(uintptr(uffd), uffdFileName)
+	for _, p := range policies {
+		cfg := newStateCfg(t, "replay-"+p.policy.Name(), baseDir, guestMemoryPath, regionSize)
+		cfg.PrefetchPolicy = p.policy
 
-		clients[i] = initClient(uffd, region, uffdFileName, guestMemoryPath, vmID, uffdFile)
+		err := loadVM(manager, cfg, func() *exec.Cmd { return startFakeVM(t, cfg, numPages, os.Getpagesize()) })
+		require.NoError(t, err, "Failed to serve the VM with the %s policy", p.policy.Name())
+
+		state := manager.instances[cfg.VMID]
+		require.Equal(t, []float64{float64(p.faults)}, state.totalPFServed, "faults with the %s policy", p.policy.Name())
+		require.Equal(t, []float64{float64(p.prefetched)}, state.prefetchedPFServed, "prefetched pages with the %s policy", p.policy.Name())
+		require.Equal(t, []float64{float64(p.unique)}, state.uniquePFServed, "unique faults with the %s policy", p.policy.Name())
+
+		require.NoError(t, manager.DumpUPFPageStats(cfg.VMID, "test", statsPath))
 	}
 
-	managerCfg := MemoryManagerCfg{}
-	manager := NewMemoryManager(managerCfg)
+	stats, err := os.ReadFile(statsPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(stats)), "\n")
+	require.Len(t, lines, len(policies)+1, "stats should share a header")
+	require.True(t, strings.HasPrefix(lines[0], "FuncName,RecPages,RecRegions,Unique,StdDev,"), "new columns should follow the original ones")
+}
+
+func TestWorkingSetRefinement(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		numPages        = 16
+		regionSize      = numPages * os.Getpagesize()
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+		refinement      = WorkingSetRefinement{Interval: 2, MinMisses: 2}
+	)
+
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
+
+	manager := NewMemoryManager(MemoryManagerCfg{MetricsModeOn: true})
+
+	recordCfg := newStateCfg(t, "record", baseDir, guestMemoryPath, regionSize)
+	err := loadVM(manager, recordCfg, func() *exec.Cmd { return startFakeVM(t, recordCfg, numPages/2, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the recording VM")
 
-	var wg sync.WaitGroup
+	// an instance that loaded the record before its refinement
+	staleCfg := newStateCfg(t, "stale", baseDir, guestMemoryPath, regionSize)
+	require.NoError(t, manager.RegisterVM(staleCfg))
+
+	// the pages missed by both invocations of an interval are merged into the working set,
+	// the next invocations then prefetch the whole guest memory upon the first page fault
+	for i, unique := range []int{numPages / 2, numPages / 2, 0} {
+		cfg := newStateCfg(t, fmt.Sprintf("replay-%d", i), baseDir, guestMemoryPath, regionSize)
+		cfg.Refinement = refinement
+
+		err := loadVM(manager, cfg, func() *exec.Cmd { return startFakeVM(t, cfg, numPages, os.Getpagesize()) })
+		require.NoError(t, err, "Failed to serve replaying VM %d", i)
+
+		state := manager.instances[cfg.VMID]
+		require.Equal(t, []float64{float64(unique)}, state.uniquePFServed, "pages missing from the working set of VM %d", i)
+	}
+
+	info, err := os.Stat(recordCfg.WorkingSetPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(regionSize), info.Size(), "working set file not regenerated")
+
+	trace, err := ReadTrace(filepath.Join(baseDir, "trace"))
+	require.NoError(t, err)
+	require.Len(t, trace.containedOffsets, numPages)
+
+	require.NoError(t, manager.FetchState(staleCfg.VMID))
+	stale := manager.instances[staleCfg.VMID]
+	require.Len(t, stale.trace.containedOffsets, numPages, "record not reloaded")
+	require.Len(t, stale.workingSet, regionSize)
+
+	require.Error(t, manager.RegisterVM(SnapshotStateCfg{VMID: "invalid", Refinement: WorkingSetRefinement{Interval: 1, MinMisses: 2}}))
+}
+
+// stalledReader Returns the first bytes of a working set, then blocks until the stream is stopped
+type stalledReader struct {
+	ctx     context.Context
+	data    []byte
+	stalled chan struct{}
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+
+	close(r.stalled)
+	<-r.ctx.Done()
+
+	return 0, r.ctx.Err()
+}
+
+func (r *stalledReader) Close() error {
+	return nil
+}
+
+func TestStreamWorkingSet(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		numPages        = 16
+		regionSize      = numPages * os.Getpagesize()
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+	)
+
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
+
+	manager := NewMemoryManager(MemoryManagerCfg{MetricsModeOn: true})
+
+	recordCfg := newStateCfg(t, "record", baseDir, guestMemoryPath, regionSize)
+	err := loadVM(manager, recordCfg, func() *exec.Cmd { return startFakeVM(t, recordCfg, numPages/2, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the recording VM")
+
+	// the working set file is streamed one page at a time
+	localCfg := newStateCfg(t, "local", baseDir, guestMemoryPath, regionSize)
+	localCfg.StreamWorkingSet = true
+	localCfg.StreamChunkSize = os.Getpagesize()
+
+	err = loadVM(manager, localCfg, func() *exec.Cmd { return startFakeVM(t, localCfg, numPages, os.Getpagesize()) })
+	require.NoError(t, err, "Failed to serve the VM streaming its working set")
+	require.Equal(t, []float64{float64(numPages / 2)}, manager.instances["local"].uniquePFServed)
+
+	workingSet, err := os.ReadFile(recordCfg.WorkingSetPath)
+	require.NoError(t, err)
+
+	// the pages of the working set that have not arrived are served out of order
+	stalled := make(chan struct{})
+	stalledCfg := newStateCfg(t, "stalled", baseDir, guestMemoryPath, regionSize)
+	stalledCfg.StreamWorkingSet = true
+	stalledCfg.StreamChunkSize = os.Getpagesize()
+	stalledCfg.WorkingSetOpener = func(ctx context.Context) (io.ReadCloser, int64, error) {
+		r := &stalledReader{ctx: ctx, data: workingSet[:2*os.Getpagesize()], stalled: stalled}
+		return r, int64(len(workingSet)), nil
+	}
+
+	require.NoError(t, manager.RegisterVM(stalledCfg))
+	require.NoError(t, manager.FetchState(stalledCfg.VMID))
+	<-stalled
+
+	vm := startFakeVM(t, stalledCfg, numPages, os.Getpagesize())
+	require.NoError(t, manager.Activate(stalledCfg.VMID))
+	require.NoError(t, waitFakeVM(vm), "Failed to serve the VM whose working set is stalled")
+	require.NoError(t, manager.Deactivate(stalledCfg.VMID))
+
+	state := manager.instances[stalledCfg.VMID]
+	require.Equal(t, []float64{float64(numPages - 1)}, state.totalPFServed, "only the pages that arrived are prefetched")
+	require.Equal(t, []float64{1}, state.prefetchedPFServed)
+
+	for _, vmID := range []string{"record", "local", "stalled"} {
+		require.NoError(t, manager.DeregisterVM(vmID))
+	}
+}
+
+func TestParallelClients(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		numParallel = 16
+		regionSize  = 4 * os.Getpagesize()
+		wg          sync.WaitGroup
+	)
+
+	manager := NewMemoryManager(MemoryManagerCfg{})
 
 	for i := 0; i < numParallel; i++ {
-		c := clients[i]
-		stateCfg := SnapshotStateCfg{
-			VMID:         c.vmID,
-			BaseDir:      "/tmp/snap_base",
-			GuestMemPath: c.guestMemoryPath,
-			GuestMemSize: regionSize,
-		}
+		baseDir := t.TempDir()
+		guestMemoryPath := filepath.Join(baseDir, "mem_file")
+		prepareGuestMemoryFile(guestMemoryPath, regionSize)
 
-		wg.Add(1)
+		cfg := newStateCfg(t, fmt.Sprintf("%d", i), baseDir, guestMemoryPath, regionSize)
+		vm := func() *exec.Cmd { return startFakeVM(t, cfg, 4, os.Getpagesize()) }
 
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
-			err = manager.RegisterVM(stateCfg)
-			require.NoError(t, err, "Failed to register VM")
+			if err := loadVM(manager, cfg, vm); err != nil {
+				t.Errorf("Failed to serve VM %s: %v", cfg.VMID, err)
+				return
+			}
+			if err := manager.DeregisterVM(cfg.VMID); err != nil {
+				t.Errorf("Failed to deregister VM %s: %v", cfg.VMID, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestMultipleRegions(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		numPages        = 8 // per region
+		regionSize      = numPages * os.Getpagesize()
+		regionSizes     = []int{regionSize, regionSize}
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+	)
 
-			err = manager.Activate(c.vmID, c.uffdFile)
-			require.NoError(t, err, "Failed to add VM")
+	prepareGuestMemoryFile(guestMemoryPath, 2*regionSize)
 
-			err = validateGuestMemory(c.region)
-			require.NoError(t, err, "Failed to validate guest memory")
+	manager := NewMemoryManager(MemoryManagerCfg{MetricsModeOn: true})
 
-			err = manager.Deactivate(c.vmID)
-			require.NoError(t, err, "Failed to remove intance")
+	recordCfg := newStateCfg(t, "record", baseDir, guestMemoryPath, 2*regionSize)
+	err := loadVM(manager, recordCfg, func() *exec.Cmd {
+		return startFakeVMRegions(t, recordCfg, regionSizes, numPages/2, os.Getpagesize())
+	})
+	require.NoError(t, err, "Failed to serve the recording VM")
 
-			err = manager.DeregisterVM(c.vmID)
-			require.NoError(t, err, "Failed to deregister vm")
-		}()
+	info, err := os.Stat(recordCfg.WorkingSetPath)
+	require.NoError(t, err, "Working set not written")
+	require.Equal(t, int64(numPages*os.Getpagesize()), info.Size(), "pages of both regions in the working set")
 
+	// the working set of both regions is installed upon the first page fault
+	replayCfg := newStateCfg(t, "replay", baseDir, guestMemoryPath, 2*regionSize)
+	err = loadVM(manager, replayCfg, func() *exec.Cmd {
+		return startFakeVMRegions(t, replayCfg, regionSizes, numPages, os.Getpagesize())
+	})
+	require.NoError(t, err, "Failed to serve the replaying VM")
+
+	state := manager.instances["replay"]
+	require.True(t, state.isRecordReady)
+	require.Equal(t, []traceRegion{{Offset: 0, Size: uint64(regionSize)}, {Offset: uint64(regionSize), Size: uint64(regionSize)}},
+		state.trace.memRegions)
+	require.Equal(t, []float64{float64(numPages)}, state.uniquePFServed, "pages missing from the working set")
+	require.Equal(t, []float64{float64(numPages + 1)}, state.totalPFServed)
+
+	// the record is taken again if the guest memory layout changes
+	singleCfg := newStateCfg(t, "single", baseDir, guestMemoryPath, 2*regionSize)
+	err = loadVM(manager, singleCfg, func() *exec.Cmd {
+		return startFakeVMRegions(t, singleCfg, []int{2 * regionSize}, 2*numPages, os.Getpagesize())
+	})
+	require.NoError(t, err, "Failed to serve the VM with a different layout")
+
+	state = manager.instances["single"]
+	require.Empty(t, state.uniquePFServed, "record discarded")
+	require.Len(t, state.trace.memRegions, 1)
+	require.Len(t, state.trace.trace, 2*numPages)
+
+	for _, vmID := range []string{"record", "replay", "single"} {
+		require.NoError(t, manager.DeregisterVM(vmID), "Failed to deregister vm")
 	}
+}
 
-	wg.Wait()
+func TestHugePages(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		numPages        = 4
+		regionSize      = numPages * hugePageSize
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+	)
+
+	requireHugePages(t, numPages)
+
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
+
+	manager := NewMemoryManager(MemoryManagerCfg{MetricsModeOn: true})
+
+	recordCfg := newStateCfg(t, "record", baseDir, guestMemoryPath, regionSize)
+	err := loadVM(manager, recordCfg, func() *exec.Cmd { return startFakeVM(t, recordCfg, numPages/2, hugePageSize) })
+	require.NoError(t, err, "Failed to serve the recording VM")
+
+	info, err := os.Stat(recordCfg.WorkingSetPath)
+	require.NoError(t, err, "Working set not written")
+	require.Equal(t, int64(numPages/2*hugePageSize), info.Size())
+
+	replayCfg := newStateCfg(t, "replay", baseDir, guestMemoryPath, regionSize)
+	err = loadVM(manager, replayCfg, func() *exec.Cmd { return startFakeVM(t, replayCfg, numPages, hugePageSize) })
+	require.NoError(t, err, "Failed to serve the replaying VM")
+
+	state := manager.instances["replay"]
+	require.True(t, state.isRecordReady)
+	require.Equal(t, uint32(hugePageSize), state.trace.pageSize)
+	require.Equal(t, []float64{float64(numPages / 2)}, state.uniquePFServed, "pages missing from the working set")
+	require.Equal(t, []float64{float64(numPages/2 + 1)}, state.totalPFServed)
+
+	for _, vmID := range []string{"record", "replay"} {
+		require.NoError(t, manager.DeregisterVM(vmID), "Failed to deregister vm")
+	}
 }
-*/
 
+func TestHandshakeUnsupportedPageSize(t *testing.T) {
+	requireUFFD(t)
+
+	var (
+		regionSize      = 4 * os.Getpagesize()
+		baseDir         = t.TempDir()
+		guestMemoryPath = filepath.Join(baseDir, "mem_file")
+		vmID            = "1"
+	)
+
+	prepareGuestMemoryFile(guestMemoryPath, regionSize)
+
+	manager := NewMemoryManager(MemoryManagerCfg{})
+	stateCfg := newStateCfg(t, vmID, baseDir, guestMemoryPath, regionSize)
+
+	err := loadVM(manager, stateCfg, func() *exec.Cmd { return startFakeVM(t, stateCfg, 0, 16*os.Getpagesize()) })
+	require.Error(t, err)
+
+	require.NoError(t, manager.DeregisterVM(vmID))
+}
+
+// prepareGuestMemoryFile Writes a guest memory file whose pages are filled with their index
 func prepareGuestMemoryFile(guestFileName string, size int) {
 	toWrite := make([]byte, size)
 	pages := size / os.Getpagesize()
@@ -178,34 +684,16 @@ func prepareGuestMemoryFile(guestFileName string, size int) {
 	}
 }
 
-func validateGuestMemory(guestMem []byte) error {
+// validateGuestMemory Checks the contents of the guest memory written by prepareGuestMemoryFile,
+// starting at the given page of the guest memory file
+func validateGuestMemory(guestMem []byte, firstPage int) error {
 	pages := len(guestMem) / os.Getpagesize()
 	for i := 0; i < pages; i++ {
-		log.Debugf("Validating page %d's contents...\n", i)
+		log.Debugf("Validating page %d's contents...\n", firstPage+i)
 		j := os.Getpagesize() * i
-		if guestMem[j] != byte(48+i) {
+		if guestMem[j] != byte(48+firstPage+i) {
 			return errors.New("Incorrect guest memory")
 		}
 	}
 	return nil
 }
-
-type upfClient struct {
-	uffd                                int
-	region                              []byte
-	uffdFileName, guestMemoryPath, vmID string
-	uffdFile                            *os.File
-}
-
-func initClient(uffd int, region []byte, uffdFileName, guestMemoryPath, vmID string, uffdFile *os.File) *upfClient {
-	c := new(upfClient)
-
-	c.uffd = uffd
-	c.region = region
-	c.uffdFileName = uffdFileName
-	c.guestMemoryPath = guestMemoryPath
-	c.vmID = vmID
-	c.uffdFile = uffdFile
-
-	return c
-}
@@ -0,0 +1,251 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Names of the prefetch policies
+const (
+	RecordPrefetch    = "record"
+	ReadaheadPrefetch = "readahead"
+	StridePrefetch    = "stride"
+	NoPrefetch        = "none"
+)
+
+// PrefetchRegion A range of contiguous pages of the guest memory
+type PrefetchRegion struct {
+	Offset uint64 // offset of the first page in the guest memory
+	Pages  int
+}
+
+// PageFault A page fault served by the memory manager
+type PageFault struct {
+	Offset       uint64           // page-aligned offset of the faulting page in the guest memory file
+	First        bool             // whether this is the first page fault since the VM was activated
+	PageSize     uint64           // size of the pages backing the guest memory
+	GuestMemSize uint64           // size of the guest memory file
+	WorkingSet   []PrefetchRegion // regions of the working set recorded by the first instance of the snapshot
+}
+
+// PrefetchPolicy Decides which pages of the guest memory are installed ahead of the page faults of a VM.
+// The first instance of a snapshot always serves its page faults one at a time to record its working set,
+// the policy is used by the next instances
+type PrefetchPolicy interface {
+	// Name Returns the name of the policy, reported in the page fault stats
+	Name() string
+	// UsesWorkingSet Returns whether the policy prefetches the recorded working set,
+	// which is then fetched from the disk before the VM is loaded
+	UsesWorkingSet() bool
+	// Reset Is called when the VM is activated, before any page fault is served
+	Reset()
+	// Prefetch Returns the regions to install upon a page fault, in addition to the faulting page.
+	// Pages that are already installed are skipped
+	Prefetch(fault PageFault) []PrefetchRegion
+}
+
+// NewPrefetchPolicy Creates a prefetch policy by name, pages is the number of pages
+// prefetched upon each page fault by the readahead and stride policies
+func NewPrefetchPolicy(name string, pages int) (PrefetchPolicy, error) {
+	if (name == ReadaheadPrefetch || name == StridePrefetch) && pages <= 0 {
+		return nil, errors.New(fmt.Sprintf("the %s prefetch policy requires a positive number of pages", name))
+	}
+
+	switch name {
+	case RecordPrefetch:
+		return NewRecordPrefetchPolicy(), nil
+	case ReadaheadPrefetch:
+		return NewReadaheadPrefetchPolicy(pages), nil
+	case StridePrefetch:
+		return NewStridePrefetchPolicy(pages), nil
+	case NoPrefetch:
+		return NewNoPrefetchPolicy(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown prefetch policy %q", name))
+	}
+}
+
+// RecordPrefetchPolicy Installs the whole recorded working set upon the first page fault (REAP)
+type RecordPrefetchPolicy struct{}
+
+// NewRecordPrefetchPolicy Creates a record-and-prefetch policy
+func NewRecordPrefetchPolicy() *RecordPrefetchPolicy {
+	return &RecordPrefetchPolicy{}
+}
+
+// Name Returns the name of the policy
+func (p *RecordPrefetchPolicy) Name() string {
+	return RecordPrefetch
+}
+
+// UsesWorkingSet Returns true, the working set is prefetched
+func (p *RecordPrefetchPolicy) UsesWorkingSet() bool {
+	return true
+}
+
+// Reset Does nothing, the policy is stateless
+func (p *RecordPrefetchPolicy) Reset() {}
+
+// Prefetch Returns the working set upon the first page fault
+func (p *RecordPrefetchPolicy) Prefetch(fault PageFault) []PrefetchRegion {
+	if !fault.First {
+		return nil
+	}
+
+	return fault.WorkingSet
+}
+
+// ReadaheadPrefetchPolicy Installs the aligned block of pages around each faulting page,
+// similarly to the fault-around of the kernel
+type ReadaheadPrefetchPolicy struct {
+	pages int
+}
+
+// NewReadaheadPrefetchPolicy Creates a readahead policy installing blocks of the given number of pages
+func NewReadaheadPrefetchPolicy(pages int) *ReadaheadPrefetchPolicy {
+	return &ReadaheadPrefetchPolicy{pages: pages}
+}
+
+// Name Returns the name of the policy
+func (p *ReadaheadPrefetchPolicy) Name() string {
+	return ReadaheadPrefetch
+}
+
+// UsesWorkingSet Returns false, the policy does not depend on the record
+func (p *ReadaheadPrefetchPolicy) UsesWorkingSet() bool {
+	return false
+}
+
+// Reset Does nothing, the policy is stateless
+func (p *ReadaheadPrefetchPolicy) Reset() {}
+
+// Prefetch Returns the block of pages containing the faulting page
+func (p *ReadaheadPrefetchPolicy) Prefetch(fault PageFault) []PrefetchRegion {
+	blockSize := uint64(p.pages) * fault.PageSize
+	start := fault.Offset - fault.Offset%blockSize
+	end := start + blockSize
+	if end > fault.GuestMemSize {
+		end = fault.GuestMemSize
+	}
+
+	return []PrefetchRegion{{Offset: start, Pages: int((end - start) / fault.PageSize)}}
+}
+
+// StridePrefetchPolicy Detects page faults at a constant stride and
+// installs the next pages along the stride
+type StridePrefetchPolicy struct {
+	pages      int
+	lastOffset uint64
+	lastStride int64
+}
+
+// NewStridePrefetchPolicy Creates a stride policy installing the given
+// number of pages once a stride is detected
+func NewStridePrefetchPolicy(pages int) *StridePrefetchPolicy {
+	return &StridePrefetchPolicy{pages: pages}
+}
+
+// Name Returns the name of the policy
+func (p *StridePrefetchPolicy) Name() string {
+	return StridePrefetch
+}
+
+// UsesWorkingSet Returns false, the policy does not depend on the record
+func (p *StridePrefetchPolicy) UsesWorkingSet() bool {
+	return false
+}
+
+// Reset Forgets the page faults of the previous activation
+func (p *StridePrefetchPolicy) Reset() {
+	p.lastOffset = 0
+	p.lastStride = 0
+}
+
+// Prefetch Returns the next pages along the stride if the last three page faults are at a constant stride
+func (p *StridePrefetchPolicy) Prefetch(fault PageFault) []PrefetchRegion {
+	stride := int64(fault.Offset) - int64(p.lastOffset)
+	if fault.First {
+		stride = 0
+	}
+
+	detected := stride != 0 && stride == p.lastStride
+
+	p.lastOffset = fault.Offset
+	p.lastStride = stride
+
+	if !detected {
+		return nil
+	}
+
+	regions := make([]PrefetchRegion, 0, p.pages)
+	offset := int64(fault.Offset)
+	for i := 0; i < p.pages; i++ {
+		offset += stride
+		if offset < 0 || uint64(offset) >= fault.GuestMemSize {
+			break
+		}
+		regions = append(regions, PrefetchRegion{Offset: uint64(offset), Pages: 1})
+	}
+
+	return regions
+}
+
+// NoPrefetchPolicy Serves page faults one at a time (lazy mode)
+type NoPrefetchPolicy struct{}
+
+// NewNoPrefetchPolicy Creates a policy that does not prefetch any page
+func NewNoPrefetchPolicy() *NoPrefetchPolicy {
+	return &NoPrefetchPolicy{}
+}
+
+// Name Returns the name of the policy
+func (p *NoPrefetchPolicy) Name() string {
+	return NoPrefetch
+}
+
+// UsesWorkingSet Returns false, the policy does not depend on the record
+func (p *NoPrefetchPolicy) UsesWorkingSet() bool {
+	return false
+}
+
+// Reset Does nothing, the policy is stateless
+func (p *NoPrefetchPolicy) Reset() {}
+
+// Prefetch Returns no region
+func (p *NoPrefetchPolicy) Prefetch(fault PageFault) []PrefetchRegion {
+	return nil
+}
+
+// getWorkingSetRegions Returns the contiguous regions of the trace, sorted by offset
+func getWorkingSetRegions(t *Trace) []PrefetchRegion {
+	regions := make([]PrefetchRegion, 0, len(t.regions))
+	for offset, pages := range t.regions {
+		regions = append(regions, PrefetchRegion{Offset: offset, Pages: pages})
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Offset < regions[j].Offset })
+
+	return regions
+}
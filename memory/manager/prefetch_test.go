@@ -0,0 +1,98 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPrefetchPolicy(t *testing.T) {
+	for _, name := range []string{RecordPrefetch, ReadaheadPrefetch, StridePrefetch, NoPrefetch} {
+		policy, err := NewPrefetchPolicy(name, 8)
+		require.NoError(t, err)
+		require.Equal(t, name, policy.Name())
+	}
+
+	_, err := NewPrefetchPolicy("unknown", 8)
+	require.Error(t, err)
+
+	_, err = NewPrefetchPolicy(ReadaheadPrefetch, 0)
+	require.Error(t, err)
+}
+
+func TestRecordPrefetchPolicy(t *testing.T) {
+	workingSet := []PrefetchRegion{{Offset: 0, Pages: 2}, {Offset: 8 * uint64(os.Getpagesize()), Pages: 1}}
+	policy := NewRecordPrefetchPolicy()
+
+	require.Equal(t, workingSet, policy.Prefetch(PageFault{First: true, WorkingSet: workingSet}))
+	require.Empty(t, policy.Prefetch(PageFault{WorkingSet: workingSet}))
+	require.True(t, policy.UsesWorkingSet())
+}
+
+func TestReadaheadPrefetchPolicy(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	policy := NewReadaheadPrefetchPolicy(4)
+
+	regions := policy.Prefetch(PageFault{Offset: 5 * pageSize, PageSize: pageSize, GuestMemSize: 16 * pageSize})
+	require.Equal(t, []PrefetchRegion{{Offset: 4 * pageSize, Pages: 4}}, regions)
+
+	// the block is truncated at the end of the guest memory
+	regions = policy.Prefetch(PageFault{Offset: 9 * pageSize, PageSize: pageSize, GuestMemSize: 10 * pageSize})
+	require.Equal(t, []PrefetchRegion{{Offset: 8 * pageSize, Pages: 2}}, regions)
+
+	// the block is made of huge pages if the guest memory is backed by huge pages
+	regions = policy.Prefetch(PageFault{Offset: 5 * hugePageSize, PageSize: hugePageSize, GuestMemSize: 16 * hugePageSize})
+	require.Equal(t, []PrefetchRegion{{Offset: 4 * hugePageSize, Pages: 4}}, regions)
+}
+
+func TestStridePrefetchPolicy(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	size := 64 * pageSize
+	policy := NewStridePrefetchPolicy(2)
+
+	require.Empty(t, policy.Prefetch(PageFault{Offset: 0, First: true, GuestMemSize: size}))
+	require.Empty(t, policy.Prefetch(PageFault{Offset: 3 * pageSize, GuestMemSize: size}))
+
+	// the third fault at the same stride triggers the prefetch
+	regions := policy.Prefetch(PageFault{Offset: 6 * pageSize, GuestMemSize: size})
+	require.Equal(t, []PrefetchRegion{{Offset: 9 * pageSize, Pages: 1}, {Offset: 12 * pageSize, Pages: 1}}, regions)
+
+	// a different stride resets the detection
+	require.Empty(t, policy.Prefetch(PageFault{Offset: 7 * pageSize, GuestMemSize: size}))
+
+	// descending strides are detected and stop at the start of the guest memory
+	policy.Reset()
+	policy.Prefetch(PageFault{Offset: 4 * pageSize, First: true, GuestMemSize: size})
+	policy.Prefetch(PageFault{Offset: 2 * pageSize, GuestMemSize: size})
+	regions = policy.Prefetch(PageFault{Offset: 0, GuestMemSize: size})
+	require.Empty(t, regions)
+
+	policy.Reset()
+	policy.Prefetch(PageFault{Offset: 10 * pageSize, First: true, GuestMemSize: size})
+	policy.Prefetch(PageFault{Offset: 8 * pageSize, GuestMemSize: size})
+	regions = policy.Prefetch(PageFault{Offset: 6 * pageSize, GuestMemSize: size})
+	require.Equal(t, []PrefetchRegion{{Offset: 4 * pageSize, Pages: 1}, {Offset: 2 * pageSize, Pages: 1}}, regions)
+}
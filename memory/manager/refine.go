@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WorkingSetRefinement Policy merging the pages that the instances replaying a record frequently
+// miss into the recorded working set, so that they are prefetched by the next instances
+type WorkingSetRefinement struct {
+	Interval  int // number of replaying invocations of a snapshot between refinements (0 disables the refinement)
+	MinMisses int // number of invocations in which a page must be missed to be merged into the working set
+}
+
+// Enabled Returns whether the working set is refined
+func (r WorkingSetRefinement) Enabled() bool {
+	return r.Interval > 0
+}
+
+// Validate Returns an error if the refinement policy is enabled with invalid parameters
+func (r WorkingSetRefinement) Validate() error {
+	if !r.Enabled() {
+		return nil
+	}
+
+	if r.MinMisses <= 0 || r.MinMisses > r.Interval {
+		return errors.New(fmt.Sprintf("the number of misses of a page merged into the working set must be between 1 and %d", r.Interval))
+	}
+
+	return nil
+}
+
+// snapshotRecord Coordinates the instances of a snapshot that share the trace and the
+// working set files in the base directory of the snapshot
+type snapshotRecord struct {
+	sync.RWMutex
+	generation  int            // incremented each time the record files are rewritten
+	invocations int            // replaying invocations since the last refinement
+	misses      map[uint64]int // number of invocations that missed each page since the last refinement
+}
+
+func newSnapshotRecord() *snapshotRecord {
+	return &snapshotRecord{misses: make(map[uint64]int)}
+}
+
+// reloadRecord Loads the record files again if they have been rewritten by another
+// instance of the snapshot. Must be called with the record locked
+func (s *SnapshotState) reloadRecord() {
+	if s.recordGeneration == s.record.generation {
+		return
+	}
+
+	s.recordGeneration = s.record.generation
+	s.isRecordReady = s.loadRecord()
+	if !s.isRecordReady {
+		s.trace = initTrace(s.getTraceFile())
+	}
+}
+
+// refineRecord Counts the pages missed by the instance since its activation and, every Refinement.Interval
+// invocations of the snapshot, merges the pages missed by at least Refinement.MinMisses invocations into
+// the trace and regenerates the working set file. Must be called with the record locked
+func (s *SnapshotState) refineRecord() error {
+	r := s.record
+
+	r.invocations++
+	for offset := range s.missedPages {
+		r.misses[offset]++
+	}
+
+	if r.invocations < s.Refinement.Interval {
+		return nil
+	}
+
+	misses := r.misses
+	r.invocations = 0
+	r.misses = make(map[uint64]int)
+
+	// the pages missed by this instance may have been merged by another instance
+	s.reloadRecord()
+	if !s.isRecordReady {
+		return nil
+	}
+
+	records := make([]Record, 0)
+	for offset, n := range misses {
+		if n >= s.Refinement.MinMisses {
+			records = append(records, Record{offset: offset, timestamp: s.missedPages[offset]})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].offset < records[j].offset })
+
+	merged := s.trace.mergeRecords(records)
+	if merged == 0 {
+		return nil
+	}
+
+	// the instances that loaded the previous record load it again before fetching the working set
+	r.generation++
+	s.recordGeneration = r.generation
+
+	err := s.trace.writeWorkingSetPagesToFile(s.GuestMemPath, s.WorkingSetPath)
+	if err == nil {
+		err = s.trace.WriteTrace()
+	}
+	if err != nil {
+		// the files may not match anymore, in which case the record is discarded
+		s.isRecordReady = s.loadRecord()
+		if !s.isRecordReady {
+			s.trace = initTrace(s.getTraceFile())
+		}
+		return err
+	}
+
+	log.Infof("Merged %d pages missed by %d invocations into the working set of %s (%d pages)",
+		merged, s.Refinement.Interval, s.BaseDir, len(s.trace.containedOffsets))
+
+	s.publishRecord()
+
+	return nil
+}
+
+// publishRecord Calls the OnRecordWritten hook once the record files have been written
+func (s *SnapshotState) publishRecord() {
+	if s.OnRecordWritten == nil {
+		return
+	}
+
+	if err := s.OnRecordWritten(); err != nil {
+		log.Warnf("Failed to publish the record of %s: %v", s.BaseDir, err)
+	}
+}
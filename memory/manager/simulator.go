@@ -0,0 +1,202 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DiskModel Estimates the time taken to read the snapshot files from the disk
+type DiskModel struct {
+	RequestLatency time.Duration // latency of a read request, regardless of its size
+	Bandwidth      float64       // sequential read bandwidth, in bytes per second
+	FaultLatency   time.Duration // latency of serving a user-level page fault, excluding reads
+}
+
+// readLatency Returns the time taken to read size bytes in a single request
+func (d DiskModel) readLatency(size uint64) time.Duration {
+	if size == 0 {
+		return 0
+	}
+
+	latency := d.RequestLatency
+	if d.Bandwidth > 0 {
+		latency += time.Duration(float64(size) / d.Bandwidth * float64(time.Second))
+	}
+
+	return latency
+}
+
+// SimulationResult The outcome of replaying the page faults of an invocation with a prefetch policy
+type SimulationResult struct {
+	Policy           string
+	Faults           int           // number of page faults served
+	Unique           int           // number of pages accessed by the invocation missing from the record
+	Reused           int           // number of pages accessed by the invocation found in the record
+	Prefetched       int           // number of pages installed ahead of page faults
+	OverFetchedBytes uint64        // bytes fetched from the disk but never accessed by the invocation
+	Latency          time.Duration // estimated time spent serving page faults and fetching the working set
+}
+
+// SimulateReplay Replays the page faults of an invocation of a snapshot, in the order in which they
+// were recorded, as if they were served with the given policy and the working set of the record
+func SimulateReplay(record, invocation *Trace, policy PrefetchPolicy, disk DiskModel) (SimulationResult, error) {
+	res := SimulationResult{Policy: policy.Name()}
+
+	pageSize := uint64(record.pageSize)
+	if invocation.pageSize != record.pageSize {
+		return res, errors.New(fmt.Sprintf("trace %s has page size %d instead of %d", invocation.traceFileName, invocation.pageSize, pageSize))
+	}
+
+	if len(record.regions) == 0 {
+		record.buildRegions()
+	}
+
+	guestMemSize := simulatedGuestMemSize(record, invocation)
+	workingSet := getWorkingSetRegions(record)
+
+	var (
+		pages     = guestMemSize / pageSize
+		installed = make([]bool, pages)
+		fetched   = make([]bool, pages) // pages read from the disk
+		accessed  = make([]bool, pages)
+		inBuffer  = make([]bool, pages) // pages of the working set fetched before the VM is loaded
+	)
+
+	if policy.UsesWorkingSet() {
+		for _, rec := range record.trace {
+			inBuffer[rec.offset/pageSize] = true
+			fetched[rec.offset/pageSize] = true
+		}
+		res.Latency += disk.readLatency(uint64(len(record.containedOffsets)) * pageSize)
+	}
+
+	// install Installs the missing pages of a region, the pages that are not in the
+	// working set buffer are read from the memory file, one request per contiguous run
+	install := func(first, count uint64) (int, time.Duration) {
+		var (
+			installedNum int
+			latency      time.Duration
+			run          uint64
+		)
+
+		for page := first; page < first+count && page < pages; page++ {
+			if installed[page] {
+				latency += disk.readLatency(run * pageSize)
+				run = 0
+				continue
+			}
+
+			installed[page] = true
+			installedNum++
+
+			if inBuffer[page] {
+				latency += disk.readLatency(run * pageSize)
+				run = 0
+				continue
+			}
+
+			fetched[page] = true
+			run++
+		}
+
+		return installedNum, latency + disk.readLatency(run*pageSize)
+	}
+
+	policy.Reset()
+	first := true
+
+	for _, rec := range invocation.trace {
+		page := rec.offset / pageSize
+		if page >= pages || accessed[page] {
+			continue
+		}
+
+		accessed[page] = true
+		if record.containsRecord(rec) {
+			res.Reused++
+		} else {
+			res.Unique++
+		}
+
+		if installed[page] {
+			continue
+		}
+
+		res.Faults++
+		res.Latency += disk.FaultLatency
+
+		regions := policy.Prefetch(PageFault{
+			Offset:       rec.offset,
+			First:        first,
+			PageSize:     pageSize,
+			GuestMemSize: guestMemSize,
+			WorkingSet:   workingSet,
+		})
+		first = false
+
+		for _, region := range regions {
+			n, latency := install(region.Offset/pageSize, uint64(region.Pages))
+			res.Prefetched += n
+			res.Latency += latency
+		}
+
+		if installed[page] {
+			// the faulting page is not prefetched ahead of its own page fault
+			res.Prefetched--
+			continue
+		}
+
+		_, latency := install(page, 1)
+		res.Latency += latency
+	}
+
+	for page := range fetched {
+		if fetched[page] && !accessed[page] {
+			res.OverFetchedBytes += pageSize
+		}
+	}
+
+	return res, nil
+}
+
+// simulatedGuestMemSize Returns the size of the guest memory of the traces, traces that
+// do not record it (e.g., in the CSV format) are assumed to end at their last page
+func simulatedGuestMemSize(traces ...*Trace) uint64 {
+	var size uint64
+	for _, t := range traces {
+		if t.guestMemSize > size {
+			size = t.guestMemSize
+		}
+
+		for _, rec := range t.trace {
+			if end := rec.offset + uint64(t.pageSize); end > size {
+				size = end
+			}
+		}
+	}
+
+	return size
+}
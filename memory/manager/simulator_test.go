@@ -0,0 +1,75 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateReplay(t *testing.T) {
+	var (
+		pageSize = uint64(os.Getpagesize())
+		// reading a page takes 1us on top of the latency of the request
+		disk = DiskModel{
+			RequestLatency: 100 * time.Microsecond,
+			Bandwidth:      float64(pageSize) * 1e6,
+			FaultLatency:   5 * time.Microsecond,
+		}
+		record     = newTestTrace(t, true, 0, 1, 2, 3)
+		invocation = newTestTrace(t, true, 0, 1, 2, 3, 8, 9)
+	)
+
+	record.guestMemSize = 16 * pageSize
+	invocation.guestMemSize = 16 * pageSize
+
+	for _, tc := range []struct {
+		policy   PrefetchPolicy
+		expected SimulationResult
+	}{
+		{
+			// the working set is fetched with a single request and installed upon the first page fault
+			policy: NewRecordPrefetchPolicy(),
+			expected: SimulationResult{Policy: RecordPrefetch, Faults: 3, Unique: 2, Reused: 4, Prefetched: 3,
+				Latency: (104 + 3*5 + 2*101) * time.Microsecond},
+		},
+		{
+			policy: NewNoPrefetchPolicy(),
+			expected: SimulationResult{Policy: NoPrefetch, Faults: 6, Unique: 2, Reused: 4,
+				Latency: 6 * (5 + 101) * time.Microsecond},
+		},
+		{
+			// the last two pages of the second block are never accessed
+			policy: NewReadaheadPrefetchPolicy(4),
+			expected: SimulationResult{Policy: ReadaheadPrefetch, Faults: 2, Unique: 2, Reused: 4, Prefetched: 6,
+				OverFetchedBytes: 2 * pageSize, Latency: 2 * (5 + 104) * time.Microsecond},
+		},
+	} {
+		res, err := SimulateReplay(record, invocation, tc.policy, disk)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, res, tc.policy.Name())
+	}
+}
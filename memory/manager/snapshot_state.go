@@ -28,19 +28,16 @@ package manager
 import "C"
 
 import (
-	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
-	"sort"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/ftrvxmtrx/fd"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 
@@ -55,10 +52,16 @@ type SnapshotStateCfg struct {
 
 	VMMStatePath, GuestMemPath, WorkingSetPath string
 
-	InstanceSockAddr string
-	BaseDir          string // base directory for the instance
-	MetricsPath      string // path to csv file where the metrics should be stored
-	IsLazyMode       bool
+	InstanceSockAddr string               // socket on which the VMM sends the uffd and the guest memory mappings
+	BaseDir          string               // base directory for the instance, where the trace of the working set is stored
+	MetricsPath      string               // path to csv file where the metrics should be stored
+	IsLazyMode       bool                 // serve page faults one at a time, if no prefetch policy is set
+	PrefetchPolicy   PrefetchPolicy       // policy deciding the pages installed upon page faults (record-and-prefetch by default)
+	Refinement       WorkingSetRefinement // merging of the pages missed by the next instances into the working set
+	StreamWorkingSet bool                 // install the working set while it is fetched, in chunks
+	WorkingSetOpener WorkingSetOpener     // source of the streamed working set (the working set file if nil)
+	OnRecordWritten  func() error         // called once the trace and the working set files are written
+	StreamChunkSize  int                  // size of the chunks of the streamed working set (2MiB if 0)
 	GuestMemSize     int
 	metricsModeOn    bool
 }
@@ -67,12 +70,16 @@ type SnapshotStateCfg struct {
 // of the VM.
 type SnapshotState struct {
 	SnapshotStateCfg
-	firstPageFaultOnce *sync.Once // to initialize the start virtual address and replay
-	startAddress       uint64
-	userFaultFD        *os.File
-	trace              *Trace
-	epfd               int
-	quitCh             chan int
+	firstPageFault bool      // whether no page fault has been served since the activation
+	activatedAt    time.Time // timestamps of the recorded page faults are relative to the activation
+	userFaultFD    *os.File
+	listener       *net.UnixListener
+	regions        []*guestRegion // regions of the guest memory, as sent by the VMM
+	pageSize       uint64         // size of the pages backing the guest memory
+	trace          *Trace
+	epfd           int
+	quitFd         int      // eventfd to stop polling page faults
+	quitCh         chan int // closed once polling has stopped
 
 	// to indicate whether the instance has even been activated. this is to
 	// get around cases where offload is called for the first time
@@ -81,18 +88,33 @@ type SnapshotState struct {
 	isActive bool
 
 	isRecordReady bool
+	// record shared with the other instances of the snapshot, and the generation of the record files loaded
+	record           *snapshotRecord
+	recordGeneration int
+	// pages missing from the record served since the activation, with the time of their page fault
+	missedPages map[uint64]time.Duration
 
-	guestMem   []byte
 	workingSet []byte
+	// offsets of the pages of the working set in the working set buffer, indexed by their offset in the guest memory file
+	workingSetPages   map[uint64]uint64
+	workingSetRegions []PrefetchRegion
+	// bytes of the working set buffer that have been fetched, as seen by the page fault handler
+	workingSetAvailable int64
+	stream              *workingSetStream
 
-	// Stats
-	totalPFServed  []float64
-	uniquePFServed []float64
-	reusedPFServed []float64
-	latencyMetrics []*metrics.Metric
+	// counters maintained regardless of the metrics mode
+	stats *upfStats
 
-	replayedNum   int // only valid for lazy serving
-	uniqueNum     int
+	// Stats
+	totalPFServed      []float64
+	uniquePFServed     []float64
+	reusedPFServed     []float64
+	prefetchedPFServed []float64
+	latencyMetrics     []*metrics.Metric
+
+	faultsNum     int // number of page faults served
+	uniqueNum     int // number of page faults on pages missing from the record
+	prefetchedNum int // number of pages installed ahead of page faults
 	currentMetric *metrics.Metric
 }
 
@@ -100,13 +122,25 @@ type SnapshotState struct {
 func NewSnapshotState(cfg SnapshotStateCfg) *SnapshotState {
 	s := new(SnapshotState)
 	s.SnapshotStateCfg = cfg
+	s.stats = newUPFStats()
+
+	if s.PrefetchPolicy == nil {
+		if s.IsLazyMode {
+			s.PrefetchPolicy = NewNoPrefetchPolicy()
+		} else {
+			s.PrefetchPolicy = NewRecordPrefetchPolicy()
+		}
+	}
 
 	s.trace = initTrace(s.getTraceFile())
+	s.isRecordReady = s.loadRecord()
 	if s.metricsModeOn {
 		s.totalPFServed = make([]float64, 0)
 		s.uniquePFServed = make([]float64, 0)
 		s.reusedPFServed = make([]float64, 0)
+		s.prefetchedPFServed = make([]float64, 0)
 		s.latencyMetrics = make([]*metrics.Metric, 0)
+		s.currentMetric = metrics.NewMetric()
 	}
 
 	return s
@@ -115,91 +149,148 @@ func NewSnapshotState(cfg SnapshotStateCfg) *SnapshotState {
 func (s *SnapshotState) setupStateOnActivate() {
 	s.isActive = true
 	s.isEverActivated = true
-	s.firstPageFaultOnce = new(sync.Once)
+	s.firstPageFault = true
+	s.activatedAt = time.Now()
+	s.stats.activations.Add(1)
 	s.quitCh = make(chan int)
+	s.missedPages = make(map[uint64]time.Duration)
+	for _, r := range s.regions {
+		r.installed = make([]bool, r.Size/s.pageSize)
+	}
+
+	if s.isRecordReady && !s.trace.matchesLayout(s.pageSize, s.memLayout()) {
+		log.Warnf("Discarding the record of %s: taken with a different guest memory layout", s.VMID)
+		s.discardRecord()
+	}
+
+	if s.isRecordReady {
+		s.workingSetRegions = getWorkingSetRegions(s.trace)
+		s.PrefetchPolicy.Reset()
+	} else {
+		s.trace.pageSize = uint32(s.pageSize)
+		s.trace.guestMemSize = s.guestMemSize()
+		s.trace.memRegions = s.memLayout()
+		s.trace.hasTimestamps = true
+	}
 
 	if s.metricsModeOn {
+		s.faultsNum = 0
 		s.uniqueNum = 0
-		s.replayedNum = 0
-		s.currentMetric = metrics.NewMetric()
+		s.prefetchedNum = 0
 	}
 }
 
-func (s *SnapshotState) getUFFD() error {
-	var d net.Dialer
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
+// loadRecord Loads the trace of the working set recorded by a previous instance
+// of the snapshot, returns whether the working set can be replayed
+func (s *SnapshotState) loadRecord() bool {
+	// a working set streamed from a remote source is checked against the trace when it is fetched
+	remote := s.StreamWorkingSet && s.WorkingSetOpener != nil
 
-	for {
-		c, err := d.DialContext(ctx, "unix", s.InstanceSockAddr)
-		if err != nil {
-			if ctx.Err() != nil {
-				log.Error("Failed to dial within the context timeout")
-				return err
-			}
-			time.Sleep(1 * time.Millisecond)
-			continue
-		}
+	if _, err := os.Stat(s.getTraceFile()); err != nil {
+		return false
+	}
+	if _, err := os.Stat(s.WorkingSetPath); err != nil && !remote {
+		return false
+	}
 
-		defer c.Close()
+	trace, err := ReadTrace(s.getTraceFile())
+	if err != nil {
+		log.Warnf("Discarding the record of %s: %v", s.VMID, err)
+		return false
+	}
 
-		sendfdConn := c.(*net.UnixConn)
+	// the record is only valid for the guest memory layout it was taken with, the page size
+	// and the regions of the guest memory are checked once they are sent by the VMM
+	if s.GuestMemSize != 0 && trace.guestMemSize != 0 && trace.guestMemSize != uint64(s.GuestMemSize) {
+		log.Warnf("Discarding the record of %s: taken with a different guest memory layout", s.VMID)
+		return false
+	}
 
-		fs, err := fd.Get(sendfdConn, 1, []string{"a file"})
-		if err != nil {
-			log.Error("Failed to receive the uffd")
-			return err
-		}
+	// the working set file may not match the trace if vHive crashed while the record was written
+	if info, err := os.Stat(s.WorkingSetPath); (err != nil && !remote) || (err == nil && info.Size() != int64(len(trace.containedOffsets))*int64(trace.pageSize)) {
+		log.Warnf("Discarding the record of %s: the working set file does not match the trace", s.VMID)
+		return false
+	}
 
-		s.userFaultFD = fs[0]
+	trace.buildRegions()
+	s.trace = trace
 
-		return nil
-	}
+	return true
 }
 
-func (s *SnapshotState) processMetrics() {
-	if s.metricsModeOn && s.isRecordReady {
-		s.uniquePFServed = append(s.uniquePFServed, float64(s.uniqueNum))
-
-		if s.IsLazyMode {
-			s.totalPFServed = append(s.totalPFServed, float64(s.replayedNum))
-			s.reusedPFServed = append(
-				s.reusedPFServed,
-				float64(s.replayedNum-s.uniqueNum),
-			)
-		}
+// discardRecord Drops the loaded record and the working set, the instance records the working set again
+func (s *SnapshotState) discardRecord() {
+	s.stopStreaming()
+	s.isRecordReady = false
+	s.trace = initTrace(s.getTraceFile())
+	s.workingSet = nil
+	s.workingSetPages = nil
+	s.workingSetAvailable = 0
+}
 
-		s.latencyMetrics = append(s.latencyMetrics, s.currentMetric)
+// listenUFFD Creates the socket on which the VMM sends the uffd when the VM is loaded
+func (s *SnapshotState) listenUFFD() error {
+	l, err := listenUFFD(s.InstanceSockAddr)
+	if err != nil {
+		return err
 	}
+
+	s.listener = l
+
+	return nil
 }
 
-func (s *SnapshotState) getTraceFile() string {
-	return filepath.Join(s.BaseDir, "trace")
+// closeListener Closes the socket on which the VMM sends the uffd, if it is open
+func (s *SnapshotState) closeListener() {
+	if s.listener == nil {
+		return
+	}
+
+	if err := s.listener.Close(); err != nil {
+		log.Warnf("Failed to close uffd socket: %v", err)
+	}
+	s.listener = nil
 }
 
-func (s *SnapshotState) mapGuestMemory() error {
-	fd, err := os.OpenFile(s.GuestMemPath, os.O_RDONLY, 0444)
-	if err != nil {
-		log.Errorf("Failed to open guest memory file: %v", err)
-		return err
+// getUFFD Receives the uffd and the guest memory mappings from the VMM
+func (s *SnapshotState) getUFFD() error {
+	if s.listener == nil {
+		if err := s.listenUFFD(); err != nil {
+			return err
+		}
 	}
+	defer s.closeListener()
 
-	s.guestMem, err = unix.Mmap(int(fd.Fd()), 0, s.GuestMemSize, unix.PROT_READ, unix.MAP_PRIVATE)
+	uffd, regions, err := acceptUFFD(s.listener, uffdHandshakeTimeout)
 	if err != nil {
-		log.Errorf("Failed to mmap guest memory file: %v", err)
+		log.Error("Failed to receive the uffd")
 		return err
 	}
 
+	s.userFaultFD = uffd
+	s.setRegions(regions)
+
 	return nil
 }
 
-func (s *SnapshotState) unmapGuestMemory() error {
-	if err := unix.Munmap(s.guestMem); err != nil {
-		log.Errorf("Failed to munmap guest memory file: %v", err)
-		return err
+func (s *SnapshotState) processMetrics() {
+	if s.metricsModeOn && s.isRecordReady {
+		s.totalPFServed = append(s.totalPFServed, float64(s.faultsNum))
+		s.uniquePFServed = append(s.uniquePFServed, float64(s.uniqueNum))
+		s.reusedPFServed = append(s.reusedPFServed, float64(s.faultsNum-s.uniqueNum))
+		s.prefetchedPFServed = append(s.prefetchedPFServed, float64(s.prefetchedNum))
+
+		s.latencyMetrics = append(s.latencyMetrics, s.currentMetric)
 	}
 
-	return nil
+	if s.metricsModeOn {
+		// the state of the next activation may be fetched before it is activated
+		s.currentMetric = metrics.NewMetric()
+	}
+}
+
+func (s *SnapshotState) getTraceFile() string {
+	return filepath.Join(s.BaseDir, TraceFileName)
 }
 
 // alignment returns alignment of the block in memory
@@ -245,31 +336,59 @@ func (s *SnapshotState) fetchState() error {
 		return err
 	}
 
-	size := len(s.trace.trace) * os.Getpagesize()
+	size := len(s.trace.containedOffsets) * int(s.trace.pageSize)
+
+	s.workingSet = AlignedBlock(size) // direct io requires aligned buffer
+	s.workingSetAvailable = 0
+	s.buildWorkingSetPages()
+
+	if s.StreamWorkingSet {
+		// the working set is installed while it is fetched
+		return s.startStreaming(size)
+	}
 
 	// O_DIRECT allows to fully leverage disk bandwidth by bypassing the OS page cache
 	f, err := os.OpenFile(s.WorkingSetPath, os.O_RDONLY|syscall.O_DIRECT, 0600)
+	if errors.Is(err, syscall.EINVAL) {
+		// the file system does not support direct-io (e.g., tmpfs)
+		f, err = os.Open(s.WorkingSetPath)
+	}
 	if err != nil {
 		log.Errorf("Failed to open the working set file for direct-io: %v\n", err)
 		return err
 	}
+	defer f.Close()
 
-	s.workingSet = AlignedBlock(size) // direct io requires aligned buffer
-
-	if n, err := f.Read(s.workingSet); n != size || err != nil {
+	if _, err := io.ReadFull(f, s.workingSet); err != nil {
 		log.Errorf("Reading working set file failed: %v\n", err)
 		return err
 	}
 
+	s.workingSetAvailable = int64(size)
+	s.stats.fetchedBytes.Add(uint64(size))
+
 	log.Debug("Fetched the entire working set")
-	if err := f.Close(); err != nil {
-		log.Errorf("Failed to close the working set file: %v\n", err)
-		return err
-	}
 
 	return nil
 }
 
+// buildWorkingSetPages Maps the pages of the working set to their offsets in the working set
+// buffer, where the regions of the working set are stored contiguously in the ascending order
+func (s *SnapshotState) buildWorkingSetPages() {
+	s.workingSetPages = make(map[uint64]uint64, len(s.trace.containedOffsets))
+
+	var (
+		pageSize  = uint64(s.trace.pageSize)
+		bufOffset uint64
+	)
+	for _, region := range getWorkingSetRegions(s.trace) {
+		for i := 0; i < region.Pages; i++ {
+			s.workingSetPages[region.Offset+uint64(i)*pageSize] = bufOffset
+			bufOffset += pageSize
+		}
+	}
+}
+
 func (s *SnapshotState) pollUserPageFaults(readyCh chan int) {
 	logger := log.WithFields(log.Fields{"vmID": s.VMID})
 
@@ -281,60 +400,78 @@ func (s *SnapshotState) pollUserPageFaults(readyCh chan int) {
 
 	logger.Debug("Starting polling loop")
 
-	defer syscall.Close(s.epfd)
+	defer func() {
+		syscall.Close(s.epfd)
+		syscall.Close(s.quitFd)
+		close(s.quitCh)
+	}()
 
 	readyCh <- 0
 
 	for {
-		select {
-		case <-s.quitCh:
-			logger.Debug("Handler received a signal to quit")
-			return
-		default:
-			nevents, err := syscall.EpollWait(s.epfd, events[:], -1)
-			if err != nil {
-				logger.Fatalf("epoll_wait: %v", err)
-				break
-			}
-
-			if nevents < 1 {
-				panic("Wrong number of events")
+		nevents, err := syscall.EpollWait(s.epfd, events[:], -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
 			}
+			logger.Fatalf("epoll_wait: %v", err)
+		}
 
-			for i := 0; i < nevents; i++ {
-				event := events[i]
+		for i := 0; i < nevents; i++ {
+			event := events[i]
 
-				fd := int(event.Fd)
+			fd := int(event.Fd)
 
-				stateFd := int(s.userFaultFD.Fd())
+			if fd == s.quitFd {
+				logger.Debug("Handler received a signal to quit")
+				return
+			}
 
-				if fd != stateFd && stateFd != -1 {
-					logger.Fatalf("Received event from unknown fd")
+			if s.stream != nil && fd == s.stream.eventFd {
+				if err := s.serveStreamedChunks(); err != nil {
+					logger.Fatalf("Failed to install the streamed working set: %v", err)
 				}
+				continue
+			}
 
-				goMsg := make([]byte, sizeOfUFFDMsg())
+			if fd != int(s.userFaultFD.Fd()) {
+				logger.Fatalf("Received event from unknown fd")
+			}
 
-				if nread, err := syscall.Read(fd, goMsg); err != nil || nread != len(goMsg) {
-					if !errors.Is(err, syscall.EBADF) {
-						log.Fatalf("Read uffd_msg failed: %v", err)
-					}
-					break
-				}
+			goMsg := make([]byte, sizeOfUFFDMsg())
 
-				if event := uint8(goMsg[0]); event != uffdPageFault() {
-					log.Fatal("Received wrong event type")
+			if nread, err := syscall.Read(fd, goMsg); err != nil || nread != len(goMsg) {
+				if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.EBADF) {
+					logger.Fatalf("Read uffd_msg failed: %v", err)
 				}
+				break
+			}
 
-				address := binary.LittleEndian.Uint64(goMsg[16:])
+			if event := uint8(goMsg[0]); event != uffdPageFault() {
+				logger.Fatal("Received wrong event type")
+			}
 
-				if err := s.servePageFault(fd, address); err != nil {
-					log.Fatalf("Failed to serve page fault")
-				}
+			address := binary.LittleEndian.Uint64(goMsg[16:])
+
+			if err := s.servePageFault(fd, address); err != nil {
+				logger.Fatalf("Failed to serve page fault: %v", err)
 			}
 		}
 	}
 }
 
+// stopPolling Signals the page fault handler to quit and waits for it to stop
+func (s *SnapshotState) stopPolling() {
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+
+	if _, err := unix.Write(s.quitFd, one[:]); err != nil {
+		log.Fatalf("Failed to signal the page fault handler: %v", err)
+	}
+
+	<-s.quitCh
+}
+
 func (s *SnapshotState) registerEpoller() error {
 	logger := log.WithFields(log.Fields{"vmID": s.VMID})
 
@@ -349,7 +486,7 @@ func (s *SnapshotState) registerEpoller() error {
 	event.Events = syscall.EPOLLIN
 	event.Fd = int32(fdInt)
 
-	s.epfd, err = syscall.EpollCreate1(0)
+	s.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
 	if err != nil {
 		logger.Errorf("Failed to create epoller %v", err)
 		return err
@@ -365,69 +502,133 @@ func (s *SnapshotState) registerEpoller() error {
 		return err
 	}
 
+	s.quitFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		logger.Errorf("Failed to create eventfd %v", err)
+		return err
+	}
+
+	quitEvent := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(s.quitFd)}
+	if err := syscall.EpollCtl(s.epfd, syscall.EPOLL_CTL_ADD, s.quitFd, &quitEvent); err != nil {
+		logger.Errorf("Failed to subscribe eventfd %v", err)
+		return err
+	}
+
+	if s.stream != nil {
+		streamEvent := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(s.stream.eventFd)}
+		if err := syscall.EpollCtl(s.epfd, syscall.EPOLL_CTL_ADD, s.stream.eventFd, &streamEvent); err != nil {
+			logger.Errorf("Failed to subscribe the working set stream %v", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (s *SnapshotState) servePageFault(fd int, address uint64) error {
-	var (
-		tStart              time.Time
-		workingSetInstalled bool
-	)
-
-	s.firstPageFaultOnce.Do(
-		func() {
-			s.startAddress = address
+	var tStart time.Time
 
-			if s.isRecordReady && !s.IsLazyMode {
-				if s.metricsModeOn {
-					tStart = time.Now()
-				}
-				s.installWorkingSetPages(fd)
-				if s.metricsModeOn {
-					s.currentMetric.MetricMap[installWSMetric] = metrics.ToUS(time.Since(tStart))
-				}
+	tFault := time.Now()
+	defer func() {
+		s.stats.observeFault(time.Since(tFault))
+	}()
 
-				workingSetInstalled = true
-			}
-		})
-
-	if workingSetInstalled {
-		return nil
+	r := s.regionAt(address)
+	if r == nil {
+		return errors.New(fmt.Sprintf("page fault at 0x%x outside of the guest memory", address))
 	}
 
-	offset := address - s.startAddress
-
-	src := uint64(uintptr(unsafe.Pointer(&s.guestMem[offset])))
-	dst := uint64(int64(address) & ^(int64(os.Getpagesize()) - 1))
-	mode := uint64(0)
+	inRegion := (address - r.BaseHostVirtAddr) & ^(s.pageSize - 1)
+	dst := r.BaseHostVirtAddr + inRegion
+	page := inRegion / s.pageSize
 
 	rec := Record{
-		offset: offset,
+		offset:    r.Offset + inRegion, // pages are identified by their offset in the guest memory file
+		timestamp: time.Since(s.activatedAt),
 	}
 
+	first := s.firstPageFault
+	s.firstPageFault = false
+
 	if !s.isRecordReady {
+		// the first instance serves page faults one at a time to record all the pages it touches
 		s.trace.AppendRecord(rec)
 	} else {
-		log.Debug("Serving a page that is missing from the working set")
-	}
+		missing := !s.trace.containsRecord(rec)
+		if missing {
+			s.stats.uniqueFaults.Add(1)
+			if s.Refinement.Enabled() {
+				s.missedPages[rec.offset] = rec.timestamp
+			}
+		}
 
-	if s.metricsModeOn {
-		if s.isRecordReady {
-			if s.IsLazyMode {
-				if !s.trace.containsRecord(rec) {
-					s.uniqueNum++
-				}
-				s.replayedNum++
-			} else {
+		if s.metricsModeOn {
+			s.faultsNum++
+			if missing {
 				s.uniqueNum++
 			}
+			tStart = time.Now()
+		}
+
+		if s.stream != nil {
+			s.workingSetAvailable = s.stream.fetched.Load()
+		}
+
+		regions := s.PrefetchPolicy.Prefetch(PageFault{
+			Offset:       rec.offset,
+			First:        first,
+			PageSize:     s.pageSize,
+			GuestMemSize: s.guestMemSize(),
+			WorkingSet:   s.workingSetRegions,
+		})
+
+		faultInstalled := r.installed[page]
+
+		prefetched, err := s.installPages(fd, regions)
+		if err != nil {
+			return err
+		}
+
+		if first && s.stream != nil {
+			// the chunks of the working set are installed as they arrive from now on
+			n, err := s.installStreamed(fd)
+			if err != nil {
+				return err
+			}
+			prefetched += n
+		}
 
+		if !faultInstalled && r.installed[page] {
+			// the faulting page is not installed ahead of its page fault
+			prefetched--
 		}
+		s.stats.prefetchedPages.Add(uint64(prefetched))
 
+		if s.metricsModeOn {
+			s.prefetchedNum += prefetched
+			s.currentMetric.MetricMap[installWSMetric] += metrics.ToUS(time.Since(tStart))
+		}
+	}
+
+	if r.installed[page] {
+		wake(fd, dst, s.pageSize)
+		return nil
+	}
+
+	if s.metricsModeOn {
 		tStart = time.Now()
 	}
 
-	err := installRegion(fd, src, dst, mode, 1)
+	src := uint64(uintptr(unsafe.Pointer(&r.mem[inRegion])))
+	mode := uint64(0)
+
+	err := installRegion(fd, src, dst, mode, s.pageSize)
+	if errors.Is(err, syscall.EEXIST) {
+		// the page has been installed while the fault was queued
+		wake(fd, dst, s.pageSize)
+		err = nil
+	}
+	r.installed[page] = true
 
 	if s.metricsModeOn {
 		s.currentMetric.MetricMap[serveUniqueMetric] += metrics.ToUS(time.Since(tStart))
@@ -436,35 +637,95 @@ func (s *SnapshotState) servePageFault(fd int, address uint64) error {
 	return err
 }
 
-func (s *SnapshotState) installWorkingSetPages(fd int) {
-	log.Debug("Installing the working set pages")
-
-	// build a list of sorted regions
-	keys := make([]uint64, 0)
-	for k := range s.trace.regions {
-		keys = append(keys, k)
-	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-
+// installPages Installs the pages of the regions that are not installed yet, without waking the faulting
+// threads until all of them are installed. The pages of the working set are copied from the fetched
+// working set, the other pages from the guest memory file. Returns the number of installed pages
+func (s *SnapshotState) installPages(fd int, regions []PrefetchRegion) (int, error) {
 	var (
-		srcOffset uint64
+		pageSize  = s.pageSize
+		installed int
+		woken     = make(map[*guestRegion]bool)
+		runRegion *guestRegion // guest memory region of the run of pages being built
+		runSrc    uintptr      // source of the run
+		runDst    uint64       // offset of the run in its guest memory region
+		runPages  uint64
+		runWS     bool // whether the run is copied from the working set
 	)
 
-	for _, offset := range keys {
-		regLength := s.trace.regions[offset]
-		regAddress := s.startAddress + offset
+	flush := func() error {
+		if runPages == 0 {
+			return nil
+		}
+
 		mode := uint64(C.const_UFFDIO_COPY_MODE_DONTWAKE)
-		src := uint64(uintptr(unsafe.Pointer(&s.workingSet[srcOffset])))
-		dst := regAddress
+		if err := installRegion(fd, uint64(runSrc), runRegion.BaseHostVirtAddr+runDst, mode, runPages*pageSize); err != nil {
+			return err
+		}
 
-		if err := installRegion(fd, src, dst, mode, uint64(regLength)); err != nil {
-			log.Fatalf("install_region: %v", err)
+		for i := uint64(0); i < runPages; i++ {
+			runRegion.installed[runDst/pageSize+i] = true
 		}
+		woken[runRegion] = true
+		installed += int(runPages)
+		if runWS {
+			s.stats.workingSetPages.Add(runPages)
+		}
+		runPages = 0
 
-		srcOffset += uint64(regLength) * 4096
+		return nil
 	}
 
-	wake(fd, s.startAddress, os.Getpagesize())
+	for _, region := range regions {
+		for i := 0; i < region.Pages; i++ {
+			offset := region.Offset + uint64(i)*pageSize
+
+			r := runRegion
+			if r == nil || !r.contains(offset) {
+				r = s.regionOf(offset)
+			}
+			if r == nil || r.installed[(offset-r.Offset)/pageSize] {
+				if err := flush(); err != nil {
+					return installed, err
+				}
+				continue
+			}
+
+			inRegion := offset - r.Offset
+			src := uintptr(unsafe.Pointer(&r.mem[inRegion]))
+			bufOffset, fromWS := s.workingSetPages[offset]
+			if fromWS {
+				if int64(bufOffset+pageSize) > s.workingSetAvailable {
+					// the page is installed when its chunk of the working set arrives
+					if err := flush(); err != nil {
+						return installed, err
+					}
+					continue
+				}
+				src = uintptr(unsafe.Pointer(&s.workingSet[bufOffset]))
+			}
+
+			// extend the run if the page is contiguous to it, both in its guest memory region and in its source
+			if runPages > 0 && (r != runRegion || fromWS != runWS || inRegion != runDst+runPages*pageSize || src != runSrc+uintptr(runPages*pageSize)) {
+				if err := flush(); err != nil {
+					return installed, err
+				}
+			}
+			if runPages == 0 {
+				runRegion, runSrc, runDst, runWS = r, src, inRegion, fromWS
+			}
+			runPages++
+		}
+	}
+
+	if err := flush(); err != nil {
+		return installed, err
+	}
+
+	for r := range woken {
+		wake(fd, r.BaseHostVirtAddr, r.Size)
+	}
+
+	return installed, nil
 }
 
 func installRegion(fd int, src, dst, mode, len uint64) error {
@@ -473,7 +734,7 @@ func installRegion(fd int, src, dst, mode, len uint64) error {
 		copy: 0,
 		src:  C.ulonglong(src),
 		dst:  C.ulonglong(dst),
-		len:  C.ulonglong(uint64(os.Getpagesize()) * len),
+		len:  C.ulonglong(len),
 	}
 
 	err := ioctl(uintptr(fd), int(C.const_UFFDIO_COPY), unsafe.Pointer(&cUC))
@@ -495,13 +756,13 @@ func ioctl(fd uintptr, request int, argp unsafe.Pointer) error {
 		uintptr(argp),
 	)
 	if errno != 0 {
-		return os.NewSyscallError("ioctl", fmt.Errorf("%d", int(errno)))
+		return os.NewSyscallError("ioctl", errno)
 	}
 
 	return nil
 }
 
-func wake(fd int, startAddress uint64, len int) {
+func wake(fd int, startAddress, len uint64) {
 	cUR := C.struct_uffdio_range{
 		start: C.ulonglong(startAddress),
 		len:   C.ulonglong(len),
@@ -514,8 +775,22 @@ func wake(fd int, startAddress uint64, len int) {
 }
 
 //nolint:deadcode,unused
-func registerForUpf(startAddress []byte, len uint64) int {
-	return int(C.register_for_upf(unsafe.Pointer(&startAddress[0]), C.ulong(len)))
+func registerForUpf(startAddress []byte, len uint64) (int, error) {
+	uffd, err := C.register_for_upf(unsafe.Pointer(&startAddress[0]), C.ulong(len))
+	if uffd < 0 {
+		return -1, err
+	}
+
+	return int(uffd), nil
+}
+
+//nolint:deadcode,unused
+func registerRange(uffd int, startAddress []byte, len uint64) error {
+	if ret, err := C.register_range(C.long(uffd), unsafe.Pointer(&startAddress[0]), C.ulong(len)); ret < 0 {
+		return err
+	}
+
+	return nil
 }
 
 func sizeOfUFFDMsg() int {
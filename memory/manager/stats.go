@@ -0,0 +1,177 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// FaultLatencyBuckets Upper bounds of the buckets of the page fault latency histograms
+var FaultLatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+}
+
+// LatencyHistogram A histogram of the latencies of the page faults
+type LatencyHistogram struct {
+	Bounds []time.Duration // upper bounds of the buckets, the last bucket has no upper bound
+	Counts []uint64        // number of page faults in each bucket, one more than the bounds
+	Count  uint64
+	Sum    time.Duration
+}
+
+// VMStats Counters of the user-level page faults served for a VM since it was registered,
+// they are maintained regardless of the metrics mode
+type VMStats struct {
+	VMID            string
+	Activations     uint64
+	Faults          uint64 // page faults served
+	UniqueFaults    uint64 // page faults on pages missing from the record, when the record is replayed
+	PrefetchedPages uint64 // pages installed ahead of their page faults
+	WorkingSetPages uint64 // pages installed from the fetched working set
+	FetchedBytes    uint64 // bytes of the working set fetched from the disk or the snapshot store
+	FaultLatency    LatencyHistogram
+}
+
+// upfStats Counters of a VM, updated by its page fault handler and read concurrently
+type upfStats struct {
+	activations     atomic.Uint64
+	uniqueFaults    atomic.Uint64
+	prefetchedPages atomic.Uint64
+	workingSetPages atomic.Uint64
+	fetchedBytes    atomic.Uint64
+
+	latencyCounts []atomic.Uint64 // one more than FaultLatencyBuckets
+	latencySum    atomic.Int64
+}
+
+func newUPFStats() *upfStats {
+	return &upfStats{latencyCounts: make([]atomic.Uint64, len(FaultLatencyBuckets)+1)}
+}
+
+// observeFault Counts a page fault served in the given time
+func (st *upfStats) observeFault(latency time.Duration) {
+	st.latencySum.Add(int64(latency))
+
+	bucket := sort.Search(len(FaultLatencyBuckets), func(i int) bool { return latency <= FaultLatencyBuckets[i] })
+	st.latencyCounts[bucket].Add(1)
+}
+
+// snapshot Returns the current values of the counters
+func (st *upfStats) snapshot(vmID string) VMStats {
+	stats := VMStats{
+		VMID:            vmID,
+		Activations:     st.activations.Load(),
+		UniqueFaults:    st.uniqueFaults.Load(),
+		PrefetchedPages: st.prefetchedPages.Load(),
+		WorkingSetPages: st.workingSetPages.Load(),
+		FetchedBytes:    st.fetchedBytes.Load(),
+		FaultLatency: LatencyHistogram{
+			Bounds: FaultLatencyBuckets,
+			Counts: make([]uint64, len(st.latencyCounts)),
+			Sum:    time.Duration(st.latencySum.Load()),
+		},
+	}
+
+	for i := range st.latencyCounts {
+		stats.FaultLatency.Counts[i] = st.latencyCounts[i].Load()
+		stats.FaultLatency.Count += stats.FaultLatency.Counts[i]
+	}
+	// every page fault served is counted in the histogram
+	stats.Faults = stats.FaultLatency.Count
+
+	return stats
+}
+
+// WriteUPFMetrics Writes the page fault counters of the VMs in the Prometheus text exposition format
+func WriteUPFMetrics(w io.Writer, stats []VMStats) error {
+	counters := []struct {
+		name, help string
+		value      func(VMStats) uint64
+	}{
+		{"vhive_upf_activations_total", "Number of activations of the VM.",
+			func(s VMStats) uint64 { return s.Activations }},
+		{"vhive_upf_faults_total", "Number of user-level page faults served.",
+			func(s VMStats) uint64 { return s.Faults }},
+		{"vhive_upf_unique_faults_total", "Number of page faults on pages missing from the recorded working set.",
+			func(s VMStats) uint64 { return s.UniqueFaults }},
+		{"vhive_upf_prefetched_pages_total", "Number of pages installed ahead of their page faults.",
+			func(s VMStats) uint64 { return s.PrefetchedPages }},
+		{"vhive_upf_working_set_pages_total", "Number of pages installed from the fetched working set.",
+			func(s VMStats) uint64 { return s.WorkingSetPages }},
+		{"vhive_upf_fetched_bytes_total", "Number of bytes of the working set fetched.",
+			func(s VMStats) uint64 { return s.FetchedBytes }},
+	}
+
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+			return err
+		}
+		for _, s := range stats {
+			if _, err := fmt.Fprintf(w, "%s{vm_id=%q} %d\n", c.name, s.VMID, c.value(s)); err != nil {
+				return err
+			}
+		}
+	}
+
+	const histogram = "vhive_upf_fault_latency_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Latency of the user-level page faults.\n# TYPE %s histogram\n", histogram, histogram); err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		h := s.FaultLatency
+
+		var cumulative uint64
+		for i, count := range h.Counts {
+			cumulative += count
+
+			le := "+Inf"
+			if i < len(h.Bounds) {
+				le = fmt.Sprint(h.Bounds[i].Seconds())
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket{vm_id=%q,le=%q} %d\n", histogram, s.VMID, le, cumulative); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s_sum{vm_id=%q} %g\n%s_count{vm_id=%q} %d\n",
+			histogram, s.VMID, h.Sum.Seconds(), histogram, s.VMID, h.Count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUPFStats(t *testing.T) {
+	st := newUPFStats()
+	st.activations.Add(1)
+	st.observeFault(5 * time.Microsecond)
+	st.observeFault(10 * time.Microsecond)
+	st.observeFault(time.Millisecond)
+	st.observeFault(time.Second)
+
+	stats := st.snapshot("vm")
+	require.Equal(t, uint64(4), stats.Faults)
+	require.Equal(t, uint64(4), stats.FaultLatency.Count)
+	require.Equal(t, time.Second+time.Millisecond+15*time.Microsecond, stats.FaultLatency.Sum)
+
+	// the bounds are inclusive, and the last bucket has no upper bound
+	require.Equal(t, []uint64{2, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}, stats.FaultLatency.Counts)
+}
+
+func TestWriteUPFMetrics(t *testing.T) {
+	st := newUPFStats()
+	st.activations.Add(2)
+	st.uniqueFaults.Add(1)
+	st.fetchedBytes.Add(8192)
+	st.observeFault(20 * time.Microsecond)
+	st.observeFault(2 * time.Millisecond)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteUPFMetrics(&buf, []VMStats{st.snapshot("vm-1")}))
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE vhive_upf_faults_total counter",
+		`vhive_upf_activations_total{vm_id="vm-1"} 2`,
+		`vhive_upf_faults_total{vm_id="vm-1"} 2`,
+		`vhive_upf_unique_faults_total{vm_id="vm-1"} 1`,
+		`vhive_upf_fetched_bytes_total{vm_id="vm-1"} 8192`,
+		"# TYPE vhive_upf_fault_latency_seconds histogram",
+		`vhive_upf_fault_latency_seconds_bucket{vm_id="vm-1",le="1e-05"} 0`,
+		`vhive_upf_fault_latency_seconds_bucket{vm_id="vm-1",le="2.5e-05"} 1`,
+		`vhive_upf_fault_latency_seconds_bucket{vm_id="vm-1",le="0.0025"} 2`,
+		`vhive_upf_fault_latency_seconds_bucket{vm_id="vm-1",le="+Inf"} 2`,
+		`vhive_upf_fault_latency_seconds_sum{vm_id="vm-1"} 0.00202`,
+		`vhive_upf_fault_latency_seconds_count{vm_id="vm-1"} 2`,
+	} {
+		require.True(t, strings.Contains(out, line+"\n"), "missing %q in:\n%s", line, out)
+	}
+}
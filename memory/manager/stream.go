@@ -0,0 +1,237 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// defaultStreamChunkSize Is the size of the chunks in which the working set is streamed by default
+const defaultStreamChunkSize = 2 * 1024 * 1024
+
+// WorkingSetOpener Opens the working set file of a snapshot for streaming, e.g., from a remote
+// snapshot store, and returns its size (or -1 if unknown). The stream must stop when ctx is done
+type WorkingSetOpener func(ctx context.Context) (io.ReadCloser, int64, error)
+
+// workingSetStream Fetches the working set into the working set buffer in the background
+type workingSetStream struct {
+	fetched   atomic.Int64 // bytes of the working set buffer that have been fetched
+	installed int64        // bytes of the working set buffer installed by the page fault handler
+	eventFd   int          // eventfd signalled each time a chunk arrives
+	stats     *upfStats
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// startStreaming Starts fetching the working set of the given size into the working
+// set buffer, the chunks are installed by the page fault handler as they arrive
+func (s *SnapshotState) startStreaming(size int) error {
+	s.stopStreaming()
+
+	eventFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		log.Errorf("Failed to create eventfd %v", err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stream = &workingSetStream{
+		eventFd: eventFd,
+		stats:   s.stats,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	opener := s.WorkingSetOpener
+	if opener == nil {
+		opener = s.openWorkingSetFile
+	}
+
+	chunkSize := s.StreamChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultStreamChunkSize
+	}
+
+	go s.stream.fetch(ctx, opener, s.workingSet[:size], chunkSize, s.VMID)
+
+	return nil
+}
+
+// openWorkingSetFile Opens the working set file on the local disk
+func (s *SnapshotState) openWorkingSetFile(_ context.Context) (io.ReadCloser, int64, error) {
+	f, err := os.Open(s.WorkingSetPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+// fetch Reads the working set into buf one chunk at a time. If the working set cannot be
+// fetched, the pages that have not arrived are served from the guest memory file
+func (ws *workingSetStream) fetch(ctx context.Context, opener WorkingSetOpener, buf []byte, chunkSize int, vmID string) {
+	defer close(ws.done)
+
+	logger := log.WithFields(log.Fields{"vmID": vmID})
+	tStart := time.Now()
+
+	if err := ws.readChunks(ctx, opener, buf, chunkSize); err != nil {
+		if ctx.Err() == nil {
+			logger.Warnf("Failed to stream the working set, the pages that have not arrived are served lazily: %v", err)
+		}
+		return
+	}
+
+	logger.Debugf("Streamed the working set (%d bytes) in %s", len(buf), time.Since(tStart))
+}
+
+func (ws *workingSetStream) readChunks(ctx context.Context, opener WorkingSetOpener, buf []byte, chunkSize int) error {
+	r, size, err := opener(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// a working set that does not match the trace would install wrong pages
+	if size != int64(len(buf)) {
+		return errors.New(fmt.Sprintf("the working set has %d bytes instead of %d", size, len(buf)))
+	}
+
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+
+	for offset := 0; offset < len(buf); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := offset + chunkSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		if _, err := io.ReadFull(r, buf[offset:end]); err != nil {
+			return err
+		}
+		ws.stats.fetchedBytes.Add(uint64(end - offset))
+		offset = end
+
+		ws.fetched.Store(int64(offset))
+		if _, err := unix.Write(ws.eventFd, one[:]); err != nil && !errors.Is(err, unix.EAGAIN) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stopStreaming Stops fetching the working set and waits for the fetch to return
+func (s *SnapshotState) stopStreaming() {
+	if s.stream == nil {
+		return
+	}
+
+	s.stream.cancel()
+	<-s.stream.done
+	unix.Close(s.stream.eventFd)
+	s.stream = nil
+}
+
+// serveStreamedChunks Installs the chunks of the working set that have arrived, once the VM has
+// touched its memory for the first time, i.e., when the working set would be installed otherwise
+func (s *SnapshotState) serveStreamedChunks() error {
+	var counter [8]byte
+	if _, err := unix.Read(s.stream.eventFd, counter[:]); err != nil && !errors.Is(err, unix.EAGAIN) {
+		return err
+	}
+
+	if s.firstPageFault {
+		return nil
+	}
+
+	prefetched, err := s.installStreamed(int(s.userFaultFD.Fd()))
+	s.stats.prefetchedPages.Add(uint64(prefetched))
+	if s.metricsModeOn {
+		s.prefetchedNum += prefetched
+	}
+
+	return err
+}
+
+// installStreamed Installs the pages of the working set that have arrived since the previous call,
+// returns the number of installed pages
+func (s *SnapshotState) installStreamed(fd int) (int, error) {
+	var (
+		pageSize  = s.pageSize
+		installed = s.stream.installed
+		available = s.stream.fetched.Load()
+		regions   = make([]PrefetchRegion, 0)
+		bufOffset int64
+	)
+
+	// a page split across chunks is installed once its last chunk arrives
+	available -= available % int64(pageSize)
+
+	// the regions of the working set are stored contiguously in the buffer
+	for _, region := range s.workingSetRegions {
+		regionEnd := bufOffset + int64(region.Pages)*int64(pageSize)
+
+		start, end := bufOffset, regionEnd
+		if start < installed {
+			start = installed
+		}
+		if end > available {
+			end = available
+		}
+
+		if start < end {
+			regions = append(regions, PrefetchRegion{
+				Offset: region.Offset + uint64(start-bufOffset),
+				Pages:  int(uint64(end-start) / pageSize),
+			})
+		}
+
+		bufOffset = regionEnd
+	}
+
+	s.workingSetAvailable = available
+	s.stream.installed = available
+
+	return s.installPages(fd, regions)
+}
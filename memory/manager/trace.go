@@ -23,18 +23,62 @@
 package manager
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Record A tuple with an address
+// TraceFileName Is the name of the trace file of the working set in the base directory of a snapshot
+const TraceFileName = "trace"
+
+const (
+	// traceMagic Identifies the files in the binary trace format
+	traceMagic = "VHTR"
+	// traceVersion Is the version of the binary trace format written by WriteTrace,
+	// version 2 adds the table of the guest memory regions
+	traceVersion = 2
+
+	// traceFlagTimestamps Is set if every record of the trace is followed by its timestamp
+	traceFlagTimestamps = 1 << 0
+)
+
+// traceHeader The fixed-size header of a binary trace file, it is followed by the table of
+// the guest memory regions and by the records, each encoded as the varint of the page delta
+// from the previous offset and, if traceFlagTimestamps is set, the varint of the delta from
+// the previous timestamp
+type traceHeader struct {
+	Magic        [4]byte
+	Version      uint16
+	Flags        uint16
+	PageSize     uint32
+	RegionCount  uint32 // reserved in version 1
+	GuestMemSize uint64
+	RecordCount  uint64
+}
+
+// traceRegion A region of the guest memory file the trace was recorded with
+type traceRegion struct {
+	Offset uint64
+	Size   uint64
+}
+
+// Record A tuple with the offset of a page in the guest memory file
+// and the time elapsed since the activation of the VM
 type Record struct {
-	offset uint64
+	offset    uint64
+	timestamp time.Duration
 }
 
 // Trace Contains records
@@ -42,6 +86,12 @@ type Trace struct {
 	sync.Mutex
 	traceFileName string
 
+	pageSize      uint32
+	guestMemSize  uint64
+	hasTimestamps bool
+	// regions of the guest memory file, unknown for the traces written by earlier versions of vHive
+	memRegions []traceRegion
+
 	containedOffsets map[uint64]int
 	trace            []Record
 	regions          map[uint64]int
@@ -51,6 +101,7 @@ func initTrace(traceFileName string) *Trace {
 	t := new(Trace)
 
 	t.traceFileName = traceFileName
+	t.pageSize = uint32(os.Getpagesize())
 	t.regions = make(map[uint64]int)
 	t.containedOffsets = make(map[uint64]int)
 	t.trace = make([]Record, 0)
@@ -67,63 +118,285 @@ func (t *Trace) AppendRecord(r Record) {
 	t.containedOffsets[r.offset] = 0
 }
 
-// WriteTrace Writes all the records to a file
-func (t *Trace) WriteTrace() {
+// WriteTrace Writes all the records to the trace file in the binary trace format,
+// the file is replaced atomically so that a crash never leaves a truncated trace behind
+func (t *Trace) WriteTrace() error {
 	t.Lock()
 	defer t.Unlock()
 
-	file, err := os.Create(t.traceFileName)
+	var buf bytes.Buffer
+	if err := t.encode(&buf); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.traceFileName), filepath.Base(t.traceFileName)+".*.tmp")
 	if err != nil {
-		log.Fatalf("Failed to open trace file for writing: %v", err)
+		log.Errorf("Failed to open trace file for writing: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		log.Errorf("Failed to write trace: %v", err)
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		log.Errorf("Failed to sync trace: %v", err)
+		return err
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), t.traceFileName)
+}
+
+// encode Writes the header and the delta-encoded records of the trace
+func (t *Trace) encode(w io.Writer) error {
+	hdr := traceHeader{
+		Version:      traceVersion,
+		PageSize:     t.pageSize,
+		RegionCount:  uint32(len(t.memRegions)),
+		GuestMemSize: t.guestMemSize,
+		RecordCount:  uint64(len(t.trace)),
+	}
+	copy(hdr.Magic[:], traceMagic)
+	if t.hasTimestamps {
+		hdr.Flags |= traceFlagTimestamps
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, t.memRegions); err != nil {
+		return err
+	}
+
+	var (
+		varint     [binary.MaxVarintLen64]byte
+		lastPage   int64
+		lastTstamp int64
+	)
 
 	for _, rec := range t.trace {
-		err := writer.Write([]string{
-			strconv.FormatUint(rec.offset, 16)})
-		if err != nil {
-			log.Fatalf("Failed to write trace: %v", err)
+		if rec.offset%uint64(t.pageSize) != 0 {
+			return errors.New(fmt.Sprintf("trace offset 0x%x is not page-aligned", rec.offset))
+		}
+
+		page := int64(rec.offset / uint64(t.pageSize))
+		n := binary.PutVarint(varint[:], page-lastPage)
+		if _, err := w.Write(varint[:n]); err != nil {
+			return err
+		}
+		lastPage = page
+
+		if t.hasTimestamps {
+			n := binary.PutVarint(varint[:], int64(rec.timestamp)-lastTstamp)
+			if _, err := w.Write(varint[:n]); err != nil {
+				return err
+			}
+			lastTstamp = int64(rec.timestamp)
 		}
 	}
+
+	return nil
 }
 
-// readTrace Reads all the records from a CSV file
-//
-//nolint:deadcode,unused
-func (t *Trace) readTrace() {
-	f, err := os.Open(t.traceFileName)
+// ReadTrace Reads a trace file written by WriteTrace, or a trace
+// in the CSV format used by earlier versions of vHive
+func ReadTrace(traceFileName string) (*Trace, error) {
+	f, err := os.Open(traceFileName)
 	if err != nil {
-		log.Fatalf("Failed to open trace file for reading: %v", err)
+		return nil, err
 	}
 	defer f.Close()
 
-	lines, err := csv.NewReader(f).ReadAll()
+	t := initTrace(traceFileName)
+	r := bufio.NewReader(f)
+
+	magic, err := r.Peek(len(traceMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if string(magic) != traceMagic {
+		err = t.decodeCSV(r)
+	} else {
+		err = t.decode(r)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read trace %s: %v", traceFileName, err))
+	}
+
+	return t, nil
+}
+
+// decode Reads the header and the delta-encoded records of a binary trace
+func (t *Trace) decode(r *bufio.Reader) error {
+	var hdr traceHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+
+	if hdr.Version == 0 || hdr.Version > traceVersion {
+		return errors.New(fmt.Sprintf("unsupported trace version %d", hdr.Version))
+	}
+
+	if hdr.PageSize == 0 || hdr.PageSize&(hdr.PageSize-1) != 0 {
+		return errors.New(fmt.Sprintf("invalid page size %d", hdr.PageSize))
+	}
+
+	// a page faults at most once per activation
+	if hdr.GuestMemSize != 0 && hdr.RecordCount > hdr.GuestMemSize/uint64(hdr.PageSize) {
+		return errors.New(fmt.Sprintf("%d records exceed the guest memory size", hdr.RecordCount))
+	}
+
+	t.pageSize = hdr.PageSize
+	t.guestMemSize = hdr.GuestMemSize
+	t.hasTimestamps = hdr.Flags&traceFlagTimestamps != 0
+
+	if hdr.Version >= 2 {
+		if err := t.decodeRegions(r, hdr.RegionCount); err != nil {
+			return err
+		}
+	}
+
+	var lastPage, lastTstamp int64
+	for i := uint64(0); i < hdr.RecordCount; i++ {
+		delta, err := binary.ReadVarint(r)
+		if err != nil {
+			return errors.New(fmt.Sprintf("truncated record %d: %v", i, err))
+		}
+
+		lastPage += delta
+		if lastPage < 0 {
+			return errors.New(fmt.Sprintf("negative offset in record %d", i))
+		}
+
+		rec := Record{offset: uint64(lastPage) * uint64(t.pageSize)}
+		if (t.guestMemSize != 0 && rec.offset >= t.guestMemSize) ||
+			(len(t.memRegions) > 0 && t.memRegionOf(rec.offset) == nil) {
+			return errors.New(fmt.Sprintf("offset 0x%x in record %d outside of the guest memory", rec.offset, i))
+		}
+
+		if t.hasTimestamps {
+			delta, err := binary.ReadVarint(r)
+			if err != nil {
+				return errors.New(fmt.Sprintf("truncated record %d: %v", i, err))
+			}
+
+			lastTstamp += delta
+			rec.timestamp = time.Duration(lastTstamp)
+		}
+
+		t.AppendRecord(rec)
+	}
+
+	if _, err := r.ReadByte(); err != io.EOF {
+		return errors.New("trailing data after the last record")
+	}
+
+	return nil
+}
+
+// decodeRegions Reads the table of the guest memory regions, which must be page-aligned,
+// sorted by offset and disjoint
+func (t *Trace) decodeRegions(r io.Reader, count uint32) error {
+	if t.guestMemSize == 0 || uint64(count) > t.guestMemSize/uint64(t.pageSize) {
+		return errors.New(fmt.Sprintf("invalid number of guest memory regions %d", count))
+	}
+
+	t.memRegions = make([]traceRegion, count)
+	if err := binary.Read(r, binary.LittleEndian, t.memRegions); err != nil {
+		return errors.New(fmt.Sprintf("truncated guest memory regions: %v", err))
+	}
+
+	var end uint64
+	for i, region := range t.memRegions {
+		if region.Size == 0 || region.Offset%uint64(t.pageSize) != 0 || region.Size%uint64(t.pageSize) != 0 ||
+			region.Offset < end || region.Offset+region.Size > t.guestMemSize {
+			return errors.New(fmt.Sprintf("invalid guest memory region %d", i))
+		}
+		end = region.Offset + region.Size
+	}
+
+	return nil
+}
+
+// memRegionOf Returns the guest memory region containing the offset, nil if there is none
+func (t *Trace) memRegionOf(offset uint64) *traceRegion {
+	for i := range t.memRegions {
+		if offset >= t.memRegions[i].Offset && offset < t.memRegions[i].Offset+t.memRegions[i].Size {
+			return &t.memRegions[i]
+		}
+	}
+
+	return nil
+}
+
+// matchesLayout Returns whether the trace was recorded with the given page size and regions of the
+// guest memory file. The traces that do not record the regions must fit into the regions
+func (t *Trace) matchesLayout(pageSize uint64, regions []traceRegion) bool {
+	if uint64(t.pageSize) != pageSize {
+		return false
+	}
+
+	if len(t.memRegions) > 0 {
+		if len(t.memRegions) != len(regions) {
+			return false
+		}
+		for i := range regions {
+			if t.memRegions[i] != regions[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	layout := &Trace{memRegions: regions}
+	for _, rec := range t.trace {
+		if layout.memRegionOf(rec.offset) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeCSV Reads the records of a trace in the CSV format
+func (t *Trace) decodeCSV(r io.Reader) error {
+	lines, err := csv.NewReader(r).ReadAll()
 	if err != nil {
-		log.Fatalf("Failed to read from the trace file: %v", err)
+		return err
 	}
 
 	for _, line := range lines {
-		rec := readRecord(line)
+		rec, err := readRecord(line)
+		if err != nil {
+			return err
+		}
 		t.AppendRecord(rec)
 	}
+
+	return nil
 }
 
-// readRecord Parses a record from a line
-//
-//nolint:deadcode,unused
-func readRecord(line []string) Record {
+// readRecord Parses a record from a CSV line
+func readRecord(line []string) (Record, error) {
 	offset, err := strconv.ParseUint(line[0], 16, 64)
 	if err != nil {
-		log.Fatalf("Failed to convert string to offset: %v", err)
+		return Record{}, err
 	}
 
 	rec := Record{
 		offset: offset,
 	}
-	return rec
+	return rec, nil
 }
 
 // Search trace for the record with the same offset
@@ -135,18 +408,50 @@ func (t *Trace) containsRecord(rec Record) bool {
 
 // ProcessRecord Prepares the trace, the regions map, and the working set file for replay
 // Must be called when record is done (i.e., it is not concurrency-safe vs. AppendRecord)
-func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
+func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) error {
 	log.Debug("Preparing replay structures")
 
-	// sort trace records in the ascending order by offset
-	sort.Slice(t.trace, func(i, j int) bool {
-		return t.trace[i].offset < t.trace[j].offset
+	t.buildRegions()
+	return t.writeWorkingSetPagesToFile(GuestMemPath, WorkingSetPath)
+}
+
+// mergeRecords Appends the records whose offsets are missing from the trace and rebuilds
+// the regions map, returns the number of merged records
+func (t *Trace) mergeRecords(records []Record) int {
+	merged := 0
+	for _, rec := range records {
+		if t.containsRecord(rec) {
+			continue
+		}
+		t.AppendRecord(rec)
+		merged++
+	}
+
+	t.buildRegions()
+
+	return merged
+}
+
+// buildRegions Builds the map of contiguous regions from the trace records, the regions do not span
+// several guest memory regions. The records themselves are kept in the order of the page faults
+func (t *Trace) buildRegions() {
+	t.regions = make(map[uint64]int)
+
+	memRegionStarts := make(map[uint64]bool, len(t.memRegions))
+	for _, region := range t.memRegions {
+		memRegionStarts[region.Offset] = true
+	}
+
+	// sort a copy of the trace records in the ascending order by offset
+	sorted := make([]Record, len(t.trace))
+	copy(sorted, t.trace)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].offset < sorted[j].offset
 	})
 
-	// build the map of contiguous regions from the trace records
 	var last, regionStart uint64
-	for _, rec := range t.trace {
-		if rec.offset != last+uint64(os.Getpagesize()) {
+	for i, rec := range sorted {
+		if i == 0 || rec.offset != last+uint64(t.pageSize) || memRegionStarts[rec.offset] {
 			regionStart = rec.offset
 			t.regions[regionStart] = 1
 		} else {
@@ -155,22 +460,24 @@ func (t *Trace) ProcessRecord(GuestMemPath, WorkingSetPath string) {
 
 		last = rec.offset
 	}
-
-	t.writeWorkingSetPagesToFile(GuestMemPath, WorkingSetPath)
 }
 
-func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath string) {
+func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath string) error {
 	log.Debug("Writing the working set pages to a disk")
 
 	fSrc, err := os.Open(guestMemFileName)
 	if err != nil {
-		log.Fatalf("Failed to open guest memory file for reading")
+		log.Errorf("Failed to open guest memory file for reading")
+		return err
 	}
 	defer fSrc.Close()
-	fDst, err := os.Create(WorkingSetPath)
+	// the working set is renamed once complete, so that it can be streamed while it is rewritten
+	fDst, err := os.CreateTemp(filepath.Dir(WorkingSetPath), filepath.Base(WorkingSetPath)+".*.tmp")
 	if err != nil {
-		log.Fatalf("Failed to open ws file for writing")
+		log.Errorf("Failed to open ws file for writing")
+		return err
 	}
+	defer os.Remove(fDst.Name())
 	defer fDst.Close()
 
 	var (
@@ -187,16 +494,18 @@ func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath stri
 
 	for _, offset := range keys {
 		regLength := t.regions[offset]
-		copyLen := regLength * os.Getpagesize()
+		copyLen := regLength * int(t.pageSize)
 
 		buf := make([]byte, copyLen)
 
 		if n, err := fSrc.ReadAt(buf, int64(offset)); n != copyLen || err != nil {
-			log.Fatalf("Read file failed for src")
+			log.Errorf("Read file failed for src")
+			return errors.New(fmt.Sprintf("failed to read %d bytes at 0x%x from the guest memory file: %v", copyLen, offset, err))
 		}
 
 		if n, err := fDst.WriteAt(buf, dstOffset); n != copyLen || err != nil {
-			log.Fatalf("Write file failed for dst")
+			log.Errorf("Write file failed for dst")
+			return errors.New(fmt.Sprintf("failed to write the working set file: %v", err))
 		}
 
 		dstOffset += int64(copyLen)
@@ -205,6 +514,9 @@ func (t *Trace) writeWorkingSetPagesToFile(guestMemFileName, WorkingSetPath stri
 	}
 
 	if err := fDst.Sync(); err != nil {
-		log.Fatalf("Sync file failed for dst")
+		log.Errorf("Sync file failed for dst")
+		return err
 	}
+
+	return os.Rename(fDst.Name(), WorkingSetPath)
 }
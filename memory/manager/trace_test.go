@@ -0,0 +1,175 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTrace(t *testing.T, timestamps bool, offsets ...uint64) *Trace {
+	trace := initTrace(filepath.Join(t.TempDir(), "trace"))
+	trace.guestMemSize = 64 * uint64(os.Getpagesize())
+	trace.hasTimestamps = timestamps
+
+	for i, offset := range offsets {
+		trace.AppendRecord(Record{
+			offset:    offset * uint64(os.Getpagesize()),
+			timestamp: time.Duration(i+1) * time.Millisecond,
+		})
+	}
+
+	return trace
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	for _, timestamps := range []bool{true, false} {
+		// the records are kept in the order of the page faults, including backward jumps
+		trace := newTestTrace(t, timestamps, 5, 6, 7, 1, 63, 0, 8)
+		require.NoError(t, trace.WriteTrace())
+
+		read, err := ReadTrace(trace.traceFileName)
+		require.NoError(t, err)
+		require.Equal(t, trace.pageSize, read.pageSize)
+		require.Equal(t, trace.guestMemSize, read.guestMemSize)
+		require.Equal(t, timestamps, read.hasTimestamps)
+		require.Len(t, read.trace, len(trace.trace))
+
+		for i, rec := range read.trace {
+			require.Equal(t, trace.trace[i].offset, rec.offset)
+			if timestamps {
+				require.Equal(t, trace.trace[i].timestamp, rec.timestamp)
+			} else {
+				require.Zero(t, rec.timestamp)
+			}
+		}
+
+		read.buildRegions()
+		require.Equal(t, map[uint64]int{
+			0:                             2,
+			5 * uint64(os.Getpagesize()):  4,
+			63 * uint64(os.Getpagesize()): 1,
+		}, read.regions)
+	}
+}
+
+func TestTraceEmpty(t *testing.T) {
+	trace := newTestTrace(t, true)
+	require.NoError(t, trace.WriteTrace())
+
+	read, err := ReadTrace(trace.traceFileName)
+	require.NoError(t, err)
+	require.Empty(t, read.trace)
+}
+
+func TestTraceInvalid(t *testing.T) {
+	trace := newTestTrace(t, true, 1, 2, 3)
+
+	var buf bytes.Buffer
+	require.NoError(t, trace.encode(&buf))
+	valid := buf.Bytes()
+
+	unsupported := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(unsupported[4:], traceVersion+1)
+
+	tooMany := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint64(tooMany[24:], 65)
+
+	for name, data := range map[string][]byte{
+		"unsupported version": unsupported,
+		"too many records":    tooMany,
+		"truncated":           valid[:len(valid)-1],
+		"trailing data":       append(append([]byte{}, valid...), 0),
+	} {
+		path := filepath.Join(t.TempDir(), "trace")
+		require.NoError(t, os.WriteFile(path, data, 0644))
+
+		_, err := ReadTrace(path)
+		require.Error(t, err, name)
+	}
+
+	trace.AppendRecord(Record{offset: 1})
+	require.Error(t, trace.WriteTrace(), "unaligned offset")
+}
+
+func TestTraceRegions(t *testing.T) {
+	pageSize := uint64(os.Getpagesize())
+	layout := []traceRegion{{Offset: 0, Size: 32 * pageSize}, {Offset: 32 * pageSize, Size: 32 * pageSize}}
+
+	trace := newTestTrace(t, true, 30, 31, 32, 33)
+	trace.memRegions = layout
+	require.NoError(t, trace.WriteTrace())
+
+	read, err := ReadTrace(trace.traceFileName)
+	require.NoError(t, err)
+	require.Equal(t, layout, read.memRegions)
+	require.True(t, read.matchesLayout(pageSize, layout))
+	require.False(t, read.matchesLayout(pageSize, layout[:1]))
+	require.False(t, read.matchesLayout(hugePageSize, layout))
+
+	// the contiguous regions of the working set do not span several guest memory regions
+	read.buildRegions()
+	require.Equal(t, map[uint64]int{30 * pageSize: 2, 32 * pageSize: 2}, read.regions)
+
+	// the traces of version 1 do not record the regions, their records must fit into the regions
+	legacy := newTestTrace(t, true, 30, 31)
+	var buf bytes.Buffer
+	require.NoError(t, legacy.encode(&buf))
+	binary.LittleEndian.PutUint16(buf.Bytes()[4:], 1)
+	require.NoError(t, os.WriteFile(legacy.traceFileName, buf.Bytes(), 0644))
+
+	read, err = ReadTrace(legacy.traceFileName)
+	require.NoError(t, err)
+	require.Empty(t, read.memRegions)
+	require.True(t, read.matchesLayout(pageSize, layout))
+	require.False(t, read.matchesLayout(pageSize, []traceRegion{{Offset: 0, Size: 16 * pageSize}}))
+
+	// the records must lie in the regions
+	outside := newTestTrace(t, true, 40)
+	outside.memRegions = layout[:1]
+	require.NoError(t, outside.WriteTrace())
+	_, err = ReadTrace(outside.traceFileName)
+	require.Error(t, err)
+
+	overlapping := newTestTrace(t, true, 1)
+	overlapping.memRegions = []traceRegion{{Offset: 0, Size: 32 * pageSize}, {Offset: 16 * pageSize, Size: 32 * pageSize}}
+	require.NoError(t, overlapping.WriteTrace())
+	_, err = ReadTrace(overlapping.traceFileName)
+	require.Error(t, err)
+}
+
+func TestTraceLegacyCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace")
+	require.NoError(t, os.WriteFile(path, []byte("2000\n0\n1000\n"), 0644))
+
+	read, err := ReadTrace(path)
+	require.NoError(t, err)
+	require.False(t, read.hasTimestamps)
+	require.Equal(t, []Record{{offset: 0x2000}, {offset: 0}, {offset: 0x1000}}, read.trace)
+}
@@ -38,28 +38,42 @@ int const_UFFDIO_COPY = UFFDIO_COPY;
 int const_UFFD_EVENT_PAGEFAULT = UFFD_EVENT_PAGEFAULT;
 int const_UFFDIO_COPY_MODE_DONTWAKE = UFFDIO_COPY_MODE_DONTWAKE;
 
-#define errExit(msg) \
-    do { perror(msg); exit(EXIT_FAILURE); } while (0)
+// register_range registers another region with the userfaultfd, for its missing pages to be served,
+// returns -1 and sets errno on failure
+int register_range(long uffd, void *start_address, unsigned long len) {
+    struct uffdio_register uffdio_register;
+
+    uffdio_register.range.start = (unsigned long) start_address;
+    uffdio_register.range.len = len;
+    uffdio_register.mode = UFFDIO_REGISTER_MODE_MISSING;
+
+    return ioctl(uffd, UFFDIO_REGISTER, &uffdio_register);
+}
 
+// register_for_upf creates a userfaultfd serving the missing pages of the region,
+// returns -1 and sets errno on failure
 long register_for_upf(void *start_address, unsigned long len) {
     struct uffdio_api uffdio_api;
-    struct uffdio_register uffdio_register;
     long uffd;
+    int err;
 
     uffd = syscall(__NR_userfaultfd, O_CLOEXEC | O_NONBLOCK);
     if (uffd == -1)
-            errExit("userfaultfd");
+        return -1;
 
     uffdio_api.api = UFFD_API;
     uffdio_api.features = 0;
     if (ioctl(uffd, UFFDIO_API, &uffdio_api) == -1)
-        errExit("ioctl-UFFDIO_API");
+        goto fail;
 
-    uffdio_register.range.start = (unsigned long) start_address;
-    uffdio_register.range.len = len;
-    uffdio_register.mode = UFFDIO_REGISTER_MODE_MISSING;
-    if (ioctl(uffd, UFFDIO_REGISTER, &uffdio_register) == -1)
-        errExit("ioctl-UFFDIO_REGISTER");
+    if (register_range(uffd, start_address, len) == -1)
+        goto fail;
 
     return uffd;
+
+fail:
+    err = errno;
+    close(uffd);
+    errno = err;
+    return -1;
 }
@@ -42,6 +42,8 @@ const (
 
 	// LoadVMM Name of LoadVMM metric
 	LoadVMM = "LoadVMM"
+	// DecompressMemFile Time to decompress the memory file of a snapshot before loading it
+	DecompressMemFile = "DecompressMemFile"
 
 	// AddInstance Time to add instance - load snap or start vm
 	AddInstance = "AddInstance"
@@ -62,6 +64,11 @@ const (
 	TaskWait = "TaskWait"
 	// TaskStart Time to start task
 	TaskStart = "TaskStart"
+
+	// PoolDataUsage Percentage of the data space of the thin pool in use
+	PoolDataUsage = "PoolDataUsage"
+	// PoolMetadataUsage Percentage of the metadata space of the thin pool in use
+	PoolMetadataUsage = "PoolMetadataUsage"
 )
 
 // Metric A general metric
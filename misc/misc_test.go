@@ -52,7 +52,7 @@ func TestAllocateFreeVMs(t *testing.T) {
 	vmIDs := [2]string{"test1", "test2"}
 
 	for _, vmID := range vmIDs {
-		_, err := vmPool.Allocate(vmID)
+		_, err := vmPool.Allocate(vmID, "")
 		require.NoError(t, err, "Failed to allocate VM")
 	}
 
@@ -75,7 +75,7 @@ func TestAllocateFreeVMsParallel(t *testing.T) {
 		go func(i int) {
 			defer vmGroup.Done()
 			vmID := fmt.Sprintf("test_%d", i)
-			_, err := vmPool.Allocate(vmID)
+			_, err := vmPool.Allocate(vmID, "")
 			require.NoError(t, err, "Failed to allocate VM")
 		}(i)
 	}
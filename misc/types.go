@@ -37,6 +37,7 @@ type VM struct {
 	ID               string
 	ContainerSnapKey string
 	SnapBooted       bool
+	ImageName        string
 	Image            *containerd.Image
 	Container        *containerd.Container
 	Task             *containerd.Task
@@ -65,6 +66,11 @@ func (vm *VM) GetIP() string {
 	return vm.NetConfig.GetCloneIP()
 }
 
+// GetIPv6 returns the IPv6 address at which the VM is reachable, empty if IPv6 is disabled
+func (vm *VM) GetIPv6() string {
+	return vm.NetConfig.GetCloneIPv6()
+}
+
 // GetMacAddress returns the name of the VM MAC address
 func (vm *VM) GetMacAddress() string {
 	return vm.NetConfig.GetMacAddress()
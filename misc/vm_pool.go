@@ -29,9 +29,9 @@ import (
 )
 
 // NewVMPool Initializes a pool of VMs
-func NewVMPool(hostIfaceName string, netPoolSize int, vethPrefix, clonePrefix string) *VMPool {
+func NewVMPool(hostIfaceName string, netPoolSize int, vethPrefix, clonePrefix string, netOpts ...networking.NetworkManagerOption) *VMPool {
 	p := new(VMPool)
-	networkManager, err := networking.NewNetworkManager(hostIfaceName, netPoolSize, vethPrefix, clonePrefix)
+	networkManager, err := networking.NewNetworkManager(hostIfaceName, netPoolSize, vethPrefix, clonePrefix, netOpts...)
 	if err != nil {
 		log.Println(err)
 	}
@@ -41,8 +41,9 @@ func NewVMPool(hostIfaceName string, netPoolSize int, vethPrefix, clonePrefix st
 	return p
 }
 
-// Allocate Initializes a VM, activates it and then adds it to VM map
-func (p *VMPool) Allocate(vmID string) (*VM, error) {
+// Allocate Initializes a VM of the given image, activates it and then adds it to VM map,
+// the network of the VM is configured with the given options
+func (p *VMPool) Allocate(vmID, imageName string, netOpts ...networking.NetworkOption) (*VM, error) {
 
 	logger := log.WithFields(log.Fields{"vmID": vmID})
 
@@ -53,9 +54,10 @@ func (p *VMPool) Allocate(vmID string) (*VM, error) {
 	}
 
 	vm := NewVM(vmID)
+	vm.ImageName = imageName
 
 	var err error
-	vm.NetConfig, err = p.networkManager.CreateNetwork(vmID)
+	vm.NetConfig, err = p.networkManager.CreateNetwork(vmID, netOpts...)
 	if err != nil {
 		logger.Warn("VM network creation failed")
 		return nil, err
@@ -88,6 +90,15 @@ func (p *VMPool) Free(vmID string) error {
 	return nil
 }
 
+// SetEgressPolicy Replaces the restrictions of the traffic sent by the VM
+func (p *VMPool) SetEgressPolicy(vmID string, policy networking.EgressPolicy) error {
+	if _, isPresent := p.vmMap.Load(vmID); !isPresent {
+		return NonExistErr("SetEgressPolicy: VM is not in the VM map")
+	}
+
+	return p.networkManager.SetEgressPolicy(vmID, policy)
+}
+
 // GetVMMap Returns a copy of vmMap as a regular concurrency-unsafe map
 func (p *VMPool) GetVMMap() map[string]*VM {
 	m := make(map[string]*VM)
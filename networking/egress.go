@@ -0,0 +1,387 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package networking
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// egressTable is the nftables table enforcing the egress policy in the namespace of the uVM
+	egressTable = "egress"
+	// egressLogRate is the maximum number of dropped packets logged per second for each uVM
+	egressLogRate = 10
+	// dnsPort is the port of the DNS servers
+	dnsPort = 53
+)
+
+// EgressMode selects the destinations the uVM may send traffic to
+type EgressMode int
+
+const (
+	// EgressAllowAll does not restrict the traffic sent by the uVM
+	EgressAllowAll EgressMode = iota
+	// EgressAllowList only allows the traffic to the destinations of the allow-list and to the cluster DNS
+	EgressAllowList
+	// EgressDNSOnly only allows the traffic to the cluster DNS
+	EgressDNSOnly
+)
+
+var egressModeNames = map[EgressMode]string{
+	EgressAllowAll:  "allow-all",
+	EgressAllowList: "allow-list",
+	EgressDNSOnly:   "dns-only",
+}
+
+// MarshalText returns the name of the mode used in the egress configuration files
+func (m EgressMode) MarshalText() ([]byte, error) {
+	if name, ok := egressModeNames[m]; ok {
+		return []byte(name), nil
+	}
+
+	return nil, errors.Errorf("invalid egress mode %d", m)
+}
+
+// UnmarshalText parses the name of a mode: allow-all, allow-list or dns-only
+func (m *EgressMode) UnmarshalText(text []byte) error {
+	for mode, name := range egressModeNames {
+		if name == string(text) {
+			*m = mode
+			return nil
+		}
+	}
+
+	return errors.Errorf("invalid egress mode %s", text)
+}
+
+// EgressRule allows the traffic to a destination network
+type EgressRule struct {
+	CIDR     string   // Destination network (CIDR notation)
+	Protocol string   // "tcp", "udp" or empty for any protocol
+	Ports    []uint16 // Destination ports, any port if empty (requires a protocol)
+}
+
+// EgressPolicy restricts the traffic sent by a uVM. The replies to the connections opened
+// towards the uVM, e.g. the responses to the invocations, are always allowed
+type EgressPolicy struct {
+	Mode       EgressMode
+	Allow      []EgressRule // Destinations allowed in the allow-list mode
+	DNSServers []string     // IP addresses of the cluster DNS servers
+	LogDropped bool         // Log the dropped packets to the kernel log
+}
+
+// EgressConfig selects the egress policies of the uVMs by the image of their function, so that the policy of a
+// function survives the restarts of its instances
+type EgressConfig struct {
+	Default EgressPolicy            // Policy of the uVMs of the images without a policy
+	Images  map[string]EgressPolicy // Policies of the uVMs, by image name
+}
+
+// LoadEgressConfig reads an egress configuration from a JSON file, e.g.
+// {"default": {"mode": "dns-only", "dnsServers": ["10.96.0.10"]}, "images": {"<image>": {"mode": "allow-all"}}}
+func LoadEgressConfig(path string) (EgressConfig, error) {
+	var cfg EgressConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Wrapf(err, "reading egress configuration")
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrapf(err, "decoding egress configuration %s", path)
+	}
+
+	if err := cfg.Default.validate(); err != nil {
+		return cfg, errors.Wrapf(err, "validating default egress policy")
+	}
+
+	for image, policy := range cfg.Images {
+		if err := policy.validate(); err != nil {
+			return cfg, errors.Wrapf(err, "validating egress policy of image %s", image)
+		}
+	}
+
+	return cfg, nil
+}
+
+// validate checks the addresses, protocols and ports of the policy
+func (p EgressPolicy) validate() error {
+	switch p.Mode {
+	case EgressAllowAll, EgressAllowList, EgressDNSOnly:
+	default:
+		return errors.Errorf("invalid egress mode %d", p.Mode)
+	}
+
+	for _, server := range p.DNSServers {
+		if net.ParseIP(server) == nil {
+			return errors.Errorf("invalid DNS server address %s", server)
+		}
+	}
+
+	for _, rule := range p.Allow {
+		if _, _, err := net.ParseCIDR(rule.CIDR); err != nil {
+			return errors.Wrapf(err, "parsing egress rule")
+		}
+		switch rule.Protocol {
+		case "tcp", "udp":
+		case "":
+			if len(rule.Ports) > 0 {
+				return errors.Errorf("egress rule for %s has ports but no protocol", rule.CIDR)
+			}
+		default:
+			return errors.Errorf("invalid protocol %s in egress rule for %s", rule.Protocol, rule.CIDR)
+		}
+	}
+
+	return nil
+}
+
+// setEgressPolicy replaces the nftables rules dropping the packets forwarded from the tap device of the uVM
+// that are not allowed by the policy
+func setEgressPolicy(tapName, logPrefix string, policy EgressPolicy, vmNsHandle netns.NsHandle) error {
+	conn := nftables.Conn{NetNS: int(vmNsHandle)}
+
+	// 1. add table inet egress
+	table := &nftables.Table{
+		Name:   egressTable,
+		Family: nftables.TableFamilyINet,
+	}
+
+	// 2. the previous policy is removed along with the table, adding the table first
+	// makes the deletion succeed if it does not exist
+	conn.AddTable(table)
+	conn.DelTable(table)
+
+	if policy.Mode != EgressAllowAll {
+		// 3. add chain inet egress FORWARD { type filter hook forward priority 0; policy accept; }
+		polAccept := nftables.ChainPolicyAccept
+		fwdCh := &nftables.Chain{
+			Name:     "FORWARD",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Priority: nftables.ChainPriorityRef(0),
+			Hooknum:  nftables.ChainHookForward,
+			Policy:   &polAccept,
+		}
+
+		conn.AddTable(table)
+		conn.AddChain(fwdCh)
+
+		// 4. add rule inet egress FORWARD iifname tap0 ct state established,related accept
+		conn.AddRule(egressRule(fwdCh, tapName, expr.VerdictAccept, establishedMatch()))
+
+		// 5. add rule inet egress FORWARD iifname tap0 ip daddr 10.96.0.10 udp dport 53 accept
+		for _, server := range policy.DNSServers {
+			ip := net.ParseIP(server)
+			dst := &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			if ip4 := ip.To4(); ip4 != nil {
+				dst = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+			}
+			for _, proto := range []string{"udp", "tcp"} {
+				conn.AddRule(egressRule(fwdCh, tapName, expr.VerdictAccept, destinationMatch(dst), portMatch(proto, dnsPort)))
+			}
+		}
+
+		// 6. add rule inet egress FORWARD iifname tap0 ip daddr 10.0.0.0/8 tcp dport 443 accept
+		if policy.Mode == EgressAllowList {
+			for _, rule := range policy.Allow {
+				_, dst, _ := net.ParseCIDR(rule.CIDR)
+				switch {
+				case rule.Protocol == "":
+					conn.AddRule(egressRule(fwdCh, tapName, expr.VerdictAccept, destinationMatch(dst)))
+				case len(rule.Ports) == 0:
+					conn.AddRule(egressRule(fwdCh, tapName, expr.VerdictAccept, destinationMatch(dst), protocolMatch(rule.Protocol)))
+				default:
+					for _, port := range rule.Ports {
+						conn.AddRule(egressRule(fwdCh, tapName, expr.VerdictAccept, destinationMatch(dst), portMatch(rule.Protocol, port)))
+					}
+				}
+			}
+		}
+
+		// 7. add rule inet egress FORWARD iifname tap0 limit rate 10/second log prefix "..."
+		if policy.LogDropped {
+			conn.AddRule(&nftables.Rule{
+				Table: table,
+				Chain: fwdCh,
+				Exprs: append(interfaceMatch(tapName),
+					&expr.Limit{
+						Type: expr.LimitTypePkts,
+						Rate: egressLogRate,
+						Unit: expr.LimitTimeSecond,
+					},
+					&expr.Log{
+						Key:  1 << unix.NFTA_LOG_PREFIX,
+						Data: []byte(logPrefix),
+					},
+				),
+			})
+		}
+
+		// 8. add rule inet egress FORWARD iifname tap0 drop
+		conn.AddRule(egressRule(fwdCh, tapName, expr.VerdictDrop))
+	}
+
+	if err := conn.Flush(); err != nil {
+		return errors.Wrapf(err, "setting egress policy")
+	}
+	return nil
+}
+
+// egressRule returns a rule applying the verdict to the packets from the tap device matching all the matches
+func egressRule(chain *nftables.Chain, tapName string, verdict expr.VerdictKind, matches ...[]expr.Any) *nftables.Rule {
+	exprs := interfaceMatch(tapName)
+	for _, match := range matches {
+		exprs = append(exprs, match...)
+	}
+
+	return &nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: append(exprs, &expr.Verdict{Kind: verdict}),
+	}
+}
+
+// interfaceMatch matches the packets whose input interface is ifaceName
+func interfaceMatch(ifaceName string) []expr.Any {
+	return []expr.Any{
+		// Load iifname in register 1
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// Check iifname == tap0
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte(fmt.Sprintf("%s\x00", ifaceName)),
+		},
+	}
+}
+
+// establishedMatch matches the packets of the established connections and the related ones
+func establishedMatch() []expr.Any {
+	return []expr.Any{
+		// Load the connection tracking state in register 1
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		// Keep the established and related bits
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		// Check either bit is set
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(0),
+		},
+	}
+}
+
+// destinationMatch matches the IPv4 or IPv6 packets whose destination address is in the network
+func destinationMatch(dst *net.IPNet) []expr.Any {
+	family, offset, ip := byte(unix.NFPROTO_IPV4), uint32(16), dst.IP.To4()
+	if ip == nil || len(dst.Mask) == net.IPv6len {
+		family, offset, ip = unix.NFPROTO_IPV6, 24, dst.IP.To16()
+	}
+
+	return []expr.Any{
+		// Load the protocol family in register 1
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		// Check the family matches the network
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{family},
+		},
+		// Load destination IP address (offset 16 bytes IPv4 header, 24 bytes IPv6 header) in register 1
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(ip)),
+		},
+		// Keep the network part of the address
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(ip)),
+			Mask:           dst.Mask,
+			Xor:            make([]byte, len(ip)),
+		},
+		// Check the network == 10.0.0.0
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ip.Mask(dst.Mask),
+		},
+	}
+}
+
+// protocolMatch matches the packets of the transport protocol (tcp or udp)
+func protocolMatch(proto string) []expr.Any {
+	l4proto := byte(unix.IPPROTO_TCP)
+	if proto == "udp" {
+		l4proto = unix.IPPROTO_UDP
+	}
+
+	return []expr.Any{
+		// Load the transport protocol in register 1
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// Check the protocol == tcp
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{l4proto},
+		},
+	}
+}
+
+// portMatch matches the packets of the transport protocol (tcp or udp) sent to the port
+func portMatch(proto string, port uint16) []expr.Any {
+	return append(protocolMatch(proto),
+		// Load destination port (offset 2 bytes transport header) in register 1
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2,
+			Len:          2,
+		},
+		// Check destination port == 443
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(port),
+		},
+	)
+}
@@ -0,0 +1,484 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package networking
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIPExhausted is returned when all the addresses of a network are allocated
+var ErrIPExhausted = errors.New("IP addresses exhausted")
+
+// IPAllocation holds the addresses allocated to a network config
+type IPAllocation struct {
+	ID        int    `json:"id"`                  // Network config ID
+	VethCIDR  string `json:"vethCIDR"`            // Network of the veth pair (/30 in CIDR notation)
+	CloneIP   string `json:"cloneIP"`             // Address the uVM is reachable at from the host
+	VethCIDR6 string `json:"vethCIDR6,omitempty"` // IPv6 network of the veth pair (/126 in CIDR notation), if enabled
+	CloneIP6  string `json:"cloneIP6,omitempty"`  // IPv6 address the uVM is reachable at from the host, if enabled
+}
+
+// IPAllocator allocates the addresses of the network configs
+type IPAllocator interface {
+	// Allocate reserves addresses for the network config id, or returns the ones already reserved for it
+	Allocate(id int) (IPAllocation, error)
+	// Release frees the addresses reserved for the network config id
+	Release(id int) error
+	// Reserve records the addresses in use by an existing network config, e.g. created by a previous run
+	Reserve(alloc IPAllocation) error
+	// Allocations returns the reserved addresses, including the ones recovered after a restart
+	Allocations() []IPAllocation
+}
+
+// IPAM allocates a /30 network for the veth pair and a clone address to each network config from networks of any
+// size, and optionally a /126 network and a clone address from IPv6 networks. The allocations are persisted to a
+// state file if one is given, so that they are recovered after a restart.
+type IPAM struct {
+	sync.Mutex
+	veths     *addressPool
+	clones    *addressPool
+	veths6    *addressPool // nil if IPv6 is disabled
+	clones6   *addressPool // nil if IPv6 is disabled
+	statePath string
+
+	allocations map[int]IPAllocation
+}
+
+// IPAMOption configures an IPAM
+type IPAMOption func(*IPAM) error
+
+// ipamState is the content of the state file of the IPAM
+type ipamState struct {
+	VethCIDR    string         `json:"vethCIDR"`
+	CloneCIDR   string         `json:"cloneCIDR"`
+	VethCIDR6   string         `json:"vethCIDR6,omitempty"`
+	CloneCIDR6  string         `json:"cloneCIDR6,omitempty"`
+	Allocations []IPAllocation `json:"allocations"`
+}
+
+// NewIPAM creates an IPAM allocating the veth networks from vethCIDR and the clone addresses from cloneCIDR. The
+// networks are given in CIDR notation or as the first octets of a network (e.g., 172.17 is 172.17.0.0/16). If
+// statePath is not empty, the allocations stored in the state file are recovered and new allocations are persisted.
+func NewIPAM(vethCIDR, cloneCIDR, statePath string, opts ...IPAMOption) (*IPAM, error) {
+	ipam := &IPAM{
+		statePath:   statePath,
+		allocations: make(map[int]IPAllocation),
+	}
+
+	var err error
+	if ipam.veths, ipam.clones, err = newPools(vethCIDR, cloneCIDR); err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		if err := opt(ipam); err != nil {
+			return nil, err
+		}
+	}
+
+	if statePath != "" {
+		if err := ipam.recover(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ipam, nil
+}
+
+// WithIPv6Networks Sets the IPv6 networks, in CIDR notation, the veth networks and the clone addresses are also
+// allocated from, so that the uVMs are reachable over both IPv4 and IPv6
+func WithIPv6Networks(vethCIDR6, cloneCIDR6 string) IPAMOption {
+	return func(ipam *IPAM) error {
+		veths6, clones6, err := newPools(vethCIDR6, cloneCIDR6)
+		if err != nil {
+			return err
+		}
+		if veths6.ipNet.IP.To4() != nil || clones6.ipNet.IP.To4() != nil {
+			return errors.Errorf("IPv6 networks %s and %s must not be IPv4 networks", veths6.ipNet, clones6.ipNet)
+		}
+
+		ipam.veths6, ipam.clones6 = veths6, clones6
+		return nil
+	}
+}
+
+// newPools creates the pools of the veth networks and of the clone addresses from non-overlapping networks
+func newPools(vethCIDR, cloneCIDR string) (*addressPool, *addressPool, error) {
+	vethNet, err := parseNetwork(vethCIDR)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing veth network")
+	}
+	if ones, size := vethNet.Mask.Size(); size-ones < 2 {
+		return nil, nil, errors.Errorf("veth network %s is smaller than a block of 4 addresses", vethNet)
+	}
+	cloneNet, err := parseNetwork(cloneCIDR)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing clone network")
+	}
+	if vethNet.Contains(cloneNet.IP) || cloneNet.Contains(vethNet.IP) {
+		return nil, nil, errors.Errorf("veth network %s and clone network %s overlap", vethNet, cloneNet)
+	}
+
+	// the first and last addresses of the clone network (e.g., network and broadcast addresses) are not allocated
+	return newAddressPool(vethNet, 2, false), newAddressPool(cloneNet, 0, true), nil
+}
+
+// parseNetwork parses a network in CIDR notation or an IPv4 network given by its first octets
+func parseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") && !strings.Contains(network, ":") {
+		octets := strings.Count(network, ".") + 1
+		if octets > net.IPv4len {
+			return nil, errors.Errorf("invalid network prefix %s", network)
+		}
+		network = fmt.Sprintf("%s%s/%d", network, strings.Repeat(".0", net.IPv4len-octets), 8*octets)
+	}
+
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		ipNet.IP = ip4
+	}
+	return ipNet, nil
+}
+
+// Allocate reserves a /30 veth network and a clone address for the network config id,
+// and a /126 veth network and a clone address from the IPv6 networks if they are set
+func (ipam *IPAM) Allocate(id int) (IPAllocation, error) {
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	if alloc, ok := ipam.allocations[id]; ok {
+		return alloc, nil
+	}
+
+	alloc := IPAllocation{ID: id}
+	for _, addr := range []struct {
+		pool *addressPool
+		dst  *string
+		mask int
+	}{
+		{ipam.veths, &alloc.VethCIDR, 30},
+		{ipam.clones, &alloc.CloneIP, 0},
+		{ipam.veths6, &alloc.VethCIDR6, 126},
+		{ipam.clones6, &alloc.CloneIP6, 0},
+	} {
+		if addr.pool == nil {
+			continue
+		}
+
+		ip, ok := addr.pool.allocate(id)
+		if !ok {
+			ipam.release(id)
+			return IPAllocation{}, errors.Wrapf(ErrIPExhausted, "no free address in network %s", addr.pool.ipNet)
+		}
+		if *addr.dst = ip.String(); addr.mask != 0 {
+			*addr.dst = fmt.Sprintf("%s/%d", ip, addr.mask)
+		}
+	}
+
+	ipam.allocations[id] = alloc
+	if err := ipam.persist(); err != nil {
+		ipam.release(id)
+		return IPAllocation{}, err
+	}
+
+	return alloc, nil
+}
+
+// Release frees the addresses reserved for the network config id
+func (ipam *IPAM) Release(id int) error {
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	if _, ok := ipam.allocations[id]; !ok {
+		return nil
+	}
+
+	ipam.release(id)
+	return ipam.persist()
+}
+
+// Reserve records the addresses in use by an existing network config, which are not allocated again until released
+func (ipam *IPAM) Reserve(alloc IPAllocation) error {
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	if _, ok := ipam.allocations[alloc.ID]; ok {
+		return errors.Errorf("addresses already allocated to network config %d", alloc.ID)
+	}
+
+	ipam.reserve(alloc)
+	return ipam.persist()
+}
+
+// Allocations returns the reserved addresses sorted by network config ID
+func (ipam *IPAM) Allocations() []IPAllocation {
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	return ipam.sortedAllocations()
+}
+
+func (ipam *IPAM) sortedAllocations() []IPAllocation {
+	allocs := make([]IPAllocation, 0, len(ipam.allocations))
+	for _, alloc := range ipam.allocations {
+		allocs = append(allocs, alloc)
+	}
+	sort.Slice(allocs, func(i, j int) bool { return allocs[i].ID < allocs[j].ID })
+
+	return allocs
+}
+
+// pools returns the address pools of the IPAM, the IPv6 ones are nil if IPv6 is disabled
+func (ipam *IPAM) pools() []*addressPool {
+	return []*addressPool{ipam.veths, ipam.clones, ipam.veths6, ipam.clones6}
+}
+
+// reserve marks the addresses of the allocation as used if they are in the networks of the IPAM
+func (ipam *IPAM) reserve(alloc IPAllocation) {
+	ipam.allocations[alloc.ID] = alloc
+
+	for i, addr := range []string{alloc.VethCIDR, alloc.CloneIP, alloc.VethCIDR6, alloc.CloneIP6} {
+		pool := ipam.pools()[i]
+		if pool == nil || addr == "" {
+			continue
+		}
+
+		ip := net.ParseIP(addr)
+		if strings.Contains(addr, "/") {
+			ip, _, _ = net.ParseCIDR(addr)
+		}
+		pool.reserve(ip, alloc.ID)
+	}
+}
+
+func (ipam *IPAM) release(id int) {
+	delete(ipam.allocations, id)
+	for _, pool := range ipam.pools() {
+		if pool != nil {
+			pool.release(id)
+		}
+	}
+}
+
+// recover loads the allocations from the state file. The allocations outside of the networks of the IPAM, e.g.,
+// made before the networks were changed, are kept until they are released but their addresses are not reused.
+func (ipam *IPAM) recover() error {
+	data, err := os.ReadFile(ipam.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "reading IPAM state")
+	}
+
+	var state ipamState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Wrapf(err, "decoding IPAM state %s", ipam.statePath)
+	}
+
+	for _, alloc := range state.Allocations {
+		ipam.reserve(alloc)
+	}
+
+	return nil
+}
+
+// persist writes the allocations to the state file, the previous state is only replaced once the new one is written
+func (ipam *IPAM) persist() error {
+	if ipam.statePath == "" {
+		return nil
+	}
+
+	state := ipamState{
+		VethCIDR:    ipam.veths.ipNet.String(),
+		CloneCIDR:   ipam.clones.ipNet.String(),
+		Allocations: ipam.sortedAllocations(),
+	}
+	if ipam.veths6 != nil {
+		state.VethCIDR6, state.CloneCIDR6 = ipam.veths6.ipNet.String(), ipam.clones6.ipNet.String()
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "encoding IPAM state")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ipam.statePath), 0755); err != nil {
+		return errors.Wrapf(err, "creating IPAM state dir")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(ipam.statePath), "."+filepath.Base(ipam.statePath)+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "creating temporary IPAM state")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "writing IPAM state")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "writing IPAM state")
+	}
+
+	if err := os.Rename(tmp.Name(), ipam.statePath); err != nil {
+		return errors.Wrapf(err, "renaming temporary IPAM state")
+	}
+
+	return nil
+}
+
+// addressPool allocates the blocks of 2^blockBits addresses of a network
+type addressPool struct {
+	ipNet     *net.IPNet
+	blockBits int
+	first     uint64         // index of the first allocated block
+	count     uint64         // number of allocated blocks
+	used      map[uint64]int // block index -> network config ID
+	next      uint64
+}
+
+// newAddressPool creates a pool of the blocks of the network, without its first and last addresses if skipEnds is set
+func newAddressPool(ipNet *net.IPNet, blockBits int, skipEnds bool) *addressPool {
+	pool := &addressPool{
+		ipNet:     ipNet,
+		blockBits: blockBits,
+		count:     networkSize(ipNet, blockBits),
+		used:      make(map[uint64]int),
+	}
+	if skipEnds && pool.count > 2 {
+		pool.first, pool.count = 1, pool.count-2
+	}
+
+	return pool
+}
+
+// allocate returns the first address of a free block, false if all the blocks are used
+func (p *addressPool) allocate(id int) (net.IP, bool) {
+	index, ok := findFree(p.used, p.next, p.first, p.count)
+	if !ok {
+		return nil, false
+	}
+
+	p.used[index] = id
+	p.next = index + 1
+	return addToIP(p.ipNet.IP, index<<p.blockBits), true
+}
+
+// reserve marks the block containing ip as used if the network contains ip
+func (p *addressPool) reserve(ip net.IP, id int) {
+	if offset, ok := ipOffset(p.ipNet, ip); ok {
+		p.used[offset>>p.blockBits] = id
+	}
+}
+
+// release frees the blocks used by the network config id
+func (p *addressPool) release(id int) {
+	for index, owner := range p.used {
+		if owner == id {
+			delete(p.used, index)
+		}
+	}
+}
+
+// findFree returns the first index in [first, first+count) that is not used, starting from next and wrapping around
+func findFree(used map[uint64]int, next, first, count uint64) (uint64, bool) {
+	if uint64(len(used)) >= count {
+		return 0, false
+	}
+	if next < first || next >= first+count {
+		next = first
+	}
+
+	for i := uint64(0); i < count; i++ {
+		index := first + (next-first+i)%count
+		if _, ok := used[index]; !ok {
+			return index, true
+		}
+	}
+
+	return 0, false
+}
+
+// networkSize returns the number of blocks of 2^blockBits addresses in the network, capped at 2^63
+func networkSize(ipNet *net.IPNet, blockBits int) uint64 {
+	ones, size := ipNet.Mask.Size()
+	hostBits := size - ones - blockBits
+	if hostBits >= 63 {
+		return 1 << 63
+	}
+	return 1 << hostBits
+}
+
+// addToIP returns the address at the given offset from ip
+func addToIP(ip net.IP, offset uint64) net.IP {
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+
+	var carry uint64
+	for i := len(res) - 1; i >= 0 && (offset > 0 || carry > 0); i-- {
+		sum := uint64(res[i]) + offset&0xff + carry
+		res[i] = byte(sum)
+		carry = sum >> 8
+		offset >>= 8
+	}
+
+	return res
+}
+
+// ipOffset returns the offset of ip from the start of the network, false if the network does not contain ip
+func ipOffset(ipNet *net.IPNet, ip net.IP) (uint64, bool) {
+	if ip == nil || !ipNet.Contains(ip) {
+		return 0, false
+	}
+	if len(ip) != len(ipNet.IP) {
+		ip = ip.To16()
+		if len(ipNet.IP) == net.IPv4len {
+			ip = ip.To4()
+		}
+	}
+
+	var offset uint64
+	for i := range ip {
+		hostBits := ip[i] &^ ipNet.Mask[i]
+		if len(ip)-i <= 8 {
+			offset = offset<<8 | uint64(hostBits)
+		} else if hostBits != 0 {
+			// the offset does not fit in 64 bits
+			return 0, false
+		}
+	}
+
+	return offset, true
+}
@@ -24,8 +24,11 @@
 package networking
 
 import (
+	"net"
+	"os"
 	"sync"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -35,27 +38,102 @@ type NetworkManager struct {
 	sync.Mutex
 	nextID        int
 	hostIfaceName string
-	vethPrefix    string
-	clonePrefix   string
+
+	// Allocator of the addresses of the network configs
+	allocator     IPAllocator
+	ipamStatePath string
+	vethNetwork6  string // IPv6 networks of the IPAM, IPv6 is disabled if empty
+	cloneNetwork6 string
 
 	// Pool of free network configs
 	networkPool []*NetworkConfig
 	poolCond    *sync.Cond
-	poolSize    int
+	poolSize    int // Low watermark, new configs are created when the pool has at most poolSize configs
+	poolMaxSize int // High watermark, the surplus configs are removed in the background
+	poolPending int // Network configs being created for the pool
+
+	// Reconciliation of the networks left by a previous run
+	reconcileOnStart bool
+	reconcileReport  *ReconcileReport
 
 	// Mapping of function instance IDs to their network config
 	netConfigs map[string]*NetworkConfig
 
 	// Network configs that are being created
 	inCreation sync.WaitGroup
+	// Surplus network configs that are being removed
+	inTeardown sync.WaitGroup
+}
+
+// NetworkManagerOption configures a network manager
+type NetworkManagerOption func(*NetworkManager)
+
+// WithIPAllocator replaces the IPAM allocating the addresses of the network configs
+func WithIPAllocator(allocator IPAllocator) NetworkManagerOption {
+	return func(mgr *NetworkManager) {
+		mgr.allocator = allocator
+	}
+}
+
+// WithIPAMState persists the addresses allocated by the IPAM to the state file,
+// so that they are recovered after a restart
+func WithIPAMState(statePath string) NetworkManagerOption {
+	return func(mgr *NetworkManager) {
+		mgr.ipamStatePath = statePath
+	}
+}
+
+// WithIPv6 also allocates the addresses of the veth pairs and the clone addresses from the IPv6 networks vethNetwork6
+// and cloneNetwork6 (in CIDR notation), so that the function instances are reachable over both IPv4 and IPv6
+func WithIPv6(vethNetwork6, cloneNetwork6 string) NetworkManagerOption {
+	return func(mgr *NetworkManager) {
+		mgr.vethNetwork6 = vethNetwork6
+		mgr.cloneNetwork6 = cloneNetwork6
+	}
+}
+
+// WithPoolMaxSize sets the high watermark of the pool (2*poolSize by default): the free network configs in excess
+// of maxSize, e.g. released after a burst of function instances, are removed in the background
+func WithPoolMaxSize(maxSize int) NetworkManagerOption {
+	return func(mgr *NetworkManager) {
+		mgr.poolMaxSize = maxSize
+	}
+}
+
+// WithReconciliation adopts the intact networks left by a previous run into the pool and removes the others
+// upon creation of the network manager (see ReconcileReport). It must not be used if other network managers
+// are running on the host, e.g., in tests
+func WithReconciliation() NetworkManagerOption {
+	return func(mgr *NetworkManager) {
+		mgr.reconcileOnStart = true
+	}
 }
 
 // NewNetworkManager creates and returns a new network manager that connects function instances to the network
 // using the supplied interface. If no interface is supplied, the default interface is used. To take the network
 // setup of the critical path of a function creation, the network manager tries to maintain a pool of ready to use
-// network configurations of size at least poolSize.
-func NewNetworkManager(hostIfaceName string, poolSize int, vethPrefix, clonePrefix string) (*NetworkManager, error) {
+// network configurations of size at least poolSize and at most twice poolSize. The addresses of the veth pairs and the clone addresses are
+// allocated from the vethNetwork and cloneNetwork networks (see NewIPAM), unless another allocator is supplied.
+func NewNetworkManager(hostIfaceName string, poolSize int, vethNetwork, cloneNetwork string, opts ...NetworkManagerOption) (*NetworkManager, error) {
 	manager := new(NetworkManager)
+	manager.poolMaxSize = 2 * poolSize
+
+	for _, opt := range opts {
+		opt(manager)
+	}
+
+	if manager.allocator == nil {
+		var ipamOpts []IPAMOption
+		if manager.ipv6Enabled() {
+			ipamOpts = append(ipamOpts, WithIPv6Networks(manager.vethNetwork6, manager.cloneNetwork6))
+		}
+
+		ipam, err := NewIPAM(vethNetwork, cloneNetwork, manager.ipamStatePath, ipamOpts...)
+		if err != nil {
+			return nil, err
+		}
+		manager.allocator = ipam
+	}
 
 	manager.hostIfaceName = hostIfaceName
 	if manager.hostIfaceName == "" {
@@ -70,72 +148,204 @@ func NewNetworkManager(hostIfaceName string, poolSize int, vethPrefix, clonePref
 	manager.netConfigs = make(map[string]*NetworkConfig)
 	manager.networkPool = make([]*NetworkConfig, 0)
 
-	startId, err := getNetworkStartID()
-	if err == nil {
-		manager.nextID = startId
+	if manager.reconcileOnStart {
+		report, err := manager.reconcile()
+		if err != nil {
+			return nil, errors.Wrapf(err, "reconciling networks")
+		}
+		manager.reconcileReport = report
 	} else {
-		manager.nextID = 0
+		startId, err := getNetworkStartID()
+		if err == nil {
+			manager.nextID = startId
+		} else {
+			manager.nextID = 0
+		}
+
+		manager.recoverAllocations()
 	}
 
 	manager.poolCond = sync.NewCond(new(sync.Mutex))
-	manager.vethPrefix = vethPrefix
-	manager.clonePrefix = clonePrefix
 	manager.initConfigPool(poolSize)
 	manager.poolSize = poolSize
 
 	return manager, nil
 }
 
-// initConfigPool fills an empty network pool up to the given poolSize
+// GetReconcileReport returns the report of the reconciliation of the networks left by a previous run,
+// nil if the networks have not been reconciled
+func (mgr *NetworkManager) GetReconcileReport() *ReconcileReport {
+	return mgr.reconcileReport
+}
+
+// initConfigPool fills the network pool, which only contains the adopted configs, up to the given poolSize
 func (mgr *NetworkManager) initConfigPool(poolSize int) {
 	var wg sync.WaitGroup
-	wg.Add(poolSize)
 
 	logger := log.WithFields(log.Fields{"poolSize": poolSize})
 	logger.Debug("Initializing network pool")
 
-	// Concurrently create poolSize network configs
-	for i := 0; i < poolSize; i++ {
+	// Remove the adopted configs in excess
+	mgr.poolCond.L.Lock()
+	mgr.trimPool()
+	mgr.poolCond.L.Unlock()
+
+	// Concurrently create the missing network configs
+	for i := len(mgr.networkPool); i < poolSize; i++ {
+		wg.Add(1)
 		go func() {
-			mgr.addNetConfig()
+			if err := mgr.addNetConfig(); err != nil {
+				log.Errorf("failed to add network config to pool: %s", err)
+			}
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 }
 
+// recoverAllocations releases the addresses allocated to the network configs whose namespace does not exist anymore,
+// e.g., after a reboot. The addresses of the network configs left by a previous run stay allocated, including the
+// ones that are not known to the allocator, e.g. created by another network manager.
+func (mgr *NetworkManager) recoverAllocations() {
+	if networks, err := findHostNetworks(); err != nil {
+		log.Warnf("failed to find the networks left by a previous run: %s", err)
+	} else {
+		allocated := make(map[int]bool)
+		for _, alloc := range mgr.allocator.Allocations() {
+			allocated[alloc.ID] = true
+		}
+		for id, alloc := range networks {
+			if allocated[id] {
+				continue
+			}
+			if err := mgr.allocator.Reserve(alloc); err != nil {
+				log.Warnf("failed to reserve addresses of network config %d: %s", id, err)
+			}
+		}
+	}
+
+	for _, alloc := range mgr.allocator.Allocations() {
+		cfg := NetworkConfig{id: alloc.ID}
+		if _, err := os.Stat(cfg.GetNamespacePath()); os.IsNotExist(err) {
+			if err := mgr.allocator.Release(alloc.ID); err != nil {
+				log.Warnf("failed to release addresses of network config %d: %s", alloc.ID, err)
+			}
+			continue
+		}
+
+		if alloc.ID >= mgr.nextID {
+			mgr.nextID = alloc.ID + 1
+		}
+	}
+}
+
 // addNetConfig creates and initializes a new network config
-func (mgr *NetworkManager) addNetConfig() {
+func (mgr *NetworkManager) addNetConfig() error {
+	netCfg, err := mgr.newNetConfig()
+	if err != nil {
+		return err
+	}
+
+	mgr.createNetConfig(netCfg)
+	return nil
+}
+
+// newNetConfig allocates the ID and the addresses of a new network config
+func (mgr *NetworkManager) newNetConfig() (*NetworkConfig, error) {
 	mgr.Lock()
+	defer mgr.Unlock()
+
 	id := mgr.nextID
+	alloc, err := mgr.allocator.Allocate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	netCfg, err := mgr.configFromAllocation(alloc)
+	if err != nil {
+		_ = mgr.allocator.Release(id)
+		return nil, err
+	}
+
 	mgr.nextID += 1
 	mgr.inCreation.Add(1)
-	mgr.Unlock()
 
-	netCfg := NewNetworkConfig(id, mgr.hostIfaceName, mgr.vethPrefix, mgr.clonePrefix)
+	mgr.poolCond.L.Lock()
+	mgr.poolPending++
+	mgr.poolCond.L.Unlock()
+
+	return netCfg, nil
+}
+
+// ipv6Enabled reports whether the IPAM also allocates IPv6 addresses
+func (mgr *NetworkManager) ipv6Enabled() bool {
+	return mgr.vethNetwork6 != ""
+}
+
+// configFromAllocation returns the network config using the allocated addresses,
+// which is dual-stack if IPv6 addresses were allocated
+func (mgr *NetworkManager) configFromAllocation(alloc IPAllocation) (*NetworkConfig, error) {
+	_, vethNet, err := net.ParseCIDR(alloc.VethCIDR)
+	cloneIP := net.ParseIP(alloc.CloneIP)
+	if err != nil || cloneIP == nil {
+		return nil, errors.Errorf("invalid addresses %s and %s allocated to network config %d", alloc.VethCIDR, alloc.CloneIP, alloc.ID)
+	}
+	cfg := NewNetworkConfig(alloc.ID, mgr.hostIfaceName, vethNet, cloneIP)
+
+	if alloc.VethCIDR6 != "" {
+		_, vethNet6, err := net.ParseCIDR(alloc.VethCIDR6)
+		cloneIP6 := net.ParseIP(alloc.CloneIP6)
+		if err != nil || cloneIP6 == nil {
+			return nil, errors.Errorf("invalid IPv6 addresses %s and %s allocated to network config %d", alloc.VethCIDR6, alloc.CloneIP6, alloc.ID)
+		}
+		cfg.enableIPv6(vethNet6, cloneIP6)
+	}
+
+	return cfg, nil
+}
+
+// createNetConfig creates the network of a new network config and adds it to the pool
+func (mgr *NetworkManager) createNetConfig(netCfg *NetworkConfig) {
 	if err := netCfg.CreateNetwork(); err != nil {
 		log.Errorf("failed to create network %s:", err)
 	}
 
 	mgr.poolCond.L.Lock()
 	mgr.networkPool = append(mgr.networkPool, netCfg)
-	// Signal in case someone is waiting for a new config to become available in the pool
-	mgr.poolCond.Signal()
+	mgr.poolPending--
+	// Broadcast in case someone is waiting for a new config to become available in the pool, or for the last
+	// config in creation if no more addresses can be allocated
+	mgr.poolCond.Broadcast()
 	mgr.poolCond.L.Unlock()
 	mgr.inCreation.Done()
 }
 
 // allocNetConfig allocates a new network config from the pool to a function instance identified by funcID
-func (mgr *NetworkManager) allocNetConfig(funcID string) *NetworkConfig {
+func (mgr *NetworkManager) allocNetConfig(funcID string) (*NetworkConfig, error) {
 	logger := log.WithFields(log.Fields{"funcID": funcID})
 	logger.Debug("Allocating a new network config from network pool to function instance")
 
 	mgr.poolCond.L.Lock()
+	replenish := len(mgr.networkPool) <= mgr.poolSize
+	mgr.poolCond.L.Unlock()
+
 	// Add netconfig to pool to keep pool to configured size
-	if len(mgr.networkPool) <= mgr.poolSize {
-		go mgr.addNetConfig()
+	var allocErr error
+	if replenish {
+		if netCfg, err := mgr.newNetConfig(); err != nil {
+			allocErr = err
+		} else {
+			go mgr.createNetConfig(netCfg)
+		}
 	}
+
+	mgr.poolCond.L.Lock()
 	for len(mgr.networkPool) == 0 {
+		if allocErr != nil && mgr.poolPending == 0 {
+			// No network config is going to be added to the pool
+			mgr.poolCond.L.Unlock()
+			return nil, errors.Wrapf(allocErr, "allocating network config")
+		}
 		// Wait until a new network config has been created
 		mgr.poolCond.Wait()
 	}
@@ -165,7 +375,7 @@ func (mgr *NetworkManager) allocNetConfig(funcID string) *NetworkConfig {
 
 	logger.Debug("Allocated a new network config")
 
-	return config
+	return config, nil
 }
 
 // releaseNetConfig releases the network config of a given function instance with id funcID back to the pool
@@ -178,23 +388,114 @@ func (mgr *NetworkManager) releaseNetConfig(funcID string) {
 	logger := log.WithFields(log.Fields{"funcID": funcID})
 	logger.Debug("Releasing network config from function instance and adding it to network pool")
 
-	// Add network config back to the pool. We allow the pool to grow over it's configured size here since the
+	if config == nil {
+		logger.Warn("No network config allocated to function instance")
+		return
+	}
+
+	// The configs in the pool are neither limited nor restricted
+	if err := config.SetRateLimits(RateLimits{}); err != nil {
+		logger.Warnf("failed to remove rate limits: %v", err)
+	}
+	if err := config.SetEgressPolicy(EgressPolicy{}); err != nil {
+		logger.Warnf("failed to remove egress policy: %v", err)
+	}
+
+	// Add network config back to the pool. We allow the pool to grow up to its high watermark here since the
 	// overhead of keeping a network config in the pool is low compared to the cost of creating a new config.
 	mgr.poolCond.L.Lock()
 	mgr.networkPool = append(mgr.networkPool, config)
 	mgr.poolCond.Signal()
+	mgr.trimPool()
 	mgr.poolCond.L.Unlock()
 }
 
+// trimPool removes the network configs in excess of the high watermark from the pool and tears them down in the
+// background, starting with the least recently released ones. The caller must hold the lock of the pool.
+func (mgr *NetworkManager) trimPool() {
+	surplus := len(mgr.networkPool) - mgr.poolMaxSize
+	if surplus <= 0 {
+		return
+	}
+
+	configs := make([]*NetworkConfig, surplus)
+	copy(configs, mgr.networkPool[:surplus])
+	mgr.networkPool = append(mgr.networkPool[:0], mgr.networkPool[surplus:]...)
+
+	log.WithFields(log.Fields{"surplus": surplus}).Debug("Removing surplus network configs from network pool")
+
+	mgr.inTeardown.Add(len(configs))
+	for _, config := range configs {
+		go func(config *NetworkConfig) {
+			defer mgr.inTeardown.Done()
+			if err := config.RemoveNetwork(); err != nil {
+				log.Errorf("failed to remove network %s:", err)
+				return
+			}
+			if err := mgr.allocator.Release(config.id); err != nil {
+				log.Errorf("failed to release addresses %s:", err)
+			}
+		}(config)
+	}
+}
+
+// NetworkOption configures the network of a function instance when it is allocated
+type NetworkOption func(*NetworkConfig) error
+
+// WithRateLimits limits the traffic to and from the function instance
+func WithRateLimits(limits RateLimits) NetworkOption {
+	return func(cfg *NetworkConfig) error {
+		return cfg.SetRateLimits(limits)
+	}
+}
+
+// WithEgressPolicy restricts the traffic sent by the function instance
+func WithEgressPolicy(policy EgressPolicy) NetworkOption {
+	return func(cfg *NetworkConfig) error {
+		return cfg.SetEgressPolicy(policy)
+	}
+}
+
 // CreateNetwork creates the networking for a function instance identified by funcID
-func (mgr *NetworkManager) CreateNetwork(funcID string) (*NetworkConfig, error) {
+func (mgr *NetworkManager) CreateNetwork(funcID string, opts ...NetworkOption) (*NetworkConfig, error) {
 	logger := log.WithFields(log.Fields{"funcID": funcID})
 	logger.Debug("Creating network config for function instance")
 
-	netCfg := mgr.allocNetConfig(funcID)
+	netCfg, err := mgr.allocNetConfig(funcID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		if err := opt(netCfg); err != nil {
+			mgr.releaseNetConfig(funcID)
+			return nil, err
+		}
+	}
+
 	return netCfg, nil
 }
 
+// SetRateLimits replaces the limits of the traffic to and from the function instance identified by funcID
+func (mgr *NetworkManager) SetRateLimits(funcID string, limits RateLimits) error {
+	cfg := mgr.GetConfig(funcID)
+	if cfg == nil {
+		return errors.Errorf("no network config for function instance %s", funcID)
+	}
+
+	return cfg.SetRateLimits(limits)
+}
+
+// SetEgressPolicy replaces the restrictions of the traffic sent by the function instance identified by funcID
+func (mgr *NetworkManager) SetEgressPolicy(funcID string, policy EgressPolicy) error {
+	cfg := mgr.GetConfig(funcID)
+	if cfg == nil {
+		return errors.Errorf("no network config for function instance %s", funcID)
+	}
+
+	return cfg.SetEgressPolicy(policy)
+}
+
 // GetConfig returns the network config assigned to a function instance identified by funcID
 func (mgr *NetworkManager) GetConfig(funcID string) *NetworkConfig {
 	mgr.Lock()
@@ -220,8 +521,9 @@ func (mgr *NetworkManager) Cleanup() error {
 	mgr.Lock()
 	defer mgr.Unlock()
 
-	// Wait till all network configs still in creation are added
+	// Wait till all network configs still in creation are added and the surplus ones are removed
 	mgr.inCreation.Wait()
+	mgr.inTeardown.Wait()
 
 	// Release network configs still in use
 	var wgu sync.WaitGroup
@@ -232,6 +534,9 @@ func (mgr *NetworkManager) Cleanup() error {
 			if err := config.RemoveNetwork(); err != nil {
 				log.Errorf("failed to remove network %s:", err)
 			}
+			if err := mgr.allocator.Release(config.id); err != nil {
+				log.Errorf("failed to release addresses %s:", err)
+			}
 			wgu.Done()
 		}(config)
 	}
@@ -248,6 +553,9 @@ func (mgr *NetworkManager) Cleanup() error {
 			if err := config.RemoveNetwork(); err != nil {
 				log.Errorf("failed to remove network %s:", err)
 			}
+			if err := mgr.allocator.Release(config.id); err != nil {
+				log.Errorf("failed to release addresses %s:", err)
+			}
 			wg.Done()
 		}(config)
 	}
@@ -27,6 +27,7 @@ import (
 	"net"
 	"runtime"
 
+	"github.com/google/nftables"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netns"
@@ -37,11 +38,15 @@ const (
 	defaultGatewayCIDR   = "172.16.0.1/24"
 	defaultContainerTap  = "tap0"
 	defaultContainerMac  = "06:00:AC:10:00:02"
+
+	defaultContainerCIDR6 = "fd00:ac10::2/64"
+	defaultGatewayCIDR6   = "fd00:ac10::1/64"
 )
 
 // NetworkConfig represents the network devices, IPs, namespaces, routes and filter rules to connect a uVM
-// to the network. The network config ID is deterministically mapped to IP addresses to be used for the uVM.
-// Note that due to the current allocation of IPs at most 2^14 VMs can be simultaneously be available on a single host.
+// to the network. The network config ID names the devices and the namespace of the uVM, while the IP addresses
+// of the veth pair and the clone address are allocated by the IP allocator of the network manager. If the network
+// config has IPv6 addresses, the uVM is also reachable over IPv6 (dual-stack).
 type NetworkConfig struct {
 	id            int
 	containerCIDR string // Container IP address (CIDR notation)
@@ -50,12 +55,20 @@ type NetworkConfig struct {
 	containerMac  string // Container Mac address
 	hostIfaceName string // Host network interface name
 
-	vethPrefix  string // Prefix for IP addresses of veth devices
-	clonePrefix string // Prefix for IP addresses of clone devices
+	vethNet *net.IPNet // Network of the veth pair (/30)
+	cloneIP net.IP     // Address the uVM is reachable at from the host
+
+	containerCIDR6 string     // Container IPv6 address (CIDR notation)
+	gatewayCIDR6   string     // Container gateway IPv6 address (CIDR notation)
+	vethNet6       *net.IPNet // IPv6 network of the veth pair (/126), nil if IPv6 is disabled
+	cloneIP6       net.IP     // IPv6 address the uVM is reachable at from the host, nil if IPv6 is disabled
+
+	rateLimits   RateLimits   // Limits of the traffic to and from the uVM
+	egressPolicy EgressPolicy // Restrictions of the traffic sent by the uVM
 }
 
-// NewNetworkConfig creates a new network config with a given id and default host interface
-func NewNetworkConfig(id int, hostIfaceName string, vethPrefix, clonePrefix string) *NetworkConfig {
+// NewNetworkConfig creates a new network config with a given id, default host interface and allocated addresses
+func NewNetworkConfig(id int, hostIfaceName string, vethNet *net.IPNet, cloneIP net.IP) *NetworkConfig {
 	return &NetworkConfig{
 		id:            id,
 		containerCIDR: defaultContainerCIDR,
@@ -64,11 +77,24 @@ func NewNetworkConfig(id int, hostIfaceName string, vethPrefix, clonePrefix stri
 		containerMac:  defaultContainerMac,
 		hostIfaceName: hostIfaceName,
 
-		vethPrefix:  vethPrefix,
-		clonePrefix: clonePrefix,
+		vethNet: vethNet,
+		cloneIP: cloneIP,
 	}
 }
 
+// enableIPv6 assigns the allocated IPv6 addresses to the network config, which must be done before creating the network
+func (cfg *NetworkConfig) enableIPv6(vethNet6 *net.IPNet, cloneIP6 net.IP) {
+	cfg.containerCIDR6 = defaultContainerCIDR6
+	cfg.gatewayCIDR6 = defaultGatewayCIDR6
+	cfg.vethNet6 = vethNet6
+	cfg.cloneIP6 = cloneIP6
+}
+
+// hasIPv6 reports whether the uVM is also reachable over IPv6
+func (cfg *NetworkConfig) hasIPv6() bool {
+	return cfg.vethNet6 != nil
+}
+
 // GetMacAddress returns the mac address used for the uVM
 func (cfg *NetworkConfig) GetMacAddress() string {
 	return cfg.containerMac
@@ -86,7 +112,7 @@ func (cfg *NetworkConfig) getVeth0Name() string {
 
 // getVeth0CIDR returns the IP address for the veth device at the side of the uVM in CIDR notation
 func (cfg *NetworkConfig) getVeth0CIDR() string {
-	return fmt.Sprintf("%s.%d.%d/30", cfg.vethPrefix, (4*cfg.id)/256, ((4*cfg.id)+2)%256)
+	return fmt.Sprintf("%s/30", addToIP(cfg.vethNet.IP, 2))
 }
 
 // getVeth1Name returns the name for the veth device at the side of the host
@@ -96,12 +122,30 @@ func (cfg *NetworkConfig) getVeth1Name() string {
 
 // getVeth1Name returns the IP address for the veth device at the side of the host in CIDR notation
 func (cfg *NetworkConfig) getVeth1CIDR() string {
-	return fmt.Sprintf("%s.%d.%d/30", cfg.vethPrefix, (4*cfg.id)/256, ((4*cfg.id)+1)%256)
+	return fmt.Sprintf("%s/30", addToIP(cfg.vethNet.IP, 1))
+}
+
+// getVeth0CIDR6 returns the IPv6 address for the veth device at the side of the uVM in CIDR notation
+func (cfg *NetworkConfig) getVeth0CIDR6() string {
+	return fmt.Sprintf("%s/126", addToIP(cfg.vethNet6.IP, 2))
+}
+
+// getVeth1CIDR6 returns the IPv6 address for the veth device at the side of the host in CIDR notation
+func (cfg *NetworkConfig) getVeth1CIDR6() string {
+	return fmt.Sprintf("%s/126", addToIP(cfg.vethNet6.IP, 1))
 }
 
 // GetCloneIP returns the IP address the uVM is reachable at from the host
 func (cfg *NetworkConfig) GetCloneIP() string {
-	return fmt.Sprintf("%s.%d.%d", cfg.clonePrefix, cfg.id/254, 1+(cfg.id%254))
+	return cfg.cloneIP.String()
+}
+
+// GetCloneIPv6 returns the IPv6 address the uVM is reachable at from the host, empty if IPv6 is disabled
+func (cfg *NetworkConfig) GetCloneIPv6() string {
+	if !cfg.hasIPv6() {
+		return ""
+	}
+	return cfg.cloneIP6.String()
 }
 
 // GetContainerCIDR returns the internal IP of the uVM in CIDR notation
@@ -109,11 +153,22 @@ func (cfg *NetworkConfig) GetContainerCIDR() string {
 	return cfg.containerCIDR
 }
 
+// GetContainerCIDR6 returns the internal IPv6 address of the uVM in CIDR notation, empty if IPv6 is disabled
+func (cfg *NetworkConfig) GetContainerCIDR6() string {
+	return cfg.containerCIDR6
+}
+
 // getNamespaceName returns the network namespace name for the uVM
 func (cfg *NetworkConfig) getNamespaceName() string {
 	return fmt.Sprintf("uvmns%d", cfg.id)
 }
 
+// getEgressLogPrefix returns the prefix of the kernel log messages of the packets dropped by the egress policy,
+// which identifies the uVM by its clone address as all uVMs share the same internal IP
+func (cfg *NetworkConfig) getEgressLogPrefix() string {
+	return fmt.Sprintf("vhive-egress-drop %s: ", cfg.GetCloneIP())
+}
+
 // GetNamespacePath returns the full path to the network namespace for the uVM
 func (cfg *NetworkConfig) GetNamespacePath() string {
 	return fmt.Sprintf("/var/run/netns/%s", cfg.getNamespaceName())
@@ -131,6 +186,71 @@ func (cfg *NetworkConfig) GetGatewayIP() string {
 	return ip.String()
 }
 
+// getContainerIP6 returns the internal IPv6 address of the uVM
+func (cfg *NetworkConfig) getContainerIP6() string {
+	ip, _, _ := net.ParseCIDR(cfg.containerCIDR6)
+	return ip.String()
+}
+
+// GetGatewayIP6 returns the IPv6 address of the tap device associated with the uVM, empty if IPv6 is disabled
+func (cfg *NetworkConfig) GetGatewayIP6() string {
+	if !cfg.hasIPv6() {
+		return ""
+	}
+	ip, _, _ := net.ParseCIDR(cfg.gatewayCIDR6)
+	return ip.String()
+}
+
+// GetRateLimits returns the limits of the traffic to and from the uVM
+func (cfg *NetworkConfig) GetRateLimits() RateLimits {
+	return cfg.rateLimits
+}
+
+// SetRateLimits replaces the limits of the traffic to and from the uVM, the network must be created
+func (cfg *NetworkConfig) SetRateLimits(limits RateLimits) error {
+	if limits == cfg.rateLimits {
+		return nil
+	}
+
+	vmNsHandle, err := netns.GetFromName(cfg.getNamespaceName())
+	if err != nil {
+		return errors.Wrapf(err, "getting network namespace")
+	}
+	defer func() { _ = vmNsHandle.Close() }()
+
+	if err := setRateLimits(cfg.containerTap, cfg.getVeth0Name(), limits, vmNsHandle); err != nil {
+		return err
+	}
+	cfg.rateLimits = limits
+
+	return nil
+}
+
+// GetEgressPolicy returns the restrictions of the traffic sent by the uVM
+func (cfg *NetworkConfig) GetEgressPolicy() EgressPolicy {
+	return cfg.egressPolicy
+}
+
+// SetEgressPolicy replaces the restrictions of the traffic sent by the uVM, the network must be created
+func (cfg *NetworkConfig) SetEgressPolicy(policy EgressPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	vmNsHandle, err := netns.GetFromName(cfg.getNamespaceName())
+	if err != nil {
+		return errors.Wrapf(err, "getting network namespace")
+	}
+	defer func() { _ = vmNsHandle.Close() }()
+
+	if err := setEgressPolicy(cfg.containerTap, cfg.getEgressLogPrefix(), policy, vmNsHandle); err != nil {
+		return err
+	}
+	cfg.egressPolicy = policy
+
+	return nil
+}
+
 // createVmNetwork creates network devices, namespaces, routes and filter rules for the uVM at the
 // uVM side
 func (cfg *NetworkConfig) createVmNetwork(hostNsHandle netns.NsHandle) error {
@@ -169,6 +289,34 @@ func (cfg *NetworkConfig) createVmNetwork(hostNsHandle netns.NsHandle) error {
 		return err
 	}
 
+	if !cfg.hasIPv6() {
+		return nil
+	}
+
+	// A.5. Repeat the configuration for IPv6
+	// A.5.1 Enable forwarding between the tap and the veth device
+	if err := enableIPv6Forwarding(); err != nil {
+		return err
+	}
+
+	// A.5.2 Give the tap and the uVM side veth pair IPv6 addresses
+	if err := addAddress(cfg.containerTap, cfg.gatewayCIDR6); err != nil {
+		return err
+	}
+	if err := addAddress(cfg.getVeth0Name(), cfg.getVeth0CIDR6()); err != nil {
+		return err
+	}
+
+	// A.5.3 Designate host side as default gateway for packets leaving namespace
+	if err := setDefaultGateway(cfg.getVeth1CIDR6()); err != nil {
+		return err
+	}
+
+	// A.5.4 Setup NAT rules
+	if err := setupNatRules(cfg.getVeth0Name(), cfg.getContainerIP6(), cfg.GetCloneIPv6(), vmNsHandle); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -187,10 +335,28 @@ func (cfg *NetworkConfig) createHostNetwork() error {
 	}
 
 	// B.3 Setup nat to route traffic out of veth device
-	if err := setupForwardRules(cfg.getVeth1Name(), cfg.hostIfaceName); err != nil {
+	if err := setupForwardRules(cfg.getVeth1Name(), cfg.hostIfaceName, nftables.TableFamilyIPv4); err != nil {
+		return err
+	}
+	if err := setupMasquerade(cfg.getVeth1Name(), cfg.hostIfaceName, nftables.TableFamilyIPv4); err != nil {
+		return err
+	}
+
+	if !cfg.hasIPv6() {
+		return nil
+	}
+
+	// B.4 Repeat the configuration for IPv6
+	if err := addAddress(cfg.getVeth1Name(), cfg.getVeth1CIDR6()); err != nil {
 		return err
 	}
-	if err := setupMasquerade(cfg.getVeth1Name(), cfg.hostIfaceName); err != nil {
+	if err := addRoute(cfg.GetCloneIPv6(), cfg.getVeth0CIDR6()); err != nil {
+		return err
+	}
+	if err := setupForwardRules(cfg.getVeth1Name(), cfg.hostIfaceName, nftables.TableFamilyIPv6); err != nil {
+		return err
+	}
+	if err := setupMasquerade(cfg.getVeth1Name(), cfg.hostIfaceName, nftables.TableFamilyIPv6); err != nil {
 		return err
 	}
 	return nil
@@ -237,11 +403,24 @@ func (cfg *NetworkConfig) CreateNetwork() error {
 // CreateNetwork removes the necessary network devices, namespaces, routes and filter rules to connect the
 // function instance to the network
 func (cfg *NetworkConfig) RemoveNetwork() error {
+	// Delete the IPv6 nat, forward rules and route on the host for the clone address
+	if cfg.hasIPv6() {
+		if err := deleteMasquerade(cfg.getVeth1Name(), nftables.TableFamilyIPv6); err != nil {
+			return err
+		}
+		if err := deleteForwardRules(cfg.getVeth1Name(), nftables.TableFamilyIPv6); err != nil {
+			return err
+		}
+		if err := deleteRoute(cfg.GetCloneIPv6(), cfg.getVeth0CIDR6()); err != nil {
+			return err
+		}
+	}
+
 	// Delete nat to route traffic out of veth device
-	if err := deleteMasquerade(cfg.getVeth1Name()); err != nil {
+	if err := deleteMasquerade(cfg.getVeth1Name(), nftables.TableFamilyIPv4); err != nil {
 		return err
 	}
-	if err := deleteForwardRules(cfg.getVeth1Name()); err != nil {
+	if err := deleteForwardRules(cfg.getVeth1Name(), nftables.TableFamilyIPv4); err != nil {
 		return err
 	}
 
@@ -271,14 +450,36 @@ func (cfg *NetworkConfig) RemoveNetwork() error {
 	}
 
 	// Delete NAT rules
-	if err := deleteNatRules(vmNsHandle); err != nil {
+	if err := deleteNatRules(vmNsHandle, nftables.TableFamilyIPv4); err != nil {
 		return err
 	}
+	if cfg.hasIPv6() {
+		if err := deleteNatRules(vmNsHandle, nftables.TableFamilyIPv6); err != nil {
+			return err
+		}
+	}
+
+	// Delete rate limits
+	if err := setRateLimits(cfg.containerTap, cfg.getVeth0Name(), RateLimits{}, vmNsHandle); err != nil {
+		return err
+	}
+	cfg.rateLimits = RateLimits{}
+
+	// Delete egress policy
+	if err := setEgressPolicy(cfg.containerTap, cfg.getEgressLogPrefix(), EgressPolicy{}, vmNsHandle); err != nil {
+		return err
+	}
+	cfg.egressPolicy = EgressPolicy{}
 
 	// Delete default gateway for packets leaving namespace
 	if err := deleteDefaultGateway(cfg.getVeth1CIDR()); err != nil {
 		return err
 	}
+	if cfg.hasIPv6() {
+		if err := deleteDefaultGateway(cfg.getVeth1CIDR6()); err != nil {
+			return err
+		}
+	}
 
 	// Delete uVM side veth pair
 	if err := deleteVethPair(cfg.getVeth0Name(), cfg.getVeth1Name(), vmNsHandle, hostNsHandle); err != nil {
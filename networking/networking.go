@@ -146,6 +146,62 @@ func configVeth(linkName, vethIp string) error {
 	return nil
 }
 
+// addAddress adds an IP address, in CIDR notation, to the link. IPv6 addresses skip the duplicate address detection,
+// as the addresses of the links of the uVM networks are unique and could not be used until the detection completes.
+func addAddress(linkName, cidr string) error {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return errors.Wrapf(err, "finding link %s", linkName)
+	}
+
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing address")
+	}
+	if addr.IP.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return errors.Wrapf(err, "adding address to link %s", linkName)
+	}
+
+	return nil
+}
+
+// enableIPv6Forwarding enables the forwarding of IPv6 packets in the current network namespace, which is not
+// inherited by new namespaces unlike the forwarding of IPv4 packets
+func enableIPv6Forwarding() error {
+	if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+		return errors.Wrapf(err, "enabling IPv6 forwarding")
+	}
+
+	return nil
+}
+
+// ipHeader describes the network header of an IP version for the nftables rules
+type ipHeader struct {
+	family      nftables.TableFamily
+	nfproto     uint32
+	saddrOffset uint32
+	daddrOffset uint32
+}
+
+// headerOf returns the network header of the packets of the IP version of ip, and ip in its header representation
+func headerOf(ip net.IP) (ipHeader, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ipHeader{family: nftables.TableFamilyIPv4, nfproto: unix.NFPROTO_IPV4, saddrOffset: 12, daddrOffset: 16}, ip4
+	}
+	return ipHeader{family: nftables.TableFamilyIPv6, nfproto: unix.NFPROTO_IPV6, saddrOffset: 8, daddrOffset: 24}, ip.To16()
+}
+
+// hostNetwork returns the network only containing ip (/32 for IPv4, /128 for IPv6)
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
 // setDefaultGateway creates a default routing rule to the supplied gatewayIP
 func setDefaultGateway(gatewayIp string) error {
 	gw, _, err := net.ParseCIDR(gatewayIp)
@@ -185,14 +241,17 @@ func deleteDefaultGateway(gatewayIp string) error {
 }
 
 // setupNatRules configures the NAT rules. Each uVMs address is translated to an external clone address to avoid
-// conflicts (see https://github.com/firecracker-microvm/firecracker/blob/main/docs/snapshotting/network-for-clones.md)
+// conflicts (see https://github.com/firecracker-microvm/firecracker/blob/main/docs/snapshotting/network-for-clones.md).
+// The rules are added to the ip or ip6 nat table depending on the IP version of the addresses.
 func setupNatRules(vethVmName, hostIp, cloneIp string, vmNsHandle netns.NsHandle) error {
 	conn := nftables.Conn{NetNS: int(vmNsHandle)}
+	header, hostAddr := headerOf(net.ParseIP(hostIp))
+	_, cloneAddr := headerOf(net.ParseIP(cloneIp))
 
 	// 1. add table ip nat
 	natTable := &nftables.Table{
 		Name:   "nat",
-		Family: nftables.TableFamilyIPv4,
+		Family: header.family,
 	}
 
 	// 2. Iptables: -t nat -A POSTROUTING -o veth1-0 -s 172.16.0.2 -j SNAT --to 192.168.0.1
@@ -220,27 +279,27 @@ func setupNatRules(vethVmName, hostIp, cloneIp string, vmNsHandle netns.NsHandle
 				Register: 1,
 				Data:     []byte(fmt.Sprintf("%s\x00", vethVmName)),
 			},
-			// Load source IP address (offset 12 bytes network header) in register 1
+			// Load source IP address (offset 12 bytes IPv4 header, 8 bytes IPv6 header) in register 1
 			&expr.Payload{
 				DestRegister: 1,
 				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       12,
-				Len:          4,
+				Offset:       header.saddrOffset,
+				Len:          uint32(len(hostAddr)),
 			},
 			// Check source ip address == 172.16.0.2
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     net.ParseIP(hostIp).To4(),
+				Data:     hostAddr,
 			},
 			// Load snatted address (192.168.0.1) in register 1
 			&expr.Immediate{
 				Register: 1,
-				Data:     net.ParseIP(cloneIp).To4(),
+				Data:     cloneAddr,
 			},
 			&expr.NAT{
 				Type:       expr.NATTypeSourceNAT, // Snat
-				Family:     unix.NFPROTO_IPV4,
+				Family:     header.nfproto,
 				RegAddrMin: 1,
 			},
 		},
@@ -270,27 +329,27 @@ func setupNatRules(vethVmName, hostIp, cloneIp string, vmNsHandle netns.NsHandle
 				Register: 1,
 				Data:     []byte(fmt.Sprintf("%s\x00", vethVmName)),
 			},
-			// Load destination IP address (offset 16 bytes network header) in register 1
+			// Load destination IP address (offset 16 bytes IPv4 header, 24 bytes IPv6 header) in register 1
 			&expr.Payload{
 				DestRegister: 1,
 				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       16,
-				Len:          4,
+				Offset:       header.daddrOffset,
+				Len:          uint32(len(cloneAddr)),
 			},
 			// Check destination ip address == 192.168.0.1
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
 				Register: 1,
-				Data:     net.ParseIP(cloneIp).To4(),
+				Data:     cloneAddr,
 			},
 			// Load dnatted address (172.16.0.2) in register 1
 			&expr.Immediate{
 				Register: 1,
-				Data:     net.ParseIP(hostIp).To4(),
+				Data:     hostAddr,
 			},
 			&expr.NAT{
 				Type:       expr.NATTypeDestNAT, // Dnat
-				Family:     unix.NFPROTO_IPV4,
+				Family:     header.nfproto,
 				RegAddrMin: 1,
 			},
 		},
@@ -308,13 +367,13 @@ func setupNatRules(vethVmName, hostIp, cloneIp string, vmNsHandle netns.NsHandle
 	return nil
 }
 
-// deleteNatRules deletes the NAT rules to give each uVM a clone address.
-func deleteNatRules(vmNsHandle netns.NsHandle) error {
+// deleteNatRules deletes the NAT rules of the family (ip or ip6) to give each uVM a clone address.
+func deleteNatRules(vmNsHandle netns.NsHandle, family nftables.TableFamily) error {
 	conn := nftables.Conn{NetNS: int(vmNsHandle)}
 
 	natTable := &nftables.Table{
 		Name:   "nat",
-		Family: nftables.TableFamilyIPv4,
+		Family: family,
 	}
 
 	// Apply
@@ -325,14 +384,15 @@ func deleteNatRules(vmNsHandle netns.NsHandle) error {
 	return nil
 }
 
-// setupForwardRules creates forwarding rules to allow traffic from the end of the veth pair to the default host interface.
-func setupForwardRules(vethHostName, hostIface string) error {
+// setupForwardRules creates forwarding rules of the family (ip or ip6) to allow traffic from the end of the veth pair to
+// the default host interface.
+func setupForwardRules(vethHostName, hostIface string, family nftables.TableFamily) error {
 	conn := nftables.Conn{}
 
 	// 1. add table ip filter
 	filterTable := &nftables.Table{
 		Name:   "filter",
-		Family: nftables.TableFamilyIPv4,
+		Family: family,
 	}
 
 	// 2. add chain ip filter FORWARD { type filter hook forward priority 0; policy accept; }
@@ -413,13 +473,13 @@ func setupForwardRules(vethHostName, hostIface string) error {
 }
 
 // deleteNatRules deletes the forward rules to allow traffic to the default host interface.
-func deleteForwardRules(vethHostName string) error {
+func deleteForwardRules(vethHostName string, family nftables.TableFamily) error {
 	conn := nftables.Conn{}
 
 	// 1. add table ip filter
 	filterTable := &nftables.Table{
 		Name:   "filter",
-		Family: nftables.TableFamilyIPv4,
+		Family: family,
 	}
 
 	// 2. add chain ip filter FORWARD { type filter hook forward priority 0; policy accept; }
@@ -442,14 +502,14 @@ func deleteForwardRules(vethHostName string) error {
 	return nil
 }
 
-// setupMasquerade creates NAT rules for external communication from the uVM.
-func setupMasquerade(vethHostName, hostIface string) error {
+// setupMasquerade creates NAT rules of the family (ip or ip6) for external communication from the uVM.
+func setupMasquerade(vethHostName, hostIface string, family nftables.TableFamily) error {
 	conn := nftables.Conn{}
 
 	// 1. add table ip nat
 	natTable := &nftables.Table{
 		Name:   "nat",
-		Family: nftables.TableFamilyIPv4,
+		Family: family,
 	}
 
 	// 2. add chain ip nat POSTROUTING { type nat hook postrouting priority 0; policy accept; }
@@ -500,13 +560,13 @@ func setupMasquerade(vethHostName, hostIface string) error {
 }
 
 // deleteMasquerade deletes the NAT rules for external communication from the uVM.
-func deleteMasquerade(vethHostName string) error {
+func deleteMasquerade(vethHostName string, family nftables.TableFamily) error {
 	conn := nftables.Conn{}
 
 	// 1. add table ip nat
 	natTable := &nftables.Table{
 		Name:   "nat",
-		Family: nftables.TableFamilyIPv4,
+		Family: family,
 	}
 
 	// 2. del chain ip filter MASQ { type filter hook forward priority 0; policy accept; }
@@ -531,9 +591,9 @@ func deleteMasquerade(vethHostName string) error {
 
 // addRoute adds a routing table entry to destIp with gateway gatewayIp.
 func addRoute(destIp, gatewayIp string) error {
-	_, dstNet, err := net.ParseCIDR(fmt.Sprintf("%s/32", destIp))
-	if err != nil {
-		return errors.Wrapf(err, "parsing route destination ip")
+	dstAddr := net.ParseIP(destIp)
+	if dstAddr == nil {
+		return errors.Errorf("parsing route destination ip %s", destIp)
 	}
 
 	gwAddr, _, err := net.ParseCIDR(gatewayIp)
@@ -542,7 +602,7 @@ func addRoute(destIp, gatewayIp string) error {
 	}
 
 	route := &netlink.Route{
-		Dst: dstNet,
+		Dst: hostNetwork(dstAddr),
 		Gw:  gwAddr,
 	}
 
@@ -554,9 +614,9 @@ func addRoute(destIp, gatewayIp string) error {
 
 // addRoute deletes the routing table entry to destIp with gateway gatewayIp.
 func deleteRoute(destIp, gatewayIp string) error {
-	_, dstNet, err := net.ParseCIDR(fmt.Sprintf("%s/32", destIp))
-	if err != nil {
-		return errors.Wrapf(err, "parsing route destination ip")
+	dstAddr := net.ParseIP(destIp)
+	if dstAddr == nil {
+		return errors.Errorf("parsing route destination ip %s", destIp)
 	}
 
 	gwAddr, _, err := net.ParseCIDR(gatewayIp)
@@ -565,7 +625,7 @@ func deleteRoute(destIp, gatewayIp string) error {
 	}
 
 	route := &netlink.Route{
-		Dst: dstNet,
+		Dst: hostNetwork(dstAddr),
 		Gw:  gwAddr,
 	}
 
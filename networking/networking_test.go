@@ -24,13 +24,20 @@ package networking
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
 
 	ctrdlog "github.com/containerd/containerd/log"
+	"github.com/google/nftables"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 func TestMain(m *testing.M) {
@@ -108,3 +115,489 @@ func TestCreateRemoveNetworkSerial(t *testing.T) {
 		require.NoError(t, err, "Failed to remove network")
 	}
 }
+
+func TestRateLimits(t *testing.T) {
+	mgr, err := NewNetworkManager("", 1, "172.17", "172.18")
+	require.NoError(t, err, "Network manager creation returned error")
+	defer func() { _ = mgr.Cleanup() }()
+
+	limits := RateLimits{
+		Ingress: RateLimit{Bandwidth: 10 * 1024 * 1024, Packets: 1000},
+		Egress:  RateLimit{Bandwidth: 1024 * 1024},
+	}
+
+	cfg, err := mgr.CreateNetwork("func_0", WithRateLimits(limits))
+	require.NoError(t, err, "Failed to create network")
+	require.Equal(t, limits, cfg.GetRateLimits())
+	requireRateLimits(t, cfg, limits)
+
+	// the limits can be changed while the network is in use
+	limits.Ingress = RateLimit{}
+	limits.Egress.Packets = 500
+	require.NoError(t, mgr.SetRateLimits("func_0", limits), "Failed to change rate limits")
+	requireRateLimits(t, cfg, limits)
+
+	// the configs are returned to the pool without limits
+	require.NoError(t, mgr.RemoveNetwork("func_0"), "Failed to remove network")
+	requireRateLimits(t, cfg, RateLimits{})
+	require.Error(t, mgr.SetRateLimits("func_0", limits))
+}
+
+// requireRateLimits checks the bandwidth limits of the devices and the packet rate limits of the namespace of the uVM
+func requireRateLimits(t *testing.T, cfg *NetworkConfig, limits RateLimits) {
+	vmNsHandle, err := netns.GetFromName(cfg.getNamespaceName())
+	require.NoError(t, err)
+	defer func() { _ = vmNsHandle.Close() }()
+
+	handle, err := netlink.NewHandleAt(vmNsHandle)
+	require.NoError(t, err)
+	defer handle.Close()
+
+	for linkName, rate := range map[string]uint64{
+		cfg.GetHostDevName(): limits.Ingress.Bandwidth,
+		cfg.getVeth0Name():   limits.Egress.Bandwidth,
+	} {
+		link, err := handle.LinkByName(linkName)
+		require.NoError(t, err)
+		qdiscs, err := handle.QdiscList(link)
+		require.NoError(t, err)
+
+		var limited uint64
+		for _, qdisc := range qdiscs {
+			if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+				limited = tbf.Rate
+			}
+		}
+		require.Equal(t, rate, limited, "bandwidth limit of %s", linkName)
+	}
+
+	expected := 0
+	for _, limit := range []RateLimit{limits.Ingress, limits.Egress} {
+		if limit.Packets > 0 {
+			expected++
+		}
+	}
+	require.Equal(t, expected, countRules(t, vmNsHandle, rateLimitTable), "packet rate limits")
+}
+
+func TestEgressPolicy(t *testing.T) {
+	mgr, err := NewNetworkManager("", 1, "172.17", "172.18")
+	require.NoError(t, err, "Network manager creation returned error")
+	defer func() { _ = mgr.Cleanup() }()
+
+	policy := EgressPolicy{
+		Mode: EgressAllowList,
+		Allow: []EgressRule{
+			{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []uint16{80, 443}},
+			{CIDR: "192.168.1.0/24"},
+			{CIDR: "fd00::/8", Protocol: "udp"},
+		},
+		DNSServers: []string{"10.96.0.10"},
+		LogDropped: true,
+	}
+
+	cfg, err := mgr.CreateNetwork("func_0", WithEgressPolicy(policy))
+	require.NoError(t, err, "Failed to create network")
+	require.Equal(t, policy, cfg.GetEgressPolicy())
+	// established, 2 DNS, 4 allowed destinations, log and drop rules
+	requireEgressRules(t, cfg, 9)
+
+	policy = EgressPolicy{Mode: EgressDNSOnly, DNSServers: []string{"10.96.0.10"}}
+	require.NoError(t, mgr.SetEgressPolicy("func_0", policy), "Failed to change egress policy")
+	// established, 2 DNS and drop rules
+	requireEgressRules(t, cfg, 4)
+
+	for _, invalid := range []EgressPolicy{
+		{Mode: EgressMode(42)},
+		{Mode: EgressDNSOnly, DNSServers: []string{"kube-dns"}},
+		{Mode: EgressAllowList, Allow: []EgressRule{{CIDR: "10.0.0.0"}}},
+		{Mode: EgressAllowList, Allow: []EgressRule{{CIDR: "10.0.0.0/8", Ports: []uint16{80}}}},
+		{Mode: EgressAllowList, Allow: []EgressRule{{CIDR: "10.0.0.0/8", Protocol: "icmp"}}},
+	} {
+		require.Error(t, mgr.SetEgressPolicy("func_0", invalid), "Invalid egress policy accepted")
+	}
+	require.Equal(t, policy, cfg.GetEgressPolicy())
+
+	// the configs are returned to the pool without restrictions
+	require.NoError(t, mgr.RemoveNetwork("func_0"), "Failed to remove network")
+	requireEgressRules(t, cfg, 0)
+}
+
+func TestLoadEgressConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "egress.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"default": {"mode": "dns-only", "dnsServers": ["10.96.0.10"]},
+		"images": {
+			"ghcr.io/ease-lab/helloworld:var_workload": {"mode": "allow-all"},
+			"ghcr.io/ease-lab/pyaes:var_workload": {
+				"mode": "allow-list",
+				"allow": [{"cidr": "10.0.0.0/8", "protocol": "tcp", "ports": [443]}],
+				"logDropped": true
+			}
+		}
+	}`), 0644))
+
+	cfg, err := LoadEgressConfig(path)
+	require.NoError(t, err, "Failed to load egress configuration")
+	require.Equal(t, EgressPolicy{Mode: EgressDNSOnly, DNSServers: []string{"10.96.0.10"}}, cfg.Default)
+	require.Equal(t, EgressPolicy{Mode: EgressAllowAll}, cfg.Images["ghcr.io/ease-lab/helloworld:var_workload"])
+	require.Equal(t, EgressPolicy{
+		Mode:       EgressAllowList,
+		Allow:      []EgressRule{{CIDR: "10.0.0.0/8", Protocol: "tcp", Ports: []uint16{443}}},
+		LogDropped: true,
+	}, cfg.Images["ghcr.io/ease-lab/pyaes:var_workload"])
+
+	for _, invalid := range []string{
+		`{"default": {"mode": "deny-all"}}`,
+		`{"images": {"helloworld": {"mode": "allow-list", "allow": [{"cidr": "10.0.0.0"}]}}}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(invalid), 0644))
+		_, err = LoadEgressConfig(path)
+		require.Error(t, err, "Invalid egress configuration accepted")
+	}
+}
+
+// requireEgressRules checks the number of rules enforcing the egress policy in the namespace of the uVM
+func requireEgressRules(t *testing.T, cfg *NetworkConfig, expected int) {
+	vmNsHandle, err := netns.GetFromName(cfg.getNamespaceName())
+	require.NoError(t, err)
+	defer func() { _ = vmNsHandle.Close() }()
+
+	require.Equal(t, expected, countRules(t, vmNsHandle, egressTable), "egress policy")
+}
+
+// countRules returns the number of rules of the inet table in the namespace, 0 if the table does not exist
+func countRules(t *testing.T, nsHandle netns.NsHandle, tableName string) int {
+	conn := nftables.Conn{NetNS: int(nsHandle)}
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	require.NoError(t, err)
+
+	rules := 0
+	for _, chain := range chains {
+		if chain.Table.Name != tableName {
+			continue
+		}
+		chainRules, err := conn.GetRules(chain.Table, chain)
+		require.NoError(t, err)
+		rules += len(chainRules)
+	}
+
+	return rules
+}
+
+func TestIPAMAllocation(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.0/29", "10.1.0.0/30", "")
+	require.NoError(t, err, "IPAM creation returned error")
+
+	first, err := ipam.Allocate(0)
+	require.NoError(t, err)
+	require.Equal(t, IPAllocation{ID: 0, VethCIDR: "10.0.0.0/30", CloneIP: "10.1.0.1"}, first)
+
+	second, err := ipam.Allocate(1)
+	require.NoError(t, err)
+	require.Equal(t, IPAllocation{ID: 1, VethCIDR: "10.0.0.4/30", CloneIP: "10.1.0.2"}, second)
+
+	again, err := ipam.Allocate(0)
+	require.NoError(t, err)
+	require.Equal(t, first, again, "Allocation of the same ID changed")
+
+	_, err = ipam.Allocate(2)
+	require.ErrorIs(t, err, ErrIPExhausted)
+
+	require.NoError(t, ipam.Release(0))
+	third, err := ipam.Allocate(2)
+	require.NoError(t, err)
+	require.Equal(t, IPAllocation{ID: 2, VethCIDR: "10.0.0.0/30", CloneIP: "10.1.0.1"}, third)
+	require.Equal(t, []IPAllocation{second, third}, ipam.Allocations())
+
+	for _, networks := range [][2]string{
+		{"10.0.0.0/31", "10.1.0.0/16"},
+		{"10.0.0.0/16", "10.0.1.0/24"},
+		{"10.0.0.0/33", "10.1.0.0/16"},
+		{"10.0.0.0.0", "10.1.0.0/16"},
+	} {
+		_, err := NewIPAM(networks[0], networks[1], "")
+		require.Error(t, err, "Invalid networks %v accepted", networks)
+	}
+
+	prefixed, err := NewIPAM("172.17", "172.18", "")
+	require.NoError(t, err)
+	require.Equal(t, "172.17.0.0/16", prefixed.veths.ipNet.String())
+	require.Equal(t, "172.18.0.0/16", prefixed.clones.ipNet.String())
+}
+
+func TestIPAMRecovery(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "ipam.json")
+
+	ipam, err := NewIPAM("10.0.0.0/16", "10.1.0.0/16", statePath)
+	require.NoError(t, err, "IPAM creation returned error")
+	for id := 0; id < 3; id++ {
+		_, err := ipam.Allocate(id)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ipam.Release(1))
+
+	recovered, err := NewIPAM("10.0.0.0/16", "10.1.0.0/16", statePath)
+	require.NoError(t, err, "IPAM recovery returned error")
+	require.Equal(t, ipam.Allocations(), recovered.Allocations())
+
+	// the recovered addresses are not allocated again
+	allocs := map[string]bool{}
+	for _, alloc := range recovered.Allocations() {
+		allocs[alloc.VethCIDR], allocs[alloc.CloneIP] = true, true
+	}
+	for id := 3; id < 6; id++ {
+		alloc, err := recovered.Allocate(id)
+		require.NoError(t, err)
+		require.False(t, allocs[alloc.VethCIDR] || allocs[alloc.CloneIP], "Recovered addresses allocated again")
+		allocs[alloc.VethCIDR], allocs[alloc.CloneIP] = true, true
+	}
+}
+
+func TestNetworkManagerIPExhaustion(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "ipam.json")
+
+	// the addresses of a network config whose namespace does not exist anymore are released
+	stale, err := NewIPAM("10.0.0.0/29", "10.1.0.0/16", statePath)
+	require.NoError(t, err)
+	_, err = stale.Allocate(1 << 30)
+	require.NoError(t, err)
+
+	// the veth network only fits 2 network configs
+	mgr, err := NewNetworkManager("", 1, "10.0.0.0/29", "10.1.0.0/16", WithIPAMState(statePath))
+	require.NoError(t, err, "Network manager creation returned error")
+	defer func() { _ = mgr.Cleanup() }()
+
+	_, err = mgr.CreateNetwork("func_0")
+	require.NoError(t, err, "Failed to create network")
+	_, err = mgr.CreateNetwork("func_1")
+	require.NoError(t, err, "Failed to create network")
+
+	_, err = mgr.CreateNetwork("func_2")
+	require.ErrorIs(t, err, ErrIPExhausted)
+
+	require.NoError(t, mgr.RemoveNetwork("func_1"), "Failed to remove network")
+	_, err = mgr.CreateNetwork("func_2")
+	require.NoError(t, err, "Failed to create network after release")
+
+	// the allocations are persisted
+	recovered, err := NewIPAM("10.0.0.0/29", "10.1.0.0/16", statePath)
+	require.NoError(t, err)
+	require.Len(t, recovered.Allocations(), 2)
+	for _, alloc := range recovered.Allocations() {
+		require.NotEqual(t, 1<<30, alloc.ID, "Stale allocation recovered")
+	}
+}
+
+func TestIPAMDualStack(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "ipam.json")
+
+	ipam, err := NewIPAM("10.0.0.0/29", "10.1.0.0/30", statePath, WithIPv6Networks("fd00:1::/64", "fd00:2::/126"))
+	require.NoError(t, err, "IPAM creation returned error")
+
+	first, err := ipam.Allocate(0)
+	require.NoError(t, err)
+	require.Equal(t, IPAllocation{ID: 0, VethCIDR: "10.0.0.0/30", CloneIP: "10.1.0.1", VethCIDR6: "fd00:1::/126", CloneIP6: "fd00:2::1"}, first)
+
+	second, err := ipam.Allocate(1)
+	require.NoError(t, err)
+	require.Equal(t, IPAllocation{ID: 1, VethCIDR: "10.0.0.4/30", CloneIP: "10.1.0.2", VethCIDR6: "fd00:1::4/126", CloneIP6: "fd00:2::2"}, second)
+
+	// the IPv4 addresses of a failed allocation are released
+	require.NoError(t, ipam.Release(0))
+	ipam.clones6.used[1] = 42
+	_, err = ipam.Allocate(2)
+	require.ErrorIs(t, err, ErrIPExhausted)
+	_, used := ipam.veths.used[0]
+	require.False(t, used, "IPv4 addresses of a failed allocation not released")
+	delete(ipam.clones6.used, 1)
+
+	recovered, err := NewIPAM("10.0.0.0/29", "10.1.0.0/30", statePath, WithIPv6Networks("fd00:1::/64", "fd00:2::/126"))
+	require.NoError(t, err, "IPAM recovery returned error")
+	require.Equal(t, []IPAllocation{second}, recovered.Allocations())
+	third, err := recovered.Allocate(2)
+	require.NoError(t, err)
+	require.Equal(t, IPAllocation{ID: 2, VethCIDR: "10.0.0.0/30", CloneIP: "10.1.0.1", VethCIDR6: "fd00:1::/126", CloneIP6: "fd00:2::1"}, third)
+
+	for _, networks := range [][2]string{
+		{"10.2.0.0/16", "fd00:2::/64"},
+		{"fd00:1::/127", "fd00:2::/64"},
+		{"fd00:1::/64", "fd00:1:0:0:1::/80"},
+		{"fd00:1", "fd00:2::/64"},
+	} {
+		_, err := NewIPAM("10.0.0.0/16", "10.1.0.0/16", "", WithIPv6Networks(networks[0], networks[1]))
+		require.Error(t, err, "Invalid IPv6 networks %v accepted", networks)
+	}
+}
+
+func TestDualStackNetwork(t *testing.T) {
+	mgr, err := NewNetworkManager("", 1, "172.17", "172.18", WithIPv6("fd00:1::/64", "fd00:2::/64"))
+	require.NoError(t, err, "Network manager creation returned error")
+
+	cfg, err := mgr.CreateNetwork("func_0")
+	require.NoError(t, err, "Failed to create network")
+	require.NotEmpty(t, cfg.GetCloneIP())
+	require.Equal(t, "fd00:ac10::2/64", cfg.GetContainerCIDR6())
+	require.Equal(t, "fd00:ac10::1", cfg.GetGatewayIP6())
+
+	_, cloneNet6, _ := net.ParseCIDR("fd00:2::/64")
+	cloneIP6 := net.ParseIP(cfg.GetCloneIPv6())
+	require.True(t, cloneNet6.Contains(cloneIP6), "Clone address %s not in the IPv6 clone network", cloneIP6)
+
+	// the clone address is routed through the veth pair
+	routes, err := netlink.RouteGet(cloneIP6)
+	require.NoError(t, err)
+	link, err := netlink.LinkByName(cfg.getVeth1Name())
+	require.NoError(t, err)
+	require.Equal(t, link.Attrs().Index, routes[0].LinkIndex)
+
+	// the ip6 nat table translates between the container and the clone addresses
+	vmNsHandle, err := netns.GetFromName(cfg.getNamespaceName())
+	require.NoError(t, err)
+	defer func() { _ = vmNsHandle.Close() }()
+	conn := nftables.Conn{NetNS: int(vmNsHandle)}
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyIPv6)
+	require.NoError(t, err)
+	require.Len(t, chains, 2, "ip6 nat chains")
+
+	require.NoError(t, mgr.RemoveNetwork("func_0"), "Failed to remove network")
+	require.NoError(t, mgr.Cleanup(), "Network manager cleanup returned error")
+
+	routes, err = netlink.RouteGet(cloneIP6)
+	require.True(t, err != nil || routes[0].LinkIndex != link.Attrs().Index, "Route to the clone address not removed")
+}
+
+func TestPoolMaxSize(t *testing.T) {
+	mgr, err := NewNetworkManager("", 2, "172.17", "172.18", WithPoolMaxSize(3))
+	require.NoError(t, err, "Network manager creation returned error")
+	defer func() { _ = mgr.Cleanup() }()
+
+	configs := make([]*NetworkConfig, 0)
+	for i := 0; i < 6; i++ {
+		cfg, err := mgr.CreateNetwork(fmt.Sprintf("func_%d", i))
+		require.NoError(t, err, "Failed to create network")
+		configs = append(configs, cfg)
+	}
+	// the pool is refilled in the background, only the released configs are trimmed
+	mgr.inCreation.Wait()
+	for i := 0; i < 6; i++ {
+		require.NoError(t, mgr.RemoveNetwork(fmt.Sprintf("func_%d", i)), "Failed to remove network")
+	}
+
+	// the surplus configs are removed in the background
+	mgr.inCreation.Wait()
+	mgr.inTeardown.Wait()
+
+	pool := make(map[*NetworkConfig]bool)
+	mgr.poolCond.L.Lock()
+	for _, cfg := range mgr.networkPool {
+		pool[cfg] = true
+	}
+	mgr.poolCond.L.Unlock()
+	require.Len(t, pool, 3, "Pool not trimmed to its maximum size")
+
+	for _, cfg := range configs {
+		_, err := os.Stat(cfg.GetNamespacePath())
+		require.Equal(t, pool[cfg], err == nil, "Namespace of network config %d", cfg.id)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "ipam.json")
+
+	// a previous run crashes with 2 networks in use and 3 in the pool, the VM of one of the networks
+	// outlives the run. The networks left on the host by other tests are reconciled as well
+	crashed, err := NewNetworkManager("", 3, "172.17", "172.18", WithIPAMState(statePath))
+	require.NoError(t, err, "Network manager creation returned error")
+	inUse, err := crashed.CreateNetwork("func_0", WithEgressPolicy(EgressPolicy{Mode: EgressDNSOnly}))
+	require.NoError(t, err, "Failed to create network")
+	running, err := crashed.CreateNetwork("func_1")
+	require.NoError(t, err, "Failed to create network")
+	crashed.inCreation.Wait()
+
+	tap := attachTap(t, running)
+	defer func() {
+		_ = tap.Close()
+		_ = running.RemoveNetwork()
+	}()
+
+	// the host side of one of the networks in the pool is removed
+	crashed.poolCond.L.Lock()
+	broken := crashed.networkPool[0]
+	crashed.poolCond.L.Unlock()
+	link, err := netlink.LinkByName(broken.getVeth1Name())
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkDel(link))
+
+	mgr, err := NewNetworkManager("", 1, "172.17", "172.18", WithIPAMState(statePath), WithReconciliation(), WithPoolMaxSize(100))
+	require.NoError(t, err, "Network manager creation returned error")
+	defer func() { _ = mgr.Cleanup() }()
+
+	adopted := []string{inUse.getNamespaceName()}
+	crashed.poolCond.L.Lock()
+	for _, cfg := range crashed.networkPool[1:] {
+		adopted = append(adopted, cfg.getNamespaceName())
+	}
+	crashed.poolCond.L.Unlock()
+
+	report := mgr.GetReconcileReport()
+	require.Subset(t, report.Adopted, adopted, "Intact networks not adopted")
+	require.Equal(t, []string{running.getNamespaceName()}, report.InUse, "Network of the running VM not kept")
+	require.NotContains(t, report.Adopted, running.getNamespaceName())
+	_, err = os.Stat(running.GetNamespacePath())
+	require.NoError(t, err, "Namespace of the running VM removed")
+	require.Contains(t, report.Namespaces, broken.getNamespaceName())
+	require.Subset(t, report.Chains, []string{"FORWARD" + broken.getVeth1Name(), "MASQ" + broken.getVeth1Name()})
+	require.NotContains(t, report.Links, broken.getVeth1Name())
+
+	_, err = os.Stat(broken.GetNamespacePath())
+	require.True(t, os.IsNotExist(err), "Broken namespace not removed")
+	for _, alloc := range mgr.allocator.Allocations() {
+		require.NotEqual(t, broken.id, alloc.ID, "Addresses of the broken network not released")
+	}
+
+	// the adopted networks are used without the egress policy of their last function instance
+	mgr.poolCond.L.Lock()
+	poolSize := len(mgr.networkPool)
+	mgr.poolCond.L.Unlock()
+	require.Equal(t, len(report.Adopted), poolSize, "Adopted networks not added to the pool")
+	requireEgressRules(t, inUse, 0)
+
+	cfg, err := mgr.CreateNetwork("func_0")
+	require.NoError(t, err, "Failed to create network with adopted config")
+	require.NotEqual(t, broken.id, cfg.id)
+	require.NotEqual(t, running.id, cfg.id)
+	for _, alloc := range mgr.allocator.Allocations() {
+		if alloc.ID == running.id {
+			return
+		}
+	}
+	require.Fail(t, "Addresses of the running VM not reserved")
+}
+
+// attachTap opens the tap device of the network like the Firecracker process of a VM
+func attachTap(t *testing.T, cfg *NetworkConfig) *os.File {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	hostNsHandle, err := netns.Get()
+	require.NoError(t, err)
+	defer func() { _ = hostNsHandle.Close() }()
+
+	vmNsHandle, err := netns.GetFromName(cfg.getNamespaceName())
+	require.NoError(t, err)
+	defer func() { _ = vmNsHandle.Close() }()
+
+	require.NoError(t, netns.Set(vmNsHandle))
+	defer func() { require.NoError(t, netns.Set(hostNsHandle)) }()
+
+	tun, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	require.NoError(t, err)
+
+	ifr, err := unix.NewIfreq(cfg.GetHostDevName())
+	require.NoError(t, err)
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	require.NoError(t, unix.IoctlIfreq(int(tun.Fd()), unix.TUNSETIFF, ifr), "Failed to attach tap")
+
+	return tun
+}
@@ -0,0 +1,197 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package networking
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// rateLimitTable is the nftables table enforcing the packet rate limits in the namespace of the uVM
+	rateLimitTable = "ratelimit"
+	// minBandwidthBurst is the minimum size of the bursts allowed by the bandwidth limits, in bytes
+	minBandwidthBurst = 32 * 1024
+	// bandwidthLatency is the maximum time a packet may wait in the queue of a bandwidth limit, in microseconds
+	bandwidthLatency = 25000
+)
+
+// RateLimit limits the traffic of a uVM in one direction, a zero value disables the corresponding limit
+type RateLimit struct {
+	Bandwidth uint64 // bytes per second
+	Packets   uint64 // packets per second
+}
+
+// RateLimits limits the traffic to (ingress) and from (egress) a uVM
+type RateLimits struct {
+	Ingress RateLimit
+	Egress  RateLimit
+}
+
+// setRateLimits replaces the rate limits of the uVM. The bandwidth is shaped by a token bucket filter qdisc on the
+// device through which the traffic leaves the namespace of the uVM: the tap device for the ingress traffic and the
+// veth device for the egress traffic. Packets over the packet rate limits are dropped by nftables rules, as the
+// packet rate of tc policers cannot be configured through netlink
+func setRateLimits(tapName, vethVmName string, limits RateLimits, vmNsHandle netns.NsHandle) error {
+	handle, err := netlink.NewHandleAt(vmNsHandle)
+	if err != nil {
+		return errors.Wrapf(err, "creating netlink handle")
+	}
+	defer handle.Close()
+
+	if err := setBandwidthLimit(handle, tapName, limits.Ingress.Bandwidth); err != nil {
+		return err
+	}
+	if err := setBandwidthLimit(handle, vethVmName, limits.Egress.Bandwidth); err != nil {
+		return err
+	}
+
+	return setPacketRateLimits(tapName, limits, vmNsHandle)
+}
+
+// setBandwidthLimit replaces the root qdisc of the device with a token bucket filter limiting its transmit
+// rate to the given number of bytes per second, or removes the token bucket filter if the rate is zero
+func setBandwidthLimit(handle *netlink.Handle, linkName string, rate uint64) error {
+	link, err := handle.LinkByName(linkName)
+	if err != nil {
+		return errors.Wrapf(err, "finding link %s", linkName)
+	}
+
+	if rate == 0 {
+		qdiscs, err := handle.QdiscList(link)
+		if err != nil {
+			return errors.Wrapf(err, "listing qdiscs of %s", linkName)
+		}
+
+		for _, qdisc := range qdiscs {
+			if qdisc.Attrs().Parent == netlink.HANDLE_ROOT && qdisc.Type() == "tbf" {
+				if err := handle.QdiscDel(qdisc); err != nil {
+					return errors.Wrapf(err, "deleting bandwidth limit of %s", linkName)
+				}
+			}
+		}
+		return nil
+	}
+
+	burst := rate / 100 // 10ms of traffic
+	if burst < minBandwidthBurst {
+		burst = minBandwidthBurst
+	}
+
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Buffer: netlink.Xmittime(rate, uint32(burst)),
+		Limit:  uint32(rate*bandwidthLatency/netlink.TIME_UNITS_PER_SEC + burst),
+	}
+
+	if err := handle.QdiscReplace(qdisc); err != nil {
+		return errors.Wrapf(err, "setting bandwidth limit of %s", linkName)
+	}
+
+	return nil
+}
+
+// setPacketRateLimits replaces the nftables rules dropping the packets forwarded to (ingress) and from (egress)
+// the tap device of the uVM over the packet rate limits
+func setPacketRateLimits(tapName string, limits RateLimits, vmNsHandle netns.NsHandle) error {
+	conn := nftables.Conn{NetNS: int(vmNsHandle)}
+
+	// 1. add table inet ratelimit
+	table := &nftables.Table{
+		Name:   rateLimitTable,
+		Family: nftables.TableFamilyINet,
+	}
+
+	// 2. the previous limits are removed along with the table, adding the table first
+	// makes the deletion succeed if it does not exist
+	conn.AddTable(table)
+	conn.DelTable(table)
+
+	if limits.Ingress.Packets > 0 || limits.Egress.Packets > 0 {
+		// 3. add chain inet ratelimit FORWARD { type filter hook forward priority 0; policy accept; }
+		polAccept := nftables.ChainPolicyAccept
+		fwdCh := &nftables.Chain{
+			Name:     "FORWARD",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Priority: nftables.ChainPriorityRef(0),
+			Hooknum:  nftables.ChainHookForward,
+			Policy:   &polAccept,
+		}
+
+		conn.AddTable(table)
+		conn.AddChain(fwdCh)
+
+		// 4. add rule inet ratelimit FORWARD oifname tap0 limit rate over 1000/second drop
+		if limits.Ingress.Packets > 0 {
+			conn.AddRule(packetRateRule(fwdCh, expr.MetaKeyOIFNAME, tapName, limits.Ingress.Packets))
+		}
+		// 5. add rule inet ratelimit FORWARD iifname tap0 limit rate over 1000/second drop
+		if limits.Egress.Packets > 0 {
+			conn.AddRule(packetRateRule(fwdCh, expr.MetaKeyIIFNAME, tapName, limits.Egress.Packets))
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return errors.Wrapf(err, "setting packet rate limits")
+	}
+	return nil
+}
+
+// packetRateRule returns a rule dropping the packets over the rate whose input or output interface is ifaceName
+func packetRateRule(chain *nftables.Chain, ifaceKey expr.MetaKey, ifaceName string, rate uint64) *nftables.Rule {
+	return &nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// Load iifname or oifname in register 1
+			&expr.Meta{Key: ifaceKey, Register: 1},
+			// Check iifname or oifname == tap0
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte(fmt.Sprintf("%s\x00", ifaceName)),
+			},
+			// Match the packets over the rate
+			&expr.Limit{
+				Type: expr.LimitTypePkts,
+				Rate: rate,
+				Over: true,
+				Unit: expr.LimitTimeSecond,
+			},
+			&expr.Verdict{
+				Kind: expr.VerdictDrop,
+			},
+		},
+	}
+}
@@ -0,0 +1,346 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package networking
+
+import (
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/google/nftables"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const netnsDir = "/run/netns"
+
+var (
+	vmNamespaceName = regexp.MustCompile(`^uvmns([0-9]+)$`)
+	hostVethName    = regexp.MustCompile(`^veth([0-9]+)-1$`)
+	hostChainName   = regexp.MustCompile(`^(?:FORWARD|MASQ)veth([0-9]+)-1$`)
+)
+
+// ReconcileReport lists the network resources left by a previous run of vHive, e.g. after a crash
+type ReconcileReport struct {
+	Adopted    []string // namespaces of the intact networks added to the pool
+	InUse      []string // namespaces of the networks still used by VMs that outlived the previous run, left in place
+	Namespaces []string // removed namespaces
+	Links      []string // removed veth devices of the host
+	Chains     []string // removed nftables chains of the host
+}
+
+// staleNetwork holds the resources of a network config left by a previous run
+type staleNetwork struct {
+	id        int
+	namespace string
+	link      string
+	chains    []*nftables.Chain
+	alloc     *IPAllocation
+}
+
+// intact reports whether all the resources of the network exist, including the IPv6 addresses and chains if ipv6 is set
+func (n *staleNetwork) intact(ipv6 bool) bool {
+	if n.namespace == "" || n.link == "" || n.alloc == nil || (n.alloc.VethCIDR6 != "") != ipv6 {
+		return false
+	}
+	if ipv6 {
+		return len(n.chains) == 4
+	}
+	return len(n.chains) == 2
+}
+
+// reconcile finds the namespaces, the veth devices of the host and the nftables chains of the host left by a previous
+// run. The networks whose tap device is still used by a VM are left in place and their addresses reserved. The
+// networks whose resources and addresses are intact are reset and adopted into the pool, the resources of the other
+// networks are removed and their addresses released.
+func (mgr *NetworkManager) reconcile() (*ReconcileReport, error) {
+	networks := make(map[int]*staleNetwork)
+	network := func(id int) *staleNetwork {
+		if _, ok := networks[id]; !ok {
+			networks[id] = &staleNetwork{id: id}
+		}
+		return networks[id]
+	}
+
+	entries, err := os.ReadDir(netnsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reading network namespace dir")
+	}
+	for _, entry := range entries {
+		if id, ok := matchID(vmNamespaceName, entry.Name()); ok {
+			network(id).namespace = entry.Name()
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing links")
+	}
+	for _, link := range links {
+		if id, ok := matchID(hostVethName, link.Attrs().Name); ok {
+			network(id).link = link.Attrs().Name
+		}
+	}
+
+	conn := nftables.Conn{}
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		chains, err := conn.ListChainsOfTableFamily(family)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing nftables chains")
+		}
+		for _, chain := range chains {
+			if id, ok := matchID(hostChainName, chain.Name); ok {
+				network(id).chains = append(network(id).chains, chain)
+			}
+		}
+	}
+
+	for _, alloc := range mgr.allocator.Allocations() {
+		alloc := alloc
+		network(alloc.ID).alloc = &alloc
+	}
+
+	ids := make([]int, 0, len(networks))
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	report := &ReconcileReport{Adopted: make([]string, 0), InUse: make([]string, 0), Namespaces: make([]string, 0), Links: make([]string, 0), Chains: make([]string, 0)}
+	for _, id := range ids {
+		stale := networks[id]
+		logger := log.WithFields(log.Fields{"id": id, "namespace": stale.namespace})
+
+		if stale.namespace != "" && tapInUse(stale.namespace, defaultContainerTap) {
+			logger.Warn("Keeping network left by a previous run, its tap is still used by a VM")
+			report.InUse = append(report.InUse, stale.namespace)
+			mgr.reserveInUse(stale)
+			continue
+		}
+
+		if stale.intact(mgr.ipv6Enabled()) {
+			cfg, err := mgr.adoptNetConfig(stale)
+			if err == nil {
+				logger.Info("Adopting network left by a previous run")
+				report.Adopted = append(report.Adopted, stale.namespace)
+				mgr.networkPool = append(mgr.networkPool, cfg)
+				if id >= mgr.nextID {
+					mgr.nextID = id + 1
+				}
+				continue
+			}
+			logger.WithError(err).Warn("failed to adopt network left by a previous run")
+		}
+
+		logger.Info("Removing network left by a previous run")
+		for _, chain := range stale.chains {
+			conn.FlushChain(chain)
+			conn.DelChain(chain)
+			if err := conn.Flush(); err != nil {
+				logger.WithError(err).Warnf("failed to remove chain %s", chain.Name)
+				continue
+			}
+			report.Chains = append(report.Chains, chain.Name)
+		}
+		if stale.link != "" {
+			// the peer of the veth device is removed along with it
+			if link, err := netlink.LinkByName(stale.link); err != nil || netlink.LinkDel(link) != nil {
+				logger.Warnf("failed to remove link %s", stale.link)
+			} else {
+				report.Links = append(report.Links, stale.link)
+			}
+		}
+		if stale.namespace != "" {
+			if err := netns.DeleteNamed(stale.namespace); err != nil {
+				logger.WithError(err).Warn("failed to remove namespace")
+			} else {
+				report.Namespaces = append(report.Namespaces, stale.namespace)
+			}
+		}
+		if stale.alloc != nil {
+			if err := mgr.allocator.Release(id); err != nil {
+				logger.WithError(err).Warn("failed to release addresses")
+			}
+		}
+	}
+
+	log.Infof("Adopted %d networks, kept %d networks in use and removed %d namespaces, %d links and %d chains left by a previous run",
+		len(report.Adopted), len(report.InUse), len(report.Namespaces), len(report.Links), len(report.Chains))
+
+	return report, nil
+}
+
+// tapInUse reports whether the tap device in the namespace is attached to a process, i.e., the Firecracker process of
+// a VM that outlived the previous run, in which case the carrier of the tap is on
+func tapInUse(namespace, tapName string) bool {
+	vmNsHandle, err := netns.GetFromName(namespace)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = vmNsHandle.Close() }()
+
+	handle, err := netlink.NewHandleAt(vmNsHandle)
+	if err != nil {
+		return false
+	}
+	defer handle.Close()
+
+	tap, err := handle.LinkByName(tapName)
+	if err != nil {
+		return false
+	}
+
+	return tap.Attrs().RawFlags&unix.IFF_LOWER_UP != 0
+}
+
+// reserveInUse keeps the addresses of a network still used by a VM allocated, recovering them from the veth device of
+// the host if the IPAM has no record of them, so that they are not allocated to another network
+func (mgr *NetworkManager) reserveInUse(stale *staleNetwork) {
+	if stale.alloc == nil && stale.link != "" {
+		if networks, err := findHostNetworks(); err != nil {
+			log.Warnf("failed to find the addresses of network config %d: %s", stale.id, err)
+		} else if alloc, ok := networks[stale.id]; ok {
+			if err := mgr.allocator.Reserve(alloc); err != nil {
+				log.Warnf("failed to reserve addresses of network config %d: %s", stale.id, err)
+			}
+		}
+	}
+
+	if stale.id >= mgr.nextID {
+		mgr.nextID = stale.id + 1
+	}
+}
+
+// adoptNetConfig returns the network config of an intact network left by a previous run,
+// without the rate limits and the egress policy of its last function instance
+func (mgr *NetworkManager) adoptNetConfig(stale *staleNetwork) (*NetworkConfig, error) {
+	cfg, err := mgr.configFromAllocation(*stale.alloc)
+	if err != nil {
+		return nil, err
+	}
+
+	vmNsHandle, err := netns.GetFromName(stale.namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting network namespace")
+	}
+	defer func() { _ = vmNsHandle.Close() }()
+
+	if err := setRateLimits(cfg.containerTap, cfg.getVeth0Name(), RateLimits{}, vmNsHandle); err != nil {
+		return nil, err
+	}
+	if err := setEgressPolicy(cfg.containerTap, cfg.getEgressLogPrefix(), EgressPolicy{}, vmNsHandle); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// matchID returns the network config ID in the name of a resource
+func matchID(re *regexp.Regexp, name string) (int, bool) {
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(match[1])
+	return id, err == nil
+}
+
+// findHostNetworks returns the addresses of the networks whose veth device exists on the host, found from the
+// IPv4 and IPv6 addresses of the veth device and the routes to the clone addresses through the veth pair
+func findHostNetworks() (map[int]IPAllocation, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing links")
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing routes")
+	}
+
+	networks := make(map[int]IPAllocation)
+	for _, link := range links {
+		id, ok := matchID(hostVethName, link.Attrs().Name)
+		if !ok {
+			continue
+		}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		vethNet := &net.IPNet{IP: addrs[0].IP.Mask(addrs[0].Mask), Mask: addrs[0].Mask}
+
+		alloc := IPAllocation{ID: id, VethCIDR: vethNet.String()}
+		for _, route := range routes {
+			if route.Dst != nil && route.Gw != nil && vethNet.Contains(route.Gw) {
+				if ones, _ := route.Dst.Mask.Size(); ones == 32 {
+					alloc.CloneIP = route.Dst.IP.String()
+				}
+			}
+		}
+
+		if vethNet6, cloneIP6 := findIPv6Network(link, routes); vethNet6 != nil {
+			alloc.VethCIDR6 = vethNet6.String()
+			if cloneIP6 != nil {
+				alloc.CloneIP6 = cloneIP6.String()
+			}
+		}
+		networks[id] = alloc
+	}
+
+	return networks, nil
+}
+
+// findIPv6Network returns the IPv6 network of a veth device of the host, ignoring its link-local address,
+// and the clone address routed through the veth pair
+func findIPv6Network(link netlink.Link, routes []netlink.Route) (*net.IPNet, net.IP) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		vethNet6 := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		for _, route := range routes {
+			if route.Dst != nil && route.Gw != nil && vethNet6.Contains(route.Gw) {
+				if ones, _ := route.Dst.Mask.Size(); ones == 128 {
+					return vethNet6, route.Dst.IP
+				}
+			}
+		}
+		return vethNet6, nil
+	}
+
+	return nil, nil
+}
@@ -43,6 +43,7 @@ sudo apt-get -y install \
     software-properties-common \
     iproute2 \
     nftables \
+    thin-provisioning-tools \
     rsync >> /dev/null
 
 # stack size, # of open files, # of pids
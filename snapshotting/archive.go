@@ -0,0 +1,247 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// zstdMagic is the magic number at the beginning of a zstd frame, used to detect compressed snapshot archives.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// ExportSnapshot writes a snapshot as a tar archive, optionally compressed with zstd, to w. The archive contains a
+// directory named after the snapshot id holding the snapshot files and the info file, which describes the image
+// reference, the key and the checksums of the snapshot. The checksums of snapshots created before checksums were
+// recorded are computed upon export.
+func ExportSnapshot(snap *Snapshot, w io.Writer, compress bool) (retErr error) {
+	if _, err := snap.PrepareMemFile(); err != nil {
+		return err
+	}
+
+	if err := snap.checkFiles(); err != nil {
+		return err
+	}
+
+	// Encode the info of a copy of the snapshot, so that missing checksums can be added without modifying the snapshot
+	info := *snap
+	if len(info.Checksums) == 0 {
+		if err := info.computeChecksums(); err != nil {
+			return errors.Wrapf(err, "computing checksums of snapshot %s", snap.GetId())
+		}
+	}
+
+	var infoBuf bytes.Buffer
+	if err := gob.NewEncoder(&infoBuf).Encode(info); err != nil {
+		return errors.Wrapf(err, "failed to encode snapinfo")
+	}
+
+	if compress {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return errors.Wrapf(err, "creating zstd writer")
+		}
+		defer func() {
+			if err := zw.Close(); err != nil && retErr == nil {
+				retErr = errors.Wrapf(err, "compressing snapshot archive")
+			}
+		}()
+		w = zw
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	if err := tw.WriteHeader(&tar.Header{Name: snap.GetId() + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: now}); err != nil {
+		return errors.Wrapf(err, "writing snapshot archive")
+	}
+
+	hdr := &tar.Header{Name: path.Join(snap.GetId(), infoFile), Mode: 0644, Size: int64(infoBuf.Len()), ModTime: now}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "writing snapshot archive")
+	}
+	if _, err := tw.Write(infoBuf.Bytes()); err != nil {
+		return errors.Wrapf(err, "writing snapshot archive")
+	}
+
+	for _, name := range snapshotFiles {
+		if err := addFileToArchive(tw, path.Join(snap.GetId(), name), filepath.Join(snap.snapDir, name)); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// addFileToArchive writes the file at localPath to a tar archive under the given name.
+func addFileToArchive(tw *tar.Writer, name, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", localPath)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "getting size of %s", localPath)
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "writing snapshot archive")
+	}
+
+	if _, err := io.Copy(tw, file); err != nil {
+		return errors.Wrapf(err, "adding %s to snapshot archive", localPath)
+	}
+
+	return nil
+}
+
+// ImportSnapshot unpacks a snapshot archive written by ExportSnapshot, compressed or not, into baseFolder. The snapshot
+// files are checked against the checksums of the archive and checkImage, if not nil, is called to validate that the
+// image of the snapshot is available before the snapshot is moved into place. ErrSnapshotExists is returned if
+// baseFolder already contains a snapshot with the same id. The snapshot is picked up by a running SnapshotManager the
+// next time it is acquired.
+func ImportSnapshot(r io.Reader, baseFolder string, checkImage func(*Snapshot) error) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(zstdMagic)); err == nil && bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating zstd reader")
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	// Unpack into a hidden directory that is ignored by the snapshot recovery
+	tmpDir, err := os.MkdirTemp(baseFolder, ".import-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating import directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	id, err := unpackArchive(tar.NewReader(r), tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := LoadSnapshot(filepath.Base(tmpDir), baseFolder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading imported snapshot")
+	}
+
+	if err := snap.Verify(); err != nil {
+		return nil, errors.Wrapf(err, "verifying imported snapshot")
+	}
+
+	// The snapshot id is derived from the key, an archive must not place a snapshot under the id of another key
+	if keyID := snap.GetKey().ID(); keyID != id {
+		return nil, errors.New(fmt.Sprintf("snapshot archive of %s contains the snapshot of key %s", id, keyID))
+	}
+
+	if checkImage != nil {
+		if err := checkImage(snap); err != nil {
+			return nil, errors.Wrapf(err, "validating image %s of imported snapshot", snap.GetImage())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(baseFolder, id)); err == nil {
+		return nil, errors.Wrapf(ErrSnapshotExists, "importing snapshot %s", id)
+	}
+
+	if err := os.Rename(tmpDir, filepath.Join(baseFolder, id)); err != nil {
+		return nil, errors.Wrapf(err, "moving imported snapshot into place")
+	}
+
+	return LoadSnapshot(id, baseFolder)
+}
+
+// unpackArchive extracts the files of a snapshot archive into dir and returns the id of the snapshot. Only the info
+// file and the snapshot files of a single snapshot are accepted.
+func unpackArchive(tr *tar.Reader, dir string) (string, error) {
+	var id string
+
+	expected := map[string]bool{infoFile: true}
+	for _, name := range snapshotFiles {
+		expected[name] = true
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", errors.Wrapf(err, "reading snapshot archive")
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		snapID, name := path.Split(path.Clean(hdr.Name))
+		snapID = path.Clean(snapID)
+		if hdr.Typeflag != tar.TypeReg || !expected[name] || snapID == "." || path.Dir(snapID) != "." || snapID[0] == '.' {
+			return "", errors.New(fmt.Sprintf("unexpected entry %s in snapshot archive", hdr.Name))
+		}
+
+		if id == "" {
+			id = snapID
+		} else if id != snapID {
+			return "", errors.New("snapshot archive contains more than one snapshot")
+		}
+
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return "", errors.Wrapf(err, "creating %s", name)
+		}
+
+		_, err = io.Copy(file, tr)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "extracting %s", name)
+		}
+		delete(expected, name)
+	}
+
+	if len(expected) > 0 {
+		return "", errors.New("snapshot archive is incomplete")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,160 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+func testSnapshotArchive(t *testing.T, compress bool) {
+	srcMgr := snapshotting.NewSnapshotManager(t.TempDir())
+	createTestSnapshot(t, srcMgr, "rev-1", 4096)
+
+	var archive bytes.Buffer
+	require.NoError(t, srcMgr.ExportSnapshot("rev-1", &archive, compress), "Failed to export snapshot")
+
+	dstFolder := t.TempDir()
+	checked := false
+	snap, err := snapshotting.ImportSnapshot(bytes.NewReader(archive.Bytes()), dstFolder, func(snap *snapshotting.Snapshot) error {
+		require.Equal(t, "testImage", snap.GetImage(), "Imported snapshot has the wrong image")
+		checked = true
+		return nil
+	})
+	require.NoError(t, err, "Failed to import snapshot")
+	require.True(t, checked, "Image of the imported snapshot should be checked")
+	require.Equal(t, "rev-1", snap.GetId(), "Imported snapshot has the wrong id")
+	require.NoError(t, snap.Verify(), "Imported snapshot should match its checksums")
+
+	entries, err := os.ReadDir(dstFolder)
+	require.NoError(t, err, "Failed to list snapshots")
+	require.Len(t, entries, 1, "Import directory should be removed")
+
+	// The imported snapshot is picked up by a running manager
+	dstMgr := snapshotting.NewSnapshotManager(t.TempDir())
+	_, err = dstMgr.ImportSnapshot(bytes.NewReader(archive.Bytes()), nil)
+	require.NoError(t, err, "Failed to import snapshot into manager")
+	snap, err = dstMgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Imported snapshot should be available")
+	dstMgr.ReleaseSnapshot(snap.GetId())
+
+	_, err = dstMgr.ImportSnapshot(bytes.NewReader(archive.Bytes()), nil)
+	require.ErrorIs(t, err, snapshotting.ErrSnapshotExists, "Importing an existing snapshot should fail")
+}
+
+func TestSnapshotArchive(t *testing.T) {
+	testSnapshotArchive(t, false)
+}
+
+func TestSnapshotArchiveCompressed(t *testing.T) {
+	testSnapshotArchive(t, true)
+}
+
+func TestSnapshotArchiveAdoption(t *testing.T) {
+	srcMgr := snapshotting.NewSnapshotManager(t.TempDir())
+	createTestSnapshot(t, srcMgr, "rev-1", 1024)
+
+	var archive bytes.Buffer
+	require.NoError(t, srcMgr.ExportSnapshot("rev-1", &archive, true), "Failed to export snapshot")
+
+	// A snapshot imported by another process is adopted by a running manager
+	dstFolder := t.TempDir()
+	dstMgr := snapshotting.NewSnapshotManager(dstFolder)
+	_, err := snapshotting.ImportSnapshot(&archive, dstFolder, nil)
+	require.NoError(t, err, "Failed to import snapshot")
+
+	snap, err := dstMgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Imported snapshot should be adopted")
+	dstMgr.ReleaseSnapshot(snap.GetId())
+}
+
+func TestSnapshotArchiveRejected(t *testing.T) {
+	srcFolder := t.TempDir()
+	srcMgr := snapshotting.NewSnapshotManager(srcFolder)
+	createTestSnapshot(t, srcMgr, "rev-1", 1024)
+
+	var archive bytes.Buffer
+	require.NoError(t, srcMgr.ExportSnapshot("rev-1", &archive, false), "Failed to export snapshot")
+
+	// Image check failure
+	dstFolder := t.TempDir()
+	imageErr := errors.New("image not found")
+	_, err := snapshotting.ImportSnapshot(bytes.NewReader(archive.Bytes()), dstFolder, func(*snapshotting.Snapshot) error {
+		return imageErr
+	})
+	require.ErrorIs(t, err, imageErr, "Image check failure should be returned")
+
+	// Corrupted memory file
+	corrupted := archive.Bytes()
+	idx := bytes.Index(corrupted, []byte("rev-1/mem_file"))
+	require.NotEqual(t, -1, idx, "Memory file not found in archive")
+	corrupted = append([]byte{}, corrupted...)
+	corrupted[idx+512] = 1 // first byte after the tar header
+	_, err = snapshotting.ImportSnapshot(bytes.NewReader(corrupted), dstFolder, nil)
+	require.ErrorIs(t, err, snapshotting.ErrChecksumMismatch, "Corrupted snapshot should be rejected")
+
+	// Snapshot stored under the id of another key
+	var renamed bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	tw := tar.NewWriter(&renamed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		hdr.Name = strings.Replace(hdr.Name, "rev-1", "rev-2", 1)
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = io.Copy(tw, tr)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	_, err = snapshotting.ImportSnapshot(&renamed, dstFolder, nil)
+	require.ErrorContains(t, err, "contains the snapshot of key", "Snapshot whose id does not match its key should be rejected")
+
+	// Path traversal
+	var malicious bytes.Buffer
+	tw = tar.NewWriter(&malicious)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../rev-1/mem_file", Mode: 0644, Size: 1}))
+	_, err = tw.Write([]byte{0})
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	_, err = snapshotting.ImportSnapshot(&malicious, dstFolder, nil)
+	require.Error(t, err, "Archive escaping the snapshot directory should be rejected")
+
+	entries, err := os.ReadDir(dstFolder)
+	require.NoError(t, err, "Failed to list snapshots")
+	require.Empty(t, entries, "Rejected snapshots should be removed")
+
+	_, err = os.Stat(filepath.Join(srcFolder, "rev-1", "mem_file"))
+	require.NoError(t, err, "Exported snapshot should be kept")
+}
@@ -0,0 +1,145 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPSnapshotStore is a SnapshotStore keeping snapshot files on an HTTP server, e.g., a web server with WebDAV
+// enabled. Files are uploaded with PUT and downloaded with GET requests to <url>/<id>/<file>.
+type HTTPSnapshotStore struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// NewHTTPSnapshotStore creates a snapshot store keeping the snapshot files under the base URL.
+func NewHTTPSnapshotStore(baseURL string) (*HTTPSnapshotStore, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing snapshot store URL %s", baseURL)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("unsupported snapshot store URL scheme %q", base.Scheme))
+	}
+
+	return &HTTPSnapshotStore{
+		base:   base,
+		client: &http.Client{},
+	}, nil
+}
+
+// PutFile uploads the file at localPath to the server.
+func (s *HTTPSnapshotStore) PutFile(ctx context.Context, id, name, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening snapshot file %s", localPath)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "getting size of snapshot file %s", localPath)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.fileURL(id, name), file)
+	if err != nil {
+		return errors.Wrapf(err, "creating HTTP request")
+	}
+	req.ContentLength = info.Size()
+	if info.Size() == 0 {
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// GetFile downloads a file from the server to localPath.
+func (s *HTTPSnapshotStore) GetFile(ctx context.Context, id, name, localPath string) error {
+	body, _, err := s.OpenFile(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return writeFileAtomic(localPath, body)
+}
+
+// OpenFile starts downloading a file from the server, the file is streamed as it is read.
+func (s *HTTPSnapshotStore) OpenFile(ctx context.Context, id, name string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.fileURL(id, name), nil)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "creating HTTP request")
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// fileURL returns the URL of file name of the snapshot with the given id.
+func (s *HTTPSnapshotStore) fileURL(id, name string) string {
+	u := *s.base
+	u.Path = path.Join("/", s.base.Path, id, name)
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// do sends a request, turning error responses into errors.
+func (s *HTTPSnapshotStore) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", req.Method, req.URL.Path)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrSnapshotNotFound
+	}
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,55 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// SnapshotKey identifies the VM state captured by a snapshot. Besides the function revision, the state depends on the
+// image the VM has been started from and on the configuration of the VM, so that a snapshot must not be loaded if any
+// of them changed.
+type SnapshotKey struct {
+	Revision      string // function revision (`K_REVISION` environment variable of knative, or function ID)
+	ImageDigest   string // digest of the image the VM has been started from
+	KernelArgs    string // kernel command line of the VM
+	MachineConfig string // machine configuration of the VM (vCPUs, memory size)
+}
+
+// ID returns the identifier of the snapshots matching the key, which is used as snapshot directory name. Keys only
+// made of a revision map to the revision itself, other keys are disambiguated with a hash of the other fields.
+func (k SnapshotKey) ID() string {
+	if k.ImageDigest == "" && k.KernelArgs == "" && k.MachineConfig == "" {
+		return k.Revision
+	}
+
+	hash := sha256.New()
+	for _, field := range []string{k.ImageDigest, k.KernelArgs, k.MachineConfig} {
+		// Length-prefix the fields so that different keys cannot produce the same hash input
+		_, _ = fmt.Fprintf(hash, "%d:%s", len(field), field)
+	}
+
+	return fmt.Sprintf("%s-%s", k.Revision, hex.EncodeToString(hash.Sum(nil))[:16])
+}
@@ -23,99 +23,825 @@
 package snapshotting
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// quarantineDir is the directory of the base folder to which corrupted snapshots are moved.
+const quarantineDir = ".quarantine"
+
+// defaultStoreTimeout is the default maximum duration of a snapshot transfer from or to the snapshot store.
+const defaultStoreTimeout = 5 * time.Minute
+
+// Bounds of the interval between two compressions of the memory files of idle snapshots
+const (
+	minCompressInterval = time.Second
+	maxCompressInterval = time.Minute
+)
+
 // SnapshotManager manages snapshots stored on the node.
 type SnapshotManager struct {
 	sync.Mutex
-	// Stored snapshots (identified by the function instance revision, which is provided by the `K_REVISION` environment
-	// variable of knative).
+	// Stored snapshots, identified by the id of their SnapshotKey (the function instance revision, which is provided by
+	// the `K_REVISION` environment variable of knative, possibly combined with the image digest and VM configuration).
 	snapshots  map[string]*Snapshot
 	baseFolder string
+
+	// Garbage collection policy, a value of 0 disables the corresponding limit
+	diskQuota    int64 // maximum number of bytes used by committed snapshots
+	maxSnapshots int   // maximum number of committed snapshots
+
+	evictions      uint64
+	reclaimedBytes int64
+	quarantined    uint64
+	invalidations  uint64
+	failures       uint64
+
+	// Remote store sharing snapshots between nodes, nil if snapshots are only stored locally
+	store          SnapshotStore
+	storeTimeout   time.Duration  // maximum duration of a snapshot transfer from or to the store
+	uploads        sync.WaitGroup // uploads of committed snapshots to the store in progress
+	uploadFailures uint64
+
+	// Duration after which the memory file of an unused snapshot is compressed, 0 disables compression
+	compressAfter time.Duration
+	compressions  uint64
+}
+
+// SnapshotStats contains statistics about the snapshots stored by a SnapshotManager.
+type SnapshotStats struct {
+	Snapshots      int    // number of committed snapshots
+	UsedBytes      int64  // disk space used by committed snapshots
+	Evictions      uint64 // number of snapshots evicted by the garbage collector
+	ReclaimedBytes int64  // disk space reclaimed by evicting snapshots
+	Quarantined    uint64 // number of snapshots quarantined because they did not match their checksums
+	Invalidations  uint64 // number of stale snapshots invalidated because their key changed
+	Failures       uint64 // number of failed snapshot creations
+	Uploading      int    // number of committed snapshots being uploaded to the snapshot store
+	UploadFailures uint64 // number of snapshots that could not be uploaded to the snapshot store
+
+	CompressedSnapshots int    // number of committed snapshots whose memory file is compressed
+	MemBytes            int64  // size of the compressed memory files once decompressed
+	CompressedMemBytes  int64  // size of the compressed memory files
+	Compressions        uint64 // number of memory files compressed
 }
 
-// Snapshot identified by VM id
+// CompressionRatio returns the ratio between the size of the compressed memory files once decompressed and their
+// size, 0 if no memory file is compressed.
+func (s SnapshotStats) CompressionRatio() float64 {
+	if s.CompressedMemBytes == 0 {
+		return 0
+	}
+
+	return float64(s.MemBytes) / float64(s.CompressedMemBytes)
+}
 
-func NewSnapshotManager(baseFolder string) *SnapshotManager {
+// NewSnapshotManager creates a snapshot manager that stores its snapshots in baseFolder. Snapshots left in baseFolder
+// by a previous run are recovered, so that they can be reused after a restart of the daemon.
+func NewSnapshotManager(baseFolder string, opts ...SnapshotManagerOption) *SnapshotManager {
 	manager := new(SnapshotManager)
 	manager.snapshots = make(map[string]*Snapshot)
 	manager.baseFolder = baseFolder
+	manager.storeTimeout = defaultStoreTimeout
 
-	// Clean & init basefolder
-	_ = os.RemoveAll(manager.baseFolder)
+	for _, opt := range opts {
+		opt(manager)
+	}
+
+	// Init basefolder
 	_ = os.MkdirAll(manager.baseFolder, os.ModePerm)
 
+	manager.recoverSnapshots()
+
+	// Recovered snapshots may exceed the configured limits
+	manager.Lock()
+	victims := manager.evictSnapshots()
+	manager.Unlock()
+	cleanupSnapshots(victims)
+
+	if manager.compressAfter > 0 {
+		go manager.compressLoop()
+	}
+
 	return manager
 }
 
-// AcquireSnapshot returns a snapshot for the specified revision if it is available.
+// recoverSnapshots rebuilds the snapshot catalog from the snapshot directories stored in the base folder. Only
+// snapshots with a readable info file and all snapshot files present are recovered, incomplete or corrupt snapshots
+// (e.g., left behind by a crash during snapshot creation) are removed. The content of the recovered snapshots is
+// verified against their checksums when they are first acquired.
+func (mgr *SnapshotManager) recoverSnapshots() {
+	entries, err := os.ReadDir(mgr.baseFolder)
+	if err != nil {
+		log.WithError(err).Warnf("failed to read snapshots directory %s", mgr.baseFolder)
+		return
+	}
+
+	for _, entry := range entries {
+		// Skip regular files and the quarantine directory
+		if !entry.IsDir() || entry.Name() == quarantineDir {
+			continue
+		}
+
+		// Remove snapshots that were being removed or imported when the daemon stopped
+		if strings.HasPrefix(entry.Name(), ".") {
+			if err := os.RemoveAll(filepath.Join(mgr.baseFolder, entry.Name())); err != nil {
+				log.WithError(err).Errorf("failed to remove %s", entry.Name())
+			}
+			continue
+		}
+
+		id := entry.Name()
+		logger := log.WithFields(log.Fields{"snapshot": id})
+
+		snap, err := LoadSnapshot(id, mgr.baseFolder)
+		if err != nil {
+			logger.WithError(err).Warn("removing incomplete or corrupt snapshot")
+			if err := snap.Cleanup(); err != nil {
+				logger.WithError(err).Error("failed to remove snapshot")
+			}
+			continue
+		}
+
+		snap.state = SnapshotReady
+		snap.size = snap.diskUsage()
+		snap.lastUsed = snap.modTime()
+		snap.updateMemSizes()
+		mgr.snapshots[id] = snap
+		logger.Debug("Recovered snapshot")
+	}
+
+	log.Infof("Recovered %d snapshots from %s", len(mgr.snapshots), mgr.baseFolder)
+}
+
+// AcquireSnapshot returns a snapshot for the specified revision if it is available. If the snapshot is not stored on
+// the node but a snapshot store is configured, the snapshot is downloaded from the store. The snapshot files are
+// checked against the checksums recorded upon snapshot creation, a snapshot that does not match them is quarantined
+// so that it can be rebuilt. The snapshot is protected from eviction until it is released with ReleaseSnapshot.
 func (mgr *SnapshotManager) AcquireSnapshot(revision string) (*Snapshot, error) {
 	mgr.Lock()
-	defer mgr.Unlock()
 
 	// Check if idle snapshot is available for the given image
 	snap, ok := mgr.snapshots[revision]
 	if !ok {
+		// The snapshot may have been imported into the base folder after the manager was created
+		snap, ok = mgr.adoptSnapshot(revision)
+	}
+
+	if !ok && mgr.store == nil {
+		mgr.Unlock()
 		return nil, errors.New(fmt.Sprintf("Get: Snapshot for revision %s does not exist", revision))
 	}
 
-	// Snapshot registered in manager but creation not finished yet
-	if !snap.ready {
-		return nil, errors.New("Snapshot is not yet usable")
+	if !ok {
+		var err error
+		if snap, err = mgr.fetchSnapshot(revision); err != nil {
+			mgr.Unlock()
+			return nil, err
+		}
 	}
 
+	// Snapshot registered in manager but creation not finished yet or failed
+	if snap.state != SnapshotReady {
+		mgr.Unlock()
+		return nil, errors.New(fmt.Sprintf("Snapshot is not usable (%s)", snap.state))
+	}
+
+	// Cheap check catching truncated files on every acquisition
+	if err := snap.checkSizes(); err != nil {
+		mgr.quarantineSnapshot(snap, err)
+		mgr.Unlock()
+		return nil, errors.Wrapf(err, "verifying snapshot for revision %s", revision)
+	}
+
+	snap.users++
+	snap.lastUsed = time.Now()
+
+	// Full verification of snapshots that have not been created or downloaded by this manager
+	if !snap.verified {
+		mgr.Unlock()
+		err := snap.Verify()
+		mgr.Lock()
+
+		if err != nil {
+			snap.users--
+			mgr.quarantineSnapshot(snap, err)
+			mgr.Unlock()
+			return nil, errors.Wrapf(err, "verifying snapshot for revision %s", revision)
+		}
+		snap.verified = true
+	}
+
+	// A fetched snapshot may exceed the configured limits
+	victims := mgr.evictSnapshots()
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+
 	// Return snapshot for supplied revision
-	return mgr.snapshots[revision], nil
+	return snap, nil
+}
+
+// adoptSnapshot adds a complete snapshot that has been stored in the base folder by another process (e.g., imported
+// with the snapshot CLI) to the manager. Must be called with the manager lock held.
+func (mgr *SnapshotManager) adoptSnapshot(id string) (*Snapshot, bool) {
+	if _, err := os.Stat(filepath.Join(mgr.baseFolder, id, infoFile)); err != nil {
+		return nil, false
+	}
+
+	snap, err := LoadSnapshot(id, mgr.baseFolder)
+	if err != nil {
+		return nil, false
+	}
+
+	snap.state = SnapshotReady
+	snap.size = snap.diskUsage()
+	snap.lastUsed = time.Now()
+	snap.updateMemSizes()
+	mgr.snapshots[id] = snap
+	log.WithFields(log.Fields{"snapshot": id}).Debug("Adopted snapshot stored in base folder")
+
+	return snap, true
+}
+
+// AcquireSnapshotWithKey returns a snapshot matching the supplied key if it is available, see AcquireSnapshot. Snapshots
+// of the same revision that do not match the key anymore (e.g., because the image tag has been pushed again or the VM
+// configuration changed) are stale and invalidated, unless they are in use.
+func (mgr *SnapshotManager) AcquireSnapshotWithKey(key SnapshotKey) (*Snapshot, error) {
+	mgr.Lock()
+	victims := mgr.invalidateSnapshots(key)
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+
+	return mgr.AcquireSnapshot(key.ID())
+}
+
+// invalidateSnapshots removes the committed snapshots of the key's revision that do not match the key and are not in
+// use. The invalidated snapshots are returned so that their files can be removed without holding the lock. Must be
+// called with the manager lock held.
+func (mgr *SnapshotManager) invalidateSnapshots(key SnapshotKey) []*Snapshot {
+	var (
+		id      = key.ID()
+		victims = make([]*Snapshot, 0)
+	)
+
+	for _, snap := range mgr.snapshots {
+		if snap.Key.Revision != key.Revision || snap.GetId() == id || snap.state != SnapshotReady || snap.users > 0 {
+			continue
+		}
+
+		log.WithFields(log.Fields{"snapshot": snap.GetId(), "revision": key.Revision}).Info("Invalidating stale snapshot")
+
+		delete(mgr.snapshots, snap.GetId())
+		mgr.invalidations++
+		snap.detach()
+		victims = append(victims, snap)
+	}
+
+	return victims
 }
 
-// InitSnapshot initializes a snapshot by adding its metadata to the SnapshotManager. Once the snapshot has
-// been created, CommitSnapshot must be run to finalize the snapshot creation and make the snapshot available for use.
+// fetchSnapshot downloads the snapshot for the specified revision from the snapshot store. The snapshot is registered
+// in the manager while being downloaded, so that concurrent acquisitions and initializations of the snapshot fail
+// instead of downloading it again. Must be called with the manager lock held, which is released during the download.
+func (mgr *SnapshotManager) fetchSnapshot(revision string) (*Snapshot, error) {
+	snap := NewSnapshot(revision, mgr.baseFolder, "")
+	mgr.snapshots[revision] = snap
+	mgr.Unlock()
+
+	logger := log.WithFields(log.Fields{"revision": revision})
+	logger.Debug("Fetching snapshot from snapshot store")
+
+	ctx, cancel := context.WithTimeout(context.Background(), mgr.storeTimeout)
+	err := pullSnapshot(ctx, mgr.store, snap)
+	cancel()
+	if err == nil {
+		err = snap.Verify()
+	}
+	if err != nil {
+		if cleanupErr := snap.Cleanup(); cleanupErr != nil {
+			logger.WithError(cleanupErr).Error("failed to remove snapshot")
+		}
+	}
+
+	mgr.Lock()
+
+	if err == ErrSnapshotNotFound {
+		delete(mgr.snapshots, revision)
+		return nil, errors.New(fmt.Sprintf("Get: Snapshot for revision %s does not exist", revision))
+	} else if err != nil {
+		delete(mgr.snapshots, revision)
+		logger.WithError(err).Warn("failed to fetch snapshot from snapshot store")
+		return nil, errors.Wrapf(err, "fetching snapshot for revision %s", revision)
+	}
+
+	snap.state = SnapshotReady
+	snap.verified = true
+	snap.size = snap.diskUsage()
+	logger.Debug("Fetched snapshot from snapshot store")
+
+	return snap, nil
+}
+
+// ReleaseSnapshot releases a snapshot previously acquired with AcquireSnapshot, making it eligible for eviction
+// once all its users have released it.
+func (mgr *SnapshotManager) ReleaseSnapshot(revision string) {
+	mgr.Lock()
+
+	snap, ok := mgr.snapshots[revision]
+	if !ok || snap.users == 0 {
+		mgr.Unlock()
+		log.WithFields(log.Fields{"revision": revision}).Warn("Releasing a snapshot that has not been acquired")
+		return
+	}
+
+	snap.users--
+
+	// Eviction may have been postponed because the snapshot was in use
+	victims := mgr.evictSnapshots()
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+}
+
+// InitSnapshot initializes a snapshot by adding its metadata to the SnapshotManager, moving it into the creating state.
+// The caller becomes the single designated creator of the snapshot: once the snapshot has been created, CommitSnapshot
+// must be run to finalize the snapshot creation and make the snapshot available for use, or FailSnapshot if the
+// creation failed. ErrSnapshotExists is returned if the snapshot is being created or ready, in which case the caller
+// should skip the snapshot creation.
 func (mgr *SnapshotManager) InitSnapshot(revision, image string) (*Snapshot, error) {
+	return mgr.InitSnapshotWithKey(SnapshotKey{Revision: revision}, image)
+}
+
+// InitSnapshotWithKey initializes a snapshot identified by a SnapshotKey, see InitSnapshot. The id of the snapshot is
+// the id of the key.
+func (mgr *SnapshotManager) InitSnapshotWithKey(key SnapshotKey, image string) (*Snapshot, error) {
 	mgr.Lock()
 
-	logger := log.WithFields(log.Fields{"revision": revision, "image": image})
+	id := key.ID()
+	logger := log.WithFields(log.Fields{"revision": key.Revision, "snapshot": id, "image": image})
 	logger.Debug("Initializing snapshot corresponding to revision and image")
 
-	if _, present := mgr.snapshots[revision]; present {
+	// A failed snapshot can be created again
+	if snap, present := mgr.snapshots[id]; present && snap.state != SnapshotFailed {
 		mgr.Unlock()
-		return nil, errors.New(fmt.Sprintf("Add: Snapshot for revision %s already exists", revision))
+		return nil, errors.Wrapf(ErrSnapshotExists, "Add: Snapshot for revision %s is %s", id, snap.state)
 	}
 
 	// Create snapshot object and move into creating state
-	snap := NewSnapshot(revision, mgr.baseFolder, image)
+	snap := NewSnapshot(id, mgr.baseFolder, image)
+	snap.Key = key
 	mgr.snapshots[snap.GetId()] = snap
 	mgr.Unlock()
 
 	// Create directory to store snapshot data
 	err := snap.CreateSnapDir()
 	if err != nil {
-		return nil, errors.Wrapf(err, "creating snapDir for snapshots %s", revision)
+		mgr.FailSnapshot(id)
+		return nil, errors.Wrapf(err, "creating snapDir for snapshots %s", id)
 	}
 
 	return snap, nil
 }
 
-// CommitSnapshot finalizes the snapshot creation and makes it available for use.
-func (mgr *SnapshotManager) CommitSnapshot(revision string) error {
+// FailSnapshot aborts the creation of a snapshot, moving it into the failed state and removing its files. The
+// snapshot can then be created again with InitSnapshot.
+func (mgr *SnapshotManager) FailSnapshot(revision string) {
 	mgr.Lock()
 	defer mgr.Unlock()
 
+	logger := log.WithFields(log.Fields{"snapshot": revision})
+
+	snap, ok := mgr.snapshots[revision]
+	if !ok || snap.state != SnapshotCreating {
+		logger.Warn("Failing a snapshot that is not being created")
+		return
+	}
+
+	snap.state = SnapshotFailed
+	mgr.failures++
+	logger.Debug("Snapshot creation failed")
+
+	if err := snap.Cleanup(); err != nil {
+		logger.WithError(err).Error("failed to remove snapshot")
+	}
+}
+
+// GetSnapshotState returns the lifecycle state of the snapshot with the given id.
+func (mgr *SnapshotManager) GetSnapshotState(revision string) SnapshotState {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	snap, ok := mgr.snapshots[revision]
+	if !ok {
+		return SnapshotAbsent
+	}
+
+	return snap.state
+}
+
+// CommitSnapshot finalizes the snapshot creation and makes it available for use. The checksums of the snapshot files
+// are recorded in the snapshot info file, the snapshot is moved into the failed state if this is not possible. If a
+// snapshot store is configured, the snapshot is also uploaded to the store in the background, failing to do so does
+// not prevent the snapshot from being used locally.
+func (mgr *SnapshotManager) CommitSnapshot(revision string) error {
+	mgr.Lock()
+
 	snap, ok := mgr.snapshots[revision]
 	if !ok {
+		mgr.Unlock()
 		return errors.New(fmt.Sprintf("Snapshot for revision %s to commit does not exist", revision))
 	}
 
-	if snap.ready {
-		return errors.New(fmt.Sprintf("Snapshot for revision %s has already been committed", revision))
+	if snap.state != SnapshotCreating {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Snapshot for revision %s to commit is %s", revision, snap.state))
 	}
 
-	snap.ready = true
+	mgr.Unlock()
+
+	if err := snap.computeChecksums(); err != nil {
+		mgr.FailSnapshot(revision)
+		return errors.Wrapf(err, "computing checksums of snapshot %s", revision)
+	}
+
+	if err := snap.SerializeSnapInfo(); err != nil {
+		mgr.FailSnapshot(revision)
+		return err
+	}
+
+	mgr.Lock()
+
+	snap.state = SnapshotReady
+	snap.verified = true
+	snap.size = snap.diskUsage()
+	snap.lastUsed = time.Now()
+
+	// Protect the snapshot from eviction and compression while it is being uploaded
+	if mgr.store != nil {
+		snap.users++
+		snap.uploading = true
+		mgr.uploads.Add(1)
+	}
+
+	victims := mgr.evictSnapshots()
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+
+	if mgr.store != nil {
+		go mgr.uploadSnapshot(snap)
+	}
 
 	return nil
 }
+
+// uploadSnapshot uploads a committed snapshot to the snapshot store and releases it once the upload is over.
+func (mgr *SnapshotManager) uploadSnapshot(snap *Snapshot) {
+	defer mgr.uploads.Done()
+
+	logger := log.WithFields(log.Fields{"revision": snap.GetId()})
+	logger.Debug("Uploading snapshot to snapshot store")
+
+	ctx, cancel := context.WithTimeout(context.Background(), mgr.storeTimeout)
+	err := pushSnapshot(ctx, mgr.store, snap)
+	cancel()
+
+	mgr.Lock()
+	snap.uploading = false
+	if err != nil {
+		mgr.uploadFailures++
+	}
+	mgr.Unlock()
+
+	if err != nil {
+		logger.WithError(err).Warn("failed to upload snapshot to snapshot store")
+	}
+
+	mgr.ReleaseSnapshot(snap.GetId())
+}
+
+// WaitUploads waits for the uploads of the committed snapshots to the snapshot store that are in progress.
+func (mgr *SnapshotManager) WaitUploads() {
+	mgr.uploads.Wait()
+}
+
+// VerifySnapshot checks the files of the snapshot for the specified revision against the checksums recorded upon
+// snapshot creation. A snapshot that does not match them is quarantined so that it can be rebuilt.
+func (mgr *SnapshotManager) VerifySnapshot(revision string) error {
+	mgr.Lock()
+
+	snap, ok := mgr.snapshots[revision]
+	if !ok || snap.state != SnapshotReady {
+		mgr.Unlock()
+		return errors.New(fmt.Sprintf("Snapshot for revision %s to verify does not exist", revision))
+	}
+
+	// Protect the snapshot from eviction during the verification
+	snap.users++
+	mgr.Unlock()
+
+	err := snap.Verify()
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	snap.users--
+	if err != nil {
+		mgr.quarantineSnapshot(snap, err)
+		return errors.Wrapf(err, "verifying snapshot for revision %s", revision)
+	}
+	snap.verified = true
+
+	return nil
+}
+
+// quarantineSnapshot removes a snapshot that does not match its checksums from the manager and moves its files to the
+// quarantine directory of the base folder. Must be called with the manager lock held.
+func (mgr *SnapshotManager) quarantineSnapshot(snap *Snapshot, cause error) {
+	// The snapshot may have already been quarantined by a concurrent verification
+	if mgr.snapshots[snap.GetId()] != snap {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"snapshot": snap.GetId()})
+	logger.WithError(cause).Warn("Quarantining corrupted snapshot")
+
+	delete(mgr.snapshots, snap.GetId())
+	mgr.quarantined++
+
+	if err := snap.quarantine(filepath.Join(mgr.baseFolder, quarantineDir)); err != nil {
+		logger.WithError(err).Error("failed to quarantine snapshot, removing it")
+		if err := snap.Cleanup(); err != nil {
+			logger.WithError(err).Error("failed to remove snapshot")
+		}
+	}
+}
+
+// ExportSnapshot writes the ready snapshot with the given id as a snapshot archive to w, see ExportSnapshot.
+func (mgr *SnapshotManager) ExportSnapshot(revision string, w io.Writer, compress bool) error {
+	snap, err := mgr.AcquireSnapshot(revision)
+	if err != nil {
+		return err
+	}
+	defer mgr.ReleaseSnapshot(snap.GetId())
+
+	if _, err := mgr.PrepareMemFile(snap); err != nil {
+		return err
+	}
+
+	return ExportSnapshot(snap, w, compress)
+}
+
+// ImportSnapshot imports a snapshot archive into the manager, see ImportSnapshot.
+func (mgr *SnapshotManager) ImportSnapshot(r io.Reader, checkImage func(*Snapshot) error) (*Snapshot, error) {
+	snap, err := ImportSnapshot(r, mgr.baseFolder, checkImage)
+	if err != nil {
+		return nil, err
+	}
+
+	mgr.Lock()
+
+	// A failed snapshot has no files and can be replaced
+	if existing, present := mgr.snapshots[snap.GetId()]; present && existing.state != SnapshotFailed {
+		mgr.Unlock()
+		return nil, errors.Wrapf(ErrSnapshotExists, "importing snapshot %s", snap.GetId())
+	}
+
+	snap.state = SnapshotReady
+	snap.verified = true
+	snap.size = snap.diskUsage()
+	snap.lastUsed = time.Now()
+	mgr.snapshots[snap.GetId()] = snap
+
+	victims := mgr.evictSnapshots()
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+
+	return snap, nil
+}
+
+// GetStats returns statistics about the stored snapshots and the garbage collection.
+func (mgr *SnapshotManager) GetStats() SnapshotStats {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	stats := SnapshotStats{
+		Evictions:      mgr.evictions,
+		ReclaimedBytes: mgr.reclaimedBytes,
+		Quarantined:    mgr.quarantined,
+		Invalidations:  mgr.invalidations,
+		Failures:       mgr.failures,
+		UploadFailures: mgr.uploadFailures,
+		Compressions:   mgr.compressions,
+	}
+
+	for _, snap := range mgr.snapshots {
+		if snap.state != SnapshotReady {
+			continue
+		}
+
+		stats.Snapshots++
+		stats.UsedBytes += snap.size
+		if snap.uploading {
+			stats.Uploading++
+		}
+
+		if snap.compressedSize > 0 {
+			stats.CompressedSnapshots++
+			stats.MemBytes += snap.memSize
+			stats.CompressedMemBytes += snap.compressedSize
+		}
+	}
+
+	return stats
+}
+
+// compressLoop periodically compresses the memory files of idle snapshots.
+func (mgr *SnapshotManager) compressLoop() {
+	interval := mgr.compressAfter
+	if interval < minCompressInterval {
+		interval = minCompressInterval
+	} else if interval > maxCompressInterval {
+		interval = maxCompressInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mgr.CompressIdleSnapshots()
+	}
+}
+
+// CompressIdleSnapshots compresses the memory files of the committed snapshots that have not been used for the
+// configured duration, eliding zero pages, and removes the uncompressed memory files of idle snapshots that already
+// have a compressed copy. The memory file is decompressed again by Snapshot.PrepareMemFile when the snapshot is loaded.
+func (mgr *SnapshotManager) CompressIdleSnapshots() {
+	mgr.Lock()
+
+	idle := make([]*Snapshot, 0)
+	for _, snap := range mgr.snapshots {
+		if snap.state != SnapshotReady || snap.users > 0 || snap.compressing || time.Since(snap.lastUsed) < mgr.compressAfter {
+			continue
+		}
+
+		// Protect the snapshot from eviction while its memory file is being compressed
+		snap.compressing = true
+		snap.users++
+		idle = append(idle, snap)
+	}
+
+	mgr.Unlock()
+
+	for _, snap := range idle {
+		mgr.compressSnapshot(snap)
+	}
+}
+
+// PrepareMemFile makes sure the memory file of an acquired snapshot can be loaded, see Snapshot.PrepareMemFile. The
+// decompressed memory file is counted in the disk usage of the snapshot, so that the snapshots using the disk space it
+// takes are evicted if the disk quota is exceeded. The time spent decompressing the memory file is returned, 0 if it
+// was already available.
+func (mgr *SnapshotManager) PrepareMemFile(snap *Snapshot) (time.Duration, error) {
+	elapsed, err := snap.PrepareMemFile()
+	if err != nil || elapsed == 0 {
+		return elapsed, err
+	}
+
+	mgr.Lock()
+	snap.size = snap.diskUsage()
+	victims := mgr.evictSnapshots()
+	mgr.Unlock()
+
+	cleanupSnapshots(victims)
+
+	return elapsed, nil
+}
+
+// compressSnapshot compresses the memory file of an idle snapshot, if it has no compressed copy yet, and removes the
+// uncompressed memory file unless the snapshot has been acquired in the meantime.
+func (mgr *SnapshotManager) compressSnapshot(snap *Snapshot) {
+	logger := log.WithFields(log.Fields{"snapshot": snap.GetId()})
+
+	var err error
+	compressed := snap.isMemCompressed()
+	if !compressed {
+		tmp := snap.GetCompressedMemFilePath() + ".tmp"
+		if _, err = compressMemFile(snap.GetMemFilePath(), tmp); err == nil {
+			err = os.Rename(tmp, snap.GetCompressedMemFilePath())
+		}
+		if err != nil {
+			logger.WithError(err).Warn("failed to compress memory file")
+			_ = os.Remove(tmp)
+		}
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	snap.compressing = false
+	snap.users--
+
+	if err != nil {
+		return
+	}
+
+	if !compressed {
+		mgr.compressions++
+	}
+
+	// The decompressed memory file is kept while the snapshot is in use
+	if snap.users == 0 {
+		if err := os.Remove(snap.GetMemFilePath()); err != nil && !os.IsNotExist(err) {
+			logger.WithError(err).Warn("failed to remove uncompressed memory file")
+		}
+	}
+
+	snap.updateMemSizes()
+	snap.size = snap.diskUsage()
+
+	if !compressed && snap.compressedSize > 0 {
+		logger.Debugf("Compressed memory file from %d to %d bytes", snap.memSize, snap.compressedSize)
+	}
+}
+
+// evictSnapshots removes least-recently-used committed snapshots from the manager until the disk quota and the
+// maximum number of snapshots are respected. Snapshots that are in use or still being created are never evicted.
+// The evicted snapshots are returned so that their files can be removed without holding the lock. Must be called
+// with the manager lock held.
+func (mgr *SnapshotManager) evictSnapshots() []*Snapshot {
+	if mgr.diskQuota <= 0 && mgr.maxSnapshots <= 0 {
+		return nil
+	}
+
+	var (
+		count      int
+		usedBytes  int64
+		candidates = make([]*Snapshot, 0)
+		victims    = make([]*Snapshot, 0)
+	)
+
+	for _, snap := range mgr.snapshots {
+		if snap.state != SnapshotReady {
+			continue
+		}
+
+		count++
+		usedBytes += snap.size
+
+		if snap.users == 0 {
+			candidates = append(candidates, snap)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	for _, snap := range candidates {
+		overQuota := mgr.diskQuota > 0 && usedBytes > mgr.diskQuota
+		overCount := mgr.maxSnapshots > 0 && count > mgr.maxSnapshots
+		if !overQuota && !overCount {
+			break
+		}
+
+		delete(mgr.snapshots, snap.GetId())
+		count--
+		usedBytes -= snap.size
+
+		mgr.evictions++
+		mgr.reclaimedBytes += snap.size
+		snap.detach()
+		victims = append(victims, snap)
+
+		log.WithFields(log.Fields{"snapshot": snap.GetId(), "size": snap.size}).Debug("Evicting snapshot")
+	}
+
+	if (mgr.diskQuota > 0 && usedBytes > mgr.diskQuota) || (mgr.maxSnapshots > 0 && count > mgr.maxSnapshots) {
+		log.Warnf("Snapshots exceed the configured limits (%d bytes, %d snapshots) but are in use", usedBytes, count)
+	}
+
+	return victims
+}
+
+// cleanupSnapshots removes the files of the supplied snapshots, which must have been detached from the base folder.
+func cleanupSnapshots(snaps []*Snapshot) {
+	for _, snap := range snaps {
+		if err := snap.Cleanup(); err != nil {
+			log.WithError(err).Errorf("failed to remove snapshot %s", snap.GetId())
+		}
+	}
+}
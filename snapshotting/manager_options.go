@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import "time"
+
+// SnapshotManagerOption Options to pass to SnapshotManager
+type SnapshotManagerOption func(*SnapshotManager)
+
+// WithDiskQuota Sets the maximum disk space (in bytes) used by committed
+// snapshots, least-recently-used snapshots are evicted above it (0 means no limit)
+func WithDiskQuota(diskQuota int64) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.diskQuota = diskQuota
+	}
+}
+
+// WithMaxSnapshots Sets the maximum number of committed snapshots,
+// least-recently-used snapshots are evicted above it (0 means no limit)
+func WithMaxSnapshots(maxSnapshots int) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.maxSnapshots = maxSnapshots
+	}
+}
+
+// WithSnapshotStore Sets the store to which committed snapshots are uploaded
+// and from which missing snapshots are downloaded (nil disables it)
+func WithSnapshotStore(store SnapshotStore) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.store = store
+	}
+}
+
+// WithStoreTimeout Sets the maximum duration of the download or upload of a
+// snapshot from or to the snapshot store (5 minutes by default)
+func WithStoreTimeout(timeout time.Duration) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.storeTimeout = timeout
+	}
+}
+
+// WithMemoryCompression Sets the duration after which the memory file of an
+// unused snapshot is compressed, it is decompressed when the snapshot is loaded
+// (0 disables compression)
+func WithMemoryCompression(idleTime time.Duration) SnapshotManagerOption {
+	return func(mgr *SnapshotManager) {
+		mgr.compressAfter = idleTime
+	}
+}
@@ -29,6 +29,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/vhive-serverless/vhive/snapshotting"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -97,3 +99,258 @@ func TestSnapshotManagerConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSnapshotManagerRecovery(t *testing.T) {
+	baseFolder := t.TempDir()
+
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+
+	// Complete snapshot
+	snap, err := mgr.InitSnapshot("complete-rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetMemFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644), "Failed to write snapshot file")
+	}
+	require.NoError(t, snap.SerializeSnapInfo(), "Failed to serialize snapshot info")
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()), "Failed to commit snapshot")
+
+	// Incomplete snapshot, e.g., the daemon crashed during snapshot creation
+	incomplete, err := mgr.InitSnapshot("incomplete-rev", "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, incomplete.SerializeSnapInfo(), "Failed to serialize snapshot info")
+
+	// Corrupt snapshot info
+	corruptDir := filepath.Join(baseFolder, "corrupt-rev")
+	require.NoError(t, os.Mkdir(corruptDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(corruptDir, "info_file"), []byte("garbage"), 0644))
+
+	// Simulate a daemon restart
+	mgr = snapshotting.NewSnapshotManager(baseFolder)
+
+	recovered, err := mgr.AcquireSnapshot("complete-rev")
+	require.NoError(t, err, "Failed to acquire recovered snapshot")
+	require.Equal(t, snap.GetImage(), recovered.GetImage())
+	require.Equal(t, snap.GetContainerSnapName(), recovered.GetContainerSnapName())
+	require.Equal(t, snap.GetMemFilePath(), recovered.GetMemFilePath())
+
+	_, err = mgr.AcquireSnapshot("incomplete-rev")
+	require.Error(t, err, "Incomplete snapshot should not be recovered")
+	_, err = os.Stat(filepath.Join(baseFolder, "incomplete-rev"))
+	require.True(t, os.IsNotExist(err), "Incomplete snapshot should be removed")
+
+	_, err = mgr.AcquireSnapshot("corrupt-rev")
+	require.Error(t, err, "Corrupt snapshot should not be recovered")
+	_, err = os.Stat(corruptDir)
+	require.True(t, os.IsNotExist(err), "Corrupt snapshot should be removed")
+}
+
+func createTestSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string, size int) {
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, os.WriteFile(snap.GetSnapshotFilePath(), []byte{}, 0644), "Failed to write snapshot file")
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), make([]byte, size), 0644), "Failed to write memory file")
+	require.NoError(t, os.WriteFile(snap.GetPatchFilePath(), []byte{}, 0644), "Failed to write patch file")
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()), "Failed to commit snapshot")
+}
+
+func TestSnapshotManagerEviction(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder, snapshotting.WithMaxSnapshots(2))
+
+	createTestSnapshot(t, mgr, "rev-1", 1024)
+	snapSize := mgr.GetStats().UsedBytes
+	createTestSnapshot(t, mgr, "rev-2", 1024)
+
+	// Use rev-1 so that rev-2 becomes the least-recently-used snapshot
+	snap, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	mgr.ReleaseSnapshot(snap.GetId())
+
+	createTestSnapshot(t, mgr, "rev-3", 1024)
+
+	_, err = mgr.AcquireSnapshot("rev-2")
+	require.Error(t, err, "Least-recently-used snapshot should be evicted")
+	_, err = os.Stat(filepath.Join(baseFolder, "rev-2"))
+	require.True(t, os.IsNotExist(err), "Evicted snapshot should be removed from disk")
+
+	for _, revision := range []string{"rev-1", "rev-3"} {
+		snap, err := mgr.AcquireSnapshot(revision)
+		require.NoError(t, err, "Recently used snapshot should not be evicted")
+		mgr.ReleaseSnapshot(snap.GetId())
+	}
+
+	stats := mgr.GetStats()
+	require.Equal(t, 2, stats.Snapshots)
+	require.Equal(t, uint64(1), stats.Evictions)
+	require.Equal(t, snapSize, stats.ReclaimedBytes)
+}
+
+func TestSnapshotManagerEvictionInUse(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir(), snapshotting.WithDiskQuota(10000))
+
+	// Snapshots take a bit more than 4096 bytes including their info file, so that only two of them fit in the quota
+	createTestSnapshot(t, mgr, "rev-1", 4096)
+	snapSize := mgr.GetStats().UsedBytes
+	snap, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Failed to acquire snapshot")
+
+	// Exceeds the quota, rev-1 is the least-recently-used snapshot but it is in use
+	createTestSnapshot(t, mgr, "rev-2", 4096)
+	createTestSnapshot(t, mgr, "rev-3", 4096)
+	_, err = os.Stat(snap.GetMemFilePath())
+	require.NoError(t, err, "Snapshot in use should not be removed from disk")
+	_, err = mgr.AcquireSnapshot("rev-2")
+	require.Error(t, err, "Least-recently-used snapshot not in use should be evicted")
+
+	// Once released, rev-1 is evicted before the more recently used rev-3
+	mgr.ReleaseSnapshot(snap.GetId())
+	createTestSnapshot(t, mgr, "rev-4", 4096)
+
+	_, err = mgr.AcquireSnapshot("rev-1")
+	require.Error(t, err, "Released snapshot should be evicted")
+
+	stats := mgr.GetStats()
+	require.Equal(t, 2, stats.Snapshots)
+	require.Equal(t, 2*snapSize, stats.UsedBytes)
+	require.Equal(t, uint64(2), stats.Evictions)
+	require.Equal(t, 2*snapSize, stats.ReclaimedBytes)
+}
+
+func TestSnapshotManagerVerification(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+
+	createTestSnapshot(t, mgr, "truncated-rev", 1024)
+	createTestSnapshot(t, mgr, "modified-rev", 1024)
+	createTestSnapshot(t, mgr, "intact-rev", 1024)
+	require.NoError(t, mgr.VerifySnapshot("intact-rev"), "Intact snapshot should be verified")
+
+	// Truncated files are detected on acquisition
+	snap, err := mgr.AcquireSnapshot("truncated-rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	mgr.ReleaseSnapshot(snap.GetId())
+	require.NoError(t, os.Truncate(snap.GetMemFilePath(), 512))
+	_, err = mgr.AcquireSnapshot("truncated-rev")
+	require.ErrorIs(t, err, snapshotting.ErrChecksumMismatch, "Truncated snapshot should not be acquired")
+
+	// Modified files are detected by an explicit verification
+	snap, err = mgr.AcquireSnapshot("modified-rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	mgr.ReleaseSnapshot(snap.GetId())
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), append(make([]byte, 1023), 1), 0644))
+	require.ErrorIs(t, mgr.VerifySnapshot("modified-rev"), snapshotting.ErrChecksumMismatch)
+	_, err = mgr.AcquireSnapshot("modified-rev")
+	require.Error(t, err, "Modified snapshot should not be acquired")
+
+	// Quarantined snapshots are kept for inspection and can be rebuilt
+	entries, err := os.ReadDir(filepath.Join(baseFolder, ".quarantine"))
+	require.NoError(t, err, "Failed to read quarantine directory")
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(2), mgr.GetStats().Quarantined)
+	createTestSnapshot(t, mgr, "modified-rev", 1024)
+
+	// Recovered snapshots are verified on their first acquisition
+	snap, err = mgr.AcquireSnapshot("intact-rev")
+	require.NoError(t, err, "Failed to acquire snapshot")
+	mgr.ReleaseSnapshot(snap.GetId())
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), append(make([]byte, 1023), 1), 0644))
+
+	mgr = snapshotting.NewSnapshotManager(baseFolder)
+	_, err = mgr.AcquireSnapshot("intact-rev")
+	require.ErrorIs(t, err, snapshotting.ErrChecksumMismatch, "Modified recovered snapshot should not be acquired")
+	snap, err = mgr.AcquireSnapshot("modified-rev")
+	require.NoError(t, err, "Rebuilt snapshot should be recovered")
+	mgr.ReleaseSnapshot(snap.GetId())
+}
+
+func TestSnapshotKey(t *testing.T) {
+	key := snapshotting.SnapshotKey{Revision: "myrev-1"}
+	require.Equal(t, "myrev-1", key.ID(), "Revision-only keys should map to the revision")
+
+	key.ImageDigest = "sha256:aaaa"
+	key.MachineConfig = "vcpus=1,mem=256MiB"
+	require.Equal(t, key.ID(), key.ID(), "Key IDs should be deterministic")
+	require.True(t, strings.HasPrefix(key.ID(), "myrev-1-"), "Key IDs should start with the revision")
+
+	other := key
+	other.ImageDigest = "sha256:bbbb"
+	require.NotEqual(t, key.ID(), other.ID(), "Keys with different image digests should not share snapshots")
+
+	other = key
+	other.MachineConfig = "vcpus=1,mem=512MiB"
+	require.NotEqual(t, key.ID(), other.ID(), "Keys with different machine configurations should not share snapshots")
+}
+
+func TestSnapshotManagerInvalidation(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder)
+
+	oldKey := snapshotting.SnapshotKey{Revision: "myrev-1", ImageDigest: "sha256:aaaa", MachineConfig: "vcpus=1,mem=256MiB"}
+	newKey := oldKey
+	newKey.ImageDigest = "sha256:bbbb"
+
+	snap, err := mgr.InitSnapshotWithKey(oldKey, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	for _, path := range []string{snap.GetSnapshotFilePath(), snap.GetMemFilePath(), snap.GetPatchFilePath()} {
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644), "Failed to write snapshot file")
+	}
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()), "Failed to commit snapshot")
+
+	// The key is persisted along with the snapshot
+	mgr = snapshotting.NewSnapshotManager(baseFolder)
+	recovered, err := mgr.AcquireSnapshotWithKey(oldKey)
+	require.NoError(t, err, "Failed to acquire snapshot")
+	require.Equal(t, oldKey, recovered.GetKey())
+
+	// Snapshots in use are not invalidated
+	_, err = mgr.AcquireSnapshotWithKey(newKey)
+	require.Error(t, err, "Snapshot for a different image digest should not be acquired")
+	require.Equal(t, uint64(0), mgr.GetStats().Invalidations)
+	mgr.ReleaseSnapshot(recovered.GetId())
+
+	// The tag now points to another digest, the stale snapshot is invalidated
+	_, err = mgr.AcquireSnapshotWithKey(newKey)
+	require.Error(t, err, "Snapshot for a different image digest should not be acquired")
+	require.Equal(t, uint64(1), mgr.GetStats().Invalidations)
+	_, err = os.Stat(filepath.Join(baseFolder, oldKey.ID()))
+	require.True(t, os.IsNotExist(err), "Stale snapshot should be removed")
+
+	snap, err = mgr.InitSnapshotWithKey(newKey, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()), "Failed to commit snapshot")
+	snap, err = mgr.AcquireSnapshotWithKey(newKey)
+	require.NoError(t, err, "Failed to acquire rebuilt snapshot")
+	mgr.ReleaseSnapshot(snap.GetId())
+}
+
+func TestSnapshotManagerLifecycle(t *testing.T) {
+	mgr := snapshotting.NewSnapshotManager(t.TempDir())
+	revision := "myrev-1"
+
+	require.Equal(t, snapshotting.SnapshotAbsent, mgr.GetSnapshotState(revision))
+
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.Equal(t, snapshotting.SnapshotCreating, mgr.GetSnapshotState(revision))
+
+	// Concurrent creators are told that the snapshot is being created
+	_, err = mgr.InitSnapshot(revision, "testImage")
+	require.ErrorIs(t, err, snapshotting.ErrSnapshotExists)
+	_, err = mgr.AcquireSnapshot(revision)
+	require.Error(t, err, "Snapshot being created should not be acquired")
+
+	// A failed snapshot is removed and can be created again
+	mgr.FailSnapshot(snap.GetId())
+	require.Equal(t, snapshotting.SnapshotFailed, mgr.GetSnapshotState(revision))
+	_, err = os.Stat(snap.GetInfoFilePath())
+	require.True(t, os.IsNotExist(err), "Failed snapshot should be removed")
+	require.Error(t, mgr.CommitSnapshot(snap.GetId()), "Failed snapshot should not be committed")
+	_, err = mgr.AcquireSnapshot(revision)
+	require.Error(t, err, "Failed snapshot should not be acquired")
+	require.Equal(t, uint64(1), mgr.GetStats().Failures)
+
+	createTestSnapshot(t, mgr, revision, 1024)
+	require.Equal(t, snapshotting.SnapshotReady, mgr.GetSnapshotState(revision))
+	_, err = mgr.InitSnapshot(revision, "testImage")
+	require.ErrorIs(t, err, snapshotting.ErrSnapshotExists)
+}
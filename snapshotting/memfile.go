@@ -0,0 +1,345 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// compressedMemFile is the compressed copy of the memory file of an idle snapshot.
+	compressedMemFile = "mem_file.zst"
+
+	// memPageSize is the granularity at which zero pages of the guest memory are elided.
+	memPageSize = 4096
+
+	// maxMemRun is the maximum length of a run of non-zero pages stored in a compressed memory file.
+	maxMemRun = 256 * memPageSize
+)
+
+// memFileMagic identifies compressed memory files.
+var memFileMagic = [8]byte{'V', 'H', 'M', 'E', 'M', 'Z', '0', '1'}
+
+// memFileHeader is the uncompressed header of a compressed memory file. It is followed by a zstd stream of runs of
+// non-zero pages, each prefixed by a memRun, the stream is terminated by a memRun with a length of 0. Zero pages are
+// not stored and are restored as holes of a sparse file upon decompression.
+type memFileHeader struct {
+	Magic    [8]byte
+	PageSize uint32
+	MemSize  uint64 // size of the uncompressed memory file
+}
+
+// memRun is the position of a run of non-zero pages in the uncompressed memory file.
+type memRun struct {
+	Offset uint64
+	Length uint64
+}
+
+// compressMemFile compresses the memory file at src into dst, eliding zero pages. The size of the compressed file is
+// returned.
+func compressMemFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, errors.Wrapf(err, "opening %s", src)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "getting size of %s", src)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating %s", dst)
+	}
+	defer out.Close()
+
+	hdr := memFileHeader{Magic: memFileMagic, PageSize: memPageSize, MemSize: uint64(info.Size())}
+	if err := binary.Write(out, binary.LittleEndian, hdr); err != nil {
+		return 0, errors.Wrapf(err, "writing %s", dst)
+	}
+
+	zw, err := zstd.NewWriter(out)
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating zstd writer")
+	}
+
+	if err := writeMemRuns(zw, bufio.NewReaderSize(in, maxMemRun)); err != nil {
+		zw.Close()
+		return 0, errors.Wrapf(err, "compressing %s", src)
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, errors.Wrapf(err, "compressing %s", src)
+	}
+
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, errors.Wrapf(err, "writing %s", dst)
+	}
+
+	if err := out.Sync(); err != nil {
+		return 0, errors.Wrapf(err, "writing %s", dst)
+	}
+
+	return size, nil
+}
+
+// writeMemRuns reads the memory file page by page and writes its runs of non-zero pages to w.
+func writeMemRuns(w io.Writer, r io.Reader) error {
+	var (
+		page   = make([]byte, memPageSize)
+		zero   = make([]byte, memPageSize)
+		run    = make([]byte, 0, maxMemRun)
+		offset uint64
+		start  uint64
+	)
+
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		if err := binary.Write(w, binary.LittleEndian, memRun{Offset: start, Length: uint64(len(run))}); err != nil {
+			return err
+		}
+		if _, err := w.Write(run); err != nil {
+			return err
+		}
+		run = run[:0]
+		return nil
+	}
+
+	for {
+		n, err := io.ReadFull(r, page)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if bytes.Equal(page[:n], zero[:n]) || len(run) == maxMemRun {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if !bytes.Equal(page[:n], zero[:n]) {
+			if len(run) == 0 {
+				start = offset
+			}
+			run = append(run, page[:n]...)
+		}
+
+		offset += uint64(n)
+		if n < memPageSize {
+			break
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, memRun{})
+}
+
+// openMemFile opens a compressed memory file, returning its header and a reader of its runs of non-zero pages. The
+// returned function must be called to close the file.
+func openMemFile(path string) (memFileHeader, io.Reader, func(), error) {
+	var hdr memFileHeader
+
+	file, err := os.Open(path)
+	if err != nil {
+		return hdr, nil, nil, errors.Wrapf(err, "opening %s", path)
+	}
+
+	if err := binary.Read(file, binary.LittleEndian, &hdr); err != nil {
+		file.Close()
+		return hdr, nil, nil, errors.Wrapf(err, "reading header of %s", path)
+	}
+	if hdr.Magic != memFileMagic {
+		file.Close()
+		return hdr, nil, nil, errors.New(fmt.Sprintf("%s is not a compressed memory file", path))
+	}
+
+	zr, err := zstd.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return hdr, nil, nil, errors.Wrapf(err, "creating zstd reader")
+	}
+
+	return hdr, zr, func() {
+		zr.Close()
+		file.Close()
+	}, nil
+}
+
+// decompressMemFile restores the memory file compressed at src into dst. If expected is not nil, the restored memory
+// file is checked against it before being moved into place. The time spent decompressing is returned.
+func decompressMemFile(src, dst string, expected *FileChecksum) (time.Duration, error) {
+	tStart := time.Now()
+
+	hdr, r, closeFn, err := openMemFile(src)
+	if err != nil {
+		return 0, err
+	}
+	defer closeFn()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, errors.Wrapf(err, "creating %s", tmp)
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	// The zero pages are left as holes of the sparse memory file
+	if err := out.Truncate(int64(hdr.MemSize)); err != nil {
+		return 0, errors.Wrapf(err, "allocating %s", tmp)
+	}
+
+	hash := sha256.New()
+	if err := readMemRuns(r, out, hash, hdr.MemSize); err != nil {
+		return 0, errors.Wrapf(err, "decompressing %s", src)
+	}
+
+	if err := checkMemFile(hdr, hash.Sum(nil), expected); err != nil {
+		return 0, err
+	}
+
+	if err := out.Close(); err != nil {
+		return 0, errors.Wrapf(err, "writing %s", tmp)
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return 0, errors.Wrapf(err, "moving decompressed memory file into place")
+	}
+
+	return time.Since(tStart), nil
+}
+
+// verifyCompressedMemFile checks the memory file compressed at path against its checksum without restoring it.
+func verifyCompressedMemFile(path string, expected FileChecksum) error {
+	hdr, r, closeFn, err := openMemFile(path)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	hash := sha256.New()
+	if err := readMemRuns(r, nil, hash, hdr.MemSize); err != nil {
+		return errors.Wrapf(ErrChecksumMismatch, "decompressing %s: %v", path, err)
+	}
+
+	return checkMemFile(hdr, hash.Sum(nil), &expected)
+}
+
+// checkMemFile checks the size and the digest of a decompressed memory file against its checksum, if any.
+func checkMemFile(hdr memFileHeader, digest []byte, expected *FileChecksum) error {
+	if expected == nil {
+		return nil
+	}
+
+	if int64(hdr.MemSize) != expected.Size {
+		return errors.Wrapf(ErrChecksumMismatch, "decompressed memory file has size %d instead of %d", hdr.MemSize, expected.Size)
+	}
+	if hex.EncodeToString(digest) != expected.SHA256 {
+		return errors.Wrapf(ErrChecksumMismatch, "decompressed memory file has digest %s instead of %s", hex.EncodeToString(digest), expected.SHA256)
+	}
+
+	return nil
+}
+
+// readMemRuns writes the runs of non-zero pages read from r to out, if not nil, and feeds the content of the whole
+// memory file, including the zero pages, to hash.
+func readMemRuns(r io.Reader, out io.WriterAt, hash io.Writer, memSize uint64) error {
+	var (
+		zero   = make([]byte, maxMemRun)
+		buf    = make([]byte, maxMemRun)
+		offset uint64
+	)
+
+	hashZeros := func(n uint64) {
+		for n > 0 {
+			chunk := n
+			if chunk > maxMemRun {
+				chunk = maxMemRun
+			}
+			hash.Write(zero[:chunk])
+			n -= chunk
+		}
+	}
+
+	for {
+		var run memRun
+		if err := binary.Read(r, binary.LittleEndian, &run); err != nil {
+			return err
+		}
+		if run.Length == 0 {
+			break
+		}
+		if run.Offset < offset || run.Length > maxMemRun || run.Offset+run.Length > memSize {
+			return errors.New("corrupted compressed memory file")
+		}
+
+		if _, err := io.ReadFull(r, buf[:run.Length]); err != nil {
+			return err
+		}
+		if out != nil {
+			if _, err := out.WriteAt(buf[:run.Length], int64(run.Offset)); err != nil {
+				return err
+			}
+		}
+
+		hashZeros(run.Offset - offset)
+		hash.Write(buf[:run.Length])
+		offset = run.Offset + run.Length
+	}
+
+	hashZeros(memSize - offset)
+
+	return nil
+}
+
+// memFileSize returns the size of the uncompressed memory file recorded in the header of a compressed memory file.
+func memFileSize(path string) (int64, error) {
+	hdr, _, closeFn, err := openMemFile(path)
+	if err != nil {
+		return 0, err
+	}
+	closeFn()
+
+	return int64(hdr.MemSize), nil
+}
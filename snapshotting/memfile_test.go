@@ -0,0 +1,160 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vhive-serverless/vhive/snapshotting"
+)
+
+// createTestMemSnapshot creates a snapshot whose memory file mostly consists of zero pages.
+func createTestMemSnapshot(t *testing.T, mgr *snapshotting.SnapshotManager, revision string) []byte {
+	mem := make([]byte, 64*4096+100)
+	for i := 0; i < 4096; i++ {
+		mem[3*4096+i] = byte(i)
+		mem[4*4096+i] = byte(i * 7)
+		mem[40*4096+i] = 0xff
+	}
+	mem[len(mem)-1] = 1
+
+	snap, err := mgr.InitSnapshot(revision, "testImage")
+	require.NoError(t, err, "Failed to create snapshot")
+	require.NoError(t, os.WriteFile(snap.GetSnapshotFilePath(), []byte{}, 0644), "Failed to write snapshot file")
+	require.NoError(t, os.WriteFile(snap.GetMemFilePath(), mem, 0644), "Failed to write memory file")
+	require.NoError(t, os.WriteFile(snap.GetPatchFilePath(), []byte{}, 0644), "Failed to write patch file")
+	require.NoError(t, mgr.CommitSnapshot(snap.GetId()), "Failed to commit snapshot")
+
+	return mem
+}
+
+func TestSnapshotMemoryCompression(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder, snapshotting.WithMemoryCompression(time.Nanosecond))
+	mem := createTestMemSnapshot(t, mgr, "rev-1")
+
+	mgr.CompressIdleSnapshots()
+
+	memFile := filepath.Join(baseFolder, "rev-1", "mem_file")
+	_, err := os.Stat(memFile)
+	require.True(t, os.IsNotExist(err), "Memory file of an idle snapshot should be removed")
+
+	stats := mgr.GetStats()
+	require.Equal(t, 1, stats.CompressedSnapshots, "Snapshot should be compressed")
+	require.Equal(t, int64(len(mem)), stats.MemBytes, "Wrong uncompressed memory size")
+	require.Greater(t, stats.CompressionRatio(), 10.0, "Zero pages should be elided")
+
+	snap, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Compressed snapshot should be available")
+
+	elapsed, err := snap.PrepareMemFile()
+	require.NoError(t, err, "Failed to decompress memory file")
+	require.Greater(t, elapsed, time.Duration(0), "Decompression time should be reported")
+
+	data, err := os.ReadFile(snap.GetMemFilePath())
+	require.NoError(t, err, "Failed to read memory file")
+	require.True(t, bytes.Equal(mem, data), "Decompressed memory file differs")
+
+	elapsed, err = snap.PrepareMemFile()
+	require.NoError(t, err, "Failed to prepare memory file")
+	require.Equal(t, time.Duration(0), elapsed, "Decompressed memory file should be cached")
+
+	// The decompressed memory file is kept while the snapshot is in use
+	mgr.CompressIdleSnapshots()
+	_, err = os.Stat(memFile)
+	require.NoError(t, err, "Memory file of a snapshot in use should be kept")
+
+	mgr.ReleaseSnapshot(snap.GetId())
+	mgr.CompressIdleSnapshots()
+	_, err = os.Stat(memFile)
+	require.True(t, os.IsNotExist(err), "Memory file of an idle snapshot should be removed")
+	require.Equal(t, uint64(1), mgr.GetStats().Compressions, "Memory file should only be compressed once")
+
+	// Compressed snapshots are recovered and verified
+	mgr = snapshotting.NewSnapshotManager(baseFolder)
+	snap, err = mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Compressed snapshot should be recovered")
+	mgr.ReleaseSnapshot(snap.GetId())
+}
+
+func TestSnapshotMemoryDecompressionQuota(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder, snapshotting.WithMemoryCompression(time.Nanosecond))
+	mem := createTestMemSnapshot(t, mgr, "rev-1")
+	createTestMemSnapshot(t, mgr, "rev-2")
+	mgr.CompressIdleSnapshots()
+
+	compressedBytes := mgr.GetStats().UsedBytes
+	require.Less(t, compressedBytes, int64(len(mem)), "Compressed snapshots should use less space than a memory file")
+
+	// The quota fits both compressed snapshots but not a decompressed memory file
+	mgr = snapshotting.NewSnapshotManager(baseFolder, snapshotting.WithDiskQuota(compressedBytes+int64(len(mem))/2))
+	require.Equal(t, 2, mgr.GetStats().Snapshots)
+
+	snap, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Compressed snapshot should be available")
+
+	elapsed, err := mgr.PrepareMemFile(snap)
+	require.NoError(t, err, "Failed to decompress memory file")
+	require.Greater(t, elapsed, time.Duration(0), "Decompression time should be reported")
+
+	stats := mgr.GetStats()
+	require.Equal(t, 1, stats.Snapshots, "The idle snapshot should be evicted to make room for the memory file")
+	require.Greater(t, stats.UsedBytes, int64(len(mem)), "The decompressed memory file should be counted")
+
+	elapsed, err = mgr.PrepareMemFile(snap)
+	require.NoError(t, err, "Failed to prepare memory file")
+	require.Zero(t, elapsed, "No decompression should be reported when the memory file is available")
+	mgr.ReleaseSnapshot(snap.GetId())
+}
+
+func TestSnapshotMemoryCompressionCorrupted(t *testing.T) {
+	baseFolder := t.TempDir()
+	mgr := snapshotting.NewSnapshotManager(baseFolder, snapshotting.WithMemoryCompression(time.Nanosecond))
+	createTestMemSnapshot(t, mgr, "rev-1")
+	mgr.CompressIdleSnapshots()
+
+	snap, err := mgr.AcquireSnapshot("rev-1")
+	require.NoError(t, err, "Compressed snapshot should be available")
+	mgr.ReleaseSnapshot(snap.GetId())
+
+	compressed := snap.GetCompressedMemFilePath()
+	data, err := os.ReadFile(compressed)
+	require.NoError(t, err, "Failed to read compressed memory file")
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(compressed, data, 0644), "Failed to corrupt compressed memory file")
+
+	_, err = snap.PrepareMemFile()
+	require.Error(t, err, "Corrupted memory file should not be decompressed")
+	_, err = os.Stat(snap.GetMemFilePath())
+	require.True(t, os.IsNotExist(err), "Corrupted memory file should not be restored")
+
+	require.ErrorIs(t, mgr.VerifySnapshot("rev-1"), snapshotting.ErrChecksumMismatch, "Verification should detect corruption")
+	_, err = mgr.AcquireSnapshot("rev-1")
+	require.Error(t, err, "Corrupted snapshot should be quarantined")
+}
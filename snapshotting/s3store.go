@@ -0,0 +1,266 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3Service         = "s3"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3DefaultRegion   = "us-east-1"
+)
+
+// S3Config configures the S3-compatible object store (e.g., AWS S3 or MinIO) used by an S3SnapshotStore.
+type S3Config struct {
+	Endpoint  string // URL of the object store, e.g., http://minio:9000
+	Bucket    string // bucket storing the snapshots, which must already exist
+	Prefix    string // key prefix of the snapshots in the bucket
+	Region    string // region of the bucket, us-east-1 if empty
+	AccessKey string
+	SecretKey string
+}
+
+// S3SnapshotStore is a SnapshotStore keeping snapshot files in a bucket of an S3-compatible object store. Objects
+// are addressed in path style (<endpoint>/<bucket>/<prefix>/<id>/<file>) and requests are signed with AWS Signature
+// Version 4.
+type S3SnapshotStore struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3SnapshotStore creates a snapshot store backed by the bucket described by cfg.
+func NewS3SnapshotStore(cfg S3Config) (*S3SnapshotStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing S3 endpoint %s", cfg.Endpoint)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("unsupported S3 endpoint scheme %q", endpoint.Scheme))
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = s3DefaultRegion
+	}
+
+	return &S3SnapshotStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+// PutFile uploads the file at localPath to the bucket.
+func (s *S3SnapshotStore) PutFile(ctx context.Context, id, name, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening snapshot file %s", localPath)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "getting size of snapshot file %s", localPath)
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, id, name, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if info.Size() == 0 {
+		// Make sure that an empty body is sent with a Content-Length header
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// GetFile downloads an object from the bucket to localPath.
+func (s *S3SnapshotStore) GetFile(ctx context.Context, id, name, localPath string) error {
+	body, _, err := s.OpenFile(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return writeFileAtomic(localPath, body)
+}
+
+// OpenFile starts downloading an object from the bucket, the object is streamed as it is read.
+func (s *S3SnapshotStore) OpenFile(ctx context.Context, id, name string) (io.ReadCloser, int64, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, id, name, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// newRequest creates an unsigned request for file name of the snapshot with the given id.
+func (s *S3SnapshotStore) newRequest(ctx context.Context, method, id, name string, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", s.endpoint.Path, s.cfg.Bucket, s.cfg.Prefix, id, name)
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating S3 request")
+	}
+
+	return req, nil
+}
+
+// do signs and sends a request, turning error responses into errors.
+func (s *S3SnapshotStore) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", req.Method, req.URL.Path)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrSnapshotNotFound
+	}
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg))
+	}
+
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization header to a request, covering the host and all the headers of
+// the request. The payload is not signed unless its hash is already set, so that snapshot files can be streamed
+// without hashing them first.
+func (s *S3SnapshotStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	}
+	req.Header.Del("Authorization")
+
+	// Sorted names of the headers covered by the signature
+	signedHeaders := []string{"host"}
+	for h := range req.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(h))
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		value := strings.Join(req.Header.Values(h), ",")
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.cfg.Region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// s3EscapePath URI-encodes every segment of an object path as required by Signature Version 4.
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		var b strings.Builder
+		for _, c := range []byte(segment) {
+			if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
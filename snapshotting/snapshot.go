@@ -23,37 +23,127 @@
 package snapshotting
 
 import (
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+// snapshotFiles are the files storing the state of a snapshot, described by the info file.
+var snapshotFiles = []string{"snap_file", "mem_file", "patch_file"}
+
+const infoFile = "info_file"
+
+// ErrSnapshotExists is returned when initializing a snapshot that is already being created or ready.
+var ErrSnapshotExists = errors.New("snapshot already exists")
+
+// ErrChecksumMismatch is returned when a snapshot file does not match the checksum recorded upon snapshot creation.
+var ErrChecksumMismatch = errors.New("snapshot file does not match its checksum")
+
+// SnapshotState is the lifecycle state of a snapshot.
+type SnapshotState int
+
+const (
+	// SnapshotAbsent means that no snapshot is stored or being created.
+	SnapshotAbsent SnapshotState = iota
+	// SnapshotCreating means that the snapshot is being created by a single designated instance.
+	SnapshotCreating
+	// SnapshotReady means that the snapshot has been committed and can be loaded.
+	SnapshotReady
+	// SnapshotFailed means that the creation of the snapshot failed, it can be created again.
+	SnapshotFailed
+)
+
+func (s SnapshotState) String() string {
+	switch s {
+	case SnapshotAbsent:
+		return "absent"
+	case SnapshotCreating:
+		return "creating"
+	case SnapshotReady:
+		return "ready"
+	case SnapshotFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("SnapshotState(%d)", int(s))
+	}
+}
+
+// FileChecksum is the size and SHA-256 digest of a snapshot file.
+type FileChecksum struct {
+	Size   int64
+	SHA256 string
+}
+
 // Snapshot identified by revision
 // Only capitalized fields are serialised / deserialised
 type Snapshot struct {
 	id                string
-	ready             bool
+	state             SnapshotState // guarded by the SnapshotManager lock
 	ContainerSnapName string
 	snapDir           string
 	Image             string
+	Key               SnapshotKey
+
+	// Checksums of the snapshot files, keyed by file name
+	Checksums map[string]FileChecksum
+
+	// Bookkeeping for garbage collection, guarded by the SnapshotManager lock
+	size     int64     // disk space used by the snapshot files
+	lastUsed time.Time // last time the snapshot has been acquired
+	users    int       // number of users currently loading the snapshot
+	verified bool      // whether the snapshot files have been checked against their checksums
+
+	// Upload to the snapshot store, guarded by the SnapshotManager lock
+	uploading bool // whether the snapshot is being uploaded to the snapshot store
+
+	// Memory file compression, guarded by the SnapshotManager lock
+	compressing    bool  // whether the memory file is being compressed
+	compressedSize int64 // size of the compressed memory file, 0 if the memory file is not compressed
+	memSize        int64 // size of the uncompressed memory file, if compressed
+
+	memLock *sync.Mutex // serializes the decompression of the memory file
 }
 
+// NewSnapshot creates a snapshot with the given id, keyed by the id only. InitSnapshotWithKey must be used to create a
+// snapshot keyed by a complete SnapshotKey.
 func NewSnapshot(id, baseFolder, image string) *Snapshot {
 	s := &Snapshot{
 		id:                id,
-		ready:             false,
+		state:             SnapshotCreating,
 		snapDir:           filepath.Join(baseFolder, id),
 		ContainerSnapName: fmt.Sprintf("%s%s", id, time.Now().Format("20060102150405")),
 		Image:             image,
+		Key:               SnapshotKey{Revision: id},
+		memLock:           new(sync.Mutex),
 	}
 
 	return s
 }
 
+// LoadSnapshot loads the snapshot with the given id stored in baseFolder from its info file. An error is returned if
+// the info file cannot be decoded or if any of the snapshot files are missing. The returned snapshot is never nil, so
+// that an incomplete snapshot can still be cleaned up.
+func LoadSnapshot(id, baseFolder string) (*Snapshot, error) {
+	snap := NewSnapshot(id, baseFolder, "")
+
+	if err := snap.LoadSnapInfo(snap.GetInfoFilePath()); err != nil {
+		return snap, err
+	}
+	if err := snap.checkFiles(); err != nil {
+		return snap, err
+	}
+
+	return snap, nil
+}
+
 func (snp *Snapshot) CreateSnapDir() error {
 	err := os.Mkdir(snp.snapDir, 0755)
 	if err != nil && os.IsExist(err) {
@@ -70,6 +160,10 @@ func (snp *Snapshot) GetId() string {
 	return snp.id
 }
 
+func (snp *Snapshot) GetKey() SnapshotKey {
+	return snp.Key
+}
+
 func (snp *Snapshot) GetContainerSnapName() string {
 	return snp.ContainerSnapName
 }
@@ -82,12 +176,23 @@ func (snp *Snapshot) GetMemFilePath() string {
 	return filepath.Join(snp.snapDir, "mem_file")
 }
 
+// GetCompressedMemFilePath returns the path of the compressed copy of the memory file, see PrepareMemFile.
+func (snp *Snapshot) GetCompressedMemFilePath() string {
+	return filepath.Join(snp.snapDir, compressedMemFile)
+}
+
 func (snp *Snapshot) GetPatchFilePath() string {
 	return filepath.Join(snp.snapDir, "patch_file")
 }
 
+// GetWorkingSetFilePath returns the path of the working set pages recorded by the memory manager upon the first load
+// of the snapshot with user-level page faults.
+func (snp *Snapshot) GetWorkingSetFilePath() string {
+	return filepath.Join(snp.snapDir, "working_set_pages")
+}
+
 func (snp *Snapshot) GetInfoFilePath() string {
-	return filepath.Join(snp.snapDir, "info_file")
+	return filepath.Join(snp.snapDir, infoFile)
 }
 
 // SerializeSnapInfo serializes the snapshot info using gob. This can be useful for remote snapshots
@@ -125,6 +230,217 @@ func (snp *Snapshot) LoadSnapInfo(infoPath string) error {
 	return nil
 }
 
+// checkFiles checks that all the files required to load the snapshot are present. The memory file may be compressed.
+func (snp *Snapshot) checkFiles() error {
+	for _, path := range []string{snp.GetSnapshotFilePath(), snp.GetMemFilePath(), snp.GetPatchFilePath()} {
+		if path == snp.GetMemFilePath() && snp.isMemCompressed() {
+			path = snp.GetCompressedMemFilePath()
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrapf(err, "checking snapshot file")
+		}
+		if !info.Mode().IsRegular() {
+			return errors.New(fmt.Sprintf("snapshot file %s is not a regular file", path))
+		}
+	}
+
+	return nil
+}
+
+// computeChecksums records the size and the digest of the snapshot files. Files that have not been created are
+// skipped.
+func (snp *Snapshot) computeChecksums() error {
+	checksums := make(map[string]FileChecksum)
+
+	for _, name := range snapshotFiles {
+		checksum, err := fileChecksum(filepath.Join(snp.snapDir, name))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		checksums[name] = checksum
+	}
+
+	snp.Checksums = checksums
+	return nil
+}
+
+// checkSizes checks that the snapshot files have the sizes recorded in their checksums. This is a cheap check catching
+// truncated files, Verify must be used to detect any modification of the files. A compressed memory file is checked
+// when it is decompressed.
+func (snp *Snapshot) checkSizes() error {
+	for name, checksum := range snp.Checksums {
+		if snp.skipChecksum(name) {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(snp.snapDir, name))
+		if err != nil {
+			return errors.Wrapf(err, "checking size of %s", name)
+		}
+		if info.Size() != checksum.Size {
+			return errors.Wrapf(ErrChecksumMismatch, "%s has size %d instead of %d", name, info.Size(), checksum.Size)
+		}
+	}
+
+	return nil
+}
+
+// Verify checks that the snapshot files match the checksums recorded upon snapshot creation, a compressed memory file
+// is checked by decompressing it on the fly. Snapshots created before checksums were recorded cannot be verified and
+// are assumed to be intact.
+func (snp *Snapshot) Verify() error {
+	if err := snp.checkSizes(); err != nil {
+		return err
+	}
+
+	for name, expected := range snp.Checksums {
+		if snp.skipChecksum(name) {
+			if err := verifyCompressedMemFile(snp.GetCompressedMemFilePath(), expected); err != nil {
+				return err
+			}
+			continue
+		}
+
+		checksum, err := fileChecksum(filepath.Join(snp.snapDir, name))
+		if err != nil {
+			return err
+		}
+		if checksum.SHA256 != expected.SHA256 {
+			return errors.Wrapf(ErrChecksumMismatch, "%s has digest %s instead of %s", name, checksum.SHA256, expected.SHA256)
+		}
+	}
+
+	return nil
+}
+
+// skipChecksum returns whether the checksum of a snapshot file cannot be checked because the file only exists in
+// compressed form.
+func (snp *Snapshot) skipChecksum(name string) bool {
+	if name != "mem_file" {
+		return false
+	}
+
+	_, err := os.Stat(snp.GetMemFilePath())
+	return os.IsNotExist(err) && snp.isMemCompressed()
+}
+
+// isMemCompressed returns whether a compressed copy of the memory file is stored.
+func (snp *Snapshot) isMemCompressed() bool {
+	_, err := os.Stat(snp.GetCompressedMemFilePath())
+	return err == nil
+}
+
+// updateMemSizes records the sizes of the compressed memory file and of the memory file it stores, if any.
+func (snp *Snapshot) updateMemSizes() {
+	snp.compressedSize, snp.memSize = 0, 0
+
+	info, err := os.Stat(snp.GetCompressedMemFilePath())
+	if err != nil {
+		return
+	}
+
+	if memSize, err := memFileSize(snp.GetCompressedMemFilePath()); err == nil {
+		snp.compressedSize, snp.memSize = info.Size(), memSize
+	}
+}
+
+// PrepareMemFile makes sure the memory file can be loaded, decompressing it from its compressed copy if the memory
+// file of an idle snapshot has been compressed. The decompressed memory file is checked against its checksum and kept
+// until the snapshot becomes idle again. The snapshot must have been acquired. The time spent decompressing the memory
+// file is returned, 0 if it was already available.
+func (snp *Snapshot) PrepareMemFile() (time.Duration, error) {
+	snp.memLock.Lock()
+	defer snp.memLock.Unlock()
+
+	if _, err := os.Stat(snp.GetMemFilePath()); err == nil {
+		return 0, nil
+	}
+
+	var expected *FileChecksum
+	if checksum, ok := snp.Checksums["mem_file"]; ok {
+		expected = &checksum
+	}
+
+	elapsed, err := decompressMemFile(snp.GetCompressedMemFilePath(), snp.GetMemFilePath(), expected)
+	if err != nil {
+		return 0, errors.Wrapf(err, "decompressing memory file of snapshot %s", snp.id)
+	}
+
+	return elapsed, nil
+}
+
+// fileChecksum computes the size and the SHA-256 digest of a file.
+func fileChecksum(path string) (FileChecksum, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return FileChecksum{}, errors.Wrapf(err, "opening %s", path)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return FileChecksum{}, errors.Wrapf(err, "reading %s", path)
+	}
+
+	return FileChecksum{Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// quarantine moves the snapshot directory into quarantineDir, keeping corrupted snapshot files for inspection.
+func (snp *Snapshot) quarantine(quarantineDir string) error {
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "creating quarantine directory")
+	}
+
+	dst := filepath.Join(quarantineDir, fmt.Sprintf("%s-%s", snp.id, time.Now().Format("20060102150405")))
+	if err := os.Rename(snp.snapDir, dst); err != nil {
+		return errors.Wrapf(err, "moving snapshot to quarantine")
+	}
+
+	return nil
+}
+
+// diskUsage returns the total size of the files stored in the snapshot directory.
+func (snp *Snapshot) diskUsage() int64 {
+	var size int64
+
+	entries, err := os.ReadDir(snp.snapDir)
+	if err != nil {
+		return 0
+	}
+
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// modTime returns the last modification time of the snapshot info file.
+func (snp *Snapshot) modTime() time.Time {
+	info, err := os.Stat(snp.GetInfoFilePath())
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// detach moves the snapshot directory to a hidden directory of the base folder, so that the snapshot id can be reused
+// immediately while the snapshot files are being removed with Cleanup.
+func (snp *Snapshot) detach() {
+	hidden := filepath.Join(filepath.Dir(snp.snapDir), fmt.Sprintf(".removed-%s-%d", snp.id, time.Now().UnixNano()))
+	if err := os.Rename(snp.snapDir, hidden); err == nil {
+		snp.snapDir = hidden
+	}
+}
+
 func (snp *Snapshot) Cleanup() error {
 	return os.RemoveAll(snp.snapDir)
 }
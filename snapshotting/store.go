@@ -0,0 +1,206 @@
+// MIT License
+//
+// Copyright (c) 2023 Georgiy Lebedev, Amory Hoste and vHive team
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package snapshotting
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSnapshotNotFound is returned by a SnapshotStore if the requested snapshot file is not stored.
+var ErrSnapshotNotFound = errors.New("snapshot file not found in store")
+
+// SnapshotStore stores the files of committed snapshots outside of the node, so that a snapshot created on one node can
+// be loaded on another node.
+type SnapshotStore interface {
+	// PutFile uploads the file at localPath as file name of the snapshot with the given id.
+	PutFile(ctx context.Context, id, name, localPath string) error
+	// GetFile downloads file name of the snapshot with the given id to localPath. ErrSnapshotNotFound is returned if
+	// the store does not contain the file.
+	GetFile(ctx context.Context, id, name, localPath string) error
+	// OpenFile opens file name of the snapshot with the given id for streaming and returns its size, or -1 if the size
+	// is unknown. ErrSnapshotNotFound is returned if the store does not contain the file.
+	OpenFile(ctx context.Context, id, name string) (io.ReadCloser, int64, error)
+}
+
+// NewSnapshotStore creates the snapshot store described by storeURL, either file:///path/to/dir for a
+// LocalSnapshotStore, http(s)://host/path for an HTTPSnapshotStore or s3://bucket/prefix for an S3SnapshotStore. S3
+// requests are sent to s3Endpoint, using the credentials and region from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_REGION environment variables.
+func NewSnapshotStore(storeURL, s3Endpoint string) (SnapshotStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing snapshot store URL %s", storeURL)
+	}
+
+	var store SnapshotStore
+	switch u.Scheme {
+	case "file":
+		store, err = NewLocalSnapshotStore(u.Path)
+	case "http", "https":
+		store, err = NewHTTPSnapshotStore(storeURL)
+	case "s3":
+		store, err = NewS3SnapshotStore(S3Config{
+			Endpoint:  s3Endpoint,
+			Bucket:    u.Host,
+			Prefix:    strings.Trim(u.Path, "/"),
+			Region:    os.Getenv("AWS_REGION"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported snapshot store URL %s", storeURL))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// LocalSnapshotStore is a SnapshotStore keeping snapshot files in a directory, e.g., a network file system mounted on
+// all nodes.
+type LocalSnapshotStore struct {
+	root string
+}
+
+// NewLocalSnapshotStore creates a snapshot store keeping the snapshot files in the root directory.
+func NewLocalSnapshotStore(root string) (*LocalSnapshotStore, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, errors.Wrapf(err, "creating snapshot store directory %s", root)
+	}
+
+	return &LocalSnapshotStore{root: root}, nil
+}
+
+// PutFile copies the file at localPath into the store.
+func (s *LocalSnapshotStore) PutFile(_ context.Context, id, name, localPath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening snapshot file %s", localPath)
+	}
+	defer src.Close()
+
+	dir := filepath.Join(s.root, id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.Wrapf(err, "creating snapshot directory %s", dir)
+	}
+
+	return writeFileAtomic(filepath.Join(dir, name), src)
+}
+
+// GetFile copies a file from the store to localPath.
+func (s *LocalSnapshotStore) GetFile(ctx context.Context, id, name, localPath string) error {
+	src, _, err := s.OpenFile(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeFileAtomic(localPath, src)
+}
+
+// OpenFile opens a file of the store.
+func (s *LocalSnapshotStore) OpenFile(_ context.Context, id, name string) (io.ReadCloser, int64, error) {
+	src, err := os.Open(filepath.Join(s.root, id, name))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrSnapshotNotFound
+	} else if err != nil {
+		return nil, 0, errors.Wrapf(err, "opening stored snapshot file")
+	}
+
+	info, err := src.Stat()
+	if err != nil {
+		src.Close()
+		return nil, 0, errors.Wrapf(err, "getting size of stored snapshot file")
+	}
+
+	return src, info.Size(), nil
+}
+
+// writeFileAtomic writes the content of r to path. The content is first written to a temporary file that is renamed
+// once complete, so that path never contains a partially written file.
+func writeFileAtomic(path string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "creating temporary file for %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "writing %s", path)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "writing %s", path)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "renaming temporary file to %s", path)
+	}
+
+	return nil
+}
+
+// pushSnapshot uploads the files of a committed snapshot to the store. The info file is uploaded last and downloaded
+// first, so that its presence in the store marks a completely uploaded snapshot.
+func pushSnapshot(ctx context.Context, store SnapshotStore, snap *Snapshot) error {
+	for _, name := range append(snapshotFiles, infoFile) {
+		if err := store.PutFile(ctx, snap.GetId(), name, filepath.Join(snap.snapDir, name)); err != nil {
+			return errors.Wrapf(err, "uploading %s", name)
+		}
+	}
+
+	return nil
+}
+
+// pullSnapshot downloads the files of the snapshot from the store into its snapshot directory and loads its info.
+func pullSnapshot(ctx context.Context, store SnapshotStore, snap *Snapshot) error {
+	if err := snap.CreateSnapDir(); err != nil {
+		return errors.Wrapf(err, "creating snapDir for snapshot %s", snap.GetId())
+	}
+
+	for _, name := range append([]string{infoFile}, snapshotFiles...) {
+		if err := store.GetFile(ctx, snap.GetId(), name, filepath.Join(snap.snapDir, name)); err != nil {
+			if err == ErrSnapshotNotFound {
+				return err
+			}
+			return errors.Wrapf(err, "downloading %s", name)
+		}
+	}
+
+	if err := snap.LoadSnapInfo(snap.GetInfoFilePath()); err != nil {
+		return err
+	}
+
+	return snap.checkFiles()
+}
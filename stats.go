@@ -28,6 +28,8 @@ import (
 	"sort"
 	"strconv"
 	"sync/atomic"
+
+	"github.com/vhive-serverless/vhive/snapshotting"
 )
 
 // FuncStat Per-function stats
@@ -95,3 +97,14 @@ func (cs *Stats) SprintStats() string {
 
 	return s
 }
+
+// SprintSnapshotStats Prints the snapshot garbage collection stats
+func SprintSnapshotStats(ss snapshotting.SnapshotStats) string {
+	var s = "==== Snapshot stats ====\n"
+	s += "#snapshots, usedBytes, #evictions, reclaimedBytes, #quarantined, #invalidations, #failures, #compressed, compressionRatio\n"
+	s += fmt.Sprintf("%d, %d, %d, %d, %d, %d, %d, %d, %.2f\n", ss.Snapshots, ss.UsedBytes, ss.Evictions, ss.ReclaimedBytes,
+		ss.Quarantined, ss.Invalidations, ss.Failures, ss.CompressedSnapshots, ss.CompressionRatio())
+	s += "========================"
+
+	return s
+}
@@ -28,8 +28,11 @@ import (
 	"fmt"
 
 	"net"
+	"net/http"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	ctrdlog "github.com/containerd/containerd/log"
 	log "github.com/sirupsen/logrus"
@@ -37,8 +40,12 @@ import (
 	fccri "github.com/vhive-serverless/vhive/cri/firecracker"
 	gvcri "github.com/vhive-serverless/vhive/cri/gvisor"
 	ctriface "github.com/vhive-serverless/vhive/ctriface"
+	"github.com/vhive-serverless/vhive/devmapper"
 	hpb "github.com/vhive-serverless/vhive/examples/protobuf/helloworld"
+	"github.com/vhive-serverless/vhive/memory/manager"
+	"github.com/vhive-serverless/vhive/networking"
 	pb "github.com/vhive-serverless/vhive/proto"
+	"github.com/vhive-serverless/vhive/snapshotting"
 	"google.golang.org/grpc"
 )
 
@@ -54,16 +61,33 @@ var (
 	orch     *ctriface.Orchestrator
 	funcPool *FuncPool
 
-	isSaveMemory       *bool
-	isSnapshotsEnabled *bool
-	isUPFEnabled       *bool
-	isLazyMode         *bool
-	isMetricsMode      *bool
-	servedThreshold    *uint64
-	pinnedFuncNum      *int
-	criSock            *string
-	hostIface          *string
-	netPoolSize        *int
+	isSaveMemory        *bool
+	isSnapshotsEnabled  *bool
+	isUPFEnabled        *bool
+	isLazyMode          *bool
+	prefetchPolicy      *string
+	prefetchPages       *int
+	wsRefineInterval    *int
+	wsRefineMinMisses   *int
+	wsStream            *bool
+	isMetricsMode       *bool
+	metricsAddr         *string
+	servedThreshold     *uint64
+	pinnedFuncNum       *int
+	criSock             *string
+	hostIface           *string
+	netPoolSize         *int
+	snapDiskQuota       *int64
+	maxSnapshots        *int
+	snapStore           *string
+	snapStoreEndpoint   *string
+	snapCompressAfter   *time.Duration
+	patchMode           *string
+	reconcileDryRun     *bool
+	reconcileNetwork    *bool
+	thinPool            *string
+	poolWarnThreshold   *float64
+	poolRejectThreshold *float64
 )
 
 func main() {
@@ -77,15 +101,37 @@ func main() {
 	isSnapshotsEnabled = flag.Bool("snapshots", false, "Use VM snapshots when adding function instances")
 	isUPFEnabled = flag.Bool("upf", false, "Enable user-level page faults guest memory management")
 	isMetricsMode = flag.Bool("metrics", false, "Calculate UPF metrics")
+	metricsAddr = flag.String("metricsAddr", "", "Address on which the thin pool usage, and the UPF counters with -upf, are exposed in the Prometheus format on /metrics, e.g. :9090 (disabled if empty)")
 	servedThreshold = flag.Uint64("st", 1000*1000, "Functions serves X RPCs before it shuts down (if saveMemory=true)")
 	pinnedFuncNum = flag.Int("hn", 0, "Number of functions pinned in memory (IDs from 0 to X)")
 	isLazyMode = flag.Bool("lazy", false, "Enable lazy serving mode when UPFs are enabled")
+	prefetchPolicy = flag.String("prefetch", "", "Prefetch policy of the user-level page faults, valid options: record, readahead, stride, none (record by default, none in lazy mode)")
+	prefetchPages = flag.Int("prefetchPages", 16, "Number of pages prefetched upon each page fault by the readahead and stride prefetch policies")
+	wsRefineInterval = flag.Int("wsRefineInterval", 0, "Number of invocations of a snapshot after which the pages they frequently miss are merged into the recorded working set (0 disables the refinement)")
+	wsRefineMinMisses = flag.Int("wsRefineMinMisses", 2, "Number of invocations of a refinement interval in which a page must be missed to be merged into the working set")
+	wsStream = flag.Bool("wsStream", false, "Install the working set of the user-level page faults in chunks as it is fetched, from the snapshot store if it is not stored locally")
 	criSock = flag.String("criSock", "/etc/vhive-cri/vhive-cri.sock", "Socket address for CRI service")
 	hostIface = flag.String("hostIface", "", "Host net-interface for the VMs to bind to for internet access")
 	netPoolSize = flag.Int("netPoolSize", 10, "Amount of network configs to preallocate in a pool")
+	netPoolMaxSize := flag.Int("netPoolMaxSize", 0, "Maximum amount of free network configs kept in the pool, the surplus ones are removed in the background (2*netPoolSize if 0)")
+	snapDiskQuota = flag.Int64("snapDiskQuota", 0, "Disk space (in MiB) that snapshots may use before the least-recently-used ones are evicted (0 means no limit)")
+	maxSnapshots = flag.Int("maxSnapshots", 0, "Number of snapshots kept before the least-recently-used ones are evicted (0 means no limit)")
+	snapStore = flag.String("snapStore", "", "Remote store to share snapshots between nodes, file:///path, http(s)://host/path or s3://bucket/prefix (disabled if empty)")
+	snapStoreEndpoint = flag.String("snapStoreEndpoint", "https://s3.amazonaws.com", "Endpoint of the S3-compatible object store used by an s3:// snapshot store")
+	snapCompressAfter = flag.Duration("snapCompressAfter", 0, "Duration after which the memory file of an unused snapshot is compressed, e.g. 10m (0 disables compression)")
+	patchMode = flag.String("patchMode", "rsync", "Mode used to capture the container disk state of snapshots, valid options: rsync, block")
+	reconcileDryRun = flag.Bool("reconcileDryRun", false, "Only report the device snapshots and leases leaked by previous runs instead of removing them upon startup")
+	reconcileNetwork = flag.Bool("reconcileNetwork", true, "Adopt the intact networks left by previous runs into the network pool and remove the other ones upon startup, except the ones still used by VMs (must be the only vHive instance on the host)")
+	thinPool = flag.String("thinPool", "fc-dev-thinpool", "Thin pool storing the container snapshots, monitored for admission control (disabled if empty)")
+	poolWarnThreshold = flag.Float64("poolWarnThreshold", 80, "Usage of the thin pool (in percent) above which warnings are emitted")
+	poolRejectThreshold = flag.Float64("poolRejectThreshold", 95, "Usage of the thin pool (in percent) above which new VMs are rejected")
 	sandbox := flag.String("sandbox", "firecracker", "Sandbox tech to use, valid options: firecracker, gvisor")
-	vethPrefix := flag.String("vethPrefix", "172.17", "Prefix for IP addresses of veth devices, expected subnet is /16")
-	clonePrefix := flag.String("clonePrefix", "172.18", "Prefix for node-accessible IP addresses of uVMs, expected subnet is /16")
+	vethPrefix := flag.String("vethPrefix", "172.17", "Network of the IP addresses of veth devices, in CIDR notation or as its leading octets (e.g., 172.17 for 172.17.0.0/16)")
+	clonePrefix := flag.String("clonePrefix", "172.18", "Network of the node-accessible IP addresses of uVMs, in CIDR notation or as its leading octets (e.g., 172.18 for 172.18.0.0/16)")
+	vethPrefix6 := flag.String("vethPrefix6", "", "IPv6 network of the IP addresses of veth devices in CIDR notation (e.g., fd00:1::/64), uVMs are only reachable over IPv4 if empty")
+	clonePrefix6 := flag.String("clonePrefix6", "", "IPv6 network of the node-accessible IP addresses of uVMs in CIDR notation (e.g., fd00:2::/64), set along with vethPrefix6")
+	ipamState := flag.String("ipamState", "/run/vhive/ipam.json", "File persisting the IP addresses allocated to uVMs across restarts (not persisted if empty)")
+	egressPolicy := flag.String("egressPolicy", "", "JSON file with the default egress policy of the uVMs and the policies of the uVMs of each image (no restrictions if empty)")
 	flag.Parse()
 
 	if *sandbox != "firecracker" && *sandbox != "gvisor" {
@@ -94,17 +140,14 @@ func main() {
 	}
 
 	if *isUPFEnabled {
-		log.Error("User-level page faults are temporarily disabled (gh-807)")
+		// the pinned firecracker-containerd cannot make Firecracker load the guest memory with the Uffd
+		// backend, so the memory manager would never receive the userfaultfd of the VMs
+		log.Error("User-level page faults are temporarily disabled until firecracker-containerd supports the Uffd memory backend (gh-807)")
 		return
 	}
 
-	if *isUPFEnabled && !*isSnapshotsEnabled {
-		log.Error("User-level page faults are not supported without snapshots")
-		return
-	}
-
-	if !*isUPFEnabled && *isLazyMode {
-		log.Error("Lazy page fault serving mode is not supported without user-level page faults")
+	if set := setUPFFlags(); len(set) > 0 {
+		log.Errorf("%s only take effect with user-level page faults, which are temporarily disabled (gh-807)", strings.Join(set, ", "))
 		return
 	}
 
@@ -132,6 +175,25 @@ func main() {
 		log.Info(fmt.Sprintf("Creating orchestrator for pinned=%d functions", *pinnedFuncNum))
 	}
 
+	diskPatchMode, err := devmapper.ParsePatchMode(*patchMode)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var egressConfig networking.EgressConfig
+	if *egressPolicy != "" {
+		if egressConfig, err = networking.LoadEgressConfig(*egressPolicy); err != nil {
+			log.Fatalf("failed to load egress policies: %v", err)
+		}
+	}
+
+	var snapshotStore snapshotting.SnapshotStore
+	if *snapStore != "" {
+		if snapshotStore, err = snapshotting.NewSnapshotStore(*snapStore, *snapStoreEndpoint); err != nil {
+			log.Fatalf("failed to create snapshot store: %v", err)
+		}
+	}
+
 	switch *sandbox {
 	case "firecracker":
 		testModeOn := false
@@ -143,13 +205,31 @@ func main() {
 			ctriface.WithUPF(*isUPFEnabled),
 			ctriface.WithMetricsMode(*isMetricsMode),
 			ctriface.WithLazyMode(*isLazyMode),
+			ctriface.WithPrefetchPolicy(*prefetchPolicy, *prefetchPages),
+			ctriface.WithWorkingSetRefinement(*wsRefineInterval, *wsRefineMinMisses),
+			ctriface.WithWorkingSetStreaming(*wsStream),
 			ctriface.WithNetPoolSize(*netPoolSize),
+			ctriface.WithNetPoolMaxSize(*netPoolMaxSize),
+			ctriface.WithNetworkReconciliation(*reconcileNetwork),
 			ctriface.WithVethPrefix(*vethPrefix),
 			ctriface.WithClonePrefix(*clonePrefix),
+			ctriface.WithIPv6Prefixes(*vethPrefix6, *clonePrefix6),
+			ctriface.WithIPAMState(*ipamState),
+			ctriface.WithEgressConfig(egressConfig),
+			ctriface.WithSnapshotsDiskQuota(*snapDiskQuota*1024*1024),
+			ctriface.WithMaxSnapshots(*maxSnapshots),
+			ctriface.WithSnapshotStore(snapshotStore),
+			ctriface.WithSnapshotsMemCompression(*snapCompressAfter),
+			ctriface.WithPatchMode(diskPatchMode),
+			ctriface.WithDeviceSnapshotsReconciliation(*reconcileDryRun),
+			ctriface.WithThinPoolMonitoring(*thinPool, *poolWarnThreshold, *poolRejectThreshold),
 		)
 		funcPool = NewFuncPool(*isSaveMemory, *servedThreshold, *pinnedFuncNum, testModeOn)
 		go setupFirecrackerCRI()
 		go orchServe()
+		if *metricsAddr != "" {
+			go metricsServe(*metricsAddr)
+		}
 		fwdServe()
 	case "gvisor":
 		setupGVisorCRI()
@@ -217,6 +297,48 @@ func fwdServe() {
 	}
 }
 
+// setUPFFlags Returns the flags set on the command line that only take effect with user-level page faults
+func setUPFFlags() []string {
+	upfFlags := map[string]bool{
+		"lazy": true, "metrics": true, "prefetch": true, "prefetchPages": true,
+		"wsRefineInterval": true, "wsRefineMinMisses": true, "wsStream": true,
+	}
+
+	var set []string
+	flag.Visit(func(f *flag.Flag) {
+		if upfFlags[f.Name] {
+			set = append(set, "-"+f.Name)
+		}
+	})
+
+	return set
+}
+
+// metricsServe Exposes the page fault counters of the memory manager and the usage of the thin pool
+// in the Prometheus text format
+func metricsServe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if orch.GetUPFEnabled() {
+			if err := manager.WriteUPFMetrics(w, orch.GetUPFStats()); err != nil {
+				log.Warnf("failed to write metrics: %v", err)
+				return
+			}
+		}
+		if usage, ok := orch.GetPoolUsage(); ok {
+			if err := devmapper.WritePoolMetrics(w, *thinPool, usage); err != nil {
+				log.Warnf("failed to write metrics: %v", err)
+			}
+		}
+	})
+
+	log.Println("Serving metrics on " + addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("failed to serve metrics: %v", err)
+	}
+}
+
 // StartVM, StopSingleVM and StopVMs are legacy functions that manage functions and VMs
 // Should be used only to bootstrap an experiment (e.g., quick parallel start of many functions)
 func (s *server) StartVM(ctx context.Context, in *pb.StartVMReq) (*pb.StartVMResp, error) {